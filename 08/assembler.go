@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Program is an assembled Hack program. Labels maps every (LABEL) to its
+// ROM address, Variables maps every variable symbol to its RAM address
+// and Lines maps every ROM address back to the 1-based line of the .asm
+// source it was assembled from.
+type Program struct {
+	Code      []uint16
+	Labels    map[string]int
+	Variables map[string]int
+	Lines     []int
+}
+
+var predefinedSymbols = map[string]int{
+	"SP": 0, "LCL": 1, "ARG": 2, "THIS": 3, "THAT": 4,
+	"R0": 0, "R1": 1, "R2": 2, "R3": 3, "R4": 4, "R5": 5, "R6": 6, "R7": 7,
+	"R8": 8, "R9": 9, "R10": 10, "R11": 11, "R12": 12, "R13": 13, "R14": 14, "R15": 15,
+	"SCREEN": 16384, "KBD": 24576,
+}
+
+var compTable = map[string]uint16{
+	"0": 0x2a, "1": 0x3f, "-1": 0x3a, "D": 0x0c, "A": 0x30, "!D": 0x0d, "!A": 0x31,
+	"-D": 0x0f, "-A": 0x33, "D+1": 0x1f, "A+1": 0x37, "D-1": 0x0e, "A-1": 0x32,
+	"D+A": 0x02, "D-A": 0x13, "A-D": 0x07, "D&A": 0x00, "D|A": 0x15,
+}
+
+var jumpTable = map[string]uint16{
+	"": 0, "JGT": 1, "JEQ": 2, "JGE": 3, "JLT": 4, "JNE": 5, "JLE": 6, "JMP": 7,
+}
+
+// Assemble translates Hack assembly into machine code following the same
+// two passes as the assembler in 06, so that the emulator can load .asm
+// files directly.
+func Assemble(r io.Reader) (*Program, error) {
+	type line struct {
+		number int
+		text   string
+	}
+	var lines []line
+	prog := &Program{Labels: map[string]int{}, Variables: map[string]int{}}
+
+	// first pass: labels
+	s := bufio.NewScanner(r)
+	number := 0
+	for s.Scan() {
+		number += 1
+		text := s.Text()
+		if i := strings.Index(text, "//"); i != -1 {
+			text = text[:i]
+		}
+		text = strings.Join(strings.Fields(text), "")
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "(") {
+			if !strings.HasSuffix(text, ")") || len(text) < 3 {
+				return nil, fmt.Errorf("line %d: invalid label %q", number, text)
+			}
+			prog.Labels[text[1:len(text)-1]] = len(lines)
+			continue
+		}
+		lines = append(lines, line{number, text})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	// second pass: code
+	variables := prog.Variables
+	next := 16
+	for _, l := range lines {
+		var code uint16
+		if strings.HasPrefix(l.text, "@") {
+			symbol := l.text[1:]
+			if n, err := strconv.Atoi(symbol); err == nil {
+				if n < 0 || n > 32767 {
+					return nil, fmt.Errorf("line %d: constant out of range: %s", l.number, symbol)
+				}
+				code = uint16(n)
+			} else if addr, ok := predefinedSymbols[symbol]; ok {
+				code = uint16(addr)
+			} else if addr, ok := prog.Labels[symbol]; ok {
+				code = uint16(addr)
+			} else {
+				addr, ok := variables[symbol]
+				if !ok {
+					addr = next
+					variables[symbol] = addr
+					next += 1
+				}
+				code = uint16(addr)
+			}
+		} else {
+			c, err := assembleC(l.text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", l.number, err)
+			}
+			code = c
+		}
+		prog.Code = append(prog.Code, code)
+		prog.Lines = append(prog.Lines, l.number)
+	}
+	return prog, nil
+}
+
+func assembleC(text string) (uint16, error) {
+	dest, jump := "", ""
+	if i := strings.Index(text, "="); i != -1 {
+		dest, text = text[:i], text[i+1:]
+	}
+	if i := strings.Index(text, ";"); i != -1 {
+		text, jump = text[:i], text[i+1:]
+	}
+
+	var a uint16
+	if strings.Contains(text, "M") {
+		a = 1
+		text = strings.Replace(text, "M", "A", -1)
+	}
+	comp, ok := compTable[text]
+	if !ok {
+		// commutative forms such as A+D or M&D
+		if len(text) == 3 && strings.ContainsAny(text[1:2], "+&|") {
+			comp, ok = compTable[text[2:]+text[1:2]+text[:1]]
+		}
+		if !ok {
+			return 0, fmt.Errorf("invalid comp %q", text)
+		}
+	}
+
+	var d uint16
+	for _, r := range dest {
+		switch r {
+		case 'A':
+			d |= 4
+		case 'D':
+			d |= 2
+		case 'M':
+			d |= 1
+		default:
+			return 0, fmt.Errorf("invalid dest %q", dest)
+		}
+	}
+
+	j, ok := jumpTable[jump]
+	if !ok {
+		return 0, fmt.Errorf("invalid jump %q", jump)
+	}
+	return 0xe000 | a<<12 | comp<<6 | d<<3 | j, nil
+}
+
+// Disassemble returns the assembly of an instruction, in the forms
+// assembleC reads. Words that are not valid C-instructions are shown as
+// numbers.
+func Disassemble(inst uint16) string {
+	if inst&0x8000 == 0 {
+		return fmt.Sprintf("@%d", inst)
+	}
+	comp := ""
+	for text, c := range compTable {
+		if c == inst>>6&0x3f {
+			comp = text
+			break
+		}
+	}
+	if comp == "" || inst&0x6000 != 0x6000 {
+		return strconv.Itoa(int(inst))
+	}
+	if inst&0x1000 != 0 {
+		comp = strings.Replace(comp, "A", "M", -1)
+	}
+	var text strings.Builder
+	for i, r := range "ADM" {
+		if inst>>uint(5-i)&1 != 0 {
+			text.WriteRune(r)
+		}
+	}
+	if text.Len() > 0 {
+		text.WriteByte('=')
+	}
+	text.WriteString(comp)
+	for jump, j := range jumpTable {
+		if j != 0 && j == inst&7 {
+			text.WriteString(";" + jump)
+		}
+	}
+	return text.String()
+}
+
+// LoadHack reads a .hack file: one 16-character binary word per line.
+func LoadHack(r io.Reader) (*Program, error) {
+	prog := &Program{Labels: map[string]int{}, Variables: map[string]int{}}
+	s := bufio.NewScanner(r)
+	number := 0
+	for s.Scan() {
+		number += 1
+		text := strings.TrimSpace(s.Text())
+		if text == "" {
+			continue
+		}
+		if len(text) != 16 {
+			return nil, fmt.Errorf("line %d: expected 16 binary digits, got %q", number, text)
+		}
+		code, err := strconv.ParseUint(text, 2, 16)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", number, err)
+		}
+		prog.Code = append(prog.Code, uint16(code))
+		prog.Lines = append(prog.Lines, number)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return prog, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// The emulators can run VM functions natively: a call to a function that
+// has a Builtin executes Go code instead of the VM commands or the
+// instructions of the function. The standard Jack OS classes are
+// registered in builtins_os.go; further classes are added with
+// RegisterClass.
+
+// Machine is the memory of the emulator running a builtin. Addresses
+// are those of the Hack computer.
+type Machine interface {
+	Peek(addr int) int16
+	Poke(addr int, value int16)
+}
+
+// Builtin is a VM function implemented in Go. Func gets the Args
+// arguments of a call and returns the value of the function, 0 for void
+// functions. Besides failing, it may return ErrHalt, ErrWait or a Jump.
+type Builtin struct {
+	Args int
+	Func func(m Machine, args []int16) (int16, error)
+}
+
+var (
+	// ErrHalt stops the program, like the endless loop of Sys.halt.
+	ErrHalt = errors.New("program halted")
+
+	// ErrWait leaves the call pending: the emulator runs the builtin
+	// again at its next step. Builtins waiting for a key return it.
+	ErrWait = errors.New("waiting")
+)
+
+// Jump is returned by a builtin to continue with the named function
+// instead of returning. The function gets the arguments of the builtin
+// and returns to its caller.
+type Jump string
+
+func (j Jump) Error() string {
+	return "jump to " + string(j)
+}
+
+// NativeClass creates the builtins of a class for one Builtins, keyed by
+// function name without the class. State shared by the functions, such as
+// the cursor of Output, belongs to the class so created.
+type NativeClass func(b *Builtins) map[string]Builtin
+
+var nativeClasses = map[string]NativeClass{}
+
+// RegisterClass makes a native class available to NewBuiltins. It is
+// meant to be called from init functions and panics if the class is
+// registered twice.
+func RegisterClass(name string, class NativeClass) {
+	if _, ok := nativeClasses[name]; ok {
+		panic("native class " + name + " registered twice")
+	}
+	nativeClasses[name] = class
+}
+
+// NativeClasses returns the names of the registered classes.
+func NativeClasses() []string {
+	var names []string
+	for name := range nativeClasses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Builtins is the set of native functions of one emulator.
+type Builtins struct {
+	// Output receives the text printed through Output, with '\n' for
+	// newlines and '\b' for backspaces, when it is not nil.
+	Output io.Writer
+
+	funcs map[string]Builtin
+}
+
+// NewBuiltins creates the builtins of the given registered classes, or of
+// all of them when none is given.
+func NewBuiltins(classes ...string) (*Builtins, error) {
+	if len(classes) == 0 {
+		classes = NativeClasses()
+	}
+	b := &Builtins{funcs: map[string]Builtin{}}
+	for _, class := range classes {
+		newClass, ok := nativeClasses[class]
+		if !ok {
+			return nil, fmt.Errorf("no native class %s", class)
+		}
+		for name, f := range newClass(b) {
+			b.funcs[class+"."+name] = f
+		}
+	}
+	return b, nil
+}
+
+// Lookup returns the builtin of the function name, such as Math.multiply.
+func (b *Builtins) Lookup(name string) (Builtin, bool) {
+	if b == nil {
+		return Builtin{}, false
+	}
+	f, ok := b.funcs[name]
+	return f, ok
+}
+
+// Functions returns the names of all builtins.
+func (b *Builtins) Functions() []string {
+	var names []string
+	for name := range b.funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Call runs the builtin name from another builtin.
+func (b *Builtins) Call(m Machine, name string, args ...int16) (int16, error) {
+	f, ok := b.Lookup(name)
+	if !ok {
+		return 0, fmt.Errorf("%s is not native", name)
+	}
+	if err := f.checkArgs(name, len(args)); err != nil {
+		return 0, err
+	}
+	return f.Func(m, args)
+}
+
+func (f Builtin) checkArgs(name string, n int) error {
+	if n != f.Args {
+		return fmt.Errorf("%s expects %d arguments, got %d", name, f.Args, n)
+	}
+	return nil
+}
+
+// print writes printed text to Output.
+func (b *Builtins) print(s string) {
+	if b.Output != nil {
+		io.WriteString(b.Output, s)
+	}
+}
@@ -0,0 +1,994 @@
+package main
+
+import "errors"
+
+// The native Jack OS. Every function does what its Jack version in
+// 11/os does, down to the blocks it allocates on the heap and what it
+// writes to them, so that a program sees the same RAM with either OS.
+// The native functions call each other through Builtins.Call where the
+// Jack versions call each other; the state the Jack classes keep in
+// static variables is kept in Go. Sys.wait returns at once, and Sys.init
+// jumps to Main.main, which returns to the caller of Sys.init instead of
+// halting.
+
+func init() {
+	RegisterClass("Array", newNativeArray)
+	RegisterClass("Keyboard", newNativeKeyboard)
+	RegisterClass("Math", newNativeMath)
+	RegisterClass("Memory", newNativeMemory)
+	RegisterClass("Output", newNativeOutput)
+	RegisterClass("Screen", newNativeScreen)
+	RegisterClass("String", newNativeString)
+	RegisterClass("Sys", newNativeSys)
+}
+
+const (
+	heapStart = 2048
+	heapEnd   = 16384
+
+	charNewLine   = 128
+	charBackSpace = 129
+)
+
+var errCorruptHeap = errors.New("corrupt heap")
+
+// peek and poke address the memory with 16-bit values, as the Jack code
+// does through arrays.
+func peek(m Machine, addr int16) int16 {
+	return m.Peek(int(uint16(addr)))
+}
+
+func poke(m Machine, addr, value int16) {
+	m.Poke(int(uint16(addr)), value)
+}
+
+// pow2 returns 2^j as a 16-bit value, 0 for j = 16.
+func pow2(j int16) int16 {
+	return int16(uint16(1) << uint(j))
+}
+
+func sysError(b *Builtins, m Machine, code int16) error {
+	_, err := b.Call(m, "Sys.error", code)
+	return err
+}
+
+// newString creates a string constant the way compiled code does.
+func newString(b *Builtins, m Machine, text string) (int16, error) {
+	s, err := b.Call(m, "String.new", int16(len(text)))
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range []byte(text) {
+		if _, err := b.Call(m, "String.appendChar", s, int16(c)); err != nil {
+			return 0, err
+		}
+	}
+	return s, nil
+}
+
+func newNativeMath(b *Builtins) map[string]Builtin {
+	abs := func(x int16) int16 {
+		if x < 0 {
+			return -x
+		}
+		return x
+	}
+	divideUnsigned := func(x, y int16) int16 {
+		var q, r int16
+		for j := int16(15); j >= 0; j-- {
+			r += r
+			if x&pow2(j) != 0 {
+				r += 1
+			}
+			// r >= y as unsigned numbers
+			ge := !(r < y)
+			if (r < 0) != (y < 0) {
+				ge = r < 0
+			}
+			if ge {
+				r -= y
+				q |= pow2(j)
+			}
+		}
+		return q
+	}
+	return map[string]Builtin{
+		"init": {0, func(m Machine, args []int16) (int16, error) {
+			twoToThe, err := b.Call(m, "Array.new", 16)
+			if err != nil {
+				return 0, err
+			}
+			for j := int16(0); j < 16; j++ {
+				poke(m, twoToThe+j, pow2(j))
+			}
+			return 0, nil
+		}},
+		"bit": {2, func(m Machine, args []int16) (int16, error) {
+			return vmBool(args[0]&pow2(args[1]) != 0), nil
+		}},
+		"abs": {1, func(m Machine, args []int16) (int16, error) {
+			return abs(args[0]), nil
+		}},
+		"multiply": {2, func(m Machine, args []int16) (int16, error) {
+			return args[0] * args[1], nil
+		}},
+		"divide": {2, func(m Machine, args []int16) (int16, error) {
+			x, y := args[0], args[1]
+			if y == 0 {
+				return 0, sysError(b, m, 3)
+			}
+			q := divideUnsigned(abs(x), abs(y))
+			if (x < 0) != (y < 0) {
+				return -q, nil
+			}
+			return q, nil
+		}},
+		"divideUnsigned": {2, func(m Machine, args []int16) (int16, error) {
+			return divideUnsigned(args[0], args[1]), nil
+		}},
+		"min": {2, func(m Machine, args []int16) (int16, error) {
+			if args[0] < args[1] {
+				return args[0], nil
+			}
+			return args[1], nil
+		}},
+		"max": {2, func(m Machine, args []int16) (int16, error) {
+			if args[0] > args[1] {
+				return args[0], nil
+			}
+			return args[1], nil
+		}},
+		"sqrt": {1, func(m Machine, args []int16) (int16, error) {
+			x := args[0]
+			if x < 0 {
+				return 0, sysError(b, m, 4)
+			}
+			var y int16
+			for j := int16(7); j >= 0; j-- {
+				t := y + pow2(j)
+				square := t * t
+				if !(square > x) && square > 0 {
+					y = t
+				}
+			}
+			return y, nil
+		}},
+	}
+}
+
+// nativeMemory keeps the free list of the heap in RAM like Memory.jack:
+// a free block starts with its size and the address of the next free
+// block, and an allocated block with its size.
+type nativeMemory struct {
+	freeList int16
+}
+
+// maxBlocks bounds the walks of the free list, which loop forever in the
+// Jack version when a program has corrupted the list.
+const maxBlocks = (heapEnd - heapStart) / 2
+
+func newNativeMemory(b *Builtins) map[string]Builtin {
+	mem := &nativeMemory{}
+	return map[string]Builtin{
+		"init": {0, func(m Machine, args []int16) (int16, error) {
+			mem.freeList = heapStart
+			poke(m, heapStart, heapEnd-heapStart)
+			poke(m, heapStart+1, 0)
+			return 0, nil
+		}},
+		"peek": {1, func(m Machine, args []int16) (int16, error) {
+			return peek(m, args[0]), nil
+		}},
+		"poke": {2, func(m Machine, args []int16) (int16, error) {
+			poke(m, args[0], args[1])
+			return 0, nil
+		}},
+		"alloc": {1, func(m Machine, args []int16) (int16, error) {
+			return mem.alloc(b, m, args[0])
+		}},
+		"deAlloc": {1, func(m Machine, args []int16) (int16, error) {
+			return 0, mem.deAlloc(m, args[0])
+		}},
+	}
+}
+
+func (mem *nativeMemory) alloc(b *Builtins, m Machine, size int16) (int16, error) {
+	if size < 1 {
+		return 0, sysError(b, m, 5)
+	}
+	var prev int16
+	block := mem.freeList
+	for n := 0; block != 0; n++ {
+		if n == maxBlocks {
+			return 0, errCorruptHeap
+		}
+		if !(peek(m, block) < size+1) {
+			rest := peek(m, block) - (size + 1)
+			if rest > 1 {
+				// allocate the end of the block
+				poke(m, block, rest)
+				block += rest
+				poke(m, block, size+1)
+			} else if prev == 0 {
+				mem.freeList = peek(m, block+1)
+			} else {
+				poke(m, prev+1, peek(m, block+1))
+			}
+			return block + 1, nil
+		}
+		prev = block
+		block = peek(m, block+1)
+	}
+	return 0, sysError(b, m, 6)
+}
+
+func (mem *nativeMemory) deAlloc(m Machine, o int16) error {
+	if o == 0 {
+		return nil
+	}
+	block := o - 1
+	var prev int16
+	next := mem.freeList
+	for n := 0; next != 0 && next < block; n++ {
+		if n == maxBlocks {
+			return errCorruptHeap
+		}
+		prev = next
+		next = peek(m, next+1)
+	}
+	poke(m, block+1, next)
+	if prev == 0 {
+		mem.freeList = block
+	} else {
+		poke(m, prev+1, block)
+	}
+	if next != 0 && block+peek(m, block) == next {
+		poke(m, block, peek(m, block)+peek(m, next))
+		poke(m, block+1, peek(m, next+1))
+	}
+	if prev != 0 && prev+peek(m, prev) == block {
+		poke(m, prev, peek(m, prev)+peek(m, block))
+		poke(m, prev+1, peek(m, block+1))
+	}
+	return nil
+}
+
+func newNativeArray(b *Builtins) map[string]Builtin {
+	return map[string]Builtin{
+		"new": {1, func(m Machine, args []int16) (int16, error) {
+			if !(args[0] > 0) {
+				return 0, sysError(b, m, 2)
+			}
+			return b.Call(m, "Memory.alloc", args[0])
+		}},
+		"dispose": {1, func(m Machine, args []int16) (int16, error) {
+			return b.Call(m, "Memory.deAlloc", args[0])
+		}},
+	}
+}
+
+// The fields of a String object.
+const (
+	stringChars = iota
+	stringLen
+	stringCapacity
+	stringFields
+)
+
+func newNativeString(b *Builtins) map[string]Builtin {
+	field := func(m Machine, s, i int16) int16 {
+		return peek(m, s+i)
+	}
+	setField := func(m Machine, s, i, value int16) {
+		poke(m, s+i, value)
+	}
+	// add appends c, failing with code when the string is full.
+	add := func(m Machine, s, c, code int16) error {
+		n := field(m, s, stringLen)
+		if n == field(m, s, stringCapacity) {
+			return sysError(b, m, code)
+		}
+		poke(m, field(m, s, stringChars)+n, c)
+		setField(m, s, stringLen, n+1)
+		return nil
+	}
+	// inRange fails with code unless j indexes a character of s.
+	inRange := func(m Machine, s, j, code int16) error {
+		if j < 0 || !(j < field(m, s, stringLen)) {
+			return sysError(b, m, code)
+		}
+		return nil
+	}
+	return map[string]Builtin{
+		"new": {1, func(m Machine, args []int16) (int16, error) {
+			maxLength := args[0]
+			s, err := b.Call(m, "Memory.alloc", stringFields)
+			if err != nil {
+				return 0, err
+			}
+			if maxLength < 0 {
+				return 0, sysError(b, m, 14)
+			}
+			if maxLength > 0 {
+				chars, err := b.Call(m, "Array.new", maxLength)
+				if err != nil {
+					return 0, err
+				}
+				setField(m, s, stringChars, chars)
+			}
+			setField(m, s, stringCapacity, maxLength)
+			setField(m, s, stringLen, 0)
+			return s, nil
+		}},
+		"dispose": {1, func(m Machine, args []int16) (int16, error) {
+			s := args[0]
+			if field(m, s, stringCapacity) > 0 {
+				if _, err := b.Call(m, "Array.dispose", field(m, s, stringChars)); err != nil {
+					return 0, err
+				}
+			}
+			return b.Call(m, "Memory.deAlloc", s)
+		}},
+		"length": {1, func(m Machine, args []int16) (int16, error) {
+			return field(m, args[0], stringLen), nil
+		}},
+		"charAt": {2, func(m Machine, args []int16) (int16, error) {
+			s, j := args[0], args[1]
+			if err := inRange(m, s, j, 15); err != nil {
+				return 0, err
+			}
+			return peek(m, field(m, s, stringChars)+j), nil
+		}},
+		"setCharAt": {3, func(m Machine, args []int16) (int16, error) {
+			s, j := args[0], args[1]
+			if err := inRange(m, s, j, 16); err != nil {
+				return 0, err
+			}
+			poke(m, field(m, s, stringChars)+j, args[2])
+			return 0, nil
+		}},
+		"appendChar": {2, func(m Machine, args []int16) (int16, error) {
+			return args[0], add(m, args[0], args[1], 17)
+		}},
+		"eraseLastChar": {1, func(m Machine, args []int16) (int16, error) {
+			s := args[0]
+			n := field(m, s, stringLen)
+			if n == 0 {
+				return 0, sysError(b, m, 18)
+			}
+			setField(m, s, stringLen, n-1)
+			return 0, nil
+		}},
+		"intValue": {1, func(m Machine, args []int16) (int16, error) {
+			s := args[0]
+			n, chars := field(m, s, stringLen), field(m, s, stringChars)
+			var i, value int16
+			negative := false
+			if n > 0 && peek(m, chars) == '-' {
+				negative = true
+				i = 1
+			}
+			for ; i < n; i++ {
+				c := peek(m, chars+i)
+				if c < '0' || c > '9' {
+					break
+				}
+				value = value*10 + (c - '0')
+			}
+			if negative {
+				return -value, nil
+			}
+			return value, nil
+		}},
+		"setInt": {2, func(m Machine, args []int16) (int16, error) {
+			s, val := args[0], args[1]
+			setField(m, s, stringLen, 0)
+			// the digits are computed on the negative value, which also
+			// works for -32768
+			n := val
+			if val > 0 {
+				n = -val
+			} else if val < 0 {
+				if err := add(m, s, '-', 19); err != nil {
+					return 0, err
+				}
+			}
+			i := field(m, s, stringLen)
+			for q := int16(1); q != 0; {
+				q = n / 10
+				if err := add(m, s, '0'+(q*10-n), 19); err != nil {
+					return 0, err
+				}
+				n = q
+			}
+			chars := field(m, s, stringChars)
+			for j := field(m, s, stringLen) - 1; i < j; i, j = i+1, j-1 {
+				c := peek(m, chars+i)
+				poke(m, chars+i, peek(m, chars+j))
+				poke(m, chars+j, c)
+			}
+			return 0, nil
+		}},
+		"setIntChar": {2, func(m Machine, args []int16) (int16, error) {
+			return 0, add(m, args[0], args[1], 19)
+		}},
+		"newLine": {0, func(m Machine, args []int16) (int16, error) {
+			return charNewLine, nil
+		}},
+		"backSpace": {0, func(m Machine, args []int16) (int16, error) {
+			return charBackSpace, nil
+		}},
+		"doubleQuote": {0, func(m Machine, args []int16) (int16, error) {
+			return '"', nil
+		}},
+	}
+}
+
+type nativeScreen struct {
+	color bool
+}
+
+func newNativeScreen(b *Builtins) map[string]Builtin {
+	s := &nativeScreen{}
+	return map[string]Builtin{
+		"init": {0, func(m Machine, args []int16) (int16, error) {
+			twoToThe, err := b.Call(m, "Array.new", 17)
+			if err != nil {
+				return 0, err
+			}
+			for j := int16(0); j < 17; j++ {
+				poke(m, twoToThe+j, pow2(j))
+			}
+			s.color = true
+			return 0, nil
+		}},
+		"clearScreen": {0, func(m Machine, args []int16) (int16, error) {
+			for i := int16(0); i < 8192; i++ {
+				poke(m, screenBase+i, 0)
+			}
+			return 0, nil
+		}},
+		"setColor": {1, func(m Machine, args []int16) (int16, error) {
+			s.color = args[0] != 0
+			return 0, nil
+		}},
+		"drawPixel": {2, func(m Machine, args []int16) (int16, error) {
+			x, y := args[0], args[1]
+			if x < 0 || x > 511 || y < 0 || y > 255 {
+				return 0, sysError(b, m, 7)
+			}
+			s.drawPixel(m, x, y)
+			return 0, nil
+		}},
+		"setBits": {2, func(m Machine, args []int16) (int16, error) {
+			s.setBits(m, args[0], args[1])
+			return 0, nil
+		}},
+		"fillRow": {3, func(m Machine, args []int16) (int16, error) {
+			s.fillRow(m, args[0], args[1], args[2])
+			return 0, nil
+		}},
+		"clipRow": {3, func(m Machine, args []int16) (int16, error) {
+			s.clipRow(m, args[0], args[1], args[2])
+			return 0, nil
+		}},
+		"drawLine": {4, func(m Machine, args []int16) (int16, error) {
+			for i, v := range args {
+				if v < 0 || (i%2 == 0 && v > 511) || (i%2 == 1 && v > 255) {
+					return 0, sysError(b, m, 8)
+				}
+			}
+			s.drawLine(m, args[0], args[1], args[2], args[3])
+			return 0, nil
+		}},
+		"drawRectangle": {4, func(m Machine, args []int16) (int16, error) {
+			x1, y1, x2, y2 := args[0], args[1], args[2], args[3]
+			if x1 > x2 || y1 > y2 || x1 < 0 || x2 > 511 || y1 < 0 || y2 > 255 {
+				return 0, sysError(b, m, 9)
+			}
+			for ; !(y1 > y2); y1++ {
+				s.fillRow(m, y1, x1, x2)
+			}
+			return 0, nil
+		}},
+		"drawCircle": {3, func(m Machine, args []int16) (int16, error) {
+			x, y, r := args[0], args[1], args[2]
+			if x < 0 || x > 511 || y < 0 || y > 255 {
+				return 0, sysError(b, m, 12)
+			}
+			if r < 0 || r > 181 {
+				return 0, sysError(b, m, 13)
+			}
+			s.drawCircle(m, x, y, r)
+			return 0, nil
+		}},
+	}
+}
+
+func (s *nativeScreen) drawPixel(m Machine, x, y int16) {
+	s.setBits(m, y*32+x/16, pow2(x&15))
+}
+
+func (s *nativeScreen) setBits(m Machine, addr, mask int16) {
+	if s.color {
+		poke(m, screenBase+addr, peek(m, screenBase+addr)|mask)
+	} else {
+		poke(m, screenBase+addr, peek(m, screenBase+addr)&^mask)
+	}
+}
+
+// fillRow draws the pixels x1..x2 of row y a word at a time.
+func (s *nativeScreen) fillRow(m Machine, y, x1, x2 int16) {
+	first := y*32 + x1/16
+	last := y*32 + x2/16
+	mask := ^(pow2(x1&15) - 1)
+	if first == last {
+		s.setBits(m, first, mask&(pow2(x2&15+1)-1))
+		return
+	}
+	s.setBits(m, first, mask)
+	for addr := first + 1; addr < last; addr++ {
+		s.setBits(m, addr, -1)
+	}
+	s.setBits(m, last, pow2(x2&15+1)-1)
+}
+
+func (s *nativeScreen) clipRow(m Machine, y, x1, x2 int16) {
+	if y < 0 || y > 255 {
+		return
+	}
+	if x1 < 0 {
+		x1 = 0
+	}
+	if x2 > 511 {
+		x2 = 511
+	}
+	if !(x1 > x2) {
+		s.fillRow(m, y, x1, x2)
+	}
+}
+
+func (s *nativeScreen) drawLine(m Machine, x1, y1, x2, y2 int16) {
+	if y1 == y2 {
+		if x2 < x1 {
+			x1, x2 = x2, x1
+		}
+		s.fillRow(m, y1, x1, x2)
+		return
+	}
+	dx, dy := x2-x1, y2-y1
+	if dx < 0 {
+		dx = -dx
+	}
+	if dy > 0 {
+		dy = -dy
+	}
+	sx, sy := int16(1), int16(1)
+	if x2 < x1 {
+		sx = -1
+	}
+	if y2 < y1 {
+		sy = -1
+	}
+	err := dx + dy
+	for {
+		s.drawPixel(m, x1, y1)
+		if x1 == x2 && y1 == y2 {
+			return
+		}
+		e2 := err + err
+		if !(e2 < dy) {
+			err += dy
+			x1 += sx
+		}
+		if !(e2 > dx) {
+			err += dx
+			y1 += sy
+		}
+	}
+}
+
+func (s *nativeScreen) drawCircle(m Machine, x, y, r int16) {
+	dx, dy, d := r, int16(0), 1-r
+	for !(dx < dy) {
+		s.clipRow(m, y+dy, x-dx, x+dx)
+		s.clipRow(m, y-dy, x-dx, x+dx)
+		s.clipRow(m, y+dx, x-dy, x+dy)
+		s.clipRow(m, y-dx, x-dy, x+dy)
+		dy += 1
+		if d < 0 {
+			d += dy + dy + 1
+		} else {
+			dx -= 1
+			d += (dy - dx) + (dy - dx) + 1
+		}
+	}
+}
+
+// nativeOutput prints on the screen like Output.jack, from the bitmaps
+// it puts on the heap.
+type nativeOutput struct {
+	charMaps int16
+	row, col int16
+}
+
+// outputFont holds the character and the 11 pixel rows of every bitmap
+// of Output.jack, in the order Output.initMap creates them.
+var outputFont = [][12]int16{
+	{0, 63, 63, 63, 63, 63, 63, 63, 63, 63, 0, 0},   // drawn for the characters without a bitmap
+	{32, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},           // space
+	{33, 12, 30, 30, 30, 12, 12, 0, 12, 12, 0, 0},   // !
+	{34, 54, 54, 20, 0, 0, 0, 0, 0, 0, 0, 0},        // "
+	{35, 0, 18, 18, 63, 18, 18, 63, 18, 18, 0, 0},   // #
+	{36, 12, 30, 51, 3, 30, 48, 51, 30, 12, 12, 0},  // $
+	{37, 0, 0, 35, 51, 24, 12, 6, 51, 49, 0, 0},     // %
+	{38, 12, 30, 30, 12, 54, 27, 27, 27, 54, 0, 0},  // &
+	{39, 12, 12, 6, 0, 0, 0, 0, 0, 0, 0, 0},         // '
+	{40, 24, 12, 6, 6, 6, 6, 6, 12, 24, 0, 0},       // (
+	{41, 6, 12, 24, 24, 24, 24, 24, 12, 6, 0, 0},    // )
+	{42, 0, 0, 0, 51, 30, 63, 30, 51, 0, 0, 0},      // *
+	{43, 0, 0, 0, 12, 12, 63, 12, 12, 0, 0, 0},      // +
+	{44, 0, 0, 0, 0, 0, 0, 0, 12, 12, 6, 0},         // ,
+	{45, 0, 0, 0, 0, 0, 63, 0, 0, 0, 0, 0},          // -
+	{46, 0, 0, 0, 0, 0, 0, 0, 12, 12, 0, 0},         // .
+	{47, 0, 0, 32, 48, 24, 12, 6, 3, 1, 0, 0},       // /
+	{48, 12, 30, 51, 51, 51, 51, 51, 30, 12, 0, 0},  // 0
+	{49, 12, 14, 15, 12, 12, 12, 12, 12, 63, 0, 0},  // 1
+	{50, 30, 51, 48, 24, 12, 6, 3, 51, 63, 0, 0},    // 2
+	{51, 30, 51, 48, 48, 28, 48, 48, 51, 30, 0, 0},  // 3
+	{52, 16, 24, 28, 26, 25, 63, 24, 24, 60, 0, 0},  // 4
+	{53, 63, 3, 3, 31, 48, 48, 48, 51, 30, 0, 0},    // 5
+	{54, 28, 6, 3, 3, 31, 51, 51, 51, 30, 0, 0},     // 6
+	{55, 63, 49, 48, 48, 24, 12, 12, 12, 12, 0, 0},  // 7
+	{56, 30, 51, 51, 51, 30, 51, 51, 51, 30, 0, 0},  // 8
+	{57, 30, 51, 51, 51, 62, 48, 48, 24, 14, 0, 0},  // 9
+	{58, 0, 0, 12, 12, 0, 0, 12, 12, 0, 0, 0},       // :
+	{59, 0, 0, 12, 12, 0, 0, 12, 12, 6, 0, 0},       // ;
+	{60, 0, 0, 24, 12, 6, 3, 6, 12, 24, 0, 0},       // <
+	{61, 0, 0, 0, 63, 0, 0, 63, 0, 0, 0, 0},         // =
+	{62, 0, 0, 3, 6, 12, 24, 12, 6, 3, 0, 0},        // >
+	{63, 30, 51, 51, 24, 12, 12, 0, 12, 12, 0, 0},   // ?
+	{64, 30, 51, 51, 59, 59, 59, 27, 3, 30, 0, 0},   // @
+	{65, 12, 30, 51, 51, 63, 51, 51, 51, 51, 0, 0},  // A
+	{66, 31, 51, 51, 51, 31, 51, 51, 51, 31, 0, 0},  // B
+	{67, 28, 54, 35, 3, 3, 3, 35, 54, 28, 0, 0},     // C
+	{68, 15, 27, 51, 51, 51, 51, 51, 27, 15, 0, 0},  // D
+	{69, 63, 51, 35, 11, 15, 11, 35, 51, 63, 0, 0},  // E
+	{70, 63, 51, 35, 11, 15, 11, 3, 3, 3, 0, 0},     // F
+	{71, 28, 54, 35, 3, 59, 51, 51, 54, 44, 0, 0},   // G
+	{72, 51, 51, 51, 51, 63, 51, 51, 51, 51, 0, 0},  // H
+	{73, 30, 12, 12, 12, 12, 12, 12, 12, 30, 0, 0},  // I
+	{74, 60, 24, 24, 24, 24, 24, 27, 27, 14, 0, 0},  // J
+	{75, 51, 51, 51, 27, 15, 27, 51, 51, 51, 0, 0},  // K
+	{76, 3, 3, 3, 3, 3, 3, 35, 51, 63, 0, 0},        // L
+	{77, 33, 51, 63, 63, 51, 51, 51, 51, 51, 0, 0},  // M
+	{78, 51, 51, 55, 55, 63, 59, 59, 51, 51, 0, 0},  // N
+	{79, 30, 51, 51, 51, 51, 51, 51, 51, 30, 0, 0},  // O
+	{80, 31, 51, 51, 51, 31, 3, 3, 3, 3, 0, 0},      // P
+	{81, 30, 51, 51, 51, 51, 51, 63, 59, 30, 48, 0}, // Q
+	{82, 31, 51, 51, 51, 31, 27, 51, 51, 51, 0, 0},  // R
+	{83, 30, 51, 51, 6, 28, 48, 51, 51, 30, 0, 0},   // S
+	{84, 63, 63, 45, 12, 12, 12, 12, 12, 30, 0, 0},  // T
+	{85, 51, 51, 51, 51, 51, 51, 51, 51, 30, 0, 0},  // U
+	{86, 51, 51, 51, 51, 51, 30, 30, 12, 12, 0, 0},  // V
+	{87, 51, 51, 51, 51, 51, 63, 63, 63, 18, 0, 0},  // W
+	{88, 51, 51, 30, 30, 12, 30, 30, 51, 51, 0, 0},  // X
+	{89, 51, 51, 51, 51, 30, 12, 12, 12, 30, 0, 0},  // Y
+	{90, 63, 51, 49, 24, 12, 6, 35, 51, 63, 0, 0},   // Z
+	{91, 30, 6, 6, 6, 6, 6, 6, 6, 30, 0, 0},         // [
+	{92, 0, 0, 1, 3, 6, 12, 24, 48, 32, 0, 0},       // \
+	{93, 30, 24, 24, 24, 24, 24, 24, 24, 30, 0, 0},  // ]
+	{94, 8, 28, 54, 0, 0, 0, 0, 0, 0, 0, 0},         // ^
+	{95, 0, 0, 0, 0, 0, 0, 0, 0, 0, 63, 0},          // _
+	{96, 6, 12, 24, 0, 0, 0, 0, 0, 0, 0, 0},         // `
+	{97, 0, 0, 0, 14, 24, 30, 27, 27, 54, 0, 0},     // a
+	{98, 3, 3, 3, 15, 27, 51, 51, 51, 30, 0, 0},     // b
+	{99, 0, 0, 0, 30, 51, 3, 3, 51, 30, 0, 0},       // c
+	{100, 48, 48, 48, 60, 54, 51, 51, 51, 30, 0, 0}, // d
+	{101, 0, 0, 0, 30, 51, 63, 3, 51, 30, 0, 0},     // e
+	{102, 28, 54, 38, 6, 15, 6, 6, 6, 15, 0, 0},     // f
+	{103, 0, 0, 30, 51, 51, 51, 62, 48, 51, 30, 0},  // g
+	{104, 3, 3, 3, 27, 55, 51, 51, 51, 51, 0, 0},    // h
+	{105, 12, 12, 0, 14, 12, 12, 12, 12, 30, 0, 0},  // i
+	{106, 48, 48, 0, 56, 48, 48, 48, 48, 51, 30, 0}, // j
+	{107, 3, 3, 3, 51, 27, 15, 15, 27, 51, 0, 0},    // k
+	{108, 14, 12, 12, 12, 12, 12, 12, 12, 30, 0, 0}, // l
+	{109, 0, 0, 0, 29, 63, 43, 43, 43, 43, 0, 0},    // m
+	{110, 0, 0, 0, 29, 51, 51, 51, 51, 51, 0, 0},    // n
+	{111, 0, 0, 0, 30, 51, 51, 51, 51, 30, 0, 0},    // o
+	{112, 0, 0, 0, 30, 51, 51, 51, 31, 3, 3, 0},     // p
+	{113, 0, 0, 0, 30, 51, 51, 51, 62, 48, 48, 0},   // q
+	{114, 0, 0, 0, 29, 55, 51, 3, 3, 7, 0, 0},       // r
+	{115, 0, 0, 0, 30, 51, 6, 24, 51, 30, 0, 0},     // s
+	{116, 4, 6, 6, 15, 6, 6, 6, 54, 28, 0, 0},       // t
+	{117, 0, 0, 0, 27, 27, 27, 27, 27, 54, 0, 0},    // u
+	{118, 0, 0, 0, 51, 51, 51, 51, 30, 12, 0, 0},    // v
+	{119, 0, 0, 0, 51, 51, 51, 63, 63, 18, 0, 0},    // w
+	{120, 0, 0, 0, 51, 30, 12, 12, 30, 51, 0, 0},    // x
+	{121, 0, 0, 0, 51, 51, 51, 62, 48, 24, 15, 0},   // y
+	{122, 0, 0, 0, 63, 27, 12, 6, 51, 63, 0, 0},     // z
+	{123, 56, 12, 12, 12, 7, 12, 12, 12, 56, 0, 0},  // {
+	{124, 12, 12, 12, 12, 12, 12, 12, 12, 12, 0, 0}, // |
+	{125, 7, 12, 12, 12, 56, 12, 12, 12, 7, 0, 0},   // }
+	{126, 38, 45, 25, 0, 0, 0, 0, 0, 0, 0, 0},       // ~
+}
+
+func newNativeOutput(b *Builtins) map[string]Builtin {
+	o := &nativeOutput{}
+	return map[string]Builtin{
+		"init": {0, func(m Machine, args []int16) (int16, error) {
+			o.row, o.col = 0, 0
+			return b.Call(m, "Output.initMap")
+		}},
+		"initMap": {0, func(m Machine, args []int16) (int16, error) {
+			charMaps, err := b.Call(m, "Array.new", 127)
+			if err != nil {
+				return 0, err
+			}
+			o.charMaps = charMaps
+			for _, bitmap := range outputFont {
+				if _, err := b.Call(m, "Output.create", bitmap[:]...); err != nil {
+					return 0, err
+				}
+			}
+			return 0, nil
+		}},
+		"create": {12, func(m Machine, args []int16) (int16, error) {
+			bitmap, err := b.Call(m, "Array.new", 11)
+			if err != nil {
+				return 0, err
+			}
+			poke(m, o.charMaps+args[0], bitmap)
+			for i, v := range args[1:] {
+				poke(m, bitmap+int16(i), v)
+			}
+			return 0, nil
+		}},
+		"getMap": {1, func(m Machine, args []int16) (int16, error) {
+			return o.getMap(m, args[0]), nil
+		}},
+		"moveCursor": {2, func(m Machine, args []int16) (int16, error) {
+			i, j := args[0], args[1]
+			if i < 0 || i > 22 || j < 0 || j > 63 {
+				return 0, sysError(b, m, 20)
+			}
+			o.row, o.col = i, j
+			return 0, nil
+		}},
+		"printChar": {1, func(m Machine, args []int16) (int16, error) {
+			o.printChar(b, m, args[0])
+			return 0, nil
+		}},
+		"drawChar": {1, func(m Machine, args []int16) (int16, error) {
+			o.drawChar(m, args[0])
+			return 0, nil
+		}},
+		"printString": {1, func(m Machine, args []int16) (int16, error) {
+			return 0, o.printString(b, m, args[0])
+		}},
+		"printInt": {1, func(m Machine, args []int16) (int16, error) {
+			s, err := b.Call(m, "String.new", 6)
+			if err != nil {
+				return 0, err
+			}
+			if _, err := b.Call(m, "String.setInt", s, args[0]); err != nil {
+				return 0, err
+			}
+			if err := o.printString(b, m, s); err != nil {
+				return 0, err
+			}
+			return b.Call(m, "String.dispose", s)
+		}},
+		"println": {0, func(m Machine, args []int16) (int16, error) {
+			o.println(b)
+			return 0, nil
+		}},
+		"backSpace": {0, func(m Machine, args []int16) (int16, error) {
+			o.backSpace(b, m)
+			return 0, nil
+		}},
+	}
+}
+
+func (o *nativeOutput) getMap(m Machine, c int16) int16 {
+	if c < 32 || c > 126 {
+		c = 0
+	}
+	return peek(m, o.charMaps+c)
+}
+
+func (o *nativeOutput) printChar(b *Builtins, m Machine, c int16) {
+	switch c {
+	case charNewLine:
+		o.println(b)
+		return
+	case charBackSpace:
+		o.backSpace(b, m)
+		return
+	}
+	if c >= 0 && c < 128 {
+		b.print(string(rune(c)))
+	}
+	o.drawChar(m, c)
+	o.col += 1
+	if o.col == 64 {
+		o.println(b)
+	}
+}
+
+func (o *nativeOutput) drawChar(m Machine, c int16) {
+	bitmap := o.getMap(m, c)
+	addr := screenBase + o.row*352 + o.col/2
+	for i := int16(0); i < 11; i++ {
+		if o.col&1 == 0 {
+			poke(m, addr, peek(m, addr)&-256|peek(m, bitmap+i))
+		} else {
+			poke(m, addr, peek(m, addr)&255|peek(m, bitmap+i)*256)
+		}
+		addr += 32
+	}
+}
+
+func (o *nativeOutput) printString(b *Builtins, m Machine, s int16) error {
+	n, err := b.Call(m, "String.length", s)
+	if err != nil {
+		return err
+	}
+	for i := int16(0); i < n; i++ {
+		c, err := b.Call(m, "String.charAt", s, i)
+		if err != nil {
+			return err
+		}
+		o.printChar(b, m, c)
+	}
+	return nil
+}
+
+func (o *nativeOutput) println(b *Builtins) {
+	b.print("\n")
+	o.col = 0
+	o.row += 1
+	if o.row == 23 {
+		o.row = 0
+	}
+}
+
+func (o *nativeOutput) backSpace(b *Builtins, m Machine) {
+	b.print("\b")
+	if o.col > 0 {
+		o.col -= 1
+	} else if o.row > 0 {
+		o.row -= 1
+		o.col = 63
+	}
+	o.drawChar(m, ' ')
+}
+
+// nativeKeyboard reads keys without blocking the emulator: a function
+// waiting for a key returns ErrWait, and its progress is kept until it
+// is run again.
+type nativeKeyboard struct {
+	key  int16 // the key pressed in readChar, until it is released
+	line int16 // the String read by readLine, 0 outside of readLine
+}
+
+func newNativeKeyboard(b *Builtins) map[string]Builtin {
+	k := &nativeKeyboard{}
+	return map[string]Builtin{
+		"init": {0, func(m Machine, args []int16) (int16, error) {
+			return 0, nil
+		}},
+		"keyPressed": {0, func(m Machine, args []int16) (int16, error) {
+			return peek(m, kbdAddr), nil
+		}},
+		"readChar": {0, func(m Machine, args []int16) (int16, error) {
+			return k.readChar(b, m)
+		}},
+		"readLine": {1, func(m Machine, args []int16) (int16, error) {
+			return k.readLine(b, m, args[0])
+		}},
+		"readInt": {1, func(m Machine, args []int16) (int16, error) {
+			s, err := k.readLine(b, m, args[0])
+			if err != nil {
+				return 0, err
+			}
+			value, err := b.Call(m, "String.intValue", s)
+			if err != nil {
+				return 0, err
+			}
+			_, err = b.Call(m, "String.dispose", s)
+			return value, err
+		}},
+	}
+}
+
+func (k *nativeKeyboard) readChar(b *Builtins, m Machine) (int16, error) {
+	if k.key == 0 {
+		k.key = peek(m, kbdAddr)
+		if k.key == 0 {
+			return 0, ErrWait
+		}
+	}
+	if peek(m, kbdAddr) != 0 {
+		return 0, ErrWait
+	}
+	c := k.key
+	k.key = 0
+	if _, err := b.Call(m, "Output.printChar", c); err != nil {
+		return 0, err
+	}
+	return c, nil
+}
+
+func (k *nativeKeyboard) readLine(b *Builtins, m Machine, message int16) (int16, error) {
+	if k.line == 0 {
+		if _, err := b.Call(m, "Output.printString", message); err != nil {
+			return 0, err
+		}
+		s, err := b.Call(m, "String.new", 64)
+		if err != nil {
+			return 0, err
+		}
+		k.line = s
+	}
+	for {
+		c, err := k.readChar(b, m)
+		if err != nil {
+			return 0, err
+		}
+		length, err := b.Call(m, "String.length", k.line)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case c == charNewLine:
+			s := k.line
+			k.line = 0
+			return s, nil
+		case c == charBackSpace:
+			if length > 0 {
+				_, err = b.Call(m, "String.eraseLastChar", k.line)
+			}
+		case length < 64:
+			_, err = b.Call(m, "String.appendChar", k.line, c)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func newNativeSys(b *Builtins) map[string]Builtin {
+	return map[string]Builtin{
+		"init": {0, func(m Machine, args []int16) (int16, error) {
+			for _, class := range []string{"Memory", "Math", "Screen", "Output", "Keyboard"} {
+				if _, err := b.Call(m, class+".init"); err != nil {
+					return 0, err
+				}
+			}
+			return 0, Jump("Main.main")
+		}},
+		"halt": {0, func(m Machine, args []int16) (int16, error) {
+			return 0, ErrHalt
+		}},
+		"error": {1, func(m Machine, args []int16) (int16, error) {
+			s, err := newString(b, m, "ERR")
+			if err != nil {
+				return 0, err
+			}
+			if _, err := b.Call(m, "Output.printString", s); err != nil {
+				return 0, err
+			}
+			if _, err := b.Call(m, "Output.printInt", args[0]); err != nil {
+				return 0, err
+			}
+			return 0, ErrHalt
+		}},
+		"wait": {1, func(m Machine, args []int16) (int16, error) {
+			if args[0] < 0 {
+				return 0, sysError(b, m, 1)
+			}
+			return 0, nil
+		}},
+	}
+}
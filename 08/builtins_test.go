@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Counter is a native class of the tests: Counter.next returns 1, 2, 3...
+func init() {
+	RegisterClass("Counter", func(b *Builtins) map[string]Builtin {
+		var n int16
+		return map[string]Builtin{
+			"next": {0, func(m Machine, args []int16) (int16, error) {
+				n += 1
+				return n, nil
+			}},
+			"add": {2, func(m Machine, args []int16) (int16, error) {
+				return args[0] + args[1], nil
+			}},
+		}
+	})
+}
+
+// runNativeVM runs the VM program src from Sys.init with the builtins of
+// classes for at most steps steps.
+func runNativeVM(t *testing.T, src string, steps int, classes ...string) (*VMEmulator, string) {
+	commands, err := ParseVM("Main.vm", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBuiltins(classes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	b.Output = &output
+	vm := NewVMEmulator()
+	vm.Builtins = b
+	if err := vm.Load(commands); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < steps && !vm.Halted(); i++ {
+		if err := vm.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return vm, output.String()
+}
+
+func TestBuiltins_Register(t *testing.T) {
+	vm, _ := runNativeVM(t, `
+function Sys.init 0
+call Counter.next 0
+call Counter.next 0
+push constant 40
+call Counter.add 2
+pop static 0
+call Counter.next 0
+pop static 1
+label END
+goto END
+`, 100, "Counter")
+	if got := vm.RAM[vm.StaticAddress("Main.0")]; got != 42 {
+		t.Errorf("Counter.add(1, 2 + 40) = %d, want 42", got)
+	}
+	if got := vm.RAM[vm.StaticAddress("Main.1")]; got != 3 {
+		t.Errorf("third Counter.next = %d, want 3", got)
+	}
+
+	if _, err := NewBuiltins("Nope"); err == nil {
+		t.Error("NewBuiltins accepted an unknown class")
+	}
+	b, err := NewBuiltins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Counter.next", "Math.multiply", "Sys.init", "Output.printInt"} {
+		if _, ok := b.Lookup(name); !ok {
+			t.Errorf("%s is not a builtin", name)
+		}
+	}
+	if _, err := b.Call(vm, "Counter.add", 1); err == nil {
+		t.Error("Call accepted the wrong number of arguments")
+	}
+}
+
+func TestBuiltins_Math(t *testing.T) {
+	b, err := NewBuiltins("Math", "Sys", "Output", "String", "Memory", "Array")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewVMEmulator()
+	samples := []struct {
+		Name string
+		Args []int16
+		Want int16
+	}{
+		{"Math.multiply", []int16{-300, 200}, -60000 + 65536},
+		{"Math.divide", []int16{-7, 2}, -3},
+		{"Math.divide", []int16{7, -2}, -3},
+		{"Math.divide", []int16{-32768, 1}, -32768},
+		{"Math.divide", []int16{-32768, -1}, -32768},
+		{"Math.divide", []int16{30000, -32768}, 0},
+		{"Math.sqrt", []int16{32767}, 181},
+		{"Math.sqrt", []int16{15}, 3},
+		{"Math.bit", []int16{-32768, 15}, -1},
+		{"Math.abs", []int16{-32768}, -32768},
+		{"String.backSpace", nil, 129},
+	}
+	for _, s := range samples {
+		got, err := b.Call(m, s.Name, s.Args...)
+		if err != nil {
+			t.Errorf("%s%v: %v", s.Name, s.Args, err)
+		} else if got != s.Want {
+			t.Errorf("%s%v = %d, want %d", s.Name, s.Args, got, s.Want)
+		}
+	}
+
+	// Sys.error prints the error code and halts
+	var output bytes.Buffer
+	b.Output = &output
+	for _, class := range []string{"Memory", "Math", "Output"} {
+		if _, err := b.Call(m, class+".init"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.Call(m, "Math.divide", 1, 0); err != ErrHalt {
+		t.Errorf("Math.divide(1, 0): %v, want ErrHalt", err)
+	}
+	if output.String() != "ERR3" {
+		t.Errorf("Math.divide(1, 0) printed %q, want \"ERR3\"", output.String())
+	}
+}
+
+func TestBuiltins_Wait(t *testing.T) {
+	src := `
+function Main.main 0
+call Keyboard.readChar 0
+pop static 0
+call Sys.halt 0
+`
+	commands, err := ParseVM("Main.vm", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBuiltins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	b.Output = &output
+	vm := NewVMEmulator()
+	vm.Builtins = b
+	if err := vm.Load(commands); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	step := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := vm.Step(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	step(10)
+	if vm.Commands[vm.PC].Arg1 != "Keyboard.readChar" {
+		t.Fatalf("not waiting for a key at %v", vm.Commands[vm.PC])
+	}
+	vm.RAM[kbdAddr] = 'A'
+	step(10)
+	if vm.Commands[vm.PC].Arg1 != "Keyboard.readChar" {
+		t.Fatalf("not waiting for the key to be released at %v", vm.Commands[vm.PC])
+	}
+	vm.RAM[kbdAddr] = 0
+	step(3)
+	if !vm.Halted() {
+		t.Fatal("Sys.halt did not halt")
+	}
+	if got := vm.RAM[vm.StaticAddress("Main.0")]; got != 'A' {
+		t.Errorf("Keyboard.readChar() = %d, want %d", got, 'A')
+	}
+	if output.String() != "A" {
+		t.Errorf("printed %q, want \"A\"", output.String())
+	}
+}
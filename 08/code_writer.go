@@ -3,7 +3,8 @@ package main
 import (
 	"fmt"
 	"io"
-	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -16,18 +17,42 @@ var baseSymbolMap = map[string]string{
 	"temp":     "R5",
 }
 
+// CodeWriter translates VM commands to Hack assembly. Calls and returns
+// jump to routines shared by the whole program, which Close writes after
+// the code, so that large programs fit in the ROM.
 type CodeWriter struct {
-	w          io.Writer
-	filename   string
-	lineNumber uint64
+	// Locations lists where the code of the commands starts, for the
+	// commands announced with SetLine.
+	Locations []VMLocation
+
+	w            io.Writer
+	filename     string
+	functionName string
+	lineNumber   uint64
+	labelCount   int
+	routines     map[string]bool
+}
+
+// VMLocation maps a VM command to the ROM address of its first
+// instruction, or of the next instruction for commands without code.
+type VMLocation struct {
+	Addr int
+	File string // the .vm file, without extension
+	Line int
 }
 
 func NewCodeWriter(w io.Writer) *CodeWriter {
-	return &CodeWriter{w: w}
+	return &CodeWriter{w: w, routines: map[string]bool{}}
 }
 
 func (c *CodeWriter) SetFileName(f string) {
-	c.filename = strings.TrimRight(path.Base(f), ".vm")
+	c.filename = strings.TrimSuffix(filepath.Base(f), ".vm")
+	c.functionName = ""
+}
+
+// SetLine announces that the next command is at line of the current file.
+func (c *CodeWriter) SetLine(line int) {
+	c.Locations = append(c.Locations, VMLocation{int(c.lineNumber), c.filename, line})
 }
 
 func (c *CodeWriter) WriteArithmetic(command string) {
@@ -78,36 +103,70 @@ func (c *CodeWriter) WriteArithmetic(command string) {
 		c.p("A=M-1") // A = M[0] - 1
 		c.p("M=!M")  // M[SP-1] = !M[SP-1]
 	case "eq", "gt", "lt":
+		c.labelCount += 1
+		l := fmt.Sprintf("$%s.%d", command, c.labelCount)
+		c.p("@SP")
+		c.p("AM=M-1") // SP = SP - 1, A = SP
+		c.p("D=M")    // D = y = M[SP]
+		c.p("@R13")
+		c.p("M=D")   // M[13] = y
 		c.p("@SP")   // A = 0
-		c.p("A=M-1") // A = M[0] - 1
-		c.p("D=M")   // D = M[SP-1]
-		c.p("A=A-1") // A = SP - 2
-		c.p("D=M-D") // D = M[SP-2] - M[SP-1]
+		c.p("A=M-1") // A = SP - 1
+		c.p("D=M")   // D = x = M[SP-1]
+		if command != "eq" {
+			// x - y overflows when x and y have different signs,
+			// but then the sign of x alone decides.
+			c.p("@%s.xneg", l)
+			c.p("D;JLT") // if (x < 0) goto xneg
+			c.p("@R13")
+			c.p("D=M") // D = y
+			if command == "gt" {
+				c.p("@%s.true", l)
+			} else {
+				c.p("@%s.false", l)
+			}
+			c.p("D;JLT") // if (x >= 0 > y) decided
+			c.p("@%s.sub", l)
+			c.p("0;JMP")
+			c.l("(%s.xneg)", l)
+			c.p("@R13")
+			c.p("D=M") // D = y
+			if command == "gt" {
+				c.p("@%s.false", l)
+			} else {
+				c.p("@%s.true", l)
+			}
+			c.p("D;JGE") // if (x < 0 <= y) decided
+			c.l("(%s.sub)", l)
+			c.p("@SP")
+			c.p("A=M-1")
+			c.p("D=M") // D = x
+		}
+		c.p("@R13")
+		c.p("D=D-M") // D = x - y
 		// compare
-		c.p("@%d", c.lineNumber+8) // A = true statement
+		c.p("@%s.true", l)
 		switch command {
 		case "eq":
-			c.p("D;JEQ") // if (D = 0) goto A
+			c.p("D;JEQ") // if (D = 0) goto true
 		case "gt":
-			c.p("D;JGT") // if (D > 0) goto A
+			c.p("D;JGT") // if (D > 0) goto true
 		case "lt":
-			c.p("D;JLT") // if (D < 0) goto A
+			c.p("D;JLT") // if (D < 0) goto true
 		}
 		// set false
+		c.l("(%s.false)", l)
 		c.p("@SP")
-		c.p("A=M-1")               // A = M[0] - 1 = SP - 1
-		c.p("A=A-1")               // A = SP - 2
-		c.p("M=0")                 // M[SP-2] = false
-		c.p("@%d", c.lineNumber+6) // A = out of if statement
-		c.p("0;JMP")               // goto A
+		c.p("A=M-1") // A = SP - 1
+		c.p("M=0")   // M[SP-1] = false
+		c.p("@%s.end", l)
+		c.p("0;JMP")
 		// set true
+		c.l("(%s.true)", l)
 		c.p("@SP")
-		c.p("A=M-1") // A = M[0] - 1 = SP - 1
-		c.p("A=A-1") // A = SP - 2
-		c.p("M=-1")  // M[SP-2] = true
-		// set new SP
-		c.p("@SP")
-		c.p("M=M-1") // M[0] = M[0] - 1
+		c.p("A=M-1") // A = SP - 1
+		c.p("M=-1")  // M[SP-1] = true
+		c.l("(%s.end)", l)
 	}
 }
 
@@ -116,95 +175,104 @@ func (c *CodeWriter) WritePushPop(command string, segment string, index string)
 	if command == "push" {
 		switch segment {
 		case "constant":
-			c.p("@%s", index) // A = n
-			c.p("D=A")        // D = A
-			c.p("@SP")        // A = 0
-			c.p("A=M")        // A = M[0]
-			c.p("M=D")        // M[SP] = n
-			c.p("@SP")        // A = 0
-			c.p("M=M+1")      // M[0] = M[0] + 1
-		case "local", "argument", "this", "that", "pointer", "temp":
-			// get value
 			c.p("@%s", index) // A = n
 			c.p("D=A")        // D = n
-			switch segment {
-			case "local", "argument", "this", "that":
+		case "local", "argument", "this", "that":
+			if index == "0" {
 				c.p("@%s", baseSymbolMap[segment]) // A = BASE address pointer
-				c.p("A=M")                         // A = M[BASE address pointer] = BASE
-			case "pointer", "temp":
-				c.p("@%s", baseSymbolMap[segment]) // A = BASE
+				c.p("A=M")                         // A = BASE
+			} else {
+				c.p("@%s", index)                  // A = n
+				c.p("D=A")                         // D = n
+				c.p("@%s", baseSymbolMap[segment]) // A = BASE address pointer
+				c.p("A=D+M")                       // A = BASE + n
 			}
-			c.p("A=D+A") // A = BASE + n
-			c.p("D=M")   // D = M[BASE + n]
-			// push
-			c.p("@SP")
-			c.p("A=M")
-			c.p("M=D")
-			// SP++
-			c.p("@SP")
-			c.p("M=M+1")
+			c.p("D=M") // D = M[BASE + n]
+		case "pointer", "temp":
+			c.p("@%s", c.fixedAddress(segment, index))
+			c.p("D=M")
 		case "static":
-			// get value
 			c.p("@%s.%s", c.filename, index) // A = FILENAME.INDEX
 			c.p("D=M")                       // D = M[FILENAME.INDEX]
-			// push
-			c.p("@SP")
-			c.p("A=M")
-			c.p("M=D")
-			// SP++
-			c.p("@SP")
-			c.p("M=M+1")
 		}
+		c.pushD()
 	} else if command == "pop" {
 		switch segment {
-		case "local", "argument", "this", "that", "pointer", "temp":
-			// calc local address
-			c.p("@%s", index) // A = n
-			c.p("D=A")        // D = n
-			switch segment {
-			case "local", "argument", "this", "that":
+		case "local", "argument", "this", "that":
+			if index == "0" {
+				c.popD()
 				c.p("@%s", baseSymbolMap[segment]) // A = BASE address pointer
-				c.p("A=M")                         // A = M[BASE address pointer] = BASE
-			case "pointer", "temp":
-				c.p("@%s", baseSymbolMap[segment]) // A = BASE
+				c.p("A=M")                         // A = BASE
+				c.p("M=D")                         // M[BASE] = M[SP]
+				return
 			}
-			c.p("D=D+A") // D = BASE + n
-			c.p("@R13")  // A = 13 (common reg)
-			c.p("M=D")   // M[13] = BASE + n
-			// get head of stack
-			c.p("@SP")   // A = 0
-			c.p("A=M-1") // A = M[0] - 1
-			c.p("D=M")   // D = M[SP-1]
+			// calc address
+			c.p("@%s", index)                  // A = n
+			c.p("D=A")                         // D = n
+			c.p("@%s", baseSymbolMap[segment]) // A = BASE address pointer
+			c.p("D=D+M")                       // D = BASE + n
+			c.p("@R13")                        // A = 13 (common reg)
+			c.p("M=D")                         // M[13] = BASE + n
+			c.popD()
 			// write
 			c.p("@R13") // A = 13
 			c.p("A=M")  // A = BASE + n
 			c.p("M=D")  // M[BASE+n] = M[SP]
-			// SP--
-			c.p("@SP")
-			c.p("M=M-1")
+		case "pointer", "temp":
+			c.popD()
+			c.p("@%s", c.fixedAddress(segment, index))
+			c.p("M=D")
 		case "static":
-			// get head of stack
-			c.p("@SP")   // A = 0
-			c.p("A=M-1") // A = M[0] - 1
-			c.p("D=M")   // D = M[SP-1]
-			// write
+			c.popD()
 			c.p("@%s.%s", c.filename, index) // A = FILENAME.INDEX
 			c.p("M=D")                       // M[FILENAME.INDEX] = M[SP]
-			// SP--
-			c.p("@SP")
-			c.p("M=M-1")
 		}
 	}
 }
 
+// fixedAddress returns the RAM address of the pointer and temp segments,
+// which do not move.
+func (c *CodeWriter) fixedAddress(segment, index string) string {
+	base := 3
+	if segment == "temp" {
+		base = 5
+	}
+	n, _ := strconv.Atoi(index) // checked by Parser.Validate
+	return fmt.Sprintf("R%d", base+n)
+}
+
+// pushD pushes D.
+func (c *CodeWriter) pushD() {
+	c.p("@SP")
+	c.p("AM=M+1") // SP = SP + 1
+	c.p("A=A-1")
+	c.p("M=D") // M[SP-1] = D
+}
+
+// popD pops into D.
+func (c *CodeWriter) popD() {
+	c.p("@SP")
+	c.p("AM=M-1") // SP = SP - 1, A = SP
+	c.p("D=M")    // D = M[SP]
+}
+
+// scopedLabel returns the assembly symbol of a VM label, which is local
+// to the function it appears in.
+func (c *CodeWriter) scopedLabel(label string) string {
+	if c.functionName == "" {
+		return label
+	}
+	return c.functionName + "$" + label
+}
+
 func (c *CodeWriter) WriteLabel(label string) {
 	c.l("//===== label %s", label)
-	c.l("(%s)", label)
+	c.l("(%s)", c.scopedLabel(label))
 }
 
 func (c *CodeWriter) WriteGoto(label string) {
 	c.l("//===== goto %s", label)
-	c.p("@%s", label)
+	c.p("@%s", c.scopedLabel(label))
 	c.p("0;JMP")
 }
 
@@ -212,41 +280,53 @@ func (c *CodeWriter) WriteIf(label string) {
 	c.l("//===== if-goto %s", label)
 	// pop
 	c.p("@SP")
-	c.p("A=M-1")
+	c.p("AM=M-1") // SP = SP - 1, A = SP
 	c.p("D=M")
-	// SP--
-	c.p("@SP")
-	c.p("M=M-1")
 	// if
-	c.p("@%d", c.lineNumber+4)
-	c.p("D;JEQ")
-	c.p("@%s", label)
-	c.p("0;JMP")
+	c.p("@%s", c.scopedLabel(label))
+	c.p("D;JNE")
 }
 
 func (c *CodeWriter) WriteCall(functionName string, numArgs int) {
 	c.l("//===== call %s, %d", functionName, numArgs)
-	returnAddr := fmt.Sprintf("%s.%d", c.filename, c.lineNumber)
-	// push return-address
-	c.WritePush(returnAddr)
-	// push LCL, ARG, THIS, THAT
-	regs := []string{"LCL", "ARG", "THIS", "THAT"}
-	for _, reg := range regs {
+	c.labelCount += 1
+	returnAddr := fmt.Sprintf("%s$ret.%d", c.functionName, c.labelCount)
+	c.routines["call"] = true
+	// R13 = n, R14 = function, D = return-address
+	c.p("@%d", numArgs)
+	c.p("D=A")
+	c.p("@R13")
+	c.p("M=D")
+	c.p("@%s", functionName)
+	c.p("D=A")
+	c.p("@R14")
+	c.p("M=D")
+	c.p("@%s", returnAddr)
+	c.p("D=A")
+	c.p("@$call")
+	c.p("0;JMP")
+	// return-address label
+	c.l("(%s)", returnAddr)
+}
+
+// writeCallRoutine writes the routine of calls: it saves the frame of the
+// caller and jumps to the function.
+func (c *CodeWriter) writeCallRoutine() {
+	c.l("($call)")
+	// push return-address, LCL, ARG, THIS, THAT
+	c.pushD()
+	for _, reg := range []string{"LCL", "ARG", "THIS", "THAT"} {
 		c.p("@%s", reg)
 		c.p("D=M")
-		c.p("@SP")
-		c.p("A=M")
-		c.p("M=D")
-		c.p("@SP")
-		c.p("M=M+1")
+		c.pushD()
 	}
 	// ARG = SP - n - 5
 	c.p("@SP")
 	c.p("D=M")
-	c.p("@%d", numArgs)
-	c.p("D=D-A")
 	c.p("@5")
-	c.p("D=D-A") // D = SP - n - 5
+	c.p("D=D-A")
+	c.p("@R13")
+	c.p("D=D-M") // D = SP - n - 5
 	c.p("@ARG")
 	c.p("M=D")
 	// LCL = SP
@@ -255,14 +335,21 @@ func (c *CodeWriter) WriteCall(functionName string, numArgs int) {
 	c.p("@LCL")
 	c.p("M=D")
 	// goto function
-	c.p("@%s", functionName)
+	c.p("@R14")
+	c.p("A=M")
 	c.p("0;JMP")
-	// return-address label
-	c.l("(%s)", returnAddr)
 }
 
 func (c *CodeWriter) WriteReturn() {
 	c.l("//===== return")
+	c.routines["return"] = true
+	c.p("@$return")
+	c.p("0;JMP")
+}
+
+// writeReturnRoutine writes the routine of returns.
+func (c *CodeWriter) writeReturnRoutine() {
+	c.l("($return)")
 	// FRAME = LCL
 	c.p("@LCL")
 	c.p("D=M")
@@ -270,16 +357,12 @@ func (c *CodeWriter) WriteReturn() {
 	c.p("M=D")
 	// return address = *(FRAME - 5)
 	c.p("@5")
-	c.p("D=A")
-	c.p("@R13")
-	c.p("A=M-D") // A = return address pointer
+	c.p("A=D-A") // A = return address pointer
 	c.p("D=M")   // D = return address
 	c.p("@R14")
 	c.p("M=D") // M[R14] = return address
 	// *ARG = pop()
-	c.p("@SP")
-	c.p("A=M-1")
-	c.p("D=M") // D = return value
+	c.popD()
 	c.p("@ARG")
 	c.p("A=M")
 	c.p("M=D") // *ARG = return value
@@ -288,36 +371,14 @@ func (c *CodeWriter) WriteReturn() {
 	c.p("D=M+1")
 	c.p("@SP")
 	c.p("M=D")
-	// THAT = *(FRAME - 1)
-	c.p("@R13")
-	c.p("A=M-1") // A = caller THAT address pointer
-	c.p("D=M")   // D = caller THAT address
-	c.p("@THAT")
-	c.p("M=D")
-	// THIS = *(FRAME - 2)
-	c.p("@2")
-	c.p("D=A")
-	c.p("@R13")
-	c.p("A=M-D") // A = caller THIS address pointer
-	c.p("D=M")   // D = caller THIS address
-	c.p("@THIS")
-	c.p("M=D")
-	// ARG = *(FRAME - 3)
-	c.p("@3")
-	c.p("D=A")
-	c.p("@R13")
-	c.p("A=M-D") // A = caller ARG address pointer
-	c.p("D=M")   // D = caller ARG address
-	c.p("@ARG")
-	c.p("M=D")
-	// LCL = *(FRAME - 4)
-	c.p("@4")
-	c.p("D=A")
-	c.p("@R13")
-	c.p("A=M-D") // A = caller LCL address pointer
-	c.p("D=M")   // D = caller LCL address
-	c.p("@LCL")
-	c.p("M=D")
+	// THAT, THIS, ARG, LCL = *(FRAME - 1), ..., *(FRAME - 4)
+	for _, reg := range []string{"THAT", "THIS", "ARG", "LCL"} {
+		c.p("@R13")
+		c.p("AM=M-1") // FRAME = FRAME - 1
+		c.p("D=M")
+		c.p("@%s", reg)
+		c.p("M=D")
+	}
 	// goto return address
 	c.p("@R14")
 	c.p("A=M")
@@ -326,25 +387,21 @@ func (c *CodeWriter) WriteReturn() {
 
 func (c *CodeWriter) WriteFunction(functionName string, numLocals int) {
 	c.l("//===== function %s, %d", functionName, numLocals)
+	c.functionName = functionName
 	c.l("(%s)", functionName)
 	// init local
+	if numLocals > 0 {
+		c.p("D=0")
+	}
 	for i := 0; i < numLocals; i++ {
-		c.p("@SP")
-		c.p("A=M")
-		c.p("M=0")
-		c.p("@SP")
-		c.p("M=M+1")
+		c.pushD()
 	}
 }
 
 func (c *CodeWriter) WritePush(addr string) {
 	c.p("@%s", addr)
 	c.p("D=A")
-	c.p("@SP")
-	c.p("A=M")
-	c.p("M=D")
-	c.p("@SP")
-	c.p("M=M+1")
+	c.pushD()
 }
 
 func (c *CodeWriter) WriteInit() {
@@ -352,8 +409,29 @@ func (c *CodeWriter) WriteInit() {
 	c.p("D=A")
 	c.p("@SP")
 	c.p("M=D")
-	c.p("@Sys.init")
 	c.WriteCall("Sys.init", 0)
+	// stop if Sys.init returns, instead of running into the first function
+	c.p("@$end")
+	c.p("0;JMP")
+}
+
+// Close writes the shared routines the program uses. They follow an
+// endless loop, so that a program without functions never runs into
+// them.
+func (c *CodeWriter) Close() {
+	if len(c.routines) == 0 {
+		return
+	}
+	c.l("//===== routines")
+	c.l("($end)")
+	c.p("@$end")
+	c.p("0;JMP")
+	if c.routines["call"] {
+		c.writeCallRoutine()
+	}
+	if c.routines["return"] {
+		c.writeReturnRoutine()
+	}
 }
 
 func (c *CodeWriter) p(format string, a ...interface{}) {
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	ramSize    = 24577
+	screenBase = 16384
+	kbdAddr    = 24576
+)
+
+// CPU emulates the Hack computer: the program in ROM, the data memory
+// with its memory-mapped screen and keyboard, and the A, D and PC
+// registers. Every Step executes one instruction, which corresponds to
+// one ticktock of the CPU emulator.
+//
+// With builtins, entering the code of a function that has one runs the
+// builtin instead, followed by the return of the VM function, in a single
+// step. Halted is set when a builtin halts the program, and Err when one
+// fails; the CPU does nothing more after either.
+//
+// With a Keyboard, KBD holds the key it reports for Time at every step.
+type CPU struct {
+	ROM    []uint16
+	RAM    []int16
+	A      int16
+	D      int16
+	PC     uint16
+	Time   int
+	Halted bool
+	Err    error
+
+	Keyboard KeyInput
+
+	// OnWrite, when set, is called before every write to RAM, by
+	// instructions, builtins and the Keyboard alike, with the old and the
+	// new value.
+	OnWrite func(addr int, old, value int16)
+
+	builtins *Builtins
+	labels   map[string]int
+	natives  map[uint16]string
+}
+
+func NewCPU() *CPU {
+	return &CPU{RAM: make([]int16, ramSize)}
+}
+
+// Load replaces the program in ROM and resets the registers. RAM is kept
+// so that test scripts may prepare it before or after loading.
+func (c *CPU) Load(prog *Program) {
+	c.ROM = prog.Code
+	c.Reset()
+}
+
+func (c *CPU) Reset() {
+	c.A, c.D, c.PC, c.Time = 0, 0, 0, 0
+	c.Halted, c.Err = false, nil
+}
+
+// SetBuiltins makes the CPU run the builtins of the functions found among
+// labels, the symbols of the program in ROM, which are also the targets of
+// Jumps. A nil b removes them.
+func (c *CPU) SetBuiltins(b *Builtins, labels map[string]int) {
+	c.builtins, c.labels, c.natives = b, labels, nil
+	if b == nil {
+		return
+	}
+	c.natives = map[uint16]string{}
+	for _, name := range b.Functions() {
+		if addr, ok := labels[name]; ok {
+			c.natives[uint16(addr)] = name
+		}
+	}
+}
+
+// Step executes the instruction at PC. Instructions past the end of the
+// program are treated as zeros, i.e. "@0", as on the real ROM.
+func (c *CPU) Step() {
+	if c.Halted {
+		return
+	}
+	if c.Keyboard != nil {
+		if key := c.Keyboard.Key(c.Time); key != c.RAM[kbdAddr] {
+			c.write(kbdAddr, key)
+		}
+	}
+	if name, ok := c.natives[c.PC]; ok {
+		c.Time += 1
+		if err := c.callBuiltin(name); err != nil {
+			c.Halted, c.Err = true, err
+		}
+		return
+	}
+	var inst uint16
+	if int(c.PC) < len(c.ROM) {
+		inst = c.ROM[c.PC]
+	}
+	c.Time += 1
+
+	// A-instruction
+	if inst&0x8000 == 0 {
+		c.A = int16(inst)
+		c.PC += 1
+		return
+	}
+
+	// C-instruction
+	addr := uint16(c.A)
+	y := c.A
+	if inst&0x1000 != 0 {
+		y = c.read(addr)
+	}
+	out := alu(c.D, y, inst>>6&0x3f)
+
+	if inst&0x08 != 0 {
+		c.write(addr, out)
+	}
+	if inst&0x20 != 0 {
+		c.A = out
+	}
+	if inst&0x10 != 0 {
+		c.D = out
+	}
+
+	jump := inst & 0x07
+	if (jump&4 != 0 && out < 0) || (jump&2 != 0 && out == 0) || (jump&1 != 0 && out > 0) {
+		// the PC is loaded with A as it was before this instruction
+		c.PC = addr
+	} else {
+		c.PC += 1
+	}
+}
+
+// Spinning reports whether the CPU is about to execute the jump of an
+// "@p, 0;JMP" loop at p, the code of a VM goto to its own label.
+func (c *CPU) Spinning() bool {
+	pc := int(c.PC)
+	if pc == 0 || pc >= len(c.ROM) {
+		return false
+	}
+	inst := c.ROM[pc]
+	return inst&0x8000 != 0 && inst&0x07 == 0x07 && int(uint16(c.A)) == pc-1 && int(c.ROM[pc-1]) == pc-1
+}
+
+// alu computes the Hack ALU output for the six control bits zx nx zy ny f no.
+func alu(x, y int16, comp uint16) int16 {
+	if comp&0x20 != 0 {
+		x = 0
+	}
+	if comp&0x10 != 0 {
+		x = ^x
+	}
+	if comp&0x08 != 0 {
+		y = 0
+	}
+	if comp&0x04 != 0 {
+		y = ^y
+	}
+	var out int16
+	if comp&0x02 != 0 {
+		out = x + y
+	} else {
+		out = x & y
+	}
+	if comp&0x01 != 0 {
+		out = ^out
+	}
+	return out
+}
+
+// callBuiltin runs the builtin name on the frame that the call of the
+// function has set up, and returns from it like the translated return.
+func (c *CPU) callBuiltin(name string) error {
+	f, _ := c.builtins.Lookup(name)
+	lcl, arg := c.RAM[1], c.RAM[2]
+	if err := f.checkArgs(name, int(lcl-arg-5)); err != nil {
+		return err
+	}
+	args := make([]int16, f.Args)
+	for i := range args {
+		args[i] = c.read(uint16(arg) + uint16(i))
+	}
+	v, err := f.Func(c, args)
+	var jump Jump
+	switch {
+	case err == nil:
+		// the return address first: without arguments, it is where the
+		// value goes
+		frame := uint16(lcl)
+		ret := c.read(frame - 5)
+		c.write(uint16(arg), v)
+		c.RAM[0] = arg + 1
+		c.RAM[4] = c.read(frame - 1)
+		c.RAM[3] = c.read(frame - 2)
+		c.RAM[2] = c.read(frame - 3)
+		c.RAM[1] = c.read(frame - 4)
+		c.PC = uint16(ret)
+	case err == ErrHalt:
+		c.Halted = true
+	case err == ErrWait:
+		// stay on the function to run the builtin again
+	case errors.As(err, &jump):
+		addr, ok := c.labels[string(jump)]
+		if !ok {
+			return fmt.Errorf("%s: undefined function %s", name, jump)
+		}
+		c.PC = uint16(addr)
+	default:
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// Peek and Poke make the CPU the Machine of its builtins.
+func (c *CPU) Peek(addr int) int16 {
+	return c.read(uint16(addr))
+}
+
+func (c *CPU) Poke(addr int, value int16) {
+	c.write(uint16(addr), value)
+}
+
+func (c *CPU) read(addr uint16) int16 {
+	if int(addr) >= len(c.RAM) {
+		return 0
+	}
+	return c.RAM[addr]
+}
+
+func (c *CPU) write(addr uint16, v int16) {
+	if int(addr) >= len(c.RAM) {
+		return
+	}
+	if c.OnWrite != nil {
+		c.OnWrite(int(addr), c.RAM[addr], v)
+	}
+	c.RAM[addr] = v
+}
+
+// CPUSimulator runs test scripts written for the CPU emulator. It loads
+// .asm and .hack programs and understands the variables RAM[n], A, D, PC
+// and time.
+type CPUSimulator struct {
+	CPU      *CPU
+	Program  *Program
+	Builtins *Builtins // run by the CPU if set before loading
+	half     bool
+}
+
+func NewCPUSimulator() *CPUSimulator {
+	return &CPUSimulator{CPU: NewCPU()}
+}
+
+func (c *CPUSimulator) Load(s *Script, name string) error {
+	if name == "" {
+		return fmt.Errorf("load expects a program file")
+	}
+	r, err := s.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var prog *Program
+	if filepath.Ext(name) == ".hack" {
+		prog, err = LoadHack(r)
+	} else {
+		prog, err = Assemble(r)
+	}
+	if err != nil {
+		return err
+	}
+	c.Program = prog
+	c.CPU.Load(prog)
+	if c.Builtins != nil {
+		c.CPU.SetBuiltins(c.Builtins, prog.Labels)
+	}
+	c.half = false
+	return nil
+}
+
+func (c *CPUSimulator) Get(name string) (int16, error) {
+	switch name {
+	case "A":
+		return c.CPU.A, nil
+	case "D":
+		return c.CPU.D, nil
+	case "PC":
+		return int16(c.CPU.PC), nil
+	case "time":
+		return int16(c.CPU.Time), nil
+	}
+	addr, err := ramAddress(name)
+	if err != nil {
+		return 0, err
+	}
+	return c.CPU.RAM[addr], nil
+}
+
+func (c *CPUSimulator) Set(name string, value int16) error {
+	switch name {
+	case "A":
+		c.CPU.A = value
+		return nil
+	case "D":
+		c.CPU.D = value
+		return nil
+	case "PC":
+		c.CPU.PC = uint16(value)
+		return nil
+	}
+	addr, err := ramAddress(name)
+	if err != nil {
+		return err
+	}
+	c.CPU.RAM[addr] = value
+	return nil
+}
+
+func (c *CPUSimulator) Step(command string) error {
+	switch command {
+	case "ticktock":
+		c.CPU.Step()
+	case "tick":
+		c.half = true
+	case "tock":
+		if c.half {
+			c.CPU.Step()
+		}
+		c.half = false
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+	return nil
+}
+
+// ramAddress parses a RAM[n] variable name.
+func ramAddress(name string) (int, error) {
+	if !strings.HasPrefix(name, "RAM[") || !strings.HasSuffix(name, "]") {
+		return 0, fmt.Errorf("unknown variable %q", name)
+	}
+	addr, err := strconv.Atoi(name[4 : len(name)-1])
+	if err != nil || addr < 0 || addr >= ramSize {
+		return 0, fmt.Errorf("invalid address in %q", name)
+	}
+	return addr, nil
+}
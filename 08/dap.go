@@ -0,0 +1,758 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The debug information of a Jack program, read from the comments jackc -g
+// writes in its VM code.
+type jackVar struct {
+	Segment string
+	Index   int
+	Type    string
+	Name    string
+}
+
+type jackClass struct {
+	Name    string
+	Source  string // empty for classes compiled without debug information
+	Statics []jackVar
+	Fields  []jackVar
+}
+
+type jackFunction struct {
+	Name   string
+	Class  *jackClass
+	Kind   string // function, method or constructor; empty without debug information
+	Args   []jackVar
+	Locals []jackVar
+	Start  int // ROM address
+
+	// First and Last are the source lines of the subroutine, from its
+	// declaration to its closing brace.
+	First, Last int
+}
+
+// jackStatement is the start of the code of a statement in ROM.
+type jackStatement struct {
+	Addr     int
+	Line     int
+	Function *jackFunction
+}
+
+// JackDebugInfo maps the code of a Jack program in ROM back to its
+// sources.
+type JackDebugInfo struct {
+	Classes    map[string]*jackClass
+	Functions  []*jackFunction  // by address
+	Statements []*jackStatement // by address
+
+	statementAt map[int]*jackStatement
+	end         int // start of the shared routines, which belong to no function
+}
+
+// LoadJackDebugInfo reads the debug information in the VM files of prog,
+// locations being where the code of their commands starts in ROM.
+func LoadJackDebugInfo(files []string, locations []VMLocation, prog *Program) (*JackDebugInfo, error) {
+	type fileLine struct {
+		file string
+		line int
+	}
+	addrs := map[fileLine]int{}
+	for _, l := range locations {
+		addrs[fileLine{l.File, l.Line}] = l.Addr
+	}
+	info := &JackDebugInfo{
+		Classes:     map[string]*jackClass{},
+		statementAt: map[int]*jackStatement{},
+		end:         len(prog.Code),
+	}
+	if end, ok := prog.Labels["$end"]; ok {
+		info.end = end
+	}
+	for _, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		file := strings.TrimSuffix(filepath.Base(path), ".vm")
+		class := &jackClass{Name: file}
+		info.Classes[file] = class
+		var function *jackFunction
+		line := 0 // of the next statement
+		for i, text := range strings.Split(string(data), "\n") {
+			text = strings.TrimSpace(text)
+			if strings.HasPrefix(text, "// @") {
+				fields := strings.Fields(text[len("// @"):])
+				if err := info.read(class, function, fields, &line); err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", path, i+1, err)
+				}
+				continue
+			}
+			if j := strings.Index(text, "//"); j != -1 {
+				text = strings.TrimSpace(text[:j])
+			}
+			if text == "" {
+				continue
+			}
+			if fields := strings.Fields(text); fields[0] == "function" && len(fields) > 1 {
+				function = &jackFunction{Name: fields[1], Class: class, Start: prog.Labels[fields[1]]}
+				info.Functions = append(info.Functions, function)
+			}
+			if line > 0 && function != nil {
+				addr, ok := addrs[fileLine{file, i + 1}]
+				if !ok {
+					return nil, fmt.Errorf("%s:%d: no code for the command", path, i+1)
+				}
+				s := &jackStatement{addr, line, function}
+				info.Statements = append(info.Statements, s)
+				// the first statement wins when several start at the same address
+				if info.statementAt[addr] == nil {
+					info.statementAt[addr] = s
+				}
+				line = 0
+			}
+		}
+	}
+	sort.SliceStable(info.Functions, func(i, j int) bool { return info.Functions[i].Start < info.Functions[j].Start })
+	sort.SliceStable(info.Statements, func(i, j int) bool { return info.Statements[i].Addr < info.Statements[j].Addr })
+	return info, nil
+}
+
+// read reads a debug comment of the class, in function if not nil.
+func (info *JackDebugInfo) read(class *jackClass, function *jackFunction, fields []string, line *int) error {
+	if len(fields) == 0 {
+		return errors.New("empty debug information")
+	}
+	switch {
+	case fields[0] == "source" && len(fields) == 2:
+		class.Source = fields[1]
+	case fields[0] == "kind" && len(fields) == 2 && function != nil:
+		function.Kind = fields[1]
+	case fields[0] == "line" && len(fields) == 2:
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid line %q", fields[1])
+		}
+		*line = n
+	case fields[0] == "lines" && len(fields) == 3 && function != nil:
+		first, err1 := strconv.Atoi(fields[1])
+		last, err2 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil || first <= 0 || last < first {
+			return fmt.Errorf("invalid lines %q %q", fields[1], fields[2])
+		}
+		function.First, function.Last = first, last
+	case fields[0] == "var" && len(fields) == 5:
+		index, err := strconv.Atoi(fields[2])
+		if err != nil || index < 0 {
+			return fmt.Errorf("invalid index %q", fields[2])
+		}
+		v := jackVar{fields[1], index, fields[3], fields[4]}
+		switch {
+		case function == nil && v.Segment == "static":
+			class.Statics = append(class.Statics, v)
+		case function == nil && v.Segment == "this":
+			class.Fields = append(class.Fields, v)
+		case function != nil && v.Segment == "argument":
+			function.Args = append(function.Args, v)
+		case function != nil && v.Segment == "local":
+			function.Locals = append(function.Locals, v)
+		default:
+			return fmt.Errorf("unexpected %s variable", v.Segment)
+		}
+	default:
+		return fmt.Errorf("unknown debug information %q", strings.Join(fields, " "))
+	}
+	return nil
+}
+
+// FunctionAt returns the function whose code has the instruction at addr,
+// nil for the bootstrap code and the shared routines.
+func (info *JackDebugInfo) FunctionAt(addr int) *jackFunction {
+	if addr >= info.end {
+		return nil
+	}
+	i := sort.Search(len(info.Functions), func(i int) bool { return info.Functions[i].Start > addr })
+	if i == 0 {
+		return nil
+	}
+	return info.Functions[i-1]
+}
+
+// LineAt returns the source line of the instruction at addr of f, 0 if f
+// has no debug information.
+func (info *JackDebugInfo) LineAt(addr int, f *jackFunction) int {
+	i := sort.Search(len(info.Statements), func(i int) bool { return info.Statements[i].Addr > addr })
+	if i == 0 || info.Statements[i-1].Function != f {
+		return 0
+	}
+	return info.Statements[i-1].Line
+}
+
+// Debug Adapter Protocol messages, as far as the debugger reads them.
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// readDAPMessage reads the body of the next message, framed by a
+// Content-Length header.
+func readDAPMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if i := strings.Index(line, ":"); i != -1 && strings.EqualFold(line[:i], "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(line[i+1:])); err != nil {
+				return nil, fmt.Errorf("invalid header %q", line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("message without Content-Length")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func writeDAPMessage(w io.Writer, message interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+// dapSlice is the number of cycles run between two looks at the requests,
+// so that a running program can be paused.
+const dapSlice = 20000
+
+// dapSession is a debugging session of a Jack program on the CPU
+// emulator. Jack breakpoints and steps stop at the first instruction of
+// statements.
+type dapSession struct {
+	w   io.Writer
+	seq int
+
+	prog    *Program
+	info    *JackDebugInfo
+	cpu     *CPU
+	halt    int
+	hasHalt bool
+	sysErr  int // Sys.error, a runtime error of the program
+	hasErr  bool
+
+	stopOnEntry bool
+	breakpoints map[string][]int // addresses by source
+	bpAddrs     map[int]bool
+
+	running bool
+	mode    string // entry, continue, next, stepIn, stepOut or pause
+	refLCL  int16  // LCL when the step started
+	frames  []dapFrame
+	refs    [][]dapSlot // variables by reference - 1, until the program runs again
+}
+
+// dapFrame is a frame of the call stack, the first being the current one.
+type dapFrame struct {
+	Function       *jackFunction
+	Line           int
+	LCL, ARG, THIS int16
+}
+
+// dapSlot is a variable shown to the client.
+type dapSlot struct {
+	Name string
+	Type string
+	Addr int // -1 for a static the program never uses
+}
+
+// serveDAP runs a Debug Adapter Protocol session reading requests from r
+// and writing responses and events to w, until the client disconnects or
+// r ends.
+//
+// The launch request takes the directory of the VM files of the program,
+// as "program", compiled with jackc -g, and optionally a key script as
+// "keys". The program runs with its bootstrap code and stops at the first
+// Jack statement with "stopOnEntry".
+func serveDAP(r io.Reader, w io.Writer) error {
+	requests := make(chan dapRequest)
+	done := make(chan struct{})
+	defer close(done)
+	var readErr error
+	go func() {
+		defer close(requests)
+		br := bufio.NewReader(r)
+		for {
+			body, err := readDAPMessage(br)
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+			var req dapRequest
+			if err := json.Unmarshal(body, &req); err != nil {
+				readErr = err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	s := &dapSession{w: w, breakpoints: map[string][]int{}, bpAddrs: map[int]bool{}}
+	for {
+		var req dapRequest
+		var ok bool
+		if s.running {
+			select {
+			case req, ok = <-requests:
+			default:
+				if err := s.run(dapSlice); err != nil {
+					return err
+				}
+				continue
+			}
+		} else {
+			req, ok = <-requests
+		}
+		if !ok {
+			return readErr
+		}
+		if req.Type != "request" {
+			continue
+		}
+		quit, err := s.handle(req)
+		if err != nil || quit {
+			return err
+		}
+	}
+}
+
+func (s *dapSession) send(message map[string]interface{}) error {
+	s.seq += 1
+	message["seq"] = s.seq
+	return writeDAPMessage(s.w, message)
+}
+
+func (s *dapSession) event(name string, body interface{}) error {
+	message := map[string]interface{}{"type": "event", "event": name}
+	if body != nil {
+		message["body"] = body
+	}
+	return s.send(message)
+}
+
+// handle answers req and reports whether the session is over.
+func (s *dapSession) handle(req dapRequest) (bool, error) {
+	body, err := s.execute(req)
+	response := map[string]interface{}{
+		"type":        "response",
+		"request_seq": req.Seq,
+		"command":     req.Command,
+		"success":     err == nil,
+	}
+	if err != nil {
+		response["message"] = err.Error()
+	} else if body != nil {
+		response["body"] = body
+	}
+	if err := s.send(response); err != nil {
+		return false, err
+	}
+	switch {
+	case req.Command == "disconnect":
+		return true, nil
+	case req.Command == "launch" && err == nil:
+		// ready for the breakpoints
+		return false, s.event("initialized", nil)
+	}
+	return false, nil
+}
+
+func (s *dapSession) execute(req dapRequest) (interface{}, error) {
+	var args struct {
+		Program     string `json:"program"`
+		Keys        string `json:"keys"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+		Source      struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+		FrameID            int `json:"frameId"`
+		VariablesReference int `json:"variablesReference"`
+	}
+	if len(req.Arguments) > 0 {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+	}
+	if s.cpu == nil {
+		switch req.Command {
+		case "initialize", "launch", "disconnect":
+		default:
+			return nil, fmt.Errorf("%s before launch", req.Command)
+		}
+	}
+
+	switch req.Command {
+	case "initialize":
+		return map[string]interface{}{"supportsConfigurationDoneRequest": true}, nil
+	case "launch":
+		if s.cpu != nil {
+			return nil, errors.New("already launched")
+		}
+		s.stopOnEntry = args.StopOnEntry
+		return nil, s.launch(args.Program, args.Keys)
+	case "setBreakpoints":
+		return s.setBreakpoints(args.Source.Path, func() []int {
+			lines := make([]int, len(args.Breakpoints))
+			for i, b := range args.Breakpoints {
+				lines[i] = b.Line
+			}
+			return lines
+		}()), nil
+	case "configurationDone":
+		if s.stopOnEntry {
+			s.resume("entry")
+		} else {
+			s.resume("continue")
+		}
+		return nil, nil
+	case "threads":
+		return map[string]interface{}{
+			"threads": []interface{}{map[string]interface{}{"id": 1, "name": "main"}},
+		}, nil
+	case "stackTrace":
+		if s.running {
+			return nil, errors.New("the program is running")
+		}
+		var frames []interface{}
+		for i, f := range s.frames {
+			frame := map[string]interface{}{"id": i + 1, "name": f.Function.Name, "line": f.Line, "column": 1}
+			if f.Function.Class.Source != "" {
+				frame["source"] = map[string]interface{}{
+					"name": filepath.Base(f.Function.Class.Source),
+					"path": f.Function.Class.Source,
+				}
+			} else {
+				frame["presentationHint"] = "subtle"
+			}
+			frames = append(frames, frame)
+		}
+		return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}, nil
+	case "scopes":
+		if s.running || args.FrameID < 1 || args.FrameID > len(s.frames) {
+			return nil, fmt.Errorf("no frame %d", args.FrameID)
+		}
+		return map[string]interface{}{"scopes": s.scopes(s.frames[args.FrameID-1])}, nil
+	case "variables":
+		if s.running || args.VariablesReference < 1 || args.VariablesReference > len(s.refs) {
+			return nil, fmt.Errorf("no variables %d", args.VariablesReference)
+		}
+		var vars []interface{}
+		for _, slot := range s.refs[args.VariablesReference-1] {
+			value, ref := s.value(slot)
+			vars = append(vars, map[string]interface{}{
+				"name": slot.Name, "type": slot.Type, "value": value, "variablesReference": ref,
+			})
+		}
+		return map[string]interface{}{"variables": vars}, nil
+	case "continue":
+		s.resume("continue")
+		return map[string]interface{}{"allThreadsContinued": true}, nil
+	case "next", "stepIn", "stepOut":
+		s.resume(req.Command)
+		return nil, nil
+	case "pause":
+		if s.running {
+			s.mode = "pause"
+		}
+		return nil, nil
+	case "disconnect":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported request %q", req.Command)
+}
+
+// launch translates and loads the program in dir, with the key script at
+// keys if not empty.
+func (s *dapSession) launch(dir, keys string) error {
+	if dir == "" {
+		return errors.New("no program to launch")
+	}
+	files, err := findVMFiles(dir, false)
+	if err != nil {
+		return err
+	}
+	var asm bytes.Buffer
+	locations, err := translateMapped(&asm, files, true)
+	if err != nil {
+		return err
+	}
+	prog, err := Assemble(&asm)
+	if err != nil {
+		return err
+	}
+	info, err := LoadJackDebugInfo(files, locations, prog)
+	if err != nil {
+		return err
+	}
+	if len(info.Statements) == 0 {
+		return fmt.Errorf("%s has no debug information, compile it with jackc -g", dir)
+	}
+	c, err := newRunCPU(prog, runOptions{Keys: keys}, nil)
+	if err != nil {
+		return err
+	}
+	s.prog, s.info, s.cpu = prog, info, c
+	s.halt, s.hasHalt = prog.Labels["Sys.halt"]
+	s.sysErr, s.hasErr = prog.Labels["Sys.error"]
+	return nil
+}
+
+// setBreakpoints replaces the breakpoints of the source at path with ones
+// at lines, each moved to the next line starting a statement of the same
+// subroutine. Lines in no subroutine, or after its last statement, get no
+// breakpoint.
+func (s *dapSession) setBreakpoints(path string, lines []int) interface{} {
+	path = filepath.Clean(path)
+	var addrs []int
+	var breakpoints []interface{}
+	for _, line := range lines {
+		var found *jackStatement
+		for _, st := range s.info.Statements {
+			f := st.Function
+			if filepath.Clean(f.Class.Source) != path || st.Line < line || line < f.First || line > f.Last {
+				continue
+			}
+			if found == nil || st.Line < found.Line || st.Line == found.Line && st.Addr < found.Addr {
+				found = st
+			}
+		}
+		if found == nil {
+			breakpoints = append(breakpoints, map[string]interface{}{"verified": false, "line": line})
+			continue
+		}
+		addrs = append(addrs, found.Addr)
+		breakpoints = append(breakpoints, map[string]interface{}{"verified": true, "line": found.Line})
+	}
+	s.breakpoints[path] = addrs
+	s.bpAddrs = map[int]bool{}
+	for _, addrs := range s.breakpoints {
+		for _, addr := range addrs {
+			s.bpAddrs[addr] = true
+		}
+	}
+	return map[string]interface{}{"breakpoints": breakpoints}
+}
+
+// resume runs the program until the stop mode asks for.
+func (s *dapSession) resume(mode string) {
+	s.mode, s.running = mode, true
+	s.refLCL = s.cpu.RAM[1]
+	s.frames, s.refs = nil, nil
+}
+
+// run executes up to n cycles, and stops when the program halts or at a
+// statement where a breakpoint or the mode asks to. The program exits
+// with code 1 when it calls Sys.error, 0 when it halts.
+func (s *dapSession) run(n int) error {
+	c := s.cpu
+	for i := 0; i < n; i++ {
+		c.Step()
+		if c.Err != nil {
+			s.running = false
+			if err := s.event("output", map[string]interface{}{"category": "stderr", "output": c.Err.Error() + "\n"}); err != nil {
+				return err
+			}
+			return s.terminate(1)
+		}
+		if s.hasErr && int(c.PC) == s.sysErr {
+			s.running = false
+			code := s.peek(int(s.peek(2)))
+			if err := s.event("output", map[string]interface{}{"category": "stderr", "output": fmt.Sprintf("Sys.error(%d)\n", code)}); err != nil {
+				return err
+			}
+			return s.terminate(1)
+		}
+		if c.Halted || c.Spinning() || s.hasHalt && int(c.PC) == s.halt {
+			s.running = false
+			return s.terminate(0)
+		}
+		if s.info.statementAt[int(c.PC)] == nil {
+			continue
+		}
+		lcl := c.RAM[1]
+		reason := ""
+		switch {
+		case s.bpAddrs[int(c.PC)]:
+			reason = "breakpoint"
+		case s.mode == "entry", s.mode == "pause":
+			reason = s.mode
+		case s.mode == "stepIn",
+			s.mode == "next" && lcl <= s.refLCL,
+			s.mode == "stepOut" && lcl < s.refLCL:
+			reason = "step"
+		}
+		if reason != "" {
+			s.running = false
+			s.frames = s.callStack()
+			return s.event("stopped", map[string]interface{}{
+				"reason": reason, "threadId": 1, "allThreadsStopped": true,
+			})
+		}
+	}
+	return nil
+}
+
+func (s *dapSession) terminate(code int) error {
+	if err := s.event("terminated", nil); err != nil {
+		return err
+	}
+	return s.event("exited", map[string]interface{}{"exitCode": code})
+}
+
+// callStack walks the frames the calls saved on the stack.
+func (s *dapSession) callStack() []dapFrame {
+	c := s.cpu
+	pc := int(c.PC)
+	lcl, arg, this := c.RAM[1], c.RAM[2], c.RAM[3]
+	var frames []dapFrame
+	for len(frames) < 1000 {
+		f := s.info.FunctionAt(pc)
+		if f == nil {
+			break
+		}
+		frames = append(frames, dapFrame{f, s.info.LineAt(pc, f), lcl, arg, this})
+		if lcl < 5 || int(lcl) >= len(c.RAM) {
+			break
+		}
+		pc = int(uint16(c.RAM[lcl-5]))
+		lcl, arg, this = c.RAM[lcl-4], c.RAM[lcl-3], c.RAM[lcl-2]
+	}
+	return frames
+}
+
+// scopes returns the scopes of the variables of f.
+func (s *dapSession) scopes(f dapFrame) []interface{} {
+	var scopes []interface{}
+	add := func(name string, vars []jackVar, base int) {
+		if len(vars) == 0 {
+			return
+		}
+		slots := make([]dapSlot, len(vars))
+		for i, v := range vars {
+			slots[i] = dapSlot{v.Name, v.Type, base + v.Index}
+			if v.Segment == "static" {
+				slots[i].Addr = -1
+				if addr, ok := s.prog.Variables[fmt.Sprintf("%s.%d", f.Function.Class.Name, v.Index)]; ok {
+					slots[i].Addr = addr
+				}
+			}
+		}
+		scopes = append(scopes, map[string]interface{}{
+			"name": name, "variablesReference": s.ref(slots), "expensive": false,
+		})
+	}
+	add("Arguments", f.Function.Args, int(f.ARG))
+	add("Locals", f.Function.Locals, int(f.LCL))
+	if f.Function.Kind == "method" || f.Function.Kind == "constructor" {
+		add("Fields", f.Function.Class.Fields, int(f.THIS))
+	}
+	add("Statics", f.Function.Class.Statics, 0)
+	return scopes
+}
+
+func (s *dapSession) ref(slots []dapSlot) int {
+	s.refs = append(s.refs, slots)
+	return len(s.refs)
+}
+
+func (s *dapSession) peek(addr int) int16 {
+	if addr < 0 || addr >= len(s.cpu.RAM) {
+		return 0
+	}
+	return s.cpu.RAM[addr]
+}
+
+// value formats the value of slot by its type, and returns the reference
+// of the fields of objects of classes with debug information.
+func (s *dapSession) value(slot dapSlot) (string, int) {
+	v := s.peek(slot.Addr)
+	switch slot.Type {
+	case "int":
+	case "char":
+		if v >= ' ' && v < 127 {
+			return fmt.Sprintf("%d '%c'", v, v), 0
+		}
+	case "boolean":
+		switch v {
+		case 0:
+			return "false", 0
+		case -1:
+			return "true", 0
+		}
+	default:
+		if v == 0 {
+			return "null", 0
+		}
+		if slot.Type == "String" {
+			if text, ok := s.text(v); ok {
+				return strconv.Quote(text), 0
+			}
+		}
+		value := fmt.Sprintf("%s@%d", slot.Type, v)
+		class := s.info.Classes[slot.Type]
+		if class == nil || len(class.Fields) == 0 {
+			return value, 0
+		}
+		slots := make([]dapSlot, len(class.Fields))
+		for i, f := range class.Fields {
+			slots[i] = dapSlot{f.Name, f.Type, int(v) + f.Index}
+		}
+		return value, s.ref(slots)
+	}
+	return strconv.Itoa(int(v)), 0
+}
+
+// text reads the String object at addr, if it looks like one.
+func (s *dapSession) text(addr int16) (string, bool) {
+	chars, n := s.peek(int(addr)+stringChars), s.peek(int(addr)+stringLen)
+	if n < 0 || n > s.peek(int(addr)+stringCapacity) || int(chars) <= 0 || int(chars)+int(n) > len(s.cpu.RAM) {
+		return "", false
+	}
+	var b strings.Builder
+	for i := 0; i < int(n); i++ {
+		b.WriteRune(rune(s.peek(int(chars) + i)))
+	}
+	return b.String(), true
+}
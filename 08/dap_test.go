@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const dapMain = `class Main {
+  static int count;
+
+  function void main() {
+    var int x;
+    var String s;
+    var Point p;
+    let s = "hi";
+    let p = Point.new(3, 4);
+    let x = Main.add(2, 5);
+    let count = x + p.sum();
+    return;
+  }
+
+  function int add(int a, int b) {
+    var int c;
+    let c = a + b;
+    return c;
+  }
+}
+`
+
+const dapPoint = `class Point {
+  field int x, y;
+
+  constructor Point new(int ax, int ay) {
+    let x = ax;
+    let y = ay;
+    return this;
+  }
+
+  method int sum() {
+    return x + y;
+  }
+}
+`
+
+// dapClient drives a session the way an editor would.
+type dapClient struct {
+	t       *testing.T
+	w       io.Writer
+	r       *bufio.Reader
+	seq     int
+	pending []dapTestMessage
+}
+
+type dapTestMessage struct {
+	Type    string          `json:"type"`
+	Command string          `json:"command"`
+	Event   string          `json:"event"`
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// request sends a request and returns the body of its successful
+// response, decoded into body if not nil.
+func (c *dapClient) request(command string, args interface{}, body interface{}) {
+	c.t.Helper()
+	c.seq += 1
+	if err := writeDAPMessage(c.w, map[string]interface{}{
+		"seq": c.seq, "type": "request", "command": command, "arguments": args,
+	}); err != nil {
+		c.t.Fatal(err)
+	}
+	m := c.expect(func(m dapTestMessage) bool { return m.Type == "response" && m.Command == command })
+	if !m.Success {
+		c.t.Fatalf("%s: %s", command, m.Message)
+	}
+	if body != nil {
+		if err := json.Unmarshal(m.Body, body); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// event waits for the event name.
+func (c *dapClient) event(name string) dapTestMessage {
+	c.t.Helper()
+	return c.expect(func(m dapTestMessage) bool { return m.Type == "event" && m.Event == name })
+}
+
+// stopped waits for the program to stop for reason.
+func (c *dapClient) stopped(reason string) {
+	c.t.Helper()
+	var body struct{ Reason string }
+	json.Unmarshal(c.event("stopped").Body, &body)
+	if body.Reason != reason {
+		c.t.Fatalf("stopped for %s, want %s", body.Reason, reason)
+	}
+}
+
+func (c *dapClient) expect(match func(m dapTestMessage) bool) dapTestMessage {
+	c.t.Helper()
+	for i, m := range c.pending {
+		if match(m) {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return m
+		}
+	}
+	for {
+		body, err := readDAPMessage(c.r)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		var m dapTestMessage
+		if err := json.Unmarshal(body, &m); err != nil {
+			c.t.Fatal(err)
+		}
+		if match(m) {
+			return m
+		}
+		c.pending = append(c.pending, m)
+	}
+}
+
+type dapTestFrame struct {
+	ID     int
+	Name   string
+	Line   int
+	Source struct{ Path string }
+}
+
+// frames returns the call stack as Function:line.
+func (c *dapClient) frames() ([]dapTestFrame, string) {
+	c.t.Helper()
+	var body struct{ StackFrames []dapTestFrame }
+	c.request("stackTrace", map[string]interface{}{"threadId": 1}, &body)
+	var names []string
+	for _, f := range body.StackFrames {
+		names = append(names, f.Name+":"+strconv.Itoa(f.Line))
+	}
+	return body.StackFrames, strings.Join(names, " ")
+}
+
+// variables returns the variables of the scopes of frame, as scope name to
+// variable name to value, with the fields of objects as object.field.
+func (c *dapClient) variables(frame int) map[string]map[string]string {
+	c.t.Helper()
+	var scopes struct {
+		Scopes []struct {
+			Name               string
+			VariablesReference int
+		}
+	}
+	c.request("scopes", map[string]interface{}{"frameId": frame}, &scopes)
+	all := map[string]map[string]string{}
+	var read func(ref int, prefix string, into map[string]string)
+	read = func(ref int, prefix string, into map[string]string) {
+		var body struct {
+			Variables []struct {
+				Name               string
+				Value              string
+				VariablesReference int
+			}
+		}
+		c.request("variables", map[string]interface{}{"variablesReference": ref}, &body)
+		for _, v := range body.Variables {
+			into[prefix+v.Name] = v.Value
+			if v.VariablesReference > 0 {
+				read(v.VariablesReference, prefix+v.Name+".", into)
+			}
+		}
+	}
+	for _, s := range scopes.Scopes {
+		all[s.Name] = map[string]string{}
+		read(s.VariablesReference, "", all[s.Name])
+	}
+	return all
+}
+
+// dapTest is a session debugging the classes of sources, compiled with
+// jackc -g, from src, the directory of their sources.
+type dapTest struct {
+	*dapClient
+	src  string
+	dir  string
+	done chan error
+}
+
+func startDAP(t *testing.T, sources map[string]string) *dapTest {
+	if testing.Short() {
+		t.Skip("builds the compiler")
+	}
+	compiler, _ := buildE2ETools(t)
+	logLevel = logQuiet
+	dir, err := ioutil.TempDir("", "dap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "src")
+	work := filepath.Join(dir, "vm")
+	for _, d := range []string{src, work} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, text := range sources {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out, err := exec.Command(compiler, "-g", "-d", work, src).CombinedOutput(); err != nil {
+		t.Fatalf("jackc: %v\n%s", err, out)
+	}
+	src, _ = filepath.Abs(src)
+
+	requests, server := io.Pipe()
+	client, responses := io.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- serveDAP(requests, responses)
+		responses.Close()
+	}()
+	d := &dapTest{&dapClient{t: t, w: server, r: bufio.NewReader(client)}, src, dir, done}
+	d.request("initialize", map[string]interface{}{"adapterID": "jack"}, nil)
+	d.request("launch", map[string]interface{}{"program": work, "stopOnEntry": true}, nil)
+	d.event("initialized")
+	return d
+}
+
+// setBreakpoints sets breakpoints at lines of the source name, and
+// returns their lines, 0 for those not verified.
+func (d *dapTest) setBreakpoints(name string, lines ...int) []int {
+	d.t.Helper()
+	var body struct {
+		Breakpoints []struct {
+			Verified bool
+			Line     int
+		}
+	}
+	bps := []interface{}{}
+	for _, line := range lines {
+		bps = append(bps, map[string]interface{}{"line": line})
+	}
+	d.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": filepath.Join(d.src, name)},
+		"breakpoints": bps,
+	}, &body)
+	var got []int
+	for _, b := range body.Breakpoints {
+		if !b.Verified {
+			b.Line = 0
+		}
+		got = append(got, b.Line)
+	}
+	return got
+}
+
+// exited waits for the end of the program and returns its exit code.
+func (d *dapTest) exited() int {
+	d.t.Helper()
+	d.event("terminated")
+	var body struct{ ExitCode int }
+	json.Unmarshal(d.event("exited").Body, &body)
+	return body.ExitCode
+}
+
+// finish disconnects and waits for the end of the session.
+func (d *dapTest) finish() {
+	d.t.Helper()
+	defer func() { logLevel = logInfo }()
+	defer os.RemoveAll(d.dir)
+	d.request("disconnect", nil, nil)
+	if err := <-d.done; err != nil {
+		d.t.Fatal(err)
+	}
+}
+
+func TestDAP(t *testing.T) {
+	c := startDAP(t, map[string]string{"Main.jack": dapMain, "Point.jack": dapPoint})
+	mainPath := filepath.Join(c.src, "Main.jack")
+	// the declaration of c moves to the first statement of add
+	if got := c.setBreakpoints("Main.jack", 16, 100); fmt.Sprint(got) != "[17 0]" {
+		t.Errorf("breakpoints at lines %v", got)
+	}
+	c.request("configurationDone", nil, nil)
+
+	c.stopped("entry")
+	frames, stack := c.frames()
+	if stack != "Main.main:8 Sys.init:0" || frames[0].Source.Path != mainPath {
+		t.Fatalf("stack at entry %s in %s", stack, frames[0].Source.Path)
+	}
+
+	c.request("continue", map[string]interface{}{"threadId": 1}, nil)
+	c.stopped("breakpoint")
+	if _, stack := c.frames(); stack != "Main.add:17 Main.main:10 Sys.init:0" {
+		t.Fatalf("stack at the breakpoint %s", stack)
+	}
+	vars := c.variables(1)
+	if vars["Arguments"]["a"] != "2" || vars["Arguments"]["b"] != "5" || vars["Locals"]["c"] != "0" || vars["Statics"]["count"] != "0" {
+		t.Errorf("variables of add %v", vars)
+	}
+	vars = c.variables(2)
+	if vars["Locals"]["s"] != `"hi"` || vars["Locals"]["p.x"] != "3" || vars["Locals"]["p.y"] != "4" {
+		t.Errorf("variables of main %v", vars)
+	}
+
+	c.request("next", map[string]interface{}{"threadId": 1}, nil)
+	c.stopped("step")
+	if _, stack := c.frames(); stack != "Main.add:18 Main.main:10 Sys.init:0" {
+		t.Fatalf("stack after next %s", stack)
+	}
+	if vars := c.variables(1); vars["Locals"]["c"] != "7" {
+		t.Errorf("c = %s after next", vars["Locals"]["c"])
+	}
+	c.request("stepOut", map[string]interface{}{"threadId": 1}, nil)
+	c.stopped("step")
+	if _, stack := c.frames(); stack != "Main.main:11 Sys.init:0" {
+		t.Fatalf("stack after stepOut %s", stack)
+	}
+	// into the method, over the OS functions without debug information
+	c.request("stepIn", map[string]interface{}{"threadId": 1}, nil)
+	c.stopped("step")
+	if _, stack := c.frames(); stack != "Point.sum:11 Main.main:11 Sys.init:0" {
+		t.Fatalf("stack after stepIn %s", stack)
+	}
+	if vars := c.variables(1); vars["Fields"]["x"] != "3" || vars["Arguments"]["this"] == "" {
+		t.Errorf("variables of sum %v", vars)
+	}
+
+	c.request("setBreakpoints", map[string]interface{}{
+		"source": map[string]interface{}{"path": mainPath}, "breakpoints": []interface{}{},
+	}, nil)
+	c.request("continue", map[string]interface{}{"threadId": 1}, nil)
+	if code := c.exited(); code != 0 {
+		t.Errorf("exit code %d", code)
+	}
+	c.finish()
+}
+
+func TestDAP_Breakpoints(t *testing.T) {
+	c := startDAP(t, map[string]string{"Main.jack": dapMain, "Point.jack": dapPoint})
+	// the static declaration, the closing brace of main, the blank line
+	// after it, the declaration of c and the closing brace of add
+	if got := c.setBreakpoints("Main.jack", 2, 13, 14, 16, 19); fmt.Sprint(got) != "[0 0 0 17 0]" {
+		t.Errorf("breakpoints at lines %v", got)
+	}
+	c.finish()
+}
+
+func TestDAP_StepOutOfMain(t *testing.T) {
+	c := startDAP(t, map[string]string{"Main.jack": dapMain, "Point.jack": dapPoint})
+	c.request("configurationDone", nil, nil)
+	c.stopped("entry")
+	// Sys.init has no debug information: the program runs to its end
+	c.request("stepOut", map[string]interface{}{"threadId": 1}, nil)
+	if code := c.exited(); code != 0 {
+		t.Errorf("exit code %d", code)
+	}
+	c.finish()
+}
+
+func TestDAP_RuntimeError(t *testing.T) {
+	c := startDAP(t, map[string]string{"Main.jack": `class Main {
+  function void main() {
+    do Output.printInt(1 / 0);
+    return;
+  }
+}
+`})
+	c.request("configurationDone", nil, nil)
+	c.stopped("entry")
+	c.request("continue", map[string]interface{}{"threadId": 1}, nil)
+	var output struct{ Category, Output string }
+	json.Unmarshal(c.event("output").Body, &output)
+	if output.Category != "stderr" || output.Output != "Sys.error(3)\n" {
+		t.Errorf("output %+v", output)
+	}
+	if code := c.exited(); code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+	c.finish()
+}
+
+func TestDAP_Objects(t *testing.T) {
+	c := startDAP(t, map[string]string{"Main.jack": dapMain, "Point.jack": dapPoint})
+	// let count = x + p.sum();
+	if got := c.setBreakpoints("Main.jack", 11); fmt.Sprint(got) != "[11]" {
+		t.Fatalf("breakpoints at lines %v", got)
+	}
+	c.request("configurationDone", nil, nil)
+	c.stopped("entry")
+	c.request("continue", map[string]interface{}{"threadId": 1}, nil)
+	c.stopped("breakpoint")
+	var scopes struct {
+		Scopes []struct {
+			Name               string
+			VariablesReference int
+		}
+	}
+	c.request("scopes", map[string]interface{}{"frameId": 1}, &scopes)
+	type variable struct {
+		Name, Type, Value  string
+		VariablesReference int
+	}
+	variables := func(ref int) []variable {
+		var body struct{ Variables []variable }
+		c.request("variables", map[string]interface{}{"variablesReference": ref}, &body)
+		return body.Variables
+	}
+	var locals []variable
+	for _, s := range scopes.Scopes {
+		if s.Name == "Locals" {
+			locals = variables(s.VariablesReference)
+		}
+	}
+	if len(locals) != 3 {
+		t.Fatalf("locals %+v", locals)
+	}
+	// a String shows its text and has no fields to expand
+	if s := locals[1]; s.Name != "s" || s.Type != "String" || s.Value != `"hi"` || s.VariablesReference != 0 {
+		t.Errorf("String %+v", s)
+	}
+	p := locals[2]
+	if p.Name != "p" || p.Type != "Point" || !strings.HasPrefix(p.Value, "Point@") || p.VariablesReference == 0 {
+		t.Fatalf("object %+v", p)
+	}
+	if fields := variables(p.VariablesReference); fmt.Sprint(fields) != "[{x int 3 0} {y int 4 0}]" {
+		t.Errorf("fields of p %v", fields)
+	}
+	c.finish()
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Debugger runs a program on the CPU emulator under the control of
+// breakpoints on ROM addresses and watchpoints on writes to RAM, and draws
+// the state of the machine as text panes: the code around PC, the
+// registers, watch expressions, the VM stack and the screen.
+type Debugger struct {
+	CPU         *CPU
+	Program     *Program
+	Breakpoints map[int]bool // ROM addresses
+	Watchpoints map[int]bool // RAM addresses
+	Watches     []string     // expressions shown in the watch pane
+
+	// Journal, when set, records the cycles run, which the debugger can
+	// then go back through.
+	Journal *Journal
+
+	// Limit is the number of cycles continue runs when no count is given.
+	Limit int
+
+	labels  map[int][]string // names of the ROM addresses
+	message string
+	hit     string // the last watchpoint written
+	last    string // the last command, which an empty line repeats
+}
+
+// errQuit is returned by Exec for the quit command.
+var errQuit = errors.New("quit")
+
+// NewDebugger debugs the program loaded in c, whose symbols are those of
+// prog.
+func NewDebugger(c *CPU, prog *Program) *Debugger {
+	d := &Debugger{
+		CPU:         c,
+		Program:     prog,
+		Breakpoints: map[int]bool{},
+		Watchpoints: map[int]bool{},
+		Limit:       10000000,
+		labels:      map[int][]string{},
+	}
+	for name, addr := range prog.Labels {
+		d.labels[addr] = append(d.labels[addr], name)
+	}
+	for _, names := range d.labels {
+		sort.Strings(names)
+	}
+	c.OnWrite = func(addr int, old, value int16) {
+		if d.Watchpoints[addr] && d.hit == "" {
+			d.hit = fmt.Sprintf("RAM[%d] %d -> %d", addr, old, value)
+		}
+	}
+	return d
+}
+
+// Halted reports whether the program has stopped: a builtin halted or
+// failed, it entered Sys.halt, or it spins in an empty loop.
+func (d *Debugger) Halted() bool {
+	if d.CPU.Halted || d.CPU.Spinning() {
+		return true
+	}
+	halt, ok := d.Program.Labels["Sys.halt"]
+	return ok && int(d.CPU.PC) == halt
+}
+
+// Step executes n instructions, stopping early at a watchpoint or when
+// the program halts, and returns why it stopped.
+func (d *Debugger) Step(n int) string {
+	for i := 0; i < n; i++ {
+		if reason := d.step(); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// step executes one instruction and reports a watchpoint or halt.
+func (d *Debugger) step() string {
+	if d.Halted() {
+		return d.haltReason()
+	}
+	d.hit = ""
+	if d.Journal != nil {
+		d.Journal.Step()
+	} else {
+		d.CPU.Step()
+	}
+	if d.hit != "" {
+		return "watchpoint " + d.hit
+	}
+	if d.CPU.Halted {
+		return d.haltReason()
+	}
+	return ""
+}
+
+func (d *Debugger) haltReason() string {
+	if d.CPU.Err != nil && d.CPU.Err != ErrHalt {
+		return "error: " + d.CPU.Err.Error()
+	}
+	return "halted"
+}
+
+// Next steps over a call: on the code of a VM call, it runs until the
+// call returns, unless a breakpoint or watchpoint stops it first.
+// Elsewhere it executes one instruction.
+func (d *Debugger) Next() string {
+	ret, ok := d.callReturn()
+	if !ok {
+		return d.step()
+	}
+	// the call returns to ret with SP at most one above its value now,
+	// the return value replacing the arguments; recursive calls from the
+	// same place return with a higher SP
+	sp := d.CPU.RAM[0]
+	return d.run(d.Limit, func() bool {
+		return int(d.CPU.PC) == ret && d.CPU.RAM[0] <= sp+1
+	})
+}
+
+// callReturn returns the return address of the call at PC: the code
+// writer calls functions with "@$call, 0;JMP" followed by the return
+// address.
+func (d *Debugger) callReturn() (int, bool) {
+	call, ok := d.Program.Labels["$call"]
+	if !ok {
+		return 0, false
+	}
+	c, pc := d.CPU, int(d.CPU.PC)
+	jump := func(addr int) bool {
+		return addr < len(c.ROM) && c.ROM[addr]&0x8000 != 0 && c.ROM[addr]&7 == 7
+	}
+	switch {
+	case pc+1 < len(c.ROM) && int(c.ROM[pc]) == call && jump(pc+1):
+		return pc + 2, true
+	case jump(pc) && int(uint16(c.A)) == call:
+		return pc + 1, true
+	}
+	return 0, false
+}
+
+// Continue runs at most limit cycles, until a breakpoint or a watchpoint
+// stops the program, or it halts.
+func (d *Debugger) Continue(limit int) string {
+	return d.run(limit, func() bool { return false })
+}
+
+func (d *Debugger) run(limit int, done func() bool) string {
+	for i := 0; i < limit; i++ {
+		if reason := d.step(); reason != "" {
+			return reason
+		}
+		if done() {
+			return ""
+		}
+		if d.Breakpoints[int(d.CPU.PC)] {
+			return "breakpoint at " + d.describe(int(d.CPU.PC))
+		}
+	}
+	return fmt.Sprintf("paused after %d cycles", limit)
+}
+
+// describe names a ROM address with its labels.
+func (d *Debugger) describe(addr int) string {
+	if names := d.labels[addr]; len(names) > 0 {
+		return fmt.Sprintf("%d (%s)", addr, strings.Join(names, ", "))
+	}
+	return strconv.Itoa(addr)
+}
+
+// romAddress parses a ROM address: a number or a label.
+func (d *Debugger) romAddress(s string) (int, error) {
+	if addr, ok := d.Program.Labels[s]; ok {
+		return addr, nil
+	}
+	addr, err := strconv.Atoi(s)
+	if err != nil || addr < 0 || addr > 32767 {
+		return 0, fmt.Errorf("no label %s", s)
+	}
+	return addr, nil
+}
+
+// ramAddress parses a RAM address: a number, a predefined symbol or a
+// variable of the program.
+func (d *Debugger) ramAddress(s string) (int, error) {
+	if addr, ok := predefinedSymbols[s]; ok {
+		return addr, nil
+	}
+	if addr, ok := d.Program.Variables[s]; ok {
+		return addr, nil
+	}
+	addr, err := strconv.Atoi(s)
+	if err != nil || addr < 0 || addr >= len(d.CPU.RAM) {
+		return 0, fmt.Errorf("no variable %s", s)
+	}
+	return addr, nil
+}
+
+const debuggerHelp = `commands:
+  s, step [n]          execute n instructions, 1 by default
+  n, next              step over the call at PC
+  c, continue [n]      run until a breakpoint, a watchpoint or n cycles
+  b, break where       break at a ROM address or label
+  d, delete where      delete a breakpoint
+  w, watch addr        stop on writes to a RAM address or variable
+  unwatch addr         delete a watchpoint
+  display expr         show an expression in the watch pane, such as
+                       RAM[SP-1], LCL + 2, &Main.0 or D; a variable or
+                       predefined symbol stands for the word it names
+  undisplay n          remove the nth expression
+  rs, back [n]         go back n cycles, 1 by default
+  last addr            go back to the last write to a RAM address or variable
+  bisect expr          go back to the first cycle after which expr is not 0
+  reset                restart the program; RAM is kept
+  q, quit              leave the debugger
+An empty line repeats the last command. Commands are read a line at a
+time and the panes are redrawn after each of them, not while the program
+runs.`
+
+// Exec runs a debugger command and sets the message shown under the
+// panes. It returns errQuit for quit.
+func (d *Debugger) Exec(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		line = d.last
+	}
+	d.last = line
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	arg := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+	count := func(def int) (int, error) {
+		if arg == "" {
+			return def, nil
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid count %q", arg)
+		}
+		return n, nil
+	}
+	need := func() error {
+		if arg == "" {
+			return fmt.Errorf("%s needs an argument", fields[0])
+		}
+		return nil
+	}
+
+	d.message = ""
+	switch fields[0] {
+	case "s", "step":
+		n, err := count(1)
+		if err != nil {
+			return err
+		}
+		d.message = d.Step(n)
+	case "n", "next":
+		d.message = d.Next()
+	case "c", "continue":
+		n, err := count(d.Limit)
+		if err != nil {
+			return err
+		}
+		d.message = d.Continue(n)
+	case "b", "break", "d", "delete":
+		if err := need(); err != nil {
+			return err
+		}
+		addr, err := d.romAddress(arg)
+		if err != nil {
+			return err
+		}
+		if fields[0][0] == 'b' {
+			d.Breakpoints[addr] = true
+			d.message = "breakpoint at " + d.describe(addr)
+		} else {
+			delete(d.Breakpoints, addr)
+		}
+	case "w", "watch", "unwatch":
+		if err := need(); err != nil {
+			return err
+		}
+		addr, err := d.ramAddress(arg)
+		if err != nil {
+			return err
+		}
+		if fields[0] == "unwatch" {
+			delete(d.Watchpoints, addr)
+		} else {
+			d.Watchpoints[addr] = true
+			d.message = fmt.Sprintf("watchpoint on RAM[%d]", addr)
+		}
+	case "display":
+		if err := need(); err != nil {
+			return err
+		}
+		if _, err := d.Eval(arg); err != nil {
+			return err
+		}
+		d.Watches = append(d.Watches, arg)
+	case "undisplay":
+		if err := need(); err != nil {
+			return err
+		}
+		n, err := count(0)
+		if err != nil || n <= 0 || n > len(d.Watches) {
+			return fmt.Errorf("no expression %q", arg)
+		}
+		d.Watches = append(d.Watches[:n-1], d.Watches[n:]...)
+	case "rs", "back", "last", "bisect":
+		if d.Journal == nil {
+			return errors.New("no history to go back through")
+		}
+		return d.reverse(fields[0], arg)
+	case "reset":
+		d.CPU.Reset()
+		if d.Journal != nil {
+			d.Journal.Reset()
+		}
+	case "q", "quit":
+		return errQuit
+	case "h", "help":
+		d.message = debuggerHelp
+	default:
+		return fmt.Errorf("unknown command %q, try help", fields[0])
+	}
+	return nil
+}
+
+// reverse runs the commands going back through the history of Journal.
+func (d *Debugger) reverse(command, arg string) error {
+	j := d.Journal
+	switch command {
+	case "rs", "back":
+		n := 1
+		if arg != "" {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil || n <= 0 {
+				return fmt.Errorf("invalid count %q", arg)
+			}
+		}
+		for i := 0; i < n; i++ {
+			if !j.Back() {
+				d.message = fmt.Sprintf("at the start of the history, cycle %d", j.Start())
+				break
+			}
+		}
+	case "last":
+		addr, err := d.ramAddress(arg)
+		if err != nil {
+			return err
+		}
+		if !j.BackToWrite(addr) {
+			d.message = fmt.Sprintf("no write to RAM[%d] since cycle %d", addr, j.Start())
+			break
+		}
+		d.message = fmt.Sprintf("RAM[%d] last written at cycle %d, by %s", addr, d.CPU.Time, d.describe(int(d.CPU.PC)))
+	case "bisect":
+		if _, err := d.Eval(arg); err != nil {
+			return err
+		}
+		time, err := j.Bisect(func(c *CPU) bool {
+			v, err := d.Eval(arg)
+			return err == nil && v != 0
+		})
+		if err != nil {
+			return err
+		}
+		d.message = fmt.Sprintf("%s holds after cycle %d, at %s", arg, time, d.describe(int(d.CPU.PC)))
+	}
+	return nil
+}
+
+// Eval evaluates a watch expression. Numbers are constants; A, D and PC
+// are the registers; predefined symbols and variables stand for the word
+// of RAM they name, & giving their address instead; labels are ROM
+// addresses; RAM[e] is the word at e. Terms are added and subtracted.
+func (d *Debugger) Eval(expr string) (int16, error) {
+	e := &watchExpr{d: d, s: expr}
+	v, err := e.sum()
+	if err == nil && e.peek() != 0 {
+		err = fmt.Errorf("unexpected %q", e.s[e.pos:])
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", expr, err)
+	}
+	return v, nil
+}
+
+type watchExpr struct {
+	d   *Debugger
+	s   string
+	pos int
+}
+
+// peek skips blanks and returns the next byte, 0 at the end.
+func (e *watchExpr) peek() byte {
+	for e.pos < len(e.s) && e.s[e.pos] == ' ' {
+		e.pos += 1
+	}
+	if e.pos == len(e.s) {
+		return 0
+	}
+	return e.s[e.pos]
+}
+
+func (e *watchExpr) sum() (int16, error) {
+	v, err := e.term()
+	for err == nil {
+		op := e.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		e.pos += 1
+		var w int16
+		w, err = e.term()
+		if op == '-' {
+			w = -w
+		}
+		v += w
+	}
+	return v, err
+}
+
+func (e *watchExpr) term() (int16, error) {
+	switch c := e.peek(); {
+	case c == '-':
+		e.pos += 1
+		v, err := e.term()
+		return -v, err
+	case c == '(':
+		e.pos += 1
+		v, err := e.sum()
+		if err == nil && e.peek() != ')' {
+			err = errors.New("missing )")
+		}
+		e.pos += 1
+		return v, err
+	case c == '&':
+		e.pos += 1
+		name := e.name()
+		addr, err := e.d.ramAddress(name)
+		if err != nil || name == "" {
+			return 0, fmt.Errorf("no variable %q", name)
+		}
+		return int16(addr), nil
+	}
+	name := e.name()
+	if name == "" {
+		return 0, fmt.Errorf("expected a term at %q", e.s[e.pos:])
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		return int16(n), nil
+	}
+	c := e.d.CPU
+	switch name {
+	case "A":
+		return c.A, nil
+	case "D":
+		return c.D, nil
+	case "PC":
+		return int16(c.PC), nil
+	case "RAM":
+		if e.peek() != '[' {
+			return 0, errors.New("expected RAM[")
+		}
+		e.pos += 1
+		addr, err := e.sum()
+		if err == nil && e.peek() != ']' {
+			err = errors.New("missing ]")
+		}
+		e.pos += 1
+		return c.read(uint16(addr)), err
+	}
+	if addr, ok := e.d.Program.Labels[name]; ok {
+		return int16(addr), nil
+	}
+	addr, err := e.d.ramAddress(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown symbol %s", name)
+	}
+	return c.read(uint16(addr)), nil
+}
+
+// name reads a number or a symbol of the assembler.
+func (e *watchExpr) name() string {
+	e.peek()
+	start := e.pos
+	for e.pos < len(e.s) && isSymbolChar(e.s[e.pos]) {
+		e.pos += 1
+	}
+	return e.s[start:e.pos]
+}
+
+func isSymbolChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("_.$:", c) != -1
+}
+
+// Panes of the debugger. The code is on the left, the other panes are
+// stacked on the right and the screen is under both.
+const (
+	codeWidth   = 44
+	codeHeight  = 24
+	stackHeight = 10
+	screenScale = 8
+)
+
+// Render draws the panes and the message of the last command.
+func (d *Debugger) Render(w io.Writer) error {
+	left := d.codePane()
+	var right []string
+	right = append(right, d.registerPane()...)
+	right = append(right, "")
+	right = append(right, d.watchPane()...)
+	right = append(right, "")
+	right = append(right, d.stackPane()...)
+
+	bw := bufio.NewWriter(w)
+	for i := 0; i < len(left) || i < len(right); i++ {
+		var l, r string
+		if i < len(left) {
+			l = left[i]
+		}
+		if i < len(right) {
+			r = right[i]
+		}
+		if r == "" {
+			fmt.Fprintln(bw, strings.TrimRight(l, " "))
+			continue
+		}
+		fmt.Fprintf(bw, "%s%s%s\n", l, strings.Repeat(" ", codeWidth-utf8.RuneCountInString(l)), r)
+	}
+	fmt.Fprintln(bw, "")
+	fmt.Fprintln(bw, "Screen")
+	if err := ScreenOf(d.CPU.RAM).WriteText(bw, screenScale); err != nil {
+		return err
+	}
+	if d.message != "" {
+		fmt.Fprintln(bw, d.message)
+	}
+	return bw.Flush()
+}
+
+// codePane disassembles the ROM around PC, with the labels. The current
+// instruction is marked with > and breakpoints with *.
+func (d *Debugger) codePane() []string {
+	c := d.CPU
+	pc := int(c.PC)
+	lines := []string{"Code"}
+	start := pc - codeHeight/3
+	if start < 0 {
+		start = 0
+	}
+	for addr := start; len(lines) < codeHeight+1 && addr < len(c.ROM); addr++ {
+		for _, name := range d.labels[addr] {
+			if len(lines) < codeHeight {
+				lines = append(lines, clip("("+name+")", codeWidth-2))
+			}
+		}
+		mark := " "
+		switch {
+		case addr == pc:
+			mark = ">"
+		case d.Breakpoints[addr]:
+			mark = "*"
+		}
+		if addr == pc && d.Breakpoints[addr] {
+			mark = "*>"
+		}
+		lines = append(lines, clip(fmt.Sprintf("%2s%5d  %-12s%s", mark, addr, Disassemble(c.ROM[addr]), d.comment(addr)), codeWidth-2))
+	}
+	return lines
+}
+
+// comment names the address loaded by an A-instruction: a label when the
+// next instruction jumps, a variable otherwise.
+func (d *Debugger) comment(addr int) string {
+	rom := d.CPU.ROM
+	inst := rom[addr]
+	if inst&0x8000 != 0 {
+		return ""
+	}
+	if addr+1 < len(rom) && rom[addr+1]&0x8000 != 0 && rom[addr+1]&7 != 0 {
+		if names := d.labels[int(inst)]; len(names) > 0 {
+			return "// " + names[0]
+		}
+	}
+	for name, v := range d.Program.Variables {
+		if v == int(inst) {
+			return "// " + name
+		}
+	}
+	return ""
+}
+
+func (d *Debugger) registerPane() []string {
+	c := d.CPU
+	lines := []string{
+		"Registers",
+		fmt.Sprintf("  A  %6d    D  %6d", c.A, c.D),
+		fmt.Sprintf("  PC %6d    time %d", c.PC, c.Time),
+	}
+	if j := d.Journal; j != nil {
+		history := fmt.Sprintf("  history %d to %d", j.Start(), j.Head())
+		if j.InPast() {
+			history += ", in the past"
+		}
+		lines = append(lines, history)
+	}
+	return lines
+}
+
+func (d *Debugger) watchPane() []string {
+	lines := []string{"Watches"}
+	for i, expr := range d.Watches {
+		v, err := d.Eval(expr)
+		value := strconv.Itoa(int(v))
+		if err != nil {
+			value = err.Error()
+		}
+		lines = append(lines, fmt.Sprintf("  %d: %s = %s", i+1, expr, value))
+	}
+	var addrs []int
+	for addr := range d.Watchpoints {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+	for _, addr := range addrs {
+		lines = append(lines, fmt.Sprintf("  w  RAM[%d] = %d", addr, d.CPU.RAM[addr]))
+	}
+	return lines
+}
+
+// stackPane shows the top of the VM stack, which starts at 256, and where
+// the segment pointers point into it.
+func (d *Debugger) stackPane() []string {
+	ram := d.CPU.RAM
+	sp := int(ram[0])
+	lines := []string{fmt.Sprintf("Stack (SP %d)", sp)}
+	if sp > len(ram) {
+		sp = len(ram)
+	}
+	for addr := sp - 1; addr >= 256 && len(lines) <= stackHeight; addr-- {
+		line := fmt.Sprintf("  %5d: %6d", addr, ram[addr])
+		for i, reg := range []string{"LCL", "ARG", "THIS", "THAT"} {
+			if int(ram[i+1]) == addr {
+				line += " <- " + reg
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// clip shortens s to n characters.
+func clip(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// runDebugger reads commands from in and draws the debugger on out, a
+// terminal, after each of them until quit or the end of in. It is not a
+// full-screen interface: the terminal stays in line mode and nothing is
+// drawn while a command runs.
+func runDebugger(d *Debugger, in io.Reader, out io.Writer) error {
+	s := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "\x1b[H\x1b[2J")
+		if err := d.Render(out); err != nil {
+			return err
+		}
+		fmt.Fprint(out, "(debug) ")
+		if !s.Scan() {
+			fmt.Fprintln(out)
+			return s.Err()
+		}
+		if err := d.Exec(s.Text()); err == errQuit {
+			return nil
+		} else if err != nil {
+			d.message = err.Error()
+		}
+	}
+}
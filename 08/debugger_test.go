@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	if got := Disassemble(21); got != "@21" {
+		t.Errorf("Disassemble(21) = %q", got)
+	}
+	for comp := range compTable {
+		for _, dest := range []string{"", "M=", "AD=", "AMD="} {
+			for jump := range jumpTable {
+				for _, m := range []bool{false, true} {
+					text := dest + comp
+					if m && strings.Contains(comp, "A") {
+						text = dest + strings.Replace(comp, "A", "M", -1)
+					}
+					if jump != "" {
+						text += ";" + jump
+					}
+					code, err := assembleC(text)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := Disassemble(code); got != text && strings.Replace(got, "ADM", "AMD", 1) != text {
+						t.Errorf("Disassemble(%016b) = %q, want %q", code, got, text)
+					}
+				}
+			}
+		}
+	}
+}
+
+// assembleVM translates the VM commands of src, as Main.vm, with the
+// bootstrap code and assembles them.
+func assembleVM(t *testing.T, src string) *Program {
+	var asm bytes.Buffer
+	w := NewCodeWriter(&asm)
+	w.WriteInit()
+	w.SetFileName("Main.vm")
+	p := NewParder(strings.NewReader(src))
+	for p.HasMoreCommands() {
+		if err := writeCommand(w, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	prog, err := Assemble(&asm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prog
+}
+
+func TestDebugger(t *testing.T) {
+	prog := assembleVM(t, `
+function Sys.init 0
+push constant 3
+call Main.double 1
+pop static 0
+label END
+goto END
+function Main.double 0
+push argument 0
+push argument 0
+add
+return
+`)
+	c := NewCPU()
+	c.Load(prog)
+	d := NewDebugger(c, prog)
+	exec := func(command string) {
+		if err := d.Exec(command); err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+	}
+	eval := func(expr string) int16 {
+		v, err := d.Eval(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	exec("b Main.double")
+	exec("c")
+	if int(c.PC) != prog.Labels["Main.double"] || !strings.Contains(d.message, "(Main.double)") {
+		t.Fatalf("stopped at %d: %s", c.PC, d.message)
+	}
+	exec("display RAM[ARG]")
+	if got := eval("RAM[ARG]"); got != 3 {
+		t.Errorf("RAM[ARG] = %d in Main.double, want 3", got)
+	}
+	if got := eval("ARG + 1 - (LCL - 6)"); got != 1 {
+		t.Errorf("ARG + 1 - (LCL - 6) = %d, want 1", got)
+	}
+	var screen bytes.Buffer
+	if err := d.Render(&screen); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"*> ", "(Main.double)", "1: RAM[ARG] = 3", "Stack (SP 267)", "<- ARG", "Screen"} {
+		if !strings.Contains(screen.String(), want) {
+			t.Errorf("panes without %q:\n%s", want, screen.String())
+		}
+	}
+
+	// step over the call from the start
+	exec("d Main.double")
+	exec("reset")
+	ret := -1
+	for name, addr := range prog.Labels {
+		if strings.HasPrefix(name, "Sys.init$ret.") {
+			ret = addr
+		}
+	}
+	exec("b " + strconv.Itoa(ret-2))
+	exec("c")
+	if int(c.PC) != ret-2 {
+		t.Fatalf("stopped at %d, not at the call at %d", c.PC, ret-2)
+	}
+	exec("next")
+	if int(c.PC) != ret || eval("RAM[SP-1]") != 6 {
+		t.Errorf("next stopped at %d with %d on the stack, want %d with 6", c.PC, eval("RAM[SP-1]"), ret)
+	}
+
+	exec("w Main.0")
+	exec("c")
+	// the debugger stops after the instruction writing
+	if d.message != "watchpoint RAM[16] 0 -> 6" || eval("Main.0") != 6 {
+		t.Errorf("continue: %s, Main.0 = %d", d.message, eval("Main.0"))
+	}
+	exec("")
+	if d.message != "halted" || eval("Main.0") != 6 {
+		t.Errorf("continue: %s, Main.0 = %d", d.message, eval("Main.0"))
+	}
+
+	for _, command := range []string{"b nowhere", "w nothing", "display RAM[", "undisplay 2", "undisplay", "undisplay 0", "s -1", "frobnicate"} {
+		if err := d.Exec(command); err == nil {
+			t.Errorf("%s: no error", command)
+		}
+	}
+	if err := d.Exec("q"); err != errQuit {
+		t.Errorf("quit: %v", err)
+	}
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The end-to-end tests run the Jack programs of 11/test, and those of
+// 11/test/ext written with the language extensions, that have an e2e.spec
+// file. Each program is compiled with the Jack OS by the compiler
+// of 11, translated by this translator, assembled by the assembler of 06
+// and executed on the CPU emulator until it halts or its cycle budget is
+// spent. The spec then asserts on the RAM, the screen memory or the
+// printed output. The program runs again with the builtins of the OS,
+// once on the CPU and once on the VM emulator, and must pass the same
+// checks.
+//
+// A spec has one directive per line; # starts a comment:
+//
+//	cycles 100000        cycle budget, 1000000 by default
+//	running              the program is not expected to halt within the budget
+//	timed                the checks depend on the time Sys.wait takes, so the
+//	                     program is not run with the native OS
+//	ext                  the program is compiled with the language extensions
+//	set 8000 13          RAM[8000] = 13 before the program starts
+//	keys Foo.keys        the key script Foo.keys next to the spec feeds KBD,
+//	                     in cycles on the CPU and in steps on the VM emulator
+//	ram 8000 1 -1 2      RAM[8000] = 1, RAM[8001] = -1, RAM[8002] = 2
+//	screen 0 -1          the same, relative to SCREEN
+//	output "7\n"         text printed through Output, as a Go string literal
+//	screenshot Foo.png   the screen at the end, as the golden image Foo.png
+//	                     next to the spec; go test -update rewrites it
+const e2eSpecFile = "e2e.spec"
+
+var (
+	update = flag.Bool("update", false, "rewrite the golden screenshots of the end-to-end tests")
+	gifDir = flag.String("gif", "", "write an animated GIF of every end-to-end run on the CPU to `dir`")
+)
+
+type e2eSpec struct {
+	Cycles  int
+	Running bool
+	Timed   bool
+	Ext     bool
+	Set     map[int]int16
+	RAM     map[int]int16
+	Output  *string
+
+	Keys       string
+	Screenshot string
+}
+
+func parseE2ESpec(path string) (*e2eSpec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	spec := &e2eSpec{Cycles: 1000000, Set: map[int]int16{}, RAM: map[int]int16{}}
+	s := bufio.NewScanner(f)
+	number := 0
+	for s.Scan() {
+		number += 1
+		line := s.Text()
+		if i := strings.Index(line, "#"); i != -1 && !strings.HasPrefix(strings.TrimSpace(line), "output") {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		errorf := func(format string, a ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", path, number, fmt.Sprintf(format, a...))
+		}
+		switch fields[0] {
+		case "cycles":
+			if len(fields) != 2 {
+				return nil, errorf("cycles expects a number")
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n <= 0 {
+				return nil, errorf("invalid cycle budget %q", fields[1])
+			}
+			spec.Cycles = n
+		case "running":
+			spec.Running = true
+		case "timed":
+			spec.Timed = true
+		case "ext":
+			spec.Ext = true
+		case "set", "ram", "screen":
+			if len(fields) < 3 {
+				return nil, errorf("%s expects an address and values", fields[0])
+			}
+			addr, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, errorf("invalid address %q", fields[1])
+			}
+			values := spec.RAM
+			switch fields[0] {
+			case "set":
+				values = spec.Set
+			case "screen":
+				addr += screenBase
+			}
+			for i, field := range fields[2:] {
+				v, err := strconv.ParseInt(field, 10, 16)
+				if err != nil {
+					return nil, errorf("invalid value %q", field)
+				}
+				if addr+i < 0 || addr+i >= ramSize {
+					return nil, errorf("address %d out of range", addr+i)
+				}
+				values[addr+i] = int16(v)
+			}
+		case "output":
+			text, err := strconv.Unquote(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "output")))
+			if err != nil {
+				return nil, errorf("output expects a quoted string")
+			}
+			spec.Output = &text
+		case "keys":
+			if len(fields) != 2 {
+				return nil, errorf("keys expects a file name")
+			}
+			spec.Keys = filepath.Join(filepath.Dir(path), fields[1])
+		case "screenshot":
+			if len(fields) != 2 {
+				return nil, errorf("screenshot expects a file name")
+			}
+			spec.Screenshot = filepath.Join(filepath.Dir(path), fields[1])
+		default:
+			return nil, errorf("unknown directive %q", fields[0])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+var e2eTools struct {
+	once      sync.Once
+	dir       string
+	compiler  string
+	assembler string
+	err       error
+}
+
+// buildE2ETools builds the compiler of 11 and the assembler of 06 once per
+// test run.
+func buildE2ETools(t *testing.T) (compiler, assembler string) {
+	e2eTools.once.Do(func() {
+		dir, err := ioutil.TempDir("", "e2e-tools")
+		if err != nil {
+			e2eTools.err = err
+			return
+		}
+		e2eTools.dir = dir
+		e2eTools.compiler = filepath.Join(dir, "jackc")
+		e2eTools.assembler = filepath.Join(dir, "assembler")
+		if err := goBuild("../11", e2eTools.compiler); err != nil {
+			e2eTools.err = err
+			return
+		}
+		e2eTools.err = goBuild("../06", e2eTools.assembler)
+	})
+	if e2eTools.err != nil {
+		t.Fatal(e2eTools.err)
+	}
+	return e2eTools.compiler, e2eTools.assembler
+}
+
+// goBuild builds the package main in dir, which has no module of its own.
+func goBuild(dir, output string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return err
+	}
+	args := []string{"build", "-o", output}
+	for _, file := range files {
+		if !strings.HasSuffix(file, "_test.go") {
+			args = append(args, filepath.Base(file))
+		}
+	}
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("go build in %s: %v\n%s", dir, err, out)
+	}
+	return nil
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if e2eTools.dir != "" {
+		os.RemoveAll(e2eTools.dir)
+	}
+	os.Exit(code)
+}
+
+func TestE2E(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the compiler and the assembler")
+	}
+	logLevel = logQuiet
+	defer func() { logLevel = logInfo }()
+	specs, err := filepath.Glob(filepath.Join("../11/test/*", e2eSpecFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ext, err := filepath.Glob(filepath.Join("../11/test/ext/*", e2eSpecFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	specs = append(specs, ext...)
+	if len(specs) == 0 {
+		t.Fatal("no programs with an " + e2eSpecFile)
+	}
+	for _, path := range specs {
+		dir := filepath.Dir(path)
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			spec, err := parseE2ESpec(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := buildE2EProgram(t, dir, spec.Ext)
+			jack := p.runCPU(t, spec)
+			t.Run("CPU", func(t *testing.T) {
+				checkE2E(t, spec, jack)
+			})
+			if spec.Timed {
+				return
+			}
+			// the same program with the OS functions run natively, with
+			// the cycle budget as the step budget
+			t.Run("NativeCPU", func(t *testing.T) {
+				r := p.runNative(t, spec, false)
+				checkE2E(t, spec, r)
+				// the native OS allocates and writes the same heap blocks
+				for addr := heapStart; addr < heapEnd; addr++ {
+					if r.RAM[addr] != jack.RAM[addr] {
+						t.Errorf("RAM[%d] = %d, %d with the Jack OS", addr, r.RAM[addr], jack.RAM[addr])
+						break
+					}
+				}
+			})
+			t.Run("NativeVM", func(t *testing.T) {
+				checkE2E(t, spec, p.runNative(t, spec, true))
+			})
+		})
+	}
+}
+
+// e2eProgram is a Jack program compiled with the Jack OS, as VM commands
+// and as Hack machine code.
+type e2eProgram struct {
+	Commands []VMCommand
+	Hack     *Program
+}
+
+// buildE2EProgram compiles, translates and assembles the Jack program in
+// dir, with the language extensions if ext is set.
+func buildE2EProgram(t *testing.T, dir string, ext bool) *e2eProgram {
+	compiler, assembler := buildE2ETools(t)
+	work, err := ioutil.TempDir("", "e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(work)
+
+	args := []string{"-d", work, dir}
+	if ext {
+		args = append([]string{"-ext"}, args...)
+	}
+	if out, err := exec.Command(compiler, args...).CombinedOutput(); err != nil {
+		t.Fatalf("jackc: %v\n%s", err, out)
+	}
+	files, err := findVMFiles(work, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defined, called, err := vmFunctions(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var undefined []string
+	for name := range called {
+		if !defined[name] {
+			undefined = append(undefined, name)
+		}
+	}
+	if len(undefined) > 0 {
+		sort.Strings(undefined)
+		t.Fatalf("undefined functions: %s", strings.Join(undefined, ", "))
+	}
+	p := &e2eProgram{}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commands, err := ParseVM(file, f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Commands = append(p.Commands, commands...)
+	}
+
+	var asm bytes.Buffer
+	if err := translate(&asm, files, true); err != nil {
+		t.Fatal(err)
+	}
+	asmPath := filepath.Join(work, "Main.asm")
+	if err := ioutil.WriteFile(asmPath, asm.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var hack, stderr bytes.Buffer
+	cmd := exec.Command(assembler, asmPath)
+	cmd.Stdout, cmd.Stderr = &hack, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("assembler: %v\n%s", err, stderr.Bytes())
+	}
+	p.Hack, err = LoadHack(&hack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the symbols of the program, which the .hack file does not keep
+	symbols, err := Assemble(bytes.NewReader(asm.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Hack.Labels = symbols.Labels
+	return p
+}
+
+// vmFunctions lists the functions defined and called by VM files.
+func vmFunctions(files []string) (defined, called map[string]bool, err error) {
+	defined, called = map[string]bool{}, map[string]bool{}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			switch fields[0] {
+			case "function":
+				defined[fields[1]] = true
+			case "call":
+				called[fields[1]] = true
+			}
+		}
+	}
+	return defined, called, nil
+}
+
+// keyboard returns a new replay of the key script of spec, or nil.
+func (spec *e2eSpec) keyboard(t *testing.T) KeyInput {
+	if spec.Keys == "" {
+		return nil
+	}
+	script, err := LoadKeyScript(spec.Keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+// e2eResult is the state of a program after its run.
+type e2eResult struct {
+	RAM    []int16
+	Halted bool
+	Output []byte
+}
+
+// runCPU executes the program on the CPU for at most the cycles of spec.
+// The program has halted when it enters Sys.halt or an empty infinite
+// loop. The output is recorded from the calls to Output.printChar,
+// Output.println and Output.backSpace.
+func (p *e2eProgram) runCPU(t *testing.T, spec *e2eSpec) *e2eResult {
+	c := NewCPU()
+	c.Load(p.Hack)
+	c.Keyboard = spec.keyboard(t)
+	for addr, v := range spec.Set {
+		c.RAM[addr] = v
+	}
+	r := &e2eResult{RAM: c.RAM}
+	var anim *Animation
+	if *gifDir != "" {
+		// about 200 frames of the run, and the last screen
+		anim = NewAnimation(spec.Cycles/200+1, 5)
+		defer writeGIF(t, anim)
+		defer anim.Capture(c.RAM)
+	}
+	labels := p.Hack.Labels
+	halt, hasHalt := labels["Sys.halt"]
+	printChar, hasPrintChar := labels["Output.printChar"]
+	println, hasPrintln := labels["Output.println"]
+	backSpace, hasBackSpace := labels["Output.backSpace"]
+	for i := 0; i < spec.Cycles; i++ {
+		pc := int(c.PC)
+		switch {
+		case hasHalt && pc == halt, c.Spinning():
+			r.Halted = true
+			return r
+		case hasPrintChar && pc == printChar:
+			// the first argument of the call; newline and backspace are
+			// recorded by the functions printChar calls for them
+			if ch := c.read(uint16(c.RAM[2])); ch < 128 {
+				r.Output = append(r.Output, byte(ch))
+			}
+		case hasPrintln && pc == println:
+			r.Output = append(r.Output, '\n')
+		case hasBackSpace && pc == backSpace:
+			r.Output = eraseLast(r.Output)
+		}
+		if anim != nil {
+			anim.Tick(c.Time, c.RAM)
+		}
+		c.Step()
+	}
+	return r
+}
+
+// writeGIF writes the animation of the run of the current test to the
+// directory of -gif.
+func writeGIF(t *testing.T, anim *Animation) {
+	path := filepath.Join(*gifDir, strings.Replace(t.Name(), "/", "_", -1)+".gif")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := anim.Encode(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runNative executes the program with the builtins of the Jack OS, on
+// the VM emulator or on the CPU, for at most the cycles of spec. The
+// output is what the builtins print.
+func (p *e2eProgram) runNative(t *testing.T, spec *e2eSpec, vm bool) *e2eResult {
+	builtins, err := NewBuiltins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	builtins.Output = &output
+	r := &e2eResult{}
+	if vm {
+		emu := NewVMEmulator()
+		emu.Builtins = builtins
+		emu.Keyboard = spec.keyboard(t)
+		if err := emu.Load(p.Commands); err != nil {
+			t.Fatal(err)
+		}
+		for addr, v := range spec.Set {
+			emu.RAM[addr] = v
+		}
+		if err := emu.Bootstrap(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < spec.Cycles && !emu.Halted(); i++ {
+			if err := emu.Step(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r.RAM, r.Halted = emu.RAM, emu.Halted()
+	} else {
+		c := NewCPU()
+		c.Load(p.Hack)
+		c.SetBuiltins(builtins, p.Hack.Labels)
+		c.Keyboard = spec.keyboard(t)
+		for addr, v := range spec.Set {
+			c.RAM[addr] = v
+		}
+		for i := 0; i < spec.Cycles && !c.Halted && !c.Spinning(); i++ {
+			c.Step()
+		}
+		if c.Err != nil {
+			t.Fatal(c.Err)
+		}
+		r.RAM, r.Halted = c.RAM, c.Halted || c.Spinning()
+	}
+	for _, ch := range output.Bytes() {
+		if ch == '\b' {
+			r.Output = eraseLast(r.Output)
+		} else {
+			r.Output = append(r.Output, ch)
+		}
+	}
+	return r
+}
+
+// eraseLast removes the last character printed on the current line.
+func eraseLast(output []byte) []byte {
+	if n := len(output); n > 0 && output[n-1] != '\n' {
+		return output[:n-1]
+	}
+	return output
+}
+
+func checkE2E(t *testing.T, spec *e2eSpec, r *e2eResult) {
+	if !spec.Running && !r.Halted {
+		t.Errorf("did not halt within %d cycles", spec.Cycles)
+	}
+	var addrs []int
+	for addr := range spec.RAM {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+	for _, addr := range addrs {
+		if got, want := r.RAM[addr], spec.RAM[addr]; got != want {
+			name := fmt.Sprintf("RAM[%d]", addr)
+			if addr >= screenBase && addr < kbdAddr {
+				name = fmt.Sprintf("SCREEN[%d]", addr-screenBase)
+			}
+			t.Errorf("%s = %d, want %d", name, got, want)
+		}
+	}
+	if spec.Output != nil && string(r.Output) != *spec.Output {
+		t.Errorf("output %q, want %q", r.Output, *spec.Output)
+	}
+	if spec.Screenshot != "" {
+		checkScreenshot(t, spec.Screenshot, ScreenOf(r.RAM))
+	}
+}
+
+// checkScreenshot compares the screen with the golden image at path, or
+// writes the image with -update.
+func checkScreenshot(t *testing.T, path string, s *Screen) {
+	if *update {
+		var buf bytes.Buffer
+		if err := s.WritePNG(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	golden, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	if b := golden.Bounds(); b.Dx() != screenWidth || b.Dy() != screenHeight {
+		t.Fatalf("%s: the image is %dx%d, not %dx%d", path, b.Dx(), b.Dy(), screenWidth, screenHeight)
+	}
+	n, first := 0, image.Point{}
+	min := golden.Bounds().Min
+	for y := 0; y < screenHeight; y++ {
+		for x := 0; x < screenWidth; x++ {
+			gray := color.GrayModel.Convert(golden.At(min.X+x, min.Y+y)).(color.Gray)
+			if (gray.Y < 0x80) != s.Black(x, y) {
+				if n == 0 {
+					first = image.Pt(x, y)
+				}
+				n += 1
+			}
+		}
+	}
+	if n > 0 {
+		var text bytes.Buffer
+		s.WriteText(&text, 4)
+		t.Errorf("%d pixels differ from %s, the first at %v; the screen is:\n%s", n, path, first, text.Bytes())
+	}
+}
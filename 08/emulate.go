@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// runOptions configures the run of a translated program on the CPU
+// emulator.
+type runOptions struct {
+	Cycles int    // cycle budget, 0 for none
+	Native bool   // run the Jack OS functions with their builtins
+	Keys   string // key script to replay
+	Live   bool   // read keys from the terminal and draw the screen
+	Record string // where to write the keys of the run as a key script
+	Hold   int    // cycles a key typed in live mode is held
+	Speed  int    // cycles per second in live mode
+	Scale  int    // pixels per character of the drawn screen
+	Screen bool   // draw the screen when the program stops
+
+	History int // cycles the debugger can go back, 0 for none
+}
+
+// liveFrames is the number of times per second the screen is drawn in
+// live mode.
+const liveFrames = 30
+
+// loadProgram returns the program to run: a single .asm or .hack input as
+// it is, or the .vm files of the inputs translated with the bootstrap code
+// and assembled.
+func loadProgram(inputs []string, recursive bool) (*Program, error) {
+	if len(inputs) == 1 {
+		switch filepath.Ext(inputs[0]) {
+		case ".asm", ".hack":
+			f, err := os.Open(inputs[0])
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			if filepath.Ext(inputs[0]) == ".hack" {
+				return LoadHack(f)
+			}
+			return Assemble(f)
+		}
+	}
+	var files []string
+	for _, input := range inputs {
+		found, err := findVMFiles(input, recursive)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, found...)
+	}
+	var asm bytes.Buffer
+	if err := translate(&asm, files, true); err != nil {
+		return nil, err
+	}
+	return Assemble(&asm)
+}
+
+// newRunCPU loads prog in a CPU set up as opts ask, the builtins printing
+// to output.
+func newRunCPU(prog *Program, opts runOptions, output io.Writer) (*CPU, error) {
+	c := NewCPU()
+	c.Load(prog)
+	if opts.Native {
+		b, err := NewBuiltins()
+		if err != nil {
+			return nil, err
+		}
+		b.Output = output
+		c.SetBuiltins(b, prog.Labels)
+	}
+	if opts.Keys != "" {
+		script, err := LoadKeyScript(opts.Keys)
+		if err != nil {
+			return nil, err
+		}
+		c.Keyboard = script
+	}
+	return c, nil
+}
+
+// emulate runs prog on the CPU emulator until it halts, its budget is
+// spent or, in live mode, Ctrl-C is typed.
+func emulate(prog *Program, opts runOptions, stdout io.Writer) error {
+	if opts.Keys != "" && opts.Live {
+		return fmt.Errorf("-keys and -live are mutually exclusive")
+	}
+	output := stdout
+	if opts.Live {
+		output = nil
+	}
+	c, err := newRunCPU(prog, opts, output)
+	if err != nil {
+		return err
+	}
+
+	var live *LiveKeyboard
+	if opts.Live {
+		restore, err := rawTerminal(os.Stdin)
+		if err != nil {
+			return err
+		}
+		defer restore()
+		live = NewLiveKeyboard(os.Stdin, opts.Hold)
+		c.Keyboard = live
+	}
+	var recorder *KeyRecorder
+	if opts.Record != "" {
+		if c.Keyboard == nil {
+			return fmt.Errorf("-record needs -keys or -live")
+		}
+		recorder = &KeyRecorder{Input: c.Keyboard}
+		c.Keyboard = recorder
+	}
+
+	halt, hasHalt := prog.Labels["Sys.halt"]
+	stopped := func() bool {
+		return c.Halted || c.Spinning() || hasHalt && int(c.PC) == halt ||
+			opts.Cycles > 0 && c.Time >= opts.Cycles
+	}
+	if live == nil {
+		for !stopped() {
+			c.Step()
+		}
+	} else {
+		frame := opts.Speed / liveFrames
+		if frame < 1 {
+			frame = 1
+		}
+		screen := &crlfWriter{stdout}
+		fmt.Fprint(screen, "\x1b[2J")
+		tick := time.NewTicker(time.Second / liveFrames)
+		defer tick.Stop()
+		for !stopped() && !live.Interrupted() {
+			for i := 0; i < frame && !stopped(); i++ {
+				c.Step()
+			}
+			fmt.Fprint(screen, "\x1b[H")
+			if err := ScreenOf(c.RAM).WriteText(screen, opts.Scale); err != nil {
+				return err
+			}
+			<-tick.C
+		}
+	}
+	if c.Err != nil {
+		return c.Err
+	}
+
+	if recorder != nil {
+		var buf bytes.Buffer
+		recorder.Script.WriteTo(&buf)
+		if err := ioutil.WriteFile(opts.Record, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	if opts.Screen && live == nil {
+		return ScreenOf(c.RAM).WriteText(stdout, opts.Scale)
+	}
+	return nil
+}
+
+// debug runs prog under the debugger, reading commands from stdin. The
+// builtins print nowhere, as the debugger redraws the terminal.
+func debug(prog *Program, opts runOptions) error {
+	if opts.Live || opts.Record != "" {
+		return fmt.Errorf("-live and -record cannot be used with -debug")
+	}
+	c, err := newRunCPU(prog, opts, nil)
+	if err != nil {
+		return err
+	}
+	d := NewDebugger(c, prog)
+	if opts.History > 0 && !opts.Native {
+		// a snapshot every hundredth of the history
+		every := opts.History/100 + 1
+		if d.Journal, err = NewJournal(c, opts.History, every); err != nil {
+			return err
+		}
+	}
+	return runDebugger(d, os.Stdin, os.Stdout)
+}
+
+// crlfWriter ends lines with "\r\n", as a terminal in raw mode needs.
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (w *crlfWriter) Write(p []byte) (int, error) {
+	if _, err := w.w.Write(bytes.Replace(p, []byte("\n"), []byte("\r\n"), -1)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
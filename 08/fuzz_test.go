@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const (
+	heapBase = 3000
+	heapSize = 64
+)
+
+type genFunction struct {
+	name    string
+	file    string
+	args    int
+	locals  int
+	loops   int // the last loops locals are reserved as loop counters
+	callees []int
+}
+
+// vmProgramGen generates random but well-formed VM programs: every
+// program starts at Sys.init, terminates, never underflows its stack and
+// only addresses valid memory. Calls only go to functions with a higher
+// index, so there is no recursion.
+type vmProgramGen struct {
+	r         *rand.Rand
+	functions []genFunction
+	files     map[string]*strings.Builder
+	w         *strings.Builder
+	fn        *genFunction
+	labels    int
+	loopDepth int
+}
+
+func generateVMProgram(seed int64) map[string]string {
+	g := &vmProgramGen{r: rand.New(rand.NewSource(seed)), files: map[string]*strings.Builder{}}
+
+	g.functions = append(g.functions, genFunction{name: "Sys.init", file: "Sys", locals: 2, loops: 2})
+	n := g.r.Intn(5)
+	for i := 0; i < n; i++ {
+		file := "Main"
+		if g.r.Intn(2) == 0 {
+			file = "Lib"
+		}
+		loops := g.r.Intn(2)
+		g.functions = append(g.functions, genFunction{
+			name:   fmt.Sprintf("%s.f%d", file, i+1),
+			file:   file,
+			args:   g.r.Intn(4),
+			locals: g.r.Intn(3) + loops,
+			loops:  loops,
+		})
+	}
+	for i := range g.functions {
+		for j := i + 1; j < len(g.functions); j++ {
+			if g.r.Intn(2) == 0 {
+				g.functions[i].callees = append(g.functions[i].callees, j)
+			}
+		}
+	}
+
+	for i := range g.functions {
+		fn := &g.functions[i]
+		w, ok := g.files[fn.file]
+		if !ok {
+			w = &strings.Builder{}
+			g.files[fn.file] = w
+		}
+		g.w, g.fn, g.labels, g.loopDepth = w, fn, 0, 0
+		g.emit("function %s %d", fn.name, fn.locals)
+		if i == 0 {
+			g.setPointer(0)
+			g.setPointer(1)
+		}
+		g.statements(3)
+		if i == 0 {
+			g.emit("label END")
+			g.emit("goto END")
+		} else {
+			g.expression(2)
+			g.emit("return")
+		}
+	}
+
+	out := map[string]string{}
+	for file, w := range g.files {
+		out[file+".vm"] = w.String()
+	}
+	return out
+}
+
+func (g *vmProgramGen) emit(format string, a ...interface{}) {
+	fmt.Fprintf(g.w, format+"\n", a...)
+}
+
+func (g *vmProgramGen) label() string {
+	// label names repeat across functions on purpose
+	g.labels += 1
+	return fmt.Sprintf("L%d", g.labels)
+}
+
+func (g *vmProgramGen) constant() int {
+	switch g.r.Intn(4) {
+	case 0:
+		return []int{0, 1, 2, 16383, 16384, 32767}[g.r.Intn(6)]
+	case 1:
+		return g.r.Intn(32768)
+	default:
+		return g.r.Intn(20)
+	}
+}
+
+func (g *vmProgramGen) setPointer(i int) {
+	g.emit("push constant %d", heapBase+g.r.Intn(heapSize-8))
+	g.emit("pop pointer %d", i)
+}
+
+// segment returns a readable and writable segment entry.
+func (g *vmProgramGen) segment() string {
+	for {
+		switch g.r.Intn(6) {
+		case 0:
+			if n := g.fn.locals - g.fn.loops; n > 0 {
+				return fmt.Sprintf("local %d", g.r.Intn(n))
+			}
+		case 1:
+			if g.fn.args > 0 {
+				return fmt.Sprintf("argument %d", g.r.Intn(g.fn.args))
+			}
+		case 2:
+			return fmt.Sprintf("static %d", g.r.Intn(4))
+		case 3:
+			return fmt.Sprintf("temp %d", g.r.Intn(8))
+		case 4:
+			return fmt.Sprintf("this %d", g.r.Intn(8))
+		case 5:
+			return fmt.Sprintf("that %d", g.r.Intn(8))
+		}
+	}
+}
+
+// expression pushes exactly one value.
+func (g *vmProgramGen) expression(depth int) {
+	k := g.r.Intn(7)
+	if depth == 0 {
+		k = g.r.Intn(2)
+	}
+	switch k {
+	case 0:
+		g.emit("push constant %d", g.constant())
+	case 1:
+		if g.r.Intn(8) == 0 {
+			g.emit("push pointer %d", g.r.Intn(2))
+		} else {
+			g.emit("push %s", g.segment())
+		}
+	case 2:
+		g.expression(depth - 1)
+		g.emit([]string{"neg", "not"}[g.r.Intn(2)])
+	case 3:
+		if len(g.fn.callees) > 0 {
+			callee := g.functions[g.fn.callees[g.r.Intn(len(g.fn.callees))]]
+			for i := 0; i < callee.args; i++ {
+				g.expression(depth - 1)
+			}
+			g.emit("call %s %d", callee.name, callee.args)
+			return
+		}
+		fallthrough
+	default:
+		g.expression(depth - 1)
+		g.expression(depth - 1)
+		g.emit([]string{"add", "sub", "and", "or", "eq", "gt", "lt"}[g.r.Intn(7)])
+	}
+}
+
+// statements leave the stack as they found it.
+func (g *vmProgramGen) statements(depth int) {
+	n := g.r.Intn(5) + 1
+	for i := 0; i < n; i++ {
+		k := g.r.Intn(6)
+		if depth == 0 {
+			k = 0
+		}
+		switch k {
+		case 0, 1:
+			g.expression(3)
+			g.emit("pop %s", g.segment())
+		case 2:
+			g.setPointer(g.r.Intn(2))
+		case 3:
+			// if-else
+			then, end := g.label(), g.label()
+			g.expression(2)
+			g.emit("if-goto %s", then)
+			g.statements(depth - 1)
+			g.emit("goto %s", end)
+			g.emit("label %s", then)
+			g.statements(depth - 1)
+			g.emit("label %s", end)
+		default:
+			if g.loopDepth == g.fn.loops {
+				g.expression(2)
+				g.emit("pop %s", g.segment())
+				continue
+			}
+			// counted loop
+			counter := g.fn.locals - g.fn.loops + g.loopDepth
+			g.loopDepth += 1
+			start, end := g.label(), g.label()
+			g.emit("push constant %d", g.r.Intn(4))
+			g.emit("pop local %d", counter)
+			g.emit("label %s", start)
+			g.emit("push local %d", counter)
+			g.emit("push constant 0")
+			g.emit("eq")
+			g.emit("if-goto %s", end)
+			g.statements(depth - 1)
+			g.emit("push local %d", counter)
+			g.emit("push constant 1")
+			g.emit("sub")
+			g.emit("pop local %d", counter)
+			g.emit("goto %s", start)
+			g.emit("label %s", end)
+			g.loopDepth -= 1
+		}
+	}
+}
+
+func sortedFiles(files map[string]string) []string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// differentialRun runs a program on the VM emulator and, translated, on
+// the CPU emulator, and compares the registers, temp, statics, the live
+// stack and the heap once both reach the END loop of Sys.init.
+func differentialRun(files map[string]string) error {
+	var commands []VMCommand
+	for _, name := range sortedFiles(files) {
+		cmds, err := ParseVM(name, strings.NewReader(files[name]))
+		if err != nil {
+			return err
+		}
+		commands = append(commands, cmds...)
+	}
+	vm := NewVMEmulator()
+	if err := vm.Load(commands); err != nil {
+		return err
+	}
+	if err := vm.Bootstrap(); err != nil {
+		return err
+	}
+	end := len(commands) - 1
+	for vm.PC != end {
+		if vm.Steps > 1000000 {
+			return fmt.Errorf("VM emulator did not reach END")
+		}
+		if err := vm.Step(); err != nil {
+			return err
+		}
+	}
+
+	var asm bytes.Buffer
+	codeWriter := NewCodeWriter(&asm)
+	codeWriter.WriteInit()
+	for _, name := range sortedFiles(files) {
+		codeWriter.SetFileName(name)
+		parser := NewParder(strings.NewReader(files[name]))
+		for parser.HasMoreCommands() {
+			if err := writeCommand(codeWriter, parser); err != nil {
+				return err
+			}
+		}
+	}
+	codeWriter.Close()
+	prog, err := Assemble(&asm)
+	if err != nil {
+		return err
+	}
+	cpu := NewCPU()
+	cpu.Load(prog)
+	endAddr, ok := prog.Labels["Sys.init$END"]
+	if !ok {
+		return fmt.Errorf("label Sys.init$END not found")
+	}
+	for int(cpu.PC) != endAddr {
+		if cpu.Time > 20000000 {
+			return fmt.Errorf("CPU emulator did not reach END")
+		}
+		cpu.Step()
+	}
+
+	diff := func(what string, addr int, vmValue, cpuValue int16) error {
+		return fmt.Errorf("%s RAM[%d]: VM %d, CPU %d", what, addr, vmValue, cpuValue)
+	}
+	for addr := 0; addr <= 12; addr++ {
+		if vm.RAM[addr] != cpu.RAM[addr] {
+			return diff("register", addr, vm.RAM[addr], cpu.RAM[addr])
+		}
+	}
+	// RAM[256] holds the bootstrap's return address, which differs
+	for addr := 257; addr < int(vm.RAM[0]); addr++ {
+		if vm.RAM[addr] != cpu.RAM[addr] {
+			return diff("stack", addr, vm.RAM[addr], cpu.RAM[addr])
+		}
+	}
+	for addr := heapBase; addr < heapBase+heapSize; addr++ {
+		if vm.RAM[addr] != cpu.RAM[addr] {
+			return diff("heap", addr, vm.RAM[addr], cpu.RAM[addr])
+		}
+	}
+	for _, name := range vm.Statics() {
+		cpuAddr, ok := prog.Variables[name]
+		if !ok {
+			return fmt.Errorf("static %s missing from the assembly", name)
+		}
+		vmAddr := vm.StaticAddress(name)
+		if vm.RAM[vmAddr] != cpu.RAM[cpuAddr] {
+			return fmt.Errorf("static %s: VM %d, CPU %d", name, vm.RAM[vmAddr], cpu.RAM[cpuAddr])
+		}
+	}
+	return nil
+}
+
+func FuzzTranslator(f *testing.F) {
+	for seed := int64(0); seed < 300; seed++ {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, seed int64) {
+		files := generateVMProgram(seed)
+		if err := differentialRun(files); err != nil {
+			var src strings.Builder
+			for _, name := range sortedFiles(files) {
+				fmt.Fprintf(&src, "// %s\n%s", name, files[name])
+			}
+			t.Fatalf("seed %d: %v\n%s", seed, err, src.String())
+		}
+	})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Journal records what every cycle of a CPU changes, so that the program
+// can run backward: the registers before and after the cycle and the
+// words of RAM it wrote with their old and new values. Moving through the
+// recorded history replays these changes instead of executing the
+// program again, so it does not depend on the keyboard or on time.
+//
+// The history is bounded: only the last Window cycles are kept. A copy of
+// the whole machine is taken every Every cycles, which seeking far away,
+// as Bisect does, starts from.
+//
+// Builtins keep state outside of the RAM, such as the cursor of Output,
+// which a journal cannot restore: a CPU with builtins cannot be journaled.
+type Journal struct {
+	Window int
+	Every  int
+
+	c         *CPU
+	start     int // time of the first recorded cycle
+	steps     []journalStep
+	writes    []journalWrite
+	pos       int // cycles of steps applied; fewer than len(steps) in the past
+	snapshots []journalSnapshot
+	replaying bool
+}
+
+type cpuRegisters struct {
+	A, D int16
+	PC   uint16
+}
+
+type journalStep struct {
+	Before, After cpuRegisters
+	End           int // end of the writes of the cycle in writes
+}
+
+type journalWrite struct {
+	Addr     int
+	Old, New int16
+}
+
+type journalSnapshot struct {
+	Time int
+	Regs cpuRegisters
+	RAM  []int16
+}
+
+// NewJournal starts recording the cycles of c from now on, keeping the
+// last window cycles and a snapshot every every cycles.
+func NewJournal(c *CPU, window, every int) (*Journal, error) {
+	if c.builtins != nil {
+		return nil, errors.New("a CPU running builtins cannot be journaled")
+	}
+	if window <= 0 || every <= 0 {
+		return nil, fmt.Errorf("invalid journal window %d or snapshot interval %d", window, every)
+	}
+	j := &Journal{Window: window, Every: every, c: c, start: c.Time}
+	onWrite := c.OnWrite
+	c.OnWrite = func(addr int, old, value int16) {
+		if !j.replaying {
+			j.writes = append(j.writes, journalWrite{addr, old, value})
+		}
+		if onWrite != nil {
+			onWrite(addr, old, value)
+		}
+	}
+	return j, nil
+}
+
+// Start is the time of the oldest cycle the journal can go back to, and
+// Head that of the latest cycle executed.
+func (j *Journal) Start() int {
+	return j.start
+}
+
+func (j *Journal) Head() int {
+	return j.start + len(j.steps)
+}
+
+// InPast reports whether the CPU has been moved back from the head.
+func (j *Journal) InPast() bool {
+	return j.pos < len(j.steps)
+}
+
+func (j *Journal) registers() cpuRegisters {
+	return cpuRegisters{j.c.A, j.c.D, j.c.PC}
+}
+
+func (j *Journal) setRegisters(r cpuRegisters) {
+	j.c.A, j.c.D, j.c.PC = r.A, r.D, r.PC
+	j.c.Time = j.start + j.pos
+}
+
+// Step executes a cycle, or replays the next recorded one when the CPU is
+// in the past. Replayed writes go through OnWrite, so watchpoints see them.
+func (j *Journal) Step() {
+	if j.InPast() {
+		s := j.steps[j.pos]
+		j.replaying = true
+		for _, w := range j.writes[j.writesStart(j.pos):s.End] {
+			j.c.write(uint16(w.Addr), w.New)
+		}
+		j.replaying = false
+		j.pos += 1
+		j.setRegisters(s.After)
+		return
+	}
+	if j.c.Time%j.Every == 0 {
+		j.snapshot()
+	}
+	before := j.registers()
+	j.c.Step()
+	j.steps = append(j.steps, journalStep{before, j.registers(), len(j.writes)})
+	j.pos += 1
+	if len(j.steps) >= 2*j.Window {
+		j.trim()
+	}
+}
+
+func (j *Journal) writesStart(i int) int {
+	if i == 0 {
+		return 0
+	}
+	return j.steps[i-1].End
+}
+
+// Back undoes the last cycle and reports whether there was one in the
+// history.
+func (j *Journal) Back() bool {
+	if j.pos == 0 {
+		return false
+	}
+	j.pos -= 1
+	s := j.steps[j.pos]
+	writes := j.writes[j.writesStart(j.pos):s.End]
+	for i := len(writes) - 1; i >= 0; i-- {
+		j.c.RAM[writes[i].Addr] = writes[i].Old
+	}
+	j.setRegisters(s.Before)
+	return true
+}
+
+func (j *Journal) snapshot() {
+	ram := make([]int16, len(j.c.RAM))
+	copy(ram, j.c.RAM)
+	j.snapshots = append(j.snapshots, journalSnapshot{j.c.Time, j.registers(), ram})
+}
+
+// trim forgets the cycles older than the window, with their snapshots.
+// New cycles are only recorded at the head, so the CPU is never in the
+// part forgotten.
+func (j *Journal) trim() {
+	n := len(j.steps) - j.Window
+	cut := j.steps[n-1].End
+	j.writes = append(j.writes[:0], j.writes[cut:]...)
+	j.steps = append(j.steps[:0], j.steps[n:]...)
+	for i := range j.steps {
+		j.steps[i].End -= cut
+	}
+	j.start += n
+	j.pos -= n
+	i := 0
+	for i < len(j.snapshots) && j.snapshots[i].Time < j.start {
+		i += 1
+	}
+	j.snapshots = append(j.snapshots[:0], j.snapshots[i:]...)
+}
+
+// Seek moves the CPU to the state at time, which must be in the history,
+// from the current state or from the closest snapshot, whichever is
+// closer.
+func (j *Journal) Seek(time int) error {
+	if time < j.Start() || time > j.Head() {
+		return fmt.Errorf("cycle %d is not in the history, %d to %d", time, j.Start(), j.Head())
+	}
+	distance := func(t int) int {
+		if t > time {
+			return t - time
+		}
+		return time - t
+	}
+	best := -1
+	for i, s := range j.snapshots {
+		if distance(s.Time) < distance(j.c.Time) && (best == -1 || distance(s.Time) < distance(j.snapshots[best].Time)) {
+			best = i
+		}
+	}
+	if best != -1 {
+		s := j.snapshots[best]
+		copy(j.c.RAM, s.RAM)
+		j.pos = s.Time - j.start
+		j.setRegisters(s.Regs)
+	}
+	for j.c.Time > time {
+		j.Back()
+	}
+	for j.c.Time < time {
+		j.Step()
+	}
+	return nil
+}
+
+// BackToWrite runs back to the last cycle that wrote addr, and stops
+// before it. It reports whether there is one in the history; if not, the
+// CPU is left at the start of the history.
+func (j *Journal) BackToWrite(addr int) bool {
+	for j.pos > 0 {
+		s := j.steps[j.pos-1]
+		writes := j.writes[j.writesStart(j.pos-1):s.End]
+		j.Back()
+		for _, w := range writes {
+			if w.Addr == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Bisect finds the first cycle of the history after which pred holds,
+// pred being false before it and true from it on, and moves the CPU to
+// the state before that cycle. pred is evaluated on the CPU at the
+// states it tries. When it fails, the CPU is left where it was.
+func (j *Journal) Bisect(pred func(c *CPU) bool) (int, error) {
+	at := func(time int) bool {
+		j.Seek(time)
+		return pred(j.c)
+	}
+	now := j.c.Time
+	lo, hi := j.Start(), j.Head()
+	if !at(hi) {
+		j.Seek(now)
+		return 0, errors.New("the condition does not hold at the head of the history")
+	}
+	if at(lo) {
+		j.Seek(now)
+		return 0, fmt.Errorf("the condition already holds at the start of the history, cycle %d", lo)
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if at(mid) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	j.Seek(lo)
+	return lo, nil
+}
+
+// Reset forgets the history, keeping the current state as its start.
+func (j *Journal) Reset() {
+	j.start, j.pos = j.c.Time, 0
+	j.steps, j.writes, j.snapshots = j.steps[:0], j.writes[:0], nil
+}
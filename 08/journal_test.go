@@ -0,0 +1,191 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// journalProgram counts down static 1 from 20, then writes 7 to RAM[5000]
+// through that.
+const journalProgram = `
+function Sys.init 0
+push constant 20
+pop static 1
+label LOOP
+push static 1
+push constant 1
+sub
+pop static 1
+push static 1
+if-goto LOOP
+push constant 5000
+pop pointer 1
+push constant 7
+pop that 0
+label END
+goto END
+`
+
+type cpuState struct {
+	Regs cpuRegisters
+	RAM  []int16
+}
+
+func stateOf(c *CPU) cpuState {
+	ram := make([]int16, len(c.RAM))
+	copy(ram, c.RAM)
+	return cpuState{cpuRegisters{c.A, c.D, c.PC}, ram}
+}
+
+func TestJournal(t *testing.T) {
+	prog := assembleVM(t, journalProgram)
+	// the states of a run without journal
+	var want []cpuState
+	ref := NewCPU()
+	ref.Load(prog)
+	for !ref.Spinning() {
+		want = append(want, stateOf(ref))
+		ref.Step()
+	}
+	want = append(want, stateOf(ref))
+
+	c := NewCPU()
+	c.Load(prog)
+	j, err := NewJournal(c, 300, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for !c.Spinning() {
+		j.Step()
+	}
+	if j.Head() != len(want)-1 || j.Start() < j.Head()-600 || j.Start() > j.Head()-300 {
+		t.Fatalf("history from %d to %d after %d cycles", j.Start(), j.Head(), len(want)-1)
+	}
+	check := func(what string) {
+		if got := stateOf(c); !reflect.DeepEqual(got, want[c.Time]) {
+			t.Fatalf("%s: state at %d differs, registers %v, want %v", what, c.Time, got.Regs, want[c.Time].Regs)
+		}
+	}
+	for _, time := range []int{j.Head() - 1, j.Start(), j.Head() - 250, j.Head(), j.Start() + 1, j.Head() - 77} {
+		if err := j.Seek(time); err != nil {
+			t.Fatal(err)
+		}
+		if c.Time != time {
+			t.Fatalf("Seek(%d) went to %d", time, c.Time)
+		}
+		check("Seek")
+	}
+	for i := 0; i < 10; i++ {
+		j.Back()
+		check("Back")
+	}
+	for i := 0; i < 5; i++ {
+		j.Step()
+		check("Step")
+	}
+	if err := j.Seek(j.Start() - 1); err == nil {
+		t.Error("Seek before the history")
+	}
+
+	j.Seek(j.Head())
+	if !j.BackToWrite(5000) || c.RAM[5000] != 0 {
+		t.Fatalf("BackToWrite(5000) stopped at %d with RAM[5000] = %d", c.Time, c.RAM[5000])
+	}
+	written := c.Time
+	j.Step()
+	if c.RAM[5000] != 7 {
+		t.Errorf("the cycle after BackToWrite did not write RAM[5000]")
+	}
+
+	time, err := j.Bisect(func(c *CPU) bool { return c.RAM[5000] != 0 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time != written || c.Time != written {
+		t.Errorf("Bisect = %d at %d, want %d", time, c.Time, written)
+	}
+	if _, err := j.Bisect(func(c *CPU) bool { return false }); err == nil {
+		t.Error("Bisect of a condition that never holds")
+	}
+
+	b, _ := NewBuiltins()
+	c.SetBuiltins(b, prog.Labels)
+	if _, err := NewJournal(c, 10, 10); err == nil {
+		t.Error("journal of a CPU with builtins")
+	}
+}
+
+// TestJournal_Bounded goes back and forth through a history that keeps
+// being trimmed: it never holds more than twice the window, and the states
+// replayed are those of the run.
+func TestJournal_Bounded(t *testing.T) {
+	prog := assembleVM(t, journalProgram)
+	var want []cpuState
+	ref := NewCPU()
+	ref.Load(prog)
+	for i := 0; i <= 1000; i++ {
+		want = append(want, stateOf(ref))
+		ref.Step()
+	}
+
+	c := NewCPU()
+	c.Load(prog)
+	const window, every = 40, 7
+	j, err := NewJournal(c, window, every)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for c.Time < 900 {
+		for i := 0; i < 50; i++ {
+			j.Step()
+		}
+		for i := 0; i < 30; i++ {
+			j.Back()
+		}
+		if len(j.steps) >= 2*window || len(j.snapshots) > 2*window/every+1 {
+			t.Fatalf("at %d: %d cycles and %d snapshots in the history", c.Time, len(j.steps), len(j.snapshots))
+		}
+		if j.Start() > c.Time || c.Time > j.Head() {
+			t.Fatalf("at %d, outside of the history from %d to %d", c.Time, j.Start(), j.Head())
+		}
+		if got := stateOf(c); !reflect.DeepEqual(got, want[c.Time]) {
+			t.Fatalf("state at %d differs, registers %v, want %v", c.Time, got.Regs, want[c.Time].Regs)
+		}
+	}
+}
+
+func TestDebugger_Reverse(t *testing.T) {
+	prog := assembleVM(t, journalProgram)
+	c := NewCPU()
+	c.Load(prog)
+	d := NewDebugger(c, prog)
+	if err := d.Exec("back"); err == nil {
+		t.Error("back without a journal")
+	}
+	var err error
+	if d.Journal, err = NewJournal(c, 10000, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Exec("c 5000"); err != nil {
+		t.Fatal(err)
+	}
+	head := c.Time
+	for _, command := range []string{"back 3", "last 5000", "bisect RAM[5000]"} {
+		if err := d.Exec(command); err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+	}
+	if c.RAM[5000] != 0 || !d.Journal.InPast() {
+		t.Errorf("bisect stopped at %d with RAM[5000] = %d", c.Time, c.RAM[5000])
+	}
+	at := c.Time
+	if err := d.Exec("bisect RAM[5000] - 7"); err == nil || c.Time != at {
+		t.Errorf("bisect of a condition holding at the start: %v, moved from %d to %d", err, at, c.Time)
+	}
+	// the watchpoint sees the write again going forward
+	d.Exec("w 5000")
+	d.Exec("c")
+	if d.message != "watchpoint RAM[5000] 0 -> 7" || c.Time >= head {
+		t.Errorf("continue from the past: %s at %d", d.message, c.Time)
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The keyboard of the Hack computer is the word at KBD, which holds the
+// code of the key pressed or 0. Printable keys have their ASCII code,
+// letters that of the upper-case letter, and the special keys the codes
+// below.
+var keyNames = map[string]int16{
+	"newline":   128,
+	"backspace": 129,
+	"left":      130,
+	"up":        131,
+	"right":     132,
+	"down":      133,
+	"home":      134,
+	"end":       135,
+	"pageup":    136,
+	"pagedown":  137,
+	"insert":    138,
+	"delete":    139,
+	"esc":       140,
+	"f1":        141,
+	"f2":        142,
+	"f3":        143,
+	"f4":        144,
+	"f5":        145,
+	"f6":        146,
+	"f7":        147,
+	"f8":        148,
+	"f9":        149,
+	"f10":       150,
+	"f11":       151,
+	"f12":       152,
+	"space":     ' ',
+	"release":   0,
+}
+
+// parseKey parses a key of a key script: a name of keyNames, a single
+// printable character or a code.
+func parseKey(s string) (int16, error) {
+	if code, ok := keyNames[strings.ToLower(s)]; ok {
+		return code, nil
+	}
+	if len(s) == 1 && s[0] > ' ' && s[0] < 127 {
+		return int16(s[0]), nil
+	}
+	n, err := strconv.ParseInt(s, 10, 16)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("unknown key %q", s)
+	}
+	return int16(n), nil
+}
+
+// keyName formats a key code the way parseKey reads it.
+func keyName(code int16) string {
+	for name, c := range keyNames {
+		if c == code && name != "space" {
+			return name
+		}
+	}
+	// digits, # and " would be read as a time, a comment and a string
+	if code > ' ' && code < 127 && (code < '0' || code > '9') && code != '#' && code != '"' {
+		return string(rune(code))
+	}
+	return strconv.Itoa(int(code))
+}
+
+// KeyInput is a source of key presses for KBD.
+type KeyInput interface {
+	// Key returns the key pressed at time, in cycles. It is called with
+	// increasing times.
+	Key(time int) int16
+}
+
+// KeyEvent presses Key at Time, until the next event; key 0 releases it.
+type KeyEvent struct {
+	Time int
+	Key  int16
+}
+
+// KeyScript replays key events. A script has one event per line, the
+// time, in cycles or in frames with an f suffix, and the key:
+//
+//	# comments start with #
+//	frame 100000         cycles per frame, 1 by default
+//	250000 right         the right arrow from cycle 250000 on
+//	30f release          released at frame 30
+//	31f X 10000          X pressed for 10000 cycles, then released
+//	40f "HI" 10000       H and I pressed and released for 10000 cycles each
+//
+// Keys are the names of keyNames, such as newline, left or f1, printable
+// characters other than # and ", or codes. A quoted Go string types its
+// characters one after the other, with \n for newline; a # after it
+// starts a comment.
+type KeyScript struct {
+	Events []KeyEvent
+
+	next int
+	key  int16
+}
+
+// ParseKeyScript reads a key script.
+func ParseKeyScript(r io.Reader) (*KeyScript, error) {
+	s := &KeyScript{}
+	frame := 1
+	scanner := bufio.NewScanner(r)
+	number := 0
+	for scanner.Scan() {
+		number += 1
+		line := strings.TrimSpace(scanner.Text())
+		// a comment starts at a # after the string of keys, if any
+		skip := 0
+		if f := strings.Fields(line); len(f) > 1 {
+			rest := strings.TrimSpace(line[len(f[0]):])
+			if quoted, err := strconv.QuotedPrefix(rest); err == nil {
+				skip = len(line) - len(rest) + len(quoted)
+			}
+		}
+		if i := strings.Index(line[skip:], "#"); i != -1 {
+			line = strings.TrimSpace(line[:skip+i])
+		}
+		if line == "" {
+			continue
+		}
+		errorf := func(format string, a ...interface{}) error {
+			return fmt.Errorf("line %d: %s", number, fmt.Sprintf(format, a...))
+		}
+		fields := strings.Fields(line)
+		if fields[0] == "frame" {
+			if len(fields) != 2 {
+				return nil, errorf("frame expects a number of cycles")
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n <= 0 {
+				return nil, errorf("invalid frame length %q", fields[1])
+			}
+			frame = n
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, errorf("expected a time and a key")
+		}
+		time, err := parseKeyTime(fields[0], frame)
+		if err != nil {
+			return nil, errorf("%v", err)
+		}
+		rest := strings.TrimSpace(line[len(fields[0]):])
+		var keys []int16
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return nil, errorf("invalid string %s", rest)
+			}
+			text, _ := strconv.Unquote(quoted)
+			for _, c := range text {
+				key := int16(c)
+				if c == '\n' {
+					key = keyNames["newline"]
+				}
+				keys = append(keys, key)
+			}
+			fields = append([]string{fields[0], ""}, strings.Fields(rest[len(quoted):])...)
+		} else {
+			key, err := parseKey(fields[1])
+			if err != nil {
+				return nil, errorf("%v", err)
+			}
+			keys = []int16{key}
+		}
+		hold := 0
+		switch len(fields) {
+		case 2:
+			if len(keys) > 1 {
+				return nil, errorf("a string needs the time each key is held")
+			}
+		case 3:
+			hold, err = parseKeyTime(fields[2], frame)
+			if err != nil || hold <= 0 {
+				return nil, errorf("invalid duration %q", fields[2])
+			}
+		default:
+			return nil, errorf("unexpected %q", fields[3])
+		}
+		for _, key := range keys {
+			s.Events = append(s.Events, KeyEvent{time, key})
+			if hold > 0 {
+				s.Events = append(s.Events, KeyEvent{time + hold, 0})
+				time += 2 * hold
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(s.Events, func(i, j int) bool {
+		return s.Events[i].Time < s.Events[j].Time
+	})
+	return s, nil
+}
+
+// LoadKeyScript reads the key script at path.
+func LoadKeyScript(path string) (*KeyScript, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := ParseKeyScript(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+func parseKeyTime(s string, frame int) (int, error) {
+	unit := 1
+	if strings.HasSuffix(s, "f") {
+		s, unit = s[:len(s)-1], frame
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return n * unit, nil
+}
+
+func (s *KeyScript) Key(time int) int16 {
+	for s.next < len(s.Events) && s.Events[s.next].Time <= time {
+		s.key = s.Events[s.next].Key
+		s.next += 1
+	}
+	return s.key
+}
+
+// Done reports whether all events have happened.
+func (s *KeyScript) Done() bool {
+	return s.next == len(s.Events)
+}
+
+// WriteTo writes the script in the format ParseKeyScript reads.
+func (s *KeyScript) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var n int64
+	for _, e := range s.Events {
+		m, _ := fmt.Fprintf(bw, "%d %s\n", e.Time, keyName(e.Key))
+		n += int64(m)
+	}
+	return n, bw.Flush()
+}
+
+// KeyRecorder passes the keys of an input on and records when they
+// change, as a script that replays them.
+type KeyRecorder struct {
+	Input  KeyInput
+	Script KeyScript
+	key    int16
+}
+
+func (r *KeyRecorder) Key(time int) int16 {
+	key := r.Input.Key(time)
+	if key != r.key {
+		r.Script.Events = append(r.Script.Events, KeyEvent{time, key})
+		r.key = key
+	}
+	return key
+}
+
+// LiveKeyboard reads the keys typed on a terminal. A terminal reports
+// characters rather than presses and releases, so every key is held for
+// Hold cycles, then released for as long before the next key, which
+// programs waiting for the release of a key need.
+type LiveKeyboard struct {
+	Hold int
+
+	mu          sync.Mutex
+	pending     []int16
+	interrupted bool
+	err         error
+	key         int16
+	next        int // time of the next change
+}
+
+// Interrupt is the key code terminalKeys returns for Ctrl-C, which
+// LiveKeyboard does not pass on.
+const Interrupt = -1
+
+// NewLiveKeyboard reads keys from r, usually a terminal in raw mode, until
+// it fails or ends.
+func NewLiveKeyboard(r io.Reader, hold int) *LiveKeyboard {
+	k := &LiveKeyboard{Hold: hold}
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := r.Read(buf)
+			keys := terminalKeys(buf[:n])
+			k.mu.Lock()
+			for _, key := range keys {
+				if key == Interrupt {
+					k.interrupted = true
+				} else {
+					k.pending = append(k.pending, key)
+				}
+			}
+			k.err = err
+			k.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return k
+}
+
+func (k *LiveKeyboard) Key(time int) int16 {
+	if time < k.next {
+		return k.key
+	}
+	if k.key != 0 {
+		k.key, k.next = 0, time+k.Hold
+		return 0
+	}
+	k.mu.Lock()
+	if len(k.pending) > 0 {
+		k.key, k.next = k.pending[0], time+k.Hold
+		k.pending = k.pending[1:]
+	}
+	k.mu.Unlock()
+	return k.key
+}
+
+// Interrupted reports whether Ctrl-C was typed.
+func (k *LiveKeyboard) Interrupted() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.interrupted
+}
+
+// Err returns why reading the keys stopped, io.EOF when the input ended.
+func (k *LiveKeyboard) Err() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.err
+}
+
+// terminalEscapes maps the escape sequences of the special keys of
+// xterm-like terminals, after ESC, to their Hack codes.
+var terminalEscapes = map[string]int16{
+	"[A": 131, "[B": 133, "[C": 132, "[D": 130,
+	"[H": 134, "[F": 135, "OH": 134, "OF": 135,
+	"[1~": 134, "[4~": 135, "[5~": 136, "[6~": 137, "[2~": 138, "[3~": 139,
+	"OP": 141, "OQ": 142, "OR": 143, "OS": 144,
+	"[15~": 145, "[17~": 146, "[18~": 147, "[19~": 148,
+	"[20~": 149, "[21~": 150, "[23~": 151, "[24~": 152,
+}
+
+// terminalKeys converts the bytes typed on a terminal in raw mode to Hack
+// key codes. Letters become upper case, as on the Hack keyboard.
+// Unknown sequences and control characters are dropped.
+func terminalKeys(b []byte) []int16 {
+	var keys []int16
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c == 0x1b:
+			seq, code := "", int16(0)
+			for j := i + 1; j < len(b) && j <= i+5; j++ {
+				seq += string(b[j])
+				if k, ok := terminalEscapes[seq]; ok {
+					code, i = k, j
+					break
+				}
+			}
+			if code == 0 && i+1 < len(b) && b[i+1] == 'O' {
+				// a sequence we do not know, up to its final letter
+				i += 2
+				continue
+			}
+			if code == 0 && i+1 < len(b) && b[i+1] == '[' {
+				for i += 2; i < len(b) && (b[i] < 0x40 || b[i] > 0x7e); i++ {
+				}
+				continue
+			}
+			if code == 0 {
+				code = keyNames["esc"]
+			}
+			keys = append(keys, code)
+		case c == 3:
+			keys = append(keys, Interrupt)
+		case c == '\r' || c == '\n':
+			keys = append(keys, keyNames["newline"])
+		case c == 127 || c == 8:
+			keys = append(keys, keyNames["backspace"])
+		case c >= 'a' && c <= 'z':
+			keys = append(keys, int16(c-'a'+'A'))
+		case c >= ' ' && c < 127:
+			keys = append(keys, int16(c))
+		}
+	}
+	return keys
+}
+
+// rawTerminal puts the terminal of f into raw mode with stty, and returns
+// the function restoring it.
+func rawTerminal(f *os.File) (restore func(), err error) {
+	stty := func(args ...string) ([]byte, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = f
+		return cmd.Output()
+	}
+	state, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("stty: %v", err)
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, fmt.Errorf("stty: %v", err)
+	}
+	return func() {
+		stty(strings.TrimSpace(string(state)))
+	}, nil
+}
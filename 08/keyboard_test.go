@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeyScript(t *testing.T) {
+	s, err := ParseKeyScript(strings.NewReader(`
+# comment
+frame 1000
+2f right
+3f release     # released
+10 X 5
+4f "A\n" 100 # a note with "quotes"
+4500 "#" 1
+5000 131
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []KeyEvent{
+		{10, 'X'}, {15, 0},
+		{2000, 132}, {3000, 0},
+		{4000, 'A'}, {4100, 0}, {4200, 128}, {4300, 0},
+		{4500, '#'}, {4501, 0},
+		{5000, 131},
+	}
+	if !reflect.DeepEqual(s.Events, want) {
+		t.Errorf("events %v, want %v", s.Events, want)
+	}
+
+	keys := map[int]int16{0: 0, 10: 'X', 14: 'X', 15: 0, 2500: 132, 4150: 0, 4200: 128, 9999: 131}
+	for _, time := range []int{0, 10, 14, 15, 2500, 4150, 4200, 9999} {
+		if got := s.Key(time); got != keys[time] {
+			t.Errorf("key at %d = %d, want %d", time, got, keys[time])
+		}
+	}
+	if !s.Done() {
+		t.Error("script not done after its last event")
+	}
+
+	for _, src := range []string{"10", "x right", "10 nokey", "frame 0", "10 \"AB\"", "10 X 0", "10 X 5 6"} {
+		if _, err := ParseKeyScript(strings.NewReader(src)); err == nil {
+			t.Errorf("%q: no error", src)
+		}
+	}
+}
+
+func TestKeyRecorder(t *testing.T) {
+	script := &KeyScript{Events: []KeyEvent{{3, 'A'}, {5, 0}, {8, 130}, {9, ' '}, {12, 0}}}
+	r := &KeyRecorder{Input: script}
+	var keys []int16
+	for time := 0; time < 15; time++ {
+		keys = append(keys, r.Key(time))
+	}
+	var buf bytes.Buffer
+	if _, err := r.Script.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := ParseKeyScript(&buf)
+	if err != nil {
+		t.Fatalf("%v in\n%s", err, buf.String())
+	}
+	if !reflect.DeepEqual(replay.Events, script.Events) {
+		t.Errorf("recorded %v, want %v", replay.Events, script.Events)
+	}
+	for time := 0; time < 15; time++ {
+		if got := replay.Key(time); got != keys[time] {
+			t.Errorf("replayed key at %d = %d, want %d", time, got, keys[time])
+		}
+	}
+}
+
+func TestKeyScript_WriteTo(t *testing.T) {
+	// more than the buffer of the writer holds
+	var script KeyScript
+	for time := 0; time < 10000; time += 2 {
+		script.Events = append(script.Events, KeyEvent{time, 'A'}, KeyEvent{time + 1, 0})
+	}
+	var buf bytes.Buffer
+	n, err := script.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) || n < 4096 {
+		t.Errorf("WriteTo = %d, wrote %d bytes", n, buf.Len())
+	}
+}
+
+func TestKeyScript_RoundTrip(t *testing.T) {
+	var script KeyScript
+	time := 0
+	add := func(key int16) {
+		time += 10
+		script.Events = append(script.Events, KeyEvent{time, key})
+	}
+	for c := int16(' '); c < 127; c++ {
+		add(c)
+	}
+	for _, code := range keyNames {
+		add(code)
+	}
+	var buf bytes.Buffer
+	if _, err := script.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := ParseKeyScript(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(replay.Events, script.Events) {
+		t.Errorf("replayed %v, want %v", replay.Events, script.Events)
+	}
+}
+
+func TestTerminalKeys(t *testing.T) {
+	samples := []struct {
+		In   string
+		Keys []int16
+	}{
+		{"aZ1 ", []int16{'A', 'Z', '1', ' '}},
+		{"\r\n\x7f\x08", []int16{128, 128, 129, 129}},
+		{"\x1b[A\x1b[B\x1b[C\x1b[D", []int16{131, 133, 132, 130}},
+		{"\x1b[H\x1b[F\x1b[5~\x1b[6~\x1b[2~\x1b[3~", []int16{134, 135, 136, 137, 138, 139}},
+		{"\x1bOP\x1b[15~\x1b[24~", []int16{141, 145, 152}},
+		{"\x1b", []int16{140}},
+		{"\x1bq", []int16{140, 'Q'}},
+		{"\x1b[99~x", []int16{'X'}},
+		{"\x03\x01", []int16{Interrupt}},
+	}
+	for _, s := range samples {
+		if got := terminalKeys([]byte(s.In)); !reflect.DeepEqual(got, s.Keys) {
+			t.Errorf("%q: %v, want %v", s.In, got, s.Keys)
+		}
+	}
+}
+
+func TestLiveKeyboard(t *testing.T) {
+	k := NewLiveKeyboard(strings.NewReader("a\x1b[A"), 10)
+	deadline := time.Now().Add(time.Second)
+	for k.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// each key is held for 10 cycles and released for 10
+	keys := map[int]int16{0: 'A', 9: 'A', 10: 0, 19: 0, 20: 131, 29: 131, 30: 0, 50: 0}
+	for _, time := range []int{0, 9, 10, 19, 20, 29, 30, 50} {
+		if got := k.Key(time); got != keys[time] {
+			t.Errorf("key at %d = %d, want %d", time, got, keys[time])
+		}
+	}
+	if k.Interrupted() {
+		t.Error("interrupted without Ctrl-C")
+	}
+
+	k = NewLiveKeyboard(strings.NewReader("\x03"), 10)
+	for k.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !k.Interrupted() || k.Key(0) != 0 {
+		t.Error("Ctrl-C was not an interrupt")
+	}
+}
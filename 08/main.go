@@ -1,80 +1,349 @@
 package main
 
 import (
-	"io/ioutil"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
 
+const (
+	logQuiet = iota
+	logInfo
+	logVerbose
+)
+
+var logLevel = logInfo
+
+func logf(level int, format string, a ...interface{}) {
+	if level <= logLevel {
+		log.Printf(format, a...)
+	}
+}
+
 func main() {
-	filename := os.Args[1]
-	stat, err := os.Stat(filename)
+	log.SetFlags(0)
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	fs := flag.NewFlagSet("vmtranslator", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: vmtranslator [flags] input...")
+		fmt.Fprintln(fs.Output(), "")
+		fmt.Fprintln(fs.Output(), "Each input is a .vm file or a directory of .vm files and becomes its own")
+		fmt.Fprintln(fs.Output(), "program, written to Foo.asm next to Foo.vm or to Dir/Dir.asm.")
+		fmt.Fprintln(fs.Output(), "With -o all inputs are linked into a single program.")
+		fmt.Fprintln(fs.Output(), "With -run they are linked with the bootstrap code and run on the CPU")
+		fmt.Fprintln(fs.Output(), "emulator instead, with keys from a script or the terminal, and with")
+		fmt.Fprintln(fs.Output(), "-debug under a debugger reading commands from the terminal. Both also")
+		fmt.Fprintln(fs.Output(), "take a single .asm or .hack program.")
+		fmt.Fprintln(fs.Output(), "With -dap it serves the Debug Adapter Protocol on stdin and stdout for")
+		fmt.Fprintln(fs.Output(), "debugging Jack programs compiled with jackc -g, and takes no input.")
+		fmt.Fprintln(fs.Output(), "")
+		fs.PrintDefaults()
+	}
+	output := fs.String("o", "", "write a single linked program to `path` (\"-\" for stdout)")
+	bootstrap := fs.Bool("bootstrap", false, "emit bootstrap code (SP=256, call Sys.init)")
+	recursive := fs.Bool("r", false, "find .vm files in subdirectories of directory inputs")
+	quiet := fs.Bool("q", false, "only log errors")
+	verbose := fs.Bool("v", false, "log every translated command")
+	test := fs.Bool("test", false, "run the test scripts (*.tst) next to each program after translating it")
+	var opts runOptions
+	runProgram := fs.Bool("run", false, "run the linked program on the CPU emulator instead of writing it")
+	debugProgram := fs.Bool("debug", false, "debug the linked program on the CPU emulator instead of writing it")
+	dap := fs.Bool("dap", false, "serve the Debug Adapter Protocol on stdin and stdout")
+	fs.IntVar(&opts.Cycles, "cycles", 0, "with -run, stop after `n` cycles (0 for no limit)")
+	fs.BoolVar(&opts.Native, "native", false, "with -run or -debug, run the Jack OS functions natively")
+	fs.StringVar(&opts.Keys, "keys", "", "with -run or -debug, replay the key script at `path`")
+	fs.BoolVar(&opts.Live, "live", false, "with -run, read keys from the terminal and draw the screen")
+	fs.StringVar(&opts.Record, "record", "", "with -run, write the keys pressed to the key script at `path`")
+	fs.IntVar(&opts.Hold, "hold", 100000, "with -live, `cycles` a typed key is held")
+	fs.IntVar(&opts.Speed, "speed", 3000000, "with -live, `cycles` per second")
+	fs.IntVar(&opts.Scale, "scale", 4, "with -run, `pixels` per character of the drawn screen")
+	fs.BoolVar(&opts.Screen, "screen", false, "with -run, draw the screen when the program stops")
+	fs.IntVar(&opts.History, "history", 1000000, "with -debug, `cycles` the debugger can go back (0 for none, not with -native)")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	switch {
+	case *quiet && *verbose:
+		log.Print("-q and -v are mutually exclusive")
+		return 2
+	case *quiet:
+		logLevel = logQuiet
+	case *verbose:
+		logLevel = logVerbose
+	}
+	if *dap {
+		if fs.NArg() > 0 {
+			log.Print("-dap takes no input, the client launches the program")
+			return 2
+		}
+		if err := serveDAP(os.Stdin, os.Stdout); err != nil {
+			log.Print(err)
+			return 1
+		}
+		return 0
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if *runProgram || *debugProgram {
+		if *output != "" || *test || *runProgram && *debugProgram {
+			log.Print("-run and -debug cannot be combined with each other, -o or -test")
+			return 2
+		}
+		prog, err := loadProgram(fs.Args(), *recursive)
+		if err == nil && *runProgram {
+			err = emulate(prog, opts, os.Stdout)
+		} else if err == nil {
+			err = debug(prog, opts)
+		}
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		return 0
+	}
+
+	var programs [][]string
+	for _, input := range fs.Args() {
+		files, err := findVMFiles(input, *recursive)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		programs = append(programs, files)
+	}
+
+	if *output != "" {
+		if *test {
+			log.Print("-test cannot be combined with -o")
+			return 2
+		}
+		var files []string
+		for _, p := range programs {
+			files = append(files, p...)
+		}
+		if err := translateTo(*output, files, *bootstrap); err != nil {
+			log.Print(err)
+			return 1
+		}
+		return 0
+	}
+
+	status := 0
+	for i, input := range fs.Args() {
+		if err := translateTo(outputPath(input), programs[i], *bootstrap); err != nil {
+			log.Print(err)
+			status = 1
+			continue
+		}
+		if *test && !runScripts(input) {
+			status = 1
+		}
+	}
+	return status
+}
+
+// runScripts runs the test scripts found next to the program at input,
+// *VME.tst on the VM emulator and the others on the CPU emulator, and
+// reports whether all of them passed.
+func runScripts(input string) bool {
+	dir := input
+	if filepath.Ext(input) == ".vm" {
+		dir = filepath.Dir(input)
+	}
+	scripts, err := filepath.Glob(filepath.Join(dir, "*.tst"))
 	if err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		return false
 	}
+	ok := true
+	for _, path := range scripts {
+		var sim Simulator = NewCPUSimulator()
+		if strings.HasSuffix(path, "VME.tst") {
+			sim = NewVMSimulator()
+		}
+		if err := NewScript(path, sim).Run(); err != nil {
+			log.Print(err)
+			ok = false
+			continue
+		}
+		logf(logQuiet, "ok %s", path)
+	}
+	return ok
+}
 
-	codeWriter := NewCodeWriter(os.Stdout)
+// findVMFiles returns the .vm files making up the program at input, sorted
+// by path so that the generated code does not depend on directory order.
+func findVMFiles(input string, recursive bool) ([]string, error) {
+	stat, err := os.Stat(input)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		if filepath.Ext(input) != ".vm" {
+			return nil, fmt.Errorf("%s: not a .vm file", input)
+		}
+		return []string{input}, nil
+	}
 
-	var files []*os.File
-	if stat.IsDir() {
-		list, err := ioutil.ReadDir(filename)
+	var files []string
+	err = filepath.Walk(input, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		for _, f := range list {
-			if !strings.HasSuffix(f.Name(), ".vm") {
-				continue
+		if info.IsDir() {
+			if path != input && !recursive {
+				return filepath.SkipDir
 			}
-			ff, err := os.Open(filename + f.Name())
-			if err != nil {
-				log.Fatal(err)
-			}
-			files = append(files, ff)
+			return nil
+		}
+		if filepath.Ext(path) == ".vm" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s: no .vm files found", input)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// outputPath names the .asm file for an input: Foo.vm becomes Foo.asm and
+// a directory Dir becomes Dir/Dir.asm.
+func outputPath(input string) string {
+	input = filepath.Clean(input)
+	if stat, err := os.Stat(input); err == nil && stat.IsDir() {
+		name := filepath.Base(input)
+		if abs, err := filepath.Abs(input); err == nil {
+			name = filepath.Base(abs)
 		}
+		return filepath.Join(input, name+".asm")
+	}
+	return strings.TrimSuffix(input, filepath.Ext(input)) + ".asm"
+}
+
+func translateTo(output string, files []string, bootstrap bool) error {
+	if output == "-" {
+		w := bufio.NewWriter(os.Stdout)
+		if err := translate(w, files, bootstrap); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = translate(w, files, bootstrap)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+	logf(logInfo, "wrote %s", output)
+	return nil
+}
+
+// translate writes the assembly for the given .vm files to w. It reports
+// every malformed command it finds and fails if there was at least one.
+func translate(w io.Writer, files []string, bootstrap bool) error {
+	_, err := translateMapped(w, files, bootstrap)
+	return err
+}
+
+// translateMapped is translate, also returning where the code of every
+// command starts in ROM.
+func translateMapped(w io.Writer, files []string, bootstrap bool) ([]VMLocation, error) {
+	codeWriter := NewCodeWriter(w)
+	if bootstrap {
 		codeWriter.WriteInit()
-	} else {
+	}
+
+	var errs []string
+	for _, filename := range files {
 		f, err := os.Open(filename)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		files = append(files, f)
-	}
-
-	for _, f := range files {
-		log.Printf("FILE: %s", f.Name())
-		codeWriter.SetFileName(f.Name())
+		logf(logInfo, "FILE: %s", filename)
+		codeWriter.SetFileName(filename)
 		parser := NewParder(f)
-
 		for parser.HasMoreCommands() {
-			log.Printf("%s", parser.line)
-			switch parser.CommandType() {
-			case C_ARITHMETIC:
-				codeWriter.WriteArithmetic(parser.Arg1())
-			case C_PUSH, C_POP:
-				codeWriter.WritePushPop(parser.Command(), parser.Arg1(), parser.Arg2())
-			case C_LABEL:
-				codeWriter.WriteLabel(parser.Arg1())
-			case C_GOTO:
-				codeWriter.WriteGoto(parser.Arg1())
-			case C_IF:
-				codeWriter.WriteIf(parser.Arg1())
-			case C_CALL:
-				i, err := strconv.Atoi(parser.Arg2())
-				if err != nil {
-					panic(err)
-				}
-				codeWriter.WriteCall(parser.Arg1(), i)
-			case C_RETURN:
-				codeWriter.WriteReturn()
-			case C_FUNCTION:
-				i, err := strconv.Atoi(parser.Arg2())
-				if err != nil {
-					panic(err)
-				}
-				codeWriter.WriteFunction(parser.Arg1(), i)
+			logf(logVerbose, "%s", parser.line)
+			codeWriter.SetLine(parser.lineNumber)
+			if err := writeCommand(codeWriter, parser); err != nil {
+				errs = append(errs, fmt.Sprintf("%s:%d: %v", filename, parser.lineNumber, err))
 			}
 		}
+		err = parser.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+	codeWriter.Close()
+	return codeWriter.Locations, nil
+}
+
+func writeCommand(codeWriter *CodeWriter, parser *Parser) error {
+	if err := parser.Validate(); err != nil {
+		return err
+	}
+	switch parser.CommandType() {
+	case C_ARITHMETIC:
+		codeWriter.WriteArithmetic(parser.Arg1())
+	case C_PUSH, C_POP:
+		codeWriter.WritePushPop(parser.Command(), parser.Arg1(), parser.Arg2())
+	case C_LABEL:
+		codeWriter.WriteLabel(parser.Arg1())
+	case C_GOTO:
+		codeWriter.WriteGoto(parser.Arg1())
+	case C_IF:
+		codeWriter.WriteIf(parser.Arg1())
+	case C_CALL:
+		i, err := strconv.Atoi(parser.Arg2())
+		if err != nil {
+			return err
+		}
+		codeWriter.WriteCall(parser.Arg1(), i)
+	case C_RETURN:
+		codeWriter.WriteReturn()
+	case C_FUNCTION:
+		i, err := strconv.Atoi(parser.Arg2())
+		if err != nil {
+			return err
+		}
+		codeWriter.WriteFunction(parser.Arg1(), i)
 	}
+	return nil
 }
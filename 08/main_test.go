@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOutputPath(t *testing.T) {
+	samples := []struct {
+		In  string
+		Out string
+	}{
+		{"test/ProgramFlow/BasicLoop/BasicLoop.vm", "test/ProgramFlow/BasicLoop/BasicLoop.asm"},
+		{"test/FunctionCalls/StaticsTest", "test/FunctionCalls/StaticsTest/StaticsTest.asm"},
+		{"test/FunctionCalls/StaticsTest/", "test/FunctionCalls/StaticsTest/StaticsTest.asm"},
+		{"Sum.vm", "Sum.asm"},
+	}
+	for _, s := range samples {
+		out := outputPath(s.In)
+		if out != s.Out {
+			t.Errorf("Sample: %#v, Out: %s", s, out)
+		}
+	}
+}
+
+func TestFindVMFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vmtranslator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"Main.vm", "Sys.vm", "notes.txt", "lib/Math.vm"} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := findVMFiles(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "Main.vm"), filepath.Join(dir, "Sys.vm")}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("non-recursive: %v, want %v", files, want)
+	}
+
+	files, err = findVMFiles(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{filepath.Join(dir, "Main.vm"), filepath.Join(dir, "Sys.vm"), filepath.Join(dir, "lib/Math.vm")}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("recursive: %v, want %v", files, want)
+	}
+
+	if _, err := findVMFiles(filepath.Join(dir, "notes.txt"), false); err == nil {
+		t.Error("expected an error for a non .vm input")
+	}
+}
+
+func TestRun_InvalidCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vmtranslator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"push foo 1", `push: unknown segment "foo"`},
+		{"pop constant 3", "pop: cannot pop to the constant segment"},
+		{"push temp x", `push: "x" is not a non-negative integer`},
+		{"push constant abc", `push: "abc" is not a non-negative integer`},
+		{"push local -1", `push: "-1" is not a non-negative integer`},
+		{"push constant 40000", "push: 40000 is out of range (0-32767)"},
+		{"push local 32768", "push: 32768 is out of range (0-32767)"},
+		{"pop temp 8", "pop: index 8 out of the temp segment (0-7)"},
+		{"push pointer 2", "push: index 2 out of the pointer segment (0-1)"},
+		{"call Main.f n", `call: "n" is not a non-negative integer`},
+	}
+	path := filepath.Join(dir, "Main.vm")
+	for _, tc := range tests {
+		src := "function Main.main 0\n" + tc.command + "\nreturn\n"
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		logs.Reset()
+		if status := run([]string{path}); status != 1 {
+			t.Errorf("%s: exit status %d, want 1", tc.command, status)
+		}
+		if want := path + ":2: " + tc.want; !strings.Contains(logs.String(), want) {
+			t.Errorf("%s: logged %q, want %q", tc.command, logs.String(), want)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "Main.asm")); err == nil {
+			t.Errorf("%s: wrote Main.asm", tc.command)
+		}
+	}
+
+	src := "function Main.main 0\npush temp 7\npop pointer 1\npush constant 32767\nreturn\n"
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if status := run([]string{path}); status != 0 {
+		t.Errorf("exit status %d for valid commands: %s", status, logs.String())
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io"
+	"strconv"
 	"strings"
 )
 
@@ -26,6 +28,19 @@ var (
 		`call`:     C_CALL,
 		`return`:   C_RETURN,
 	}
+
+	// segmentSize is the number of cells of the fixed segments, and 0 for
+	// those of any size.
+	segmentSize = map[string]int{
+		`argument`: 0,
+		`local`:    0,
+		`static`:   0,
+		`constant`: 0,
+		`this`:     0,
+		`that`:     0,
+		`pointer`:  2,
+		`temp`:     8,
+	}
 )
 
 type CommandType uint8
@@ -44,9 +59,10 @@ const (
 )
 
 type Parser struct {
-	r    io.Reader
-	s    *bufio.Scanner
-	line string
+	r          io.Reader
+	s          *bufio.Scanner
+	line       string
+	lineNumber int
 }
 
 func NewParder(r io.Reader) *Parser {
@@ -57,17 +73,69 @@ func NewParder(r io.Reader) *Parser {
 }
 
 func (p *Parser) HasMoreCommands() bool {
-	if !p.s.Scan() {
-		return false
+	for p.s.Scan() {
+		p.lineNumber += 1
+		line := p.s.Text()
+		if i := strings.Index(line, "//"); i != -1 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line != "" {
+			p.line = line
+			return true
+		}
 	}
+	return false
+}
 
-	line := strings.TrimSpace(p.s.Text())
-	command := strings.Split(line, " ")[0]
-	if _, ok := commandTypeMap[command]; ok {
-		p.line = line
-		return true
+// Err returns the first read error, if any.
+func (p *Parser) Err() error {
+	return p.s.Err()
+}
+
+// Validate reports an unknown command, a wrong number of arguments, an
+// unknown segment, a pop to the constant segment and an index that is not
+// an integer from 0 to 32767 or is out of the temp or pointer segment.
+func (p *Parser) Validate() error {
+	args := strings.Fields(p.line)
+	want := 0
+	switch p.CommandType() {
+	case C_NONE:
+		return fmt.Errorf("unknown command %q", args[0])
+	case C_ARITHMETIC, C_RETURN:
+		want = 1
+	case C_LABEL, C_GOTO, C_IF:
+		want = 2
+	case C_PUSH, C_POP, C_FUNCTION, C_CALL:
+		want = 3
 	}
-	return p.HasMoreCommands()
+	if len(args) != want {
+		return fmt.Errorf("%s: expected %d arguments, got %d", args[0], want-1, len(args)-1)
+	}
+	if want < 3 {
+		return nil
+	}
+	n, err := strconv.Atoi(args[2])
+	if err != nil || n < 0 {
+		return fmt.Errorf("%s: %q is not a non-negative integer", args[0], args[2])
+	}
+	// larger numbers do not fit in an A-instruction
+	if n > 32767 {
+		return fmt.Errorf("%s: %d is out of range (0-32767)", args[0], n)
+	}
+	if p.CommandType() != C_PUSH && p.CommandType() != C_POP {
+		return nil
+	}
+	size, ok := segmentSize[args[1]]
+	switch {
+	case !ok:
+		return fmt.Errorf("%s: unknown segment %q", args[0], args[1])
+	case args[1] == "constant" && p.CommandType() == C_POP:
+		return fmt.Errorf("pop: cannot pop to the constant segment")
+	case size > 0 && n >= size:
+		return fmt.Errorf("%s: index %d out of the %s segment (0-%d)", args[0], n, args[1], size-1)
+	}
+	return nil
 }
 
 func (p *Parser) Advance() string {
@@ -75,16 +143,11 @@ func (p *Parser) Advance() string {
 }
 
 func (p *Parser) CommandType() CommandType {
-	for k, v := range commandTypeMap {
-		if strings.Index(p.line, k) == 0 {
-			return v
-		}
-	}
-	return C_NONE
+	return commandTypeMap[p.Command()]
 }
 
 func (p *Parser) Command() string {
-	return strings.Split(p.line, ` `)[0]
+	return strings.Fields(p.line)[0]
 }
 
 func (p *Parser) Arg1() string {
@@ -94,7 +157,7 @@ func (p *Parser) Arg1() string {
 	case C_ARITHMETIC:
 		return p.Command()
 	default:
-		list := strings.Split(p.line, ` `)
+		list := strings.Fields(p.line)
 		return list[1]
 	}
 }
@@ -102,7 +165,7 @@ func (p *Parser) Arg1() string {
 func (p *Parser) Arg2() string {
 	switch p.CommandType() {
 	case C_PUSH, C_POP, C_FUNCTION, C_CALL:
-		list := strings.Split(p.line, ` `)
+		list := strings.Fields(p.line)
 		return list[2]
 	default:
 		panic(`Invalid CommandType`)
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"strings"
+)
+
+const (
+	screenWidth  = 512
+	screenHeight = 256
+	screenWords  = screenWidth / 16 * screenHeight
+)
+
+// screenPalette draws the pixels that are 0 white and those that are 1
+// black, like the screen of the CPU emulator.
+var screenPalette = color.Palette{color.White, color.Black}
+
+// Screen is a snapshot of the screen memory map: 256 rows of 32 words,
+// the least significant bit of a word being the leftmost of its 16
+// pixels, and 1 being black.
+type Screen [screenWords]int16
+
+// ScreenOf copies the screen memory out of the RAM of an emulator.
+func ScreenOf(ram []int16) *Screen {
+	s := new(Screen)
+	copy(s[:], ram[screenBase:])
+	return s
+}
+
+// Black reports whether the pixel at column x of row y is black.
+func (s *Screen) Black(x, y int) bool {
+	return s[y*screenWidth/16+x/16]>>uint(x%16)&1 != 0
+}
+
+// Image returns the screen as a 512x256 image with screenPalette.
+func (s *Screen) Image() *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, screenWidth, screenHeight), screenPalette)
+	for y := 0; y < screenHeight; y++ {
+		for x := 0; x < screenWidth; x++ {
+			if s.Black(x, y) {
+				img.Pix[y*img.Stride+x] = 1
+			}
+		}
+	}
+	return img
+}
+
+// WritePNG writes the screen as a PNG image.
+func (s *Screen) WritePNG(w io.Writer) error {
+	return png.Encode(w, s.Image())
+}
+
+// WriteText draws the screen with block characters, one character for
+// scale columns and two for 2*scale rows of pixels. A half of a
+// character is black if any of its pixels is. Trailing blanks are left
+// out.
+func (s *Screen) WriteText(w io.Writer, scale int) error {
+	if scale < 1 {
+		scale = 1
+	}
+	black := func(x0, y0 int) bool {
+		for y := y0; y < y0+scale && y < screenHeight; y++ {
+			for x := x0; x < x0+scale && x < screenWidth; x++ {
+				if s.Black(x, y) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	bw := bufio.NewWriter(w)
+	var line strings.Builder
+	for y := 0; y < screenHeight; y += 2 * scale {
+		line.Reset()
+		for x := 0; x < screenWidth; x += scale {
+			top, bottom := black(x, y), black(x, y+scale)
+			switch {
+			case top && bottom:
+				line.WriteRune('█')
+			case top:
+				line.WriteRune('▀')
+			case bottom:
+				line.WriteRune('▄')
+			default:
+				line.WriteByte(' ')
+			}
+		}
+		bw.WriteString(strings.TrimRight(line.String(), " "))
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// Animation records the screen of a running program as an animated GIF.
+// Frames that do not change the screen lengthen the previous frame
+// instead of being added.
+type Animation struct {
+	Every int // cycles between frames
+	Delay int // hundredths of a second a frame is shown
+	GIF   gif.GIF
+
+	last *Screen
+}
+
+// NewAnimation returns an animation sampled every every cycles, each
+// sample shown for delay hundredths of a second.
+func NewAnimation(every, delay int) *Animation {
+	return &Animation{Every: every, Delay: delay}
+}
+
+// Tick records the screen in ram when time, in cycles, is a multiple of
+// Every.
+func (a *Animation) Tick(time int, ram []int16) {
+	if a.Every > 0 && time%a.Every == 0 {
+		a.Capture(ram)
+	}
+}
+
+// Capture records the screen in ram.
+func (a *Animation) Capture(ram []int16) {
+	s := ScreenOf(ram)
+	if a.last != nil && *s == *a.last {
+		a.GIF.Delay[len(a.GIF.Delay)-1] += a.Delay
+		return
+	}
+	a.last = s
+	a.GIF.Image = append(a.GIF.Image, s.Image())
+	a.GIF.Delay = append(a.GIF.Delay, a.Delay)
+}
+
+// Encode writes the animation, which loops forever.
+func (a *Animation) Encode(w io.Writer) error {
+	return gif.EncodeAll(w, &a.GIF)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"image/gif"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestScreen_Black(t *testing.T) {
+	ram := make([]int16, ramSize)
+	ram[screenBase] = 1               // (0, 0)
+	ram[screenBase+1] = -32768        // (31, 0)
+	ram[screenBase+32*255+31] = 0x100 // (504, 255)
+	s := ScreenOf(ram)
+	for _, p := range [][2]int{{0, 0}, {31, 0}, {504, 255}} {
+		if !s.Black(p[0], p[1]) {
+			t.Errorf("pixel %v is white", p)
+		}
+	}
+	for _, p := range [][2]int{{1, 0}, {15, 0}, {16, 0}, {0, 1}, {505, 255}} {
+		if s.Black(p[0], p[1]) {
+			t.Errorf("pixel %v is black", p)
+		}
+	}
+}
+
+func TestScreen_PNG(t *testing.T) {
+	ram := make([]int16, ramSize)
+	ram[screenBase+32*100+3] = 0x0f0f
+	s := ScreenOf(ram)
+	var buf bytes.Buffer
+	if err := s.WritePNG(&buf); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != screenWidth || b.Dy() != screenHeight {
+		t.Fatalf("image of %v", b)
+	}
+	for x := 48; x < 64; x++ {
+		r, _, _, _ := img.At(x, 100).RGBA()
+		if black := r == 0; black != s.Black(x, 100) {
+			t.Errorf("pixel (%d, 100) black = %v in the image", x, black)
+		}
+	}
+}
+
+func TestScreen_WriteText(t *testing.T) {
+	ram := make([]int16, ramSize)
+	ram[screenBase] = 0x0003       // (0, 0), (1, 0)
+	ram[screenBase+32] = 0x0001    // (0, 1)
+	ram[screenBase+32*3] = 0x000c  // (2, 3), (3, 3)
+	ram[screenBase+32*4+1] = 0x001 // (16, 4)
+	var buf bytes.Buffer
+	if err := ScreenOf(ram).WriteText(&buf, 1); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if len(lines) != screenHeight/2+1 {
+		t.Fatalf("%d lines", len(lines))
+	}
+	want := []string{"█▀", "  ▄▄", strings.Repeat(" ", 16) + "▀", ""}
+	for i, w := range want {
+		if lines[i] != w {
+			t.Errorf("line %d = %q, want %q", i, lines[i], w)
+		}
+	}
+
+	buf.Reset()
+	if err := ScreenOf(ram).WriteText(&buf, 4); err != nil {
+		t.Fatal(err)
+	}
+	// rows 0..3 above rows 4..7, in blocks of 4 columns
+	if got, want := strings.SplitN(buf.String(), "\n", 2)[0], "▀   ▄"; got != want {
+		t.Errorf("first line at scale 4 = %q, want %q", got, want)
+	}
+}
+
+func TestAnimation(t *testing.T) {
+	ram := make([]int16, ramSize)
+	anim := NewAnimation(10, 2)
+	for time := 0; time < 50; time++ {
+		if time == 25 {
+			ram[screenBase] = -1
+		}
+		anim.Tick(time, ram)
+	}
+	// frames at 0, 10 and 20 are the same, then 30 and 40
+	if len(anim.GIF.Image) != 2 {
+		t.Fatalf("%d frames, want 2", len(anim.GIF.Image))
+	}
+	if anim.GIF.Delay[0] != 6 || anim.GIF.Delay[1] != 4 {
+		t.Errorf("delays %v, want [6 4]", anim.GIF.Delay)
+	}
+	var buf bytes.Buffer
+	if err := anim.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 2 {
+		t.Errorf("%d frames decoded, want 2", len(g.Image))
+	}
+}
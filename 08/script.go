@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Simulator is the machine a test script drives. Load receives the
+// argument of the load command, which may be empty.
+type Simulator interface {
+	Load(s *Script, name string) error
+	Get(name string) (int16, error)
+	Set(name string, value int16) error
+	Step(command string) error
+}
+
+// Script runs the test scripts (.tst) of the nand2tetris emulators:
+// load, output-file, compare-to, output-list, set, output, echo,
+// repeat and while blocks and the simulator's step commands.
+type Script struct {
+	Path string
+	Dir  string
+	Sim  Simulator
+
+	// Open and Create resolve the file names used by load, compare-to and
+	// output-file. By default they are relative to Dir.
+	Open   func(name string) (io.ReadCloser, error)
+	Create func(name string) (io.WriteCloser, error)
+	Echo   io.Writer
+
+	out     io.WriteCloser
+	cmp     []string
+	outLine int
+	columns []outputColumn
+}
+
+// CompareError reports the first output line that differs from the
+// compare-to file.
+type CompareError struct {
+	Script string
+	Line   int
+	Column int
+	Name   string
+	Got    string
+	Want   string
+}
+
+func (e *CompareError) Error() string {
+	if e.Column == 0 {
+		return fmt.Sprintf("%s: comparison failure at line %d: got %q, want %q", e.Script, e.Line, e.Got, e.Want)
+	}
+	return fmt.Sprintf("%s: comparison failure at line %d, column %d (%s): got %q, want %q",
+		e.Script, e.Line, e.Column, e.Name, e.Got, e.Want)
+}
+
+type outputColumn struct {
+	name   string
+	format byte
+	left   int
+	width  int
+	right  int
+}
+
+func NewScript(path string, sim Simulator) *Script {
+	s := &Script{Path: path, Dir: filepath.Dir(path), Sim: sim, Echo: os.Stdout}
+	s.Open = func(name string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(s.Dir, name))
+	}
+	s.Create = func(name string) (io.WriteCloser, error) {
+		return os.Create(filepath.Join(s.Dir, name))
+	}
+	return s
+}
+
+// Run parses and executes the script file at s.Path.
+func (s *Script) Run() error {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.Exec(f)
+}
+
+// Exec parses and executes a script read from r.
+func (s *Script) Exec(r io.Reader) error {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	tokens, err := scanScript(string(src))
+	if err != nil {
+		return fmt.Errorf("%s:%v", s.Path, err)
+	}
+	p := &scriptParser{tokens: tokens}
+	stmts, err := p.parseBlock(false)
+	if err != nil {
+		return fmt.Errorf("%s:%v", s.Path, err)
+	}
+	defer s.closeOutput()
+	if err := s.execBlock(stmts); err != nil {
+		return err
+	}
+	if s.cmp != nil && s.outLine < len(s.cmp) {
+		return &CompareError{Script: s.Path, Line: s.outLine + 1, Want: s.cmp[s.outLine]}
+	}
+	return nil
+}
+
+func (s *Script) closeOutput() {
+	if s.out != nil {
+		s.out.Close()
+		s.out = nil
+	}
+}
+
+type scriptStmt struct {
+	line    int
+	command string
+	args    []string
+	count   int // repeat count, -1 for forever
+	cond    []string
+	body    []scriptStmt
+}
+
+func (s *Script) execBlock(stmts []scriptStmt) error {
+	for _, st := range stmts {
+		if err := s.exec(st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Script) exec(st scriptStmt) error {
+	errorf := func(format string, a ...interface{}) error {
+		return fmt.Errorf("%s:%d: %s", s.Path, st.line, fmt.Sprintf(format, a...))
+	}
+	switch st.command {
+	case "repeat":
+		for i := 0; st.count < 0 || i < st.count; i++ {
+			if err := s.execBlock(st.body); err != nil {
+				return err
+			}
+		}
+	case "while":
+		for {
+			ok, err := s.evalCond(st.cond)
+			if err != nil {
+				return errorf("%v", err)
+			}
+			if !ok {
+				break
+			}
+			if err := s.execBlock(st.body); err != nil {
+				return err
+			}
+		}
+	case "load":
+		name := ""
+		if len(st.args) > 0 {
+			name = st.args[0]
+		}
+		if err := s.Sim.Load(s, name); err != nil {
+			return errorf("load %s: %v", name, err)
+		}
+	case "output-file":
+		if len(st.args) != 1 {
+			return errorf("output-file expects a file name")
+		}
+		s.closeOutput()
+		w, err := s.Create(st.args[0])
+		if err != nil {
+			return errorf("%v", err)
+		}
+		s.out = w
+	case "compare-to":
+		if len(st.args) != 1 {
+			return errorf("compare-to expects a file name")
+		}
+		r, err := s.Open(st.args[0])
+		if err != nil {
+			return errorf("%v", err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return errorf("%v", err)
+		}
+		s.cmp = splitLines(string(b))
+	case "output-list":
+		s.columns = nil
+		for _, arg := range st.args {
+			col, err := parseOutputColumn(arg)
+			if err != nil {
+				return errorf("%v", err)
+			}
+			s.columns = append(s.columns, col)
+		}
+		return s.writeOutput(s.header())
+	case "output":
+		line := "|"
+		for _, col := range s.columns {
+			v, err := s.Sim.Get(col.name)
+			if err != nil {
+				return errorf("%v", err)
+			}
+			line += col.formatValue(v) + "|"
+		}
+		return s.writeOutput(line)
+	case "set":
+		if len(st.args) != 2 {
+			return errorf("set expects a variable and a value")
+		}
+		v, err := parseScriptValue(st.args[1])
+		if err != nil {
+			return errorf("%v", err)
+		}
+		if err := s.Sim.Set(st.args[0], v); err != nil {
+			return errorf("%v", err)
+		}
+	case "echo":
+		fmt.Fprintln(s.Echo, strings.Join(st.args, " "))
+	case "clear-echo", "breakpoint", "clear-breakpoints":
+		// GUI only
+	default:
+		if err := s.Sim.Step(st.command); err != nil {
+			return errorf("%v", err)
+		}
+	}
+	return nil
+}
+
+func (s *Script) header() string {
+	line := "|"
+	for _, col := range s.columns {
+		w := col.left + col.width + col.right
+		name := col.name
+		if len(name) > w {
+			name = name[:w]
+		}
+		left := (w - len(name)) / 2
+		line += strings.Repeat(" ", left) + name + strings.Repeat(" ", w-len(name)-left) + "|"
+	}
+	return line
+}
+
+func (s *Script) writeOutput(line string) error {
+	if s.out != nil {
+		fmt.Fprintln(s.out, line)
+	}
+	if s.cmp != nil {
+		n := s.outLine
+		if n >= len(s.cmp) {
+			return &CompareError{Script: s.Path, Line: n + 1, Got: line}
+		}
+		if !matchCompareLine(line, s.cmp[n]) {
+			err := &CompareError{Script: s.Path, Line: n + 1, Got: line, Want: s.cmp[n]}
+			got, want := strings.Split(line, "|"), strings.Split(s.cmp[n], "|")
+			for i := 1; i < len(got) && i < len(want); i++ {
+				if !matchCompareLine(got[i], want[i]) {
+					err.Column = i
+					if i-1 < len(s.columns) {
+						err.Name = s.columns[i-1].name
+					}
+					err.Got, err.Want = got[i], want[i]
+					break
+				}
+			}
+			return err
+		}
+	}
+	s.outLine += 1
+	return nil
+}
+
+// matchCompareLine compares an output line with the expected one, where
+// '*' in the expected line matches any character.
+func matchCompareLine(got, want string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := 0; i < len(got); i++ {
+		if want[i] != '*' && want[i] != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Script) evalCond(cond []string) (bool, error) {
+	if len(cond) != 3 {
+		return false, fmt.Errorf("invalid condition %v", cond)
+	}
+	operand := func(t string) (int16, error) {
+		if v, err := parseScriptValue(t); err == nil {
+			return v, nil
+		}
+		return s.Sim.Get(t)
+	}
+	x, err := operand(cond[0])
+	if err != nil {
+		return false, err
+	}
+	y, err := operand(cond[2])
+	if err != nil {
+		return false, err
+	}
+	switch cond[1] {
+	case "=":
+		return x == y, nil
+	case "<>":
+		return x != y, nil
+	case "<":
+		return x < y, nil
+	case ">":
+		return x > y, nil
+	case "<=":
+		return x <= y, nil
+	case ">=":
+		return x >= y, nil
+	}
+	return false, fmt.Errorf("invalid operator %q", cond[1])
+}
+
+// parseOutputColumn parses an output-list item such as RAM[0]%D2.6.2.
+func parseOutputColumn(s string) (outputColumn, error) {
+	col := outputColumn{name: s, format: 'D', left: 1, width: 6, right: 1}
+	i := strings.Index(s, "%")
+	if i == -1 {
+		return col, nil
+	}
+	col.name = s[:i]
+	spec := s[i+1:]
+	if spec == "" || !strings.ContainsRune("DBXS", rune(spec[0])) {
+		return col, fmt.Errorf("invalid output format %q", s)
+	}
+	col.format = spec[0]
+	parts := strings.Split(spec[1:], ".")
+	if len(parts) != 3 {
+		return col, fmt.Errorf("invalid output format %q", s)
+	}
+	var n [3]int
+	for j, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil || v < 0 {
+			return col, fmt.Errorf("invalid output format %q", s)
+		}
+		n[j] = v
+	}
+	col.left, col.width, col.right = n[0], n[1], n[2]
+	return col, nil
+}
+
+func (col outputColumn) formatValue(v int16) string {
+	var text string
+	switch col.format {
+	case 'B':
+		text = fmt.Sprintf("%016b", uint16(v))
+	case 'X':
+		text = fmt.Sprintf("%04X", uint16(v))
+	case 'S':
+		text = string(rune(v))
+	default:
+		text = strconv.Itoa(int(v))
+	}
+	if len(text) > col.width {
+		text = text[len(text)-col.width:]
+	}
+	pad := strings.Repeat(" ", col.width-len(text))
+	if col.format == 'S' {
+		text += pad
+	} else {
+		text = pad + text
+	}
+	return strings.Repeat(" ", col.left) + text + strings.Repeat(" ", col.right)
+}
+
+func parseScriptValue(s string) (int16, error) {
+	base := 10
+	switch {
+	case strings.HasPrefix(s, "%X"):
+		base, s = 16, s[2:]
+	case strings.HasPrefix(s, "%B"):
+		base, s = 2, s[2:]
+	case strings.HasPrefix(s, "%D"):
+		s = s[2:]
+	}
+	v, err := strconv.ParseInt(s, base, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if base == 10 && (v < -32768 || v > 32767) {
+		return 0, fmt.Errorf("value out of range: %s", s)
+	}
+	return int16(v), nil
+}
+
+func splitLines(s string) []string {
+	var lines []string
+	sc := bufio.NewScanner(strings.NewReader(s))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+type scriptToken struct {
+	line int
+	text string
+}
+
+func scanScript(src string) ([]scriptToken, error) {
+	var tokens []scriptToken
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line += 1
+			i += 1
+		case c == ' ' || c == '\t' || c == '\r':
+			i += 1
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i += 1
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end == -1 {
+				return nil, fmt.Errorf("%d: unterminated comment", line)
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case c == ',' || c == ';' || c == '{' || c == '}':
+			tokens = append(tokens, scriptToken{line, string(c)})
+			i += 1
+		case c == '"':
+			end := strings.IndexByte(src[i+1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("%d: unterminated string", line)
+			}
+			tokens = append(tokens, scriptToken{line, src[i+1 : i+1+end]})
+			i += end + 2
+		default:
+			j := i
+			for j < len(src) && !strings.ContainsRune(" \t\r\n,;{}", rune(src[j])) {
+				j += 1
+			}
+			tokens = append(tokens, scriptToken{line, src[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type scriptParser struct {
+	tokens []scriptToken
+	pos    int
+}
+
+func (p *scriptParser) parseBlock(nested bool) ([]scriptStmt, error) {
+	var stmts []scriptStmt
+	for p.pos < len(p.tokens) {
+		t := p.tokens[p.pos]
+		switch t.text {
+		case "}":
+			if !nested {
+				return nil, fmt.Errorf("%d: unexpected '}'", t.line)
+			}
+			p.pos += 1
+			return stmts, nil
+		case ",", ";":
+			p.pos += 1
+			continue
+		case "repeat", "while":
+			st := scriptStmt{line: t.line, command: t.text, count: -1}
+			p.pos += 1
+			var head []string
+			for p.pos < len(p.tokens) && p.tokens[p.pos].text != "{" {
+				head = append(head, p.tokens[p.pos].text)
+				p.pos += 1
+			}
+			if p.pos == len(p.tokens) {
+				return nil, fmt.Errorf("%d: missing '{' after %s", t.line, t.text)
+			}
+			p.pos += 1
+			if t.text == "repeat" {
+				if len(head) > 1 {
+					return nil, fmt.Errorf("%d: invalid repeat count", t.line)
+				}
+				if len(head) == 1 {
+					n, err := strconv.Atoi(head[0])
+					if err != nil || n < 0 {
+						return nil, fmt.Errorf("%d: invalid repeat count %q", t.line, head[0])
+					}
+					st.count = n
+				}
+			} else {
+				st.cond = head
+			}
+			body, err := p.parseBlock(true)
+			if err != nil {
+				return nil, err
+			}
+			st.body = body
+			stmts = append(stmts, st)
+		default:
+			st := scriptStmt{line: t.line, command: t.text}
+			p.pos += 1
+			for p.pos < len(p.tokens) && !isScriptDelim(p.tokens[p.pos].text) {
+				st.args = append(st.args, p.tokens[p.pos].text)
+				p.pos += 1
+			}
+			stmts = append(stmts, st)
+		}
+	}
+	if nested {
+		return nil, fmt.Errorf("missing '}'")
+	}
+	return stmts, nil
+}
+
+func isScriptDelim(t string) bool {
+	return t == "," || t == ";" || t == "{" || t == "}"
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// findScripts returns the CPU emulator test scripts under the given roots.
+// Chapter 8's translator still has to pass the chapter 7 tests.
+func findScripts(t *testing.T, roots ...string) []string {
+	var scripts []string
+	for _, root := range roots {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if strings.HasSuffix(path, ".tst") && !strings.HasSuffix(path, "VME.tst") {
+				scripts = append(scripts, path)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return scripts
+}
+
+// translateDir translates the .vm files next to a script in memory. The
+// bootstrap code is only emitted for programs that provide Sys.vm.
+func translateDir(t *testing.T, dir string) []byte {
+	files, err := findVMFiles(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(filepath.Join(dir, "Sys.vm"))
+	var buf bytes.Buffer
+	if err := translate(&buf, files, err == nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func runTranslatedScript(t *testing.T, path string) error {
+	asm := translateDir(t, filepath.Dir(path))
+	s := NewScript(path, NewCPUSimulator())
+	open := s.Open
+	s.Open = func(name string) (io.ReadCloser, error) {
+		if filepath.Ext(name) == ".asm" {
+			return ioutil.NopCloser(bytes.NewReader(asm)), nil
+		}
+		return open(name)
+	}
+	s.Create = func(name string) (io.WriteCloser, error) {
+		return nopWriteCloser{ioutil.Discard}, nil
+	}
+	return s.Run()
+}
+
+func TestScript_Translator(t *testing.T) {
+	logLevel = logQuiet
+	defer func() { logLevel = logInfo }()
+
+	for _, path := range findScripts(t, "test", "../07/test") {
+		if err := runTranslatedScript(t, path); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestScript_CompareError(t *testing.T) {
+	s := NewScript("Inline.tst", NewCPUSimulator())
+	s.Open = func(name string) (io.ReadCloser, error) {
+		switch name {
+		case "Inline.asm":
+			return ioutil.NopCloser(strings.NewReader("@7\nD=A\n@256\nM=D\n")), nil
+		case "Inline.cmp":
+			return ioutil.NopCloser(strings.NewReader("|  RAM[0]  | RAM[256] |\n|       0  |       8  |\n")), nil
+		}
+		return nil, os.ErrNotExist
+	}
+	err := s.Exec(strings.NewReader(`
+load Inline.asm,
+compare-to Inline.cmp,
+output-list RAM[0]%D2.6.2 RAM[256]%D2.6.2;
+repeat 4 { ticktock; }
+output;
+`))
+	cerr, ok := err.(*CompareError)
+	if !ok {
+		t.Fatalf("expected a CompareError, got %v", err)
+	}
+	if cerr.Line != 2 || cerr.Column != 2 || cerr.Name != "RAM[256]" {
+		t.Errorf("unexpected position: %v", cerr)
+	}
+	if cerr.Got != "       7  " || cerr.Want != "       8  " {
+		t.Errorf("unexpected values: %v", cerr)
+	}
+}
+
+func TestOutputColumn_Header(t *testing.T) {
+	s := &Script{}
+	for _, item := range []string{"RAM[0]%D2.6.2", "RAM[256]%D1.6.1", "RAM[3032]%D1.6.1", "RAM[11]%D1.6.1"} {
+		col, err := parseOutputColumn(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.columns = append(s.columns, col)
+	}
+	want := "|  RAM[0]  |RAM[256]|RAM[3032|RAM[11] |"
+	if h := s.header(); h != want {
+		t.Errorf("header %q, want %q", h, want)
+	}
+}
+
+func TestScript_VMEmulator(t *testing.T) {
+	var scripts []string
+	for _, root := range []string{"test", "../07/test"} {
+		paths, err := filepath.Glob(filepath.Join(root, "*", "*", "*VME.tst"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		scripts = append(scripts, paths...)
+	}
+	if len(scripts) == 0 {
+		t.Fatal("no VM emulator scripts found")
+	}
+	for _, path := range scripts {
+		s := NewScript(path, NewVMSimulator())
+		s.Create = func(name string) (io.WriteCloser, error) {
+			return nopWriteCloser{ioutil.Discard}, nil
+		}
+		if err := s.Run(); err != nil {
+			t.Error(err)
+		}
+	}
+}
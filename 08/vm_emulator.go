@@ -0,0 +1,499 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VMCommand is one parsed VM command. Function is the function the
+// command belongs to, which scopes its labels.
+type VMCommand struct {
+	Type     CommandType
+	Command  string
+	Arg1     string
+	Arg2     int
+	File     string
+	Function string
+	Line     int
+}
+
+// ParseVM reads the commands of one .vm file. The file name, without
+// extension, names its static segment.
+func ParseVM(filename string, r io.Reader) ([]VMCommand, error) {
+	file := strings.TrimSuffix(filepath.Base(filename), ".vm")
+	parser := NewParder(r)
+	var commands []VMCommand
+	var errs []string
+	function := ""
+	for parser.HasMoreCommands() {
+		if err := parser.Validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: %v", filename, parser.lineNumber, err))
+			continue
+		}
+		cmd := VMCommand{
+			Type:     parser.CommandType(),
+			Command:  parser.Command(),
+			File:     file,
+			Function: function,
+			Line:     parser.lineNumber,
+		}
+		if cmd.Type != C_RETURN {
+			cmd.Arg1 = parser.Arg1()
+		}
+		switch cmd.Type {
+		case C_PUSH, C_POP, C_FUNCTION, C_CALL:
+			n, err := strconv.Atoi(parser.Arg2())
+			if err != nil || n < 0 {
+				errs = append(errs, fmt.Sprintf("%s:%d: invalid argument %q", filename, parser.lineNumber, parser.Arg2()))
+				continue
+			}
+			cmd.Arg2 = n
+		}
+		if cmd.Type == C_FUNCTION {
+			function = cmd.Arg1
+			cmd.Function = function
+		}
+		commands = append(commands, cmd)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return commands, nil
+}
+
+// VMEmulator interprets VM commands directly on the Hack memory layout,
+// like the VM emulator of the nand2tetris tools. Labels are not counted
+// as steps; every other command is. Addresses wrap at 32K words so that
+// a runaway program cannot index outside of RAM.
+//
+// Calls to the functions of Builtins run natively, whether the program
+// defines them or not. A native call counts as one step.
+type VMEmulator struct {
+	RAM      []int16
+	Commands []VMCommand
+	PC       int
+	Steps    int
+	Builtins *Builtins
+	Keyboard KeyInput // sets KBD at every step, the time being Steps
+
+	halted     bool
+	labels     map[string]int
+	functions  map[string]int
+	statics    map[string]int
+	nextStatic int
+}
+
+func NewVMEmulator() *VMEmulator {
+	return &VMEmulator{RAM: make([]int16, 32768)}
+}
+
+// Load replaces the program and starts it at Sys.init when the program
+// defines it, otherwise at its first command. RAM is kept.
+func (vm *VMEmulator) Load(commands []VMCommand) error {
+	vm.Commands = commands
+	vm.labels = map[string]int{}
+	vm.functions = map[string]int{}
+	vm.statics = map[string]int{}
+	vm.nextStatic = 16
+	vm.PC, vm.Steps = 0, 0
+	vm.halted = false
+	for i, cmd := range commands {
+		switch cmd.Type {
+		case C_LABEL:
+			vm.labels[cmd.Function+"$"+cmd.Arg1] = i
+		case C_FUNCTION:
+			if _, ok := vm.functions[cmd.Arg1]; ok {
+				return fmt.Errorf("%s:%d: function %s redefined", cmd.File, cmd.Line, cmd.Arg1)
+			}
+			vm.functions[cmd.Arg1] = i
+		}
+	}
+	for _, cmd := range commands {
+		switch cmd.Type {
+		case C_GOTO, C_IF:
+			if _, ok := vm.labels[cmd.Function+"$"+cmd.Arg1]; !ok {
+				return fmt.Errorf("%s:%d: undefined label %s", cmd.File, cmd.Line, cmd.Arg1)
+			}
+		case C_CALL:
+			_, native := vm.Builtins.Lookup(cmd.Arg1)
+			if _, ok := vm.functions[cmd.Arg1]; !ok && !native {
+				return fmt.Errorf("%s:%d: undefined function %s", cmd.File, cmd.Line, cmd.Arg1)
+			}
+		}
+	}
+	if i, ok := vm.functions["Sys.init"]; ok {
+		vm.PC = i
+	}
+	vm.skipLabels()
+	return nil
+}
+
+// Bootstrap sets SP to 256 and calls Sys.init the way the translator's
+// bootstrap code does.
+func (vm *VMEmulator) Bootstrap() error {
+	_, native := vm.Builtins.Lookup("Sys.init")
+	if _, ok := vm.functions["Sys.init"]; !ok && !native {
+		return fmt.Errorf("Sys.init not found")
+	}
+	vm.RAM[0] = 256
+	return vm.callFunction("Sys.init", 0, len(vm.Commands))
+}
+
+// StaticAddress returns the RAM address of the static variable File.i,
+// allocating it on first use.
+func (vm *VMEmulator) StaticAddress(name string) int {
+	addr, ok := vm.statics[name]
+	if !ok {
+		addr = vm.nextStatic
+		vm.statics[name] = addr
+		vm.nextStatic += 1
+	}
+	return addr
+}
+
+// Statics returns the names of all static variables used so far.
+func (vm *VMEmulator) Statics() []string {
+	var names []string
+	for name := range vm.statics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Halted reports whether execution ran past the last command or a
+// builtin halted the program.
+func (vm *VMEmulator) Halted() bool {
+	return vm.halted || vm.PC >= len(vm.Commands)
+}
+
+// Peek and Poke make the emulator the Machine of its builtins.
+func (vm *VMEmulator) Peek(addr int) int16 {
+	return vm.RAM[addr&0x7fff]
+}
+
+func (vm *VMEmulator) Poke(addr int, value int16) {
+	vm.RAM[addr&0x7fff] = value
+}
+
+// Step executes one command.
+func (vm *VMEmulator) Step() error {
+	if vm.Halted() {
+		return fmt.Errorf("program halted")
+	}
+	if vm.Keyboard != nil {
+		vm.RAM[kbdAddr] = vm.Keyboard.Key(vm.Steps)
+	}
+	cmd := vm.Commands[vm.PC]
+	vm.PC += 1
+	vm.Steps += 1
+	if err := vm.exec(cmd); err != nil {
+		return fmt.Errorf("%s:%d: %s: %v", cmd.File, cmd.Line, cmd.Command, err)
+	}
+	vm.skipLabels()
+	return nil
+}
+
+func (vm *VMEmulator) skipLabels() {
+	for vm.PC < len(vm.Commands) && vm.Commands[vm.PC].Type == C_LABEL {
+		vm.PC += 1
+	}
+}
+
+func (vm *VMEmulator) exec(cmd VMCommand) error {
+	switch cmd.Type {
+	case C_ARITHMETIC:
+		return vm.arithmetic(cmd.Command)
+	case C_PUSH:
+		addr, err := vm.address(cmd)
+		if err != nil {
+			return err
+		}
+		if addr < 0 {
+			vm.push(int16(cmd.Arg2))
+		} else {
+			vm.push(vm.RAM[addr])
+		}
+	case C_POP:
+		if cmd.Arg1 == "constant" {
+			return fmt.Errorf("cannot pop to constant")
+		}
+		addr, err := vm.address(cmd)
+		if err != nil {
+			return err
+		}
+		vm.RAM[addr] = vm.pop()
+	case C_GOTO:
+		vm.PC = vm.labels[cmd.Function+"$"+cmd.Arg1]
+	case C_IF:
+		if vm.pop() != 0 {
+			vm.PC = vm.labels[cmd.Function+"$"+cmd.Arg1]
+		}
+	case C_FUNCTION:
+		for i := 0; i < cmd.Arg2; i++ {
+			vm.push(0)
+		}
+	case C_CALL:
+		err := vm.callFunction(cmd.Arg1, cmd.Arg2, vm.PC)
+		if err == ErrWait {
+			// run the call again at the next step
+			vm.PC -= 1
+			return nil
+		}
+		return err
+	case C_RETURN:
+		frame := vm.RAM[1]
+		ret := int(vm.RAM[wrap(frame-5)])
+		vm.RAM[wrap(vm.RAM[2])] = vm.pop()
+		vm.RAM[0] = vm.RAM[2] + 1
+		vm.RAM[4] = vm.RAM[wrap(frame-1)]
+		vm.RAM[3] = vm.RAM[wrap(frame-2)]
+		vm.RAM[2] = vm.RAM[wrap(frame-3)]
+		vm.RAM[1] = vm.RAM[wrap(frame-4)]
+		if ret < 0 || ret > len(vm.Commands) {
+			return fmt.Errorf("invalid return address %d", ret)
+		}
+		vm.PC = ret
+	}
+	return nil
+}
+
+// callFunction calls the function name with the numArgs arguments on
+// the stack, natively if it has a builtin.
+func (vm *VMEmulator) callFunction(name string, numArgs, ret int) error {
+	f, ok := vm.Builtins.Lookup(name)
+	if !ok {
+		i, ok := vm.functions[name]
+		if !ok {
+			return fmt.Errorf("undefined function %s", name)
+		}
+		vm.call(i, numArgs, ret)
+		return nil
+	}
+	if err := f.checkArgs(name, numArgs); err != nil {
+		return err
+	}
+	args := make([]int16, numArgs)
+	for i := range args {
+		args[i] = vm.RAM[wrap(vm.RAM[0]-int16(numArgs-i))]
+	}
+	v, err := f.Func(vm, args)
+	var jump Jump
+	switch {
+	case err == nil:
+		vm.RAM[0] -= int16(numArgs)
+		vm.push(v)
+		vm.PC = ret
+	case err == ErrHalt:
+		vm.halted = true
+	case err == ErrWait:
+		return err
+	case errors.As(err, &jump):
+		if err := vm.callFunction(string(jump), numArgs, ret); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	default:
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+func (vm *VMEmulator) call(function, numArgs, ret int) {
+	vm.push(int16(ret))
+	for i := 1; i <= 4; i++ {
+		vm.push(vm.RAM[i])
+	}
+	vm.RAM[2] = vm.RAM[0] - int16(numArgs) - 5
+	vm.RAM[1] = vm.RAM[0]
+	vm.PC = function
+}
+
+// address returns the RAM address of a segment entry, or -1 for the
+// constant segment.
+func (vm *VMEmulator) address(cmd VMCommand) (int, error) {
+	index := cmd.Arg2
+	var addr int
+	switch cmd.Arg1 {
+	case "constant":
+		if index > 32767 {
+			return 0, fmt.Errorf("constant out of range: %d", index)
+		}
+		return -1, nil
+	case "local":
+		addr = wrap(vm.RAM[1] + int16(index))
+	case "argument":
+		addr = wrap(vm.RAM[2] + int16(index))
+	case "this":
+		addr = wrap(vm.RAM[3] + int16(index))
+	case "that":
+		addr = wrap(vm.RAM[4] + int16(index))
+	case "pointer":
+		if index > 1 {
+			return 0, fmt.Errorf("pointer index out of range: %d", index)
+		}
+		addr = 3 + index
+	case "temp":
+		if index > 7 {
+			return 0, fmt.Errorf("temp index out of range: %d", index)
+		}
+		addr = 5 + index
+	case "static":
+		addr = vm.StaticAddress(fmt.Sprintf("%s.%d", cmd.File, index))
+	default:
+		return 0, fmt.Errorf("unknown segment %q", cmd.Arg1)
+	}
+	return addr, nil
+}
+
+func (vm *VMEmulator) arithmetic(command string) error {
+	switch command {
+	case "neg":
+		vm.push(-vm.pop())
+		return nil
+	case "not":
+		vm.push(^vm.pop())
+		return nil
+	}
+	y := vm.pop()
+	x := vm.pop()
+	switch command {
+	case "add":
+		vm.push(x + y)
+	case "sub":
+		vm.push(x - y)
+	case "and":
+		vm.push(x & y)
+	case "or":
+		vm.push(x | y)
+	case "eq":
+		vm.push(vmBool(x == y))
+	case "gt":
+		vm.push(vmBool(x > y))
+	case "lt":
+		vm.push(vmBool(x < y))
+	default:
+		return fmt.Errorf("unknown command")
+	}
+	return nil
+}
+
+func vmBool(b bool) int16 {
+	if b {
+		return -1
+	}
+	return 0
+}
+
+func (vm *VMEmulator) push(v int16) {
+	vm.RAM[wrap(vm.RAM[0])] = v
+	vm.RAM[0] += 1
+}
+
+func (vm *VMEmulator) pop() int16 {
+	vm.RAM[0] -= 1
+	return vm.RAM[wrap(vm.RAM[0])]
+}
+
+func wrap(addr int16) int {
+	return int(uint16(addr) & 0x7fff)
+}
+
+// VMSimulator runs test scripts written for the VM emulator. load takes a
+// .vm file, or no argument to load every .vm file of the script's
+// directory. Besides RAM[n] it understands sp, local, argument, this,
+// that and indexed segment entries such as argument[2] or temp[0].
+type VMSimulator struct {
+	VM *VMEmulator
+}
+
+func NewVMSimulator() *VMSimulator {
+	return &VMSimulator{VM: NewVMEmulator()}
+}
+
+func (v *VMSimulator) Load(s *Script, name string) error {
+	var names []string
+	if name == "" {
+		files, err := findVMFiles(s.Dir, false)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			names = append(names, filepath.Base(f))
+		}
+	} else {
+		names = []string{name}
+	}
+	var commands []VMCommand
+	for _, n := range names {
+		r, err := s.Open(n)
+		if err != nil {
+			return err
+		}
+		cmds, err := ParseVM(n, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		commands = append(commands, cmds...)
+	}
+	return v.VM.Load(commands)
+}
+
+func (v *VMSimulator) Get(name string) (int16, error) {
+	addr, err := v.address(name)
+	if err != nil {
+		return 0, err
+	}
+	return v.VM.RAM[addr], nil
+}
+
+func (v *VMSimulator) Set(name string, value int16) error {
+	addr, err := v.address(name)
+	if err != nil {
+		return err
+	}
+	v.VM.RAM[addr] = value
+	return nil
+}
+
+var vmRegisters = map[string]int{"sp": 0, "local": 1, "argument": 2, "this": 3, "that": 4}
+
+func (v *VMSimulator) address(name string) (int, error) {
+	if addr, ok := vmRegisters[name]; ok {
+		return addr, nil
+	}
+	if strings.HasPrefix(name, "RAM[") {
+		return ramAddress(name)
+	}
+	i := strings.Index(name, "[")
+	if i == -1 || !strings.HasSuffix(name, "]") {
+		return 0, fmt.Errorf("unknown variable %q", name)
+	}
+	index, err := strconv.Atoi(name[i+1 : len(name)-1])
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("invalid index in %q", name)
+	}
+	addr, err := v.VM.address(VMCommand{Arg1: name[:i], Arg2: index})
+	if err != nil {
+		return 0, err
+	}
+	if addr < 0 {
+		return 0, fmt.Errorf("unknown variable %q", name)
+	}
+	return addr, nil
+}
+
+func (v *VMSimulator) Step(command string) error {
+	if command != "vmstep" {
+		return fmt.Errorf("unknown command %q", command)
+	}
+	return v.VM.Step()
+}
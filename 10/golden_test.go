@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The golden tests compare the output of the tokenizer and the parser with
+// the reference files next to each .jack file under test: FooT.xml for the
+// tokens of Foo.jack and Foo.xml for its parse tree. A new golden program
+// is added by dropping its .jack and .xml files into a directory of test;
+// go test -run Golden -update writes the reference files from the current
+// output instead.
+var update = flag.Bool("update", false, "rewrite the golden files from the current output")
+
+func TestGolden(t *testing.T) {
+	var sources []string
+	err := filepath.Walk("test", func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && filepath.Ext(path) == ".jack" {
+			sources = append(sources, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, path := range sources {
+		base := strings.TrimSuffix(path, ".jack")
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if golden := base + "T.xml"; *update || exists(golden) {
+			n += 1
+			t.Run(golden, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := WriteTokensXML(&buf, NewStringTokenizer(path, string(src))); err != nil {
+					t.Fatal(err)
+				}
+				checkGolden(t, golden, buf.Bytes())
+			})
+		}
+		if golden := base + ".xml"; *update || exists(golden) {
+			n += 1
+			t.Run(golden, func(t *testing.T) {
+				class, err := NewParser(NewStringTokenizer(path, string(src))).ParseClass()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var buf bytes.Buffer
+				if err := WriteXML(&buf, class); err != nil {
+					t.Fatal(err)
+				}
+				checkGolden(t, golden, buf.Bytes())
+			})
+		}
+	}
+	if n == 0 {
+		t.Fatal("no golden files found under test")
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// checkGolden compares got with the golden file, ignoring the layout of
+// both, and reports the first element that differs.
+func checkGolden(t *testing.T, golden string, got []byte) {
+	if *update {
+		if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLines, err := normalizeXML(want)
+	if err != nil {
+		t.Fatalf("%s: %v", golden, err)
+	}
+	gotLines, err := normalizeXML(got)
+	if err != nil {
+		t.Fatalf("output: %v\n%s", err, got)
+	}
+	if diff := diffXML(wantLines, gotLines); diff != "" {
+		t.Errorf("output differs from %s:\n%s", golden, diff)
+	}
+}
+
+// xmlLine is an element of a normalized XML document: a start or end tag,
+// or a leaf element with its trimmed text. Path locates the element in
+// the tree, such as class/subroutineDec[2]/subroutineBody.
+type xmlLine struct {
+	Text  string
+	Path  string
+	Depth int
+}
+
+// normalizeXML flattens an XML document to one line per element, so that
+// documents differing only in indentation, line breaks or the spaces
+// around token values compare equal.
+func normalizeXML(doc []byte) ([]xmlLine, error) {
+	type frame struct {
+		path   string
+		counts map[string]int
+		start  int // index of the start tag in lines
+		leaf   bool
+	}
+	var lines []xmlLine
+	var text strings.Builder
+	stack := []*frame{{counts: map[string]int{}}}
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		top := stack[len(stack)-1]
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			top.leaf = false
+			name := tok.Name.Local
+			top.counts[name] += 1
+			path := name
+			if n := top.counts[name]; n > 1 {
+				path = fmt.Sprintf("%s[%d]", name, n)
+			}
+			if top.path != "" {
+				path = top.path + "/" + path
+			}
+			lines = append(lines, xmlLine{"<" + name + ">", path, len(stack) - 1})
+			stack = append(stack, &frame{path: path, counts: map[string]int{}, start: len(lines) - 1, leaf: true})
+			text.Reset()
+		case xml.CharData:
+			text.Write(tok)
+		case xml.EndElement:
+			name := tok.Name.Local
+			if top.leaf && strings.TrimSpace(text.String()) != "" {
+				// a token: fold its text into a single line
+				lines[top.start].Text = fmt.Sprintf("<%s> %s </%s>", name, strings.TrimSpace(text.String()), name)
+			} else {
+				lines = append(lines, xmlLine{"</" + name + ">", top.path, len(stack) - 2})
+			}
+			stack = stack[:len(stack)-1]
+			text.Reset()
+		}
+	}
+	return lines, nil
+}
+
+// diffXML returns a description of the first difference between want and
+// got with a few elements of context, or "" if they are equal.
+func diffXML(want, got []xmlLine) string {
+	i := 0
+	for i < len(want) && i < len(got) && want[i].Text == got[i].Text {
+		i += 1
+	}
+	if i == len(want) && i == len(got) {
+		return ""
+	}
+	var b strings.Builder
+	switch {
+	case i < len(want):
+		fmt.Fprintf(&b, "at %s:\n", want[i].Path)
+	default:
+		fmt.Fprintf(&b, "at %s:\n", got[i].Path)
+	}
+	const context = 3
+	from := i - context
+	if from < 0 {
+		from = 0
+	}
+	section := func(title string, lines []xmlLine) {
+		fmt.Fprintf(&b, "%s:\n", title)
+		for j := from; j < len(lines) && j <= i+context; j++ {
+			mark := " "
+			if j == i {
+				mark = ">"
+			}
+			fmt.Fprintf(&b, "%s %s%s\n", mark, strings.Repeat("  ", lines[j].Depth), lines[j].Text)
+		}
+		if i >= len(lines) {
+			fmt.Fprintf(&b, "> (end of document)\n")
+		}
+	}
+	section("want", want)
+	section("got", got)
+	return b.String()
+}
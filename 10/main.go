@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -39,9 +40,15 @@ func main() {
 		files = append(files, f)
 	}
 
+	status := 0
 	for _, f := range files {
 		log.Printf("FILE: %s", f.Name())
-		tokenizer := NewTokenizer(f)
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		src := string(b)
+		tokenizer := NewStringTokenizer(f.Name(), src)
 
 		w, err := os.Create(f.Name() + ".tokens")
 		if err != nil {
@@ -50,20 +57,22 @@ func main() {
 
 		fmt.Fprint(w, "<tokens>\n")
 
-		for tokenizer.HasMoreTokens() {
-			log.Printf("%#v", tokenizer)
-			switch tokenizer.TokenType() {
-			case TOKEN_SYMBOL:
-				fmt.Fprintf(w, "<symbol> %s </symbol>\n", tokenizer.Symbol())
-			case TOKEN_KEYWORD:
-				fmt.Fprintf(w, "<keyword> %s </keyword>\n", tokenizer.KeyWord())
-			case TOKEN_INT_CONST:
-				fmt.Fprintf(w, "<integerConstant> %d </integerConstant>\n", tokenizer.IntVal())
-			case TOKEN_STRING_CONST:
-				fmt.Fprintf(w, "<stringConstant> %s </stringConstant>\n", tokenizer.StringVal())
-			case TOKEN_IDENTIFIER:
-				fmt.Fprintf(w, "<identifier> %s </identifier>\n", tokenizer.Identifier())
+		failed := false
+		for {
+			token, err := tokenizer.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Print(err)
+				failed = true
+				continue
+			}
+			value := token.Value
+			if token.Kind == TOKEN_SYMBOL {
+				value = xmlEscape(value)
 			}
+			fmt.Fprintf(w, "<%s> %s </%s>\n", token.Kind, value, token.Kind)
 		}
 
 		fmt.Fprint(w, "</tokens>\n")
@@ -71,15 +80,26 @@ func main() {
 		w.Close()
 		f.Close()
 
+		if failed {
+			status = 1
+			continue
+		}
+
 		// CREATE XML
-		r, err := os.Open(f.Name() + ".tokens")
+		class, err := NewParser(NewStringTokenizer(f.Name(), src)).ParseClass()
+		if err != nil {
+			log.Print(err)
+			status = 1
+			continue
+		}
 		w, err = os.Create(f.Name() + ".xml")
 		if err != nil {
 			panic(err)
 		}
-		compiler := NewCompiler(r, w)
-		compiler.CompileClass()
-		r.Close()
+		if err := WriteXML(w, class); err != nil {
+			log.Fatal(err)
+		}
 		w.Close()
 	}
+	os.Exit(status)
 }
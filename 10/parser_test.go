@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParser_ParseClass(t *testing.T) {
+	src := `class Foo {
+  field int x, y;
+  method int sum(int a, Array b) {
+    var int i;
+    let b[i] = a + x * -(y - 1);
+    if (~(i = 0)) { do Output.printInt(i); } else { return 0; }
+    return sum(1, b);
+  }
+}
+`
+	class, err := NewParser(NewStringTokenizer("Foo.jack", src)).ParseClass()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if class.Name.Name != "Foo" || len(class.Vars) != 1 || len(class.Vars[0].Names) != 2 {
+		t.Fatalf("class: %#v", class)
+	}
+	sub := class.Subroutines[0]
+	if sub.Kind != "method" || sub.ReturnType.Name != "int" || sub.Name.Name != "sum" || len(sub.Params) != 2 {
+		t.Fatalf("subroutine: %#v", sub)
+	}
+	if sub.Params[1].Type.Name != "Array" || sub.Params[1].Name.Pos != (Pos{"Foo.jack", 3, 31}) {
+		t.Errorf("param: %#v", sub.Params[1])
+	}
+
+	statements := sub.Body.Statements
+	if len(statements) != 3 {
+		t.Fatalf("statements: %#v", statements)
+	}
+	let, ok := statements[0].(*LetStatement)
+	if !ok || let.Index == nil || let.Pos != (Pos{"Foo.jack", 5, 5}) {
+		t.Fatalf("let: %#v", statements[0])
+	}
+	// a + x * -(y - 1) is evaluated from left to right: (a + x) * -(y - 1)
+	mul, ok := let.Value.(*BinaryExpr)
+	if !ok || mul.Op != "*" || mul.OpPos != (Pos{"Foo.jack", 5, 22}) {
+		t.Fatalf("value: %#v", let.Value)
+	}
+	if add, ok := mul.X.(*BinaryExpr); !ok || add.Op != "+" {
+		t.Errorf("left operand: %#v", mul.X)
+	}
+	if neg, ok := mul.Y.(*UnaryExpr); !ok || neg.Op != "-" {
+		t.Errorf("right operand: %#v", mul.Y)
+	} else if _, ok := neg.X.(*ParenExpr); !ok {
+		t.Errorf("negated term: %#v", neg.X)
+	}
+
+	ifs, ok := statements[1].(*IfStatement)
+	if !ok || ifs.Else == nil || len(ifs.Then.Statements) != 1 {
+		t.Fatalf("if: %#v", statements[1])
+	}
+	do := ifs.Then.Statements[0].(*DoStatement)
+	if do.Call.Receiver == nil || do.Call.Receiver.Name != "Output" || do.Call.Name.Name != "printInt" || len(do.Call.Args) != 1 {
+		t.Errorf("do: %#v", do.Call)
+	}
+
+	ret := statements[2].(*ReturnStatement)
+	if call, ok := ret.Value.(*CallExpr); !ok || call.Receiver != nil || len(call.Args) != 2 {
+		t.Errorf("return: %#v", ret.Value)
+	}
+}
+
+func TestParser_Errors(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"class Foo { function void f() { let x = 1 let y = 2; } }", "T.jack:1:43: expected ';' but found 'let'"},
+		{"class Foo { function void f() { let x = ; } }", "T.jack:1:41: expected expression but found ';'"},
+		{"class Foo { field 1 x; }", "T.jack:1:19: expected type but found '1'"},
+		{"class Foo { function void f() { do f(; } }", "T.jack:1:38: expected ')' but found ';'"},
+		{"class Foo { function void f() { return; }", "T.jack:1:42: expected '}' but found end of file"},
+		{"class Foo { } }", "T.jack:1:15: expected end of file but found '}'"},
+		{"class Foo { function void f() { let s = \"x; } }", "T.jack:1:41: string constant not terminated before the end of the line\nT.jack:1:48: expected expression but found end of file"},
+	}
+	for _, test := range tests {
+		_, err := NewParser(NewStringTokenizer("T.jack", test.src)).ParseClass()
+		if err == nil {
+			t.Errorf("%q: no error", test.src)
+			continue
+		}
+		if err.Error() != test.err {
+			t.Errorf("%q: error %q, want %q", test.src, err, test.err)
+		}
+	}
+}
+
+func TestWriteXML(t *testing.T) {
+	paths, err := filepath.Glob("test/Square/*.jack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		class, err := NewParser(NewTokenizer(path, f)).ParseClass()
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := WriteXML(&buf, class); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(buf.Bytes(), []byte("<class>\n  <keyword> class </keyword>\n")) || !bytes.HasSuffix(buf.Bytes(), []byte("</class>\n")) {
+			t.Errorf("%s: unexpected XML:\n%s", path, buf.String())
+		}
+	}
+}
+
+func TestParser_Recovery(t *testing.T) {
+	src := `class Foo {
+  field int x
+  field int y;
+  method void f() {
+    let x = 1
+    let y = ;
+    do g(x;
+    x = 2;
+    if (x { let x = 3; }
+    return;
+  }
+  function void g(int a) {
+    var int b
+    while (a > 0) { let a = a - 1; }
+    return # ;
+  }
+  static int z;
+  method void h( {
+    return;
+  }
+}
+`
+	class, err := NewParser(NewStringTokenizer("Foo.jack", src)).ParseClass()
+	want := []string{
+		"Foo.jack:3:3: expected ';' but found 'field'",
+		"Foo.jack:6:5: expected ';' but found 'let'",
+		"Foo.jack:6:13: expected expression but found ';'",
+		"Foo.jack:7:11: expected ')' but found ';'",
+		"Foo.jack:8:5: expected statement but found 'x'",
+		"Foo.jack:9:11: expected ')' but found '{'",
+		"Foo.jack:14:5: expected ';' but found 'while'",
+		"Foo.jack:15:12: unexpected character '#'",
+		"Foo.jack:17:3: class variables must be declared before subroutines",
+		"Foo.jack:18:18: expected ')' but found '{'",
+	}
+	list, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("expected an ErrorList, got %v", err)
+	}
+	var got []string
+	for _, e := range list {
+		got = append(got, e.Error())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("errors:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// the rest of the class is still parsed
+	if class == nil || len(class.Vars) != 2 || len(class.Subroutines) != 2 {
+		t.Fatalf("class: %#v", class)
+	}
+	if n := len(class.Subroutines[1].Body.Statements); n != 2 {
+		t.Errorf("g has %d statements, want 2", n)
+	}
+}
+
+func TestParser_Extensions(t *testing.T) {
+	src := `class Foo {
+  function void f(Array a) {
+    var int i;
+    for (i = 0; i < 10; a[i] = i) {
+      if (i = 3) { continue; }
+      while (true) { break; }
+    }
+    for (; false;) { }
+    return;
+  }
+}
+`
+	tk := NewStringTokenizer("Foo.jack", src)
+	tk.Extensions = true
+	class, err := NewParser(tk).ParseClass()
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := class.Subroutines[0].Body.Statements
+	loop, ok := statements[0].(*ForStatement)
+	if !ok || loop.Init == nil || loop.Init.Name.Name != "i" || loop.Step == nil || loop.Step.Index == nil || len(loop.Body.Statements) != 2 {
+		t.Fatalf("for: %#v", statements[0])
+	}
+	if ifs := loop.Body.Statements[0].(*IfStatement); len(ifs.Then.Statements) != 1 {
+		t.Errorf("if: %#v", ifs)
+	} else if _, ok := ifs.Then.Statements[0].(*ContinueStatement); !ok {
+		t.Errorf("continue: %#v", ifs.Then.Statements[0])
+	}
+	if _, ok := loop.Body.Statements[1].(*WhileStatement).Body.Statements[0].(*BreakStatement); !ok {
+		t.Errorf("break: %#v", loop.Body.Statements[1])
+	}
+	if empty, ok := statements[1].(*ForStatement); !ok || empty.Init != nil || empty.Step != nil {
+		t.Errorf("for without initialization and step: %#v", statements[1])
+	}
+
+	var buf bytes.Buffer
+	if err := WriteXML(&buf, class); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<forStatement>\n          <keyword> for </keyword>\n          <symbol> ( </symbol>\n          <identifier> i </identifier>\n          <symbol> = </symbol>\n",
+		"<continueStatement>\n",
+		"<breakStatement>\n",
+		"<symbol> ( </symbol>\n          <symbol> ; </symbol>\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("XML without %q:\n%s", want, buf.String())
+		}
+	}
+
+	for _, test := range []struct {
+		src string
+		ext bool
+		err string
+	}{
+		{"class Foo { function void f() { break; return; } }", true, "T.jack:1:33: break is not in a loop"},
+		{"class Foo { function void f() { if (true) { continue; } return; } }", true, "T.jack:1:45: continue is not in a loop"},
+		{"class Foo { function void f() { for (;;) { } return; } }", true, "T.jack:1:39: expected expression but found ';'"},
+		{"class Foo { function void f() { for (i = 0; i < 3; i = i + 1) { let i = 1; } break; return; } }", false,
+			"T.jack:1:33: for is a language extension\nT.jack:1:78: break is a language extension"},
+	} {
+		tk := NewStringTokenizer("T.jack", test.src)
+		tk.Extensions = test.ext
+		_, err := NewParser(tk).ParseClass()
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%q: error %v, want %q", test.src, err, test.err)
+		}
+	}
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
-func TestTokenizer_HasMoreTokens(t *testing.T) {
-	tk := NewTokenizer(bytes.NewBufferString(`
+func TestTokenizer_Next(t *testing.T) {
+	tk := NewTokenizer("Foo.jack", bytes.NewBufferString(`
 	// comment1
 	/* Foo class */
 	class Foo {
@@ -19,18 +24,238 @@ func TestTokenizer_HasMoreTokens(t *testing.T) {
 	  }
 	}
 	`))
-	for tk.HasMoreTokens() {
-		t.Logf("Token: %#v, TokenType: %s", tk.token, tk.tokenType)
+	samples := []struct {
+		Kind  TokenType
+		Value string
+		Line  int
+		Col   int
+	}{
+		{TOKEN_KEYWORD, "class", 4, 2},
+		{TOKEN_IDENTIFIER, "Foo", 4, 8},
+		{TOKEN_SYMBOL, "{", 4, 12},
+		{TOKEN_KEYWORD, "function", 5, 4},
+	}
+	for _, s := range samples {
+		token, err := tk.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Kind != s.Kind || token.Value != s.Value || token.Line != s.Line || token.Col != s.Col {
+			t.Errorf("Sample: %#v, Token: %#v", s, token)
+		}
+	}
+	for {
+		token, err := tk.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch token.Kind {
+		case TOKEN_INT_CONST:
+			if token.Int != 100 || token.Text != "100" {
+				t.Errorf("Token: %#v", token)
+			}
+		case TOKEN_STRING_CONST:
+			if token.Value != "hello world" || token.Text != `"hello world"` || token.Line != 9 || token.Col != 14 {
+				t.Errorf("Token: %#v", token)
+			}
+		}
+	}
+}
+
+func TestTokenizer_Errors(t *testing.T) {
+	tk := NewTokenizer("Bad.jack", bytes.NewBufferString("let x = # 1;\nlet s = \"open;\ndo f();\n"))
+	var values []string
+	var errs []string
+	for {
+		token, err := tk.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		values = append(values, token.Value)
+	}
+	wantErrs := []string{
+		"Bad.jack:1:9: unexpected character '#'",
+		"Bad.jack:2:9: string constant not terminated before the end of the line",
+	}
+	if len(errs) != len(wantErrs) {
+		t.Fatalf("errors: %q", errs)
+	}
+	for i := range errs {
+		if errs[i] != wantErrs[i] {
+			t.Errorf("error %q, want %q", errs[i], wantErrs[i])
+		}
+	}
+	// scanning continues after each error
+	want := []string{"let", "x", "=", "1", ";", "let", "s", "=", "do", "f", "(", ")", ";"}
+	if len(values) != len(want) {
+		t.Fatalf("tokens: %q", values)
+	}
+	for i := range want {
+		if values[i] != want[i] {
+			t.Errorf("token %d: %q, want %q", i, values[i], want[i])
+		}
+	}
+}
+
+func TestTokenizer_Lexical(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		tokens []string // Kind:Value
+		errs   []string
+	}{
+		{"max int", "32767", []string{"integerConstant:32767"}, nil},
+		{"leading zeros", "007", []string{"integerConstant:7"}, nil},
+		{"int out of range", "32768 1", []string{"integerConstant:1"}, []string{"T.jack:1:1: integer constant 32768 out of range (0..32767)"}},
+		{"huge int", "99999999999999999999;", []string{"symbol:;"}, []string{"T.jack:1:1: integer constant 99999999999999999999 out of range (0..32767)"}},
+		{"int followed by letters", "12abc;", []string{"symbol:;"}, []string{"T.jack:1:1: invalid integer constant 12abc"}},
+		{"negative is a symbol", "-1", []string{"symbol:-", "integerConstant:1"}, nil},
+		{"empty string", `""`, []string{"stringConstant:"}, nil},
+		{"comment inside string", `"a // b /* c */"`, []string{"stringConstant:a // b /* c */"}, nil},
+		{"string across lines", "\"ab\ncd\";", []string{"identifier:cd"}, []string{
+			"T.jack:1:1: string constant not terminated before the end of the line",
+			"T.jack:2:3: string constant not terminated before the end of the line",
+		}},
+		{"string at end of input", `"ab`, nil, []string{"T.jack:1:1: string constant not terminated before the end of the line"}},
+		{"api comment", "/** Returns x.\n * @param x */ x", []string{"identifier:x"}, nil},
+		{"empty block comment", "/**/x", []string{"identifier:x"}, nil},
+		{"overlapping comment delimiters", "/*/ x */y", []string{"identifier:y"}, nil},
+		{"code after comment", "let /* a */ x = 1; /* b */ do f();", []string{
+			"keyword:let", "identifier:x", "symbol:=", "integerConstant:1", "symbol:;",
+			"keyword:do", "identifier:f", "symbol:(", "symbol:)", "symbol:;",
+		}, nil},
+		{"code after multi-line comment", "/* a\n b */ return;", []string{"keyword:return", "symbol:;"}, nil},
+		{"star slash outside a comment", "x */ y", []string{"identifier:x", "symbol:*", "symbol:/", "identifier:y"}, nil},
+		{"line comment at end of input", "x // y", []string{"identifier:x"}, nil},
+		{"unterminated comment", "x /* y", []string{"identifier:x"}, []string{"T.jack:1:3: comment not terminated"}},
+		{"keyword prefix", "classy this_", []string{"identifier:classy", "identifier:this_"}, nil},
+		{"unexpected character", "x $ y", []string{"identifier:x", "identifier:y"}, []string{"T.jack:1:3: unexpected character '$'"}},
+	}
+	for _, test := range tests {
+		tk := NewStringTokenizer("T.jack", test.src)
+		var tokens, errs []string
+		for {
+			token, err := tk.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			tokens = append(tokens, token.Kind.String()+":"+token.Value)
+		}
+		if strings.Join(tokens, " ") != strings.Join(test.tokens, " ") {
+			t.Errorf("%s: tokens %q, want %q", test.name, tokens, test.tokens)
+		}
+		if strings.Join(errs, "\n") != strings.Join(test.errs, "\n") {
+			t.Errorf("%s: errors %q, want %q", test.name, errs, test.errs)
+		}
+	}
+}
+
+func TestTokenizer_Comments(t *testing.T) {
+	tk := NewStringTokenizer("Foo.jack", "/** Foo.\r\n * bar */\nclass // end\r\n/* x */ Foo")
+	tk.Comments = true
+	var got []string
+	for {
+		token, err := tk.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d:%d %s %q", token.Line, token.Col, token.Kind, token.Text))
+	}
+	want := []string{
+		`1:1 comment "/** Foo.\r\n * bar */"`,
+		`3:1 keyword "class"`,
+		`3:7 comment "// end"`,
+		`4:1 comment "/* x */"`,
+		`4:9 identifier "Foo"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("tokens with comments:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
 	}
 }
 
-func TestTokenizer_HasMoreTokens2(t *testing.T) {
-	f, err := os.Open("test/ArrayTest/Main.jack")
+func TestTokenizer_Next2(t *testing.T) {
+	f, err := os.Open("test/Square/Main.jack")
 	if err != nil {
 		t.Fatal(err)
 	}
-	tk := NewTokenizer(f)
-	for tk.HasMoreTokens() {
-		t.Logf("Token: %#v, TokenType: %s", tk.token, tk.tokenType)
+	tk := NewTokenizer(f.Name(), f)
+	for {
+		token, err := tk.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("Token: %#v, TokenType: %s", token.Value, token.Kind)
+	}
+}
+
+// loadCorpus reads every .jack file under test.
+func loadCorpus(b *testing.B) map[string]string {
+	corpus := map[string]string{}
+	err := filepath.Walk("test", func(path string, info os.FileInfo, err error) error {
+		if err != nil || !strings.HasSuffix(path, ".jack") {
+			return err
+		}
+		src, err := ioutil.ReadFile(path)
+		corpus[path] = string(src)
+		return err
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if len(corpus) == 0 {
+		b.Fatal("no .jack files found")
 	}
+	return corpus
+}
+
+func benchmarkTokenizer(b *testing.B, newTokenizer func(file, src string) *Tokenizer) {
+	corpus := loadCorpus(b)
+	size := 0
+	for _, src := range corpus {
+		size += len(src)
+	}
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for file, src := range corpus {
+			tk := newTokenizer(file, src)
+			for {
+				_, err := tk.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkTokenizer(b *testing.B) {
+	benchmarkTokenizer(b, NewStringTokenizer)
+}
+
+func BenchmarkTokenizer_Reader(b *testing.B) {
+	benchmarkTokenizer(b, func(file, src string) *Tokenizer {
+		return NewTokenizer(file, strings.NewReader(src))
+	})
 }
@@ -0,0 +1,219 @@
+package main
+
+// Node is a node of the Jack syntax tree. Every node records the position
+// of its first token.
+type Node interface {
+	Position() Pos
+}
+
+// Position returns p, so that every node embedding a Pos is a Node.
+func (p Pos) Position() Pos {
+	return p
+}
+
+// Ident is a name as written in the source: a class, subroutine, variable
+// or type name. Types also use the keywords int, char, boolean and void.
+type Ident struct {
+	Pos
+	Name string
+}
+
+// Class is a whole .jack file.
+type Class struct {
+	Pos
+	Name        Ident
+	Vars        []*ClassVarDec
+	Subroutines []*SubroutineDec
+	End         Pos // closing brace
+}
+
+// ClassVarDec declares static or field variables.
+type ClassVarDec struct {
+	Pos
+	Kind  string // static or field
+	Type  Ident
+	Names []Ident
+}
+
+// SubroutineDec declares a constructor, function or method. Body is nil
+// for a signature without a body, such as the OS API's.
+type SubroutineDec struct {
+	Pos
+	Kind       string // constructor, function or method
+	ReturnType Ident
+	Name       Ident
+	Params     []*Param
+	Body       *SubroutineBody
+}
+
+type Param struct {
+	Type Ident
+	Name Ident
+}
+
+type SubroutineBody struct {
+	Pos
+	Vars       []*VarDec
+	Statements []Statement
+	End        Pos
+}
+
+// VarDec declares local variables.
+type VarDec struct {
+	Pos
+	Type  Ident
+	Names []Ident
+}
+
+// Block is a braced list of statements.
+type Block struct {
+	Pos
+	Statements []Statement
+	End        Pos
+}
+
+type Statement interface {
+	Node
+	statementNode()
+}
+
+// LetStatement assigns Value to Name, or to Name[Index] if Index is not
+// nil.
+type LetStatement struct {
+	Pos
+	Name  Ident
+	Index Expression
+	Value Expression
+}
+
+// IfStatement has a nil Else without an else clause.
+type IfStatement struct {
+	Pos
+	Cond Expression
+	Then *Block
+	Else *Block
+}
+
+type WhileStatement struct {
+	Pos
+	Cond Expression
+	Body *Block
+}
+
+// ForStatement runs Init, then Body followed by Step as long as Cond is
+// true. Init and Step are assignments written without let, either may be
+// nil. It is a language extension.
+type ForStatement struct {
+	Pos
+	Init *LetStatement
+	Cond Expression
+	Step *LetStatement
+	Body *Block
+}
+
+// BreakStatement leaves the innermost loop. It is a language extension.
+type BreakStatement struct {
+	Pos
+}
+
+// ContinueStatement goes on with the next iteration of the innermost
+// loop, after the Step of a for loop. It is a language extension.
+type ContinueStatement struct {
+	Pos
+}
+
+type DoStatement struct {
+	Pos
+	Call *CallExpr
+}
+
+// ReturnStatement has a nil Value in void subroutines.
+type ReturnStatement struct {
+	Pos
+	Value Expression
+}
+
+func (*LetStatement) statementNode()      {}
+func (*IfStatement) statementNode()       {}
+func (*WhileStatement) statementNode()    {}
+func (*ForStatement) statementNode()      {}
+func (*BreakStatement) statementNode()    {}
+func (*ContinueStatement) statementNode() {}
+func (*DoStatement) statementNode()       {}
+func (*ReturnStatement) statementNode()   {}
+
+type Expression interface {
+	Node
+	expressionNode()
+}
+
+type IntegerConstant struct {
+	Pos
+	Value int
+}
+
+type StringConstant struct {
+	Pos
+	Value string
+}
+
+// KeywordConstant is true, false, null or this.
+type KeywordConstant struct {
+	Pos
+	Value string
+}
+
+type VarExpr struct {
+	Pos
+	Name string
+}
+
+// IndexExpr is an array access Name[Index].
+type IndexExpr struct {
+	Pos
+	Name  Ident
+	Index Expression
+}
+
+// CallExpr calls Name(Args) or Receiver.Name(Args); Receiver is a class
+// or variable name, or nil.
+type CallExpr struct {
+	Pos
+	Receiver *Ident
+	Name     Ident
+	Args     []Expression
+}
+
+// UnaryExpr applies - or ~ to X.
+type UnaryExpr struct {
+	Pos
+	Op string
+	X  Expression
+}
+
+// ParenExpr is a parenthesized expression.
+type ParenExpr struct {
+	Pos
+	X Expression
+}
+
+// BinaryExpr is X Op Y. Jack has no operator precedence: an expression
+// is evaluated from left to right, so Y is never a BinaryExpr and Pos is
+// the position of X.
+type BinaryExpr struct {
+	Pos
+	Op    string
+	OpPos Pos
+	X     Expression
+	Y     Expression
+}
+
+func (*IntegerConstant) expressionNode() {}
+func (*StringConstant) expressionNode()  {}
+func (*KeywordConstant) expressionNode() {}
+func (*VarExpr) expressionNode()         {}
+func (*IndexExpr) expressionNode()       {}
+func (*CallExpr) expressionNode()        {}
+func (*UnaryExpr) expressionNode()       {}
+func (*ParenExpr) expressionNode()       {}
+func (*BinaryExpr) expressionNode()      {}
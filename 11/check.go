@@ -0,0 +1,436 @@
+package main
+
+import "fmt"
+
+// Types are represented by their names: int, char, boolean, void or a
+// class name. typeAny is the type of values the checker knows nothing
+// about, such as array elements and results of calls into classes outside
+// the program; it is compatible with every type.
+const (
+	typeAny  = ""
+	typeNull = "null"
+)
+
+func isPrimitive(t string) bool {
+	return t == "int" || t == "char" || t == "boolean"
+}
+
+func isNumeric(t string) bool {
+	return t == typeAny || t == "int" || t == "char"
+}
+
+// assignable reports whether a value of type from can be stored in a
+// variable of type to. Jack is loosely typed: int and char mix freely,
+// null is any object, and Array doubles as a raw address that converts
+// to and from int and every class.
+func assignable(from, to string) bool {
+	switch {
+	case from == typeAny || to == typeAny || from == to:
+		return true
+	case isNumeric(from) && isNumeric(to):
+		return true
+	case from == typeNull:
+		return !isPrimitive(to)
+	case from == "Array":
+		return to != "boolean"
+	case to == "Array":
+		return from != "boolean"
+	}
+	return false
+}
+
+// indexable reports whether a variable of type t can be indexed.
+func indexable(t string) bool {
+	return t == "Array" || t == typeAny
+}
+
+type symbol struct {
+	Kind string // static, field, arg or local
+	Type string
+	Pos  Pos
+}
+
+type classInfo struct {
+	class *Class
+	vars  map[string]symbol
+}
+
+// checker runs the semantic analysis of a program.
+type checker struct {
+	index   *Index
+	classes map[string]*classInfo
+	errs    ErrorList
+
+	class  *classInfo
+	sub    *SubroutineDec
+	locals map[string]symbol
+}
+
+// Check analyses the classes of a program before any code is generated.
+// It reports undeclared identifiers, type errors, calls with the wrong
+// number of arguments and subroutines that do not end in a return. Calls
+// are resolved against index, which must include the classes. The errors
+// are sorted by position.
+func Check(index *Index, classes []*Class) []error {
+	c := &checker{index: index, classes: map[string]*classInfo{}}
+	for _, class := range classes {
+		c.declareClass(class)
+	}
+	for _, class := range classes {
+		if c.classes[class.Name.Name].class == class {
+			c.checkClass(c.classes[class.Name.Name])
+		}
+	}
+	c.errs.Sort()
+	return c.errs
+}
+
+func (c *checker) errorf(pos Pos, format string, a ...interface{}) {
+	c.errs = append(c.errs, &Error{Pos: pos, Msg: fmt.Sprintf(format, a...)})
+}
+
+func (c *checker) declareClass(class *Class) {
+	name := class.Name.Name
+	if prev, ok := c.classes[name]; ok {
+		c.errorf(class.Name.Pos, "class %s redeclared, previous declaration at %s", name, prev.class.Name.Pos)
+		return
+	}
+	info := &classInfo{class: class, vars: map[string]symbol{}}
+	c.classes[name] = info
+	for _, dec := range class.Vars {
+		for _, id := range dec.Names {
+			if prev, ok := info.vars[id.Name]; ok {
+				c.errorf(id.Pos, "%s redeclared, previous declaration at %s", id.Name, prev.Pos)
+				continue
+			}
+			info.vars[id.Name] = symbol{Kind: dec.Kind, Type: dec.Type.Name, Pos: id.Pos}
+		}
+	}
+	subroutines := map[string]*SubroutineDec{}
+	for _, dec := range class.Subroutines {
+		if prev, ok := subroutines[dec.Name.Name]; ok {
+			c.errorf(dec.Name.Pos, "%s.%s redeclared, previous declaration at %s", name, dec.Name.Name, prev.Name.Pos)
+			continue
+		}
+		subroutines[dec.Name.Name] = dec
+	}
+}
+
+// checkType reports a type that cannot be used for a variable.
+func (c *checker) checkType(id Ident) {
+	switch {
+	case id.Name == "void":
+		c.errorf(id.Pos, "void is not a variable type")
+	case !isPrimitive(id.Name) && !c.index.Known(id.Name):
+		c.errorf(id.Pos, "undefined: %s", id.Name)
+	}
+}
+
+func (c *checker) checkClass(info *classInfo) {
+	c.class = info
+	for _, dec := range info.class.Vars {
+		c.checkType(dec.Type)
+	}
+	for _, dec := range info.class.Subroutines {
+		c.checkSubroutine(dec)
+	}
+}
+
+func (c *checker) checkSubroutine(dec *SubroutineDec) {
+	c.sub = dec
+	c.locals = map[string]symbol{}
+	if dec.Kind == "constructor" && dec.ReturnType.Name != c.class.class.Name.Name {
+		c.errorf(dec.ReturnType.Pos, "constructor %s must return %s", dec.Name.Name, c.class.class.Name.Name)
+	} else if dec.ReturnType.Name != "void" {
+		c.checkType(dec.ReturnType)
+	}
+	declare := func(kind string, typ, id Ident) {
+		c.checkType(typ)
+		if prev, ok := c.locals[id.Name]; ok {
+			c.errorf(id.Pos, "%s redeclared, previous declaration at %s", id.Name, prev.Pos)
+			return
+		}
+		c.locals[id.Name] = symbol{Kind: kind, Type: typ.Name, Pos: id.Pos}
+	}
+	for _, param := range dec.Params {
+		declare("arg", param.Type, param.Name)
+	}
+	for _, v := range dec.Body.Vars {
+		for _, id := range v.Names {
+			declare("local", v.Type, id)
+		}
+	}
+	c.checkStatements(dec.Body.Statements)
+	if !returns(dec.Body.Statements) {
+		c.errorf(dec.Body.End, "missing return at end of %s", dec.Name.Name)
+	}
+}
+
+// returns reports whether every path through statements ends in a
+// return statement.
+func returns(statements []Statement) bool {
+	if len(statements) == 0 {
+		return false
+	}
+	switch s := statements[len(statements)-1].(type) {
+	case *ReturnStatement:
+		return true
+	case *IfStatement:
+		return s.Else != nil && returns(s.Then.Statements) && returns(s.Else.Statements)
+	}
+	return false
+}
+
+// lookup finds a variable in the current subroutine or class.
+func (c *checker) lookup(id Ident) (symbol, bool) {
+	if s, ok := c.locals[id.Name]; ok {
+		return s, true
+	}
+	s, ok := c.class.vars[id.Name]
+	if !ok {
+		return s, false
+	}
+	if s.Kind == "field" && c.sub.Kind == "function" {
+		c.errorf(id.Pos, "field %s cannot be used in function %s", id.Name, c.sub.Name.Name)
+	}
+	return s, true
+}
+
+// variable looks up a variable and reports it if it is undeclared.
+func (c *checker) variable(id Ident) (symbol, bool) {
+	s, ok := c.lookup(id)
+	if !ok {
+		c.errorf(id.Pos, "undefined: %s", id.Name)
+	}
+	return s, ok
+}
+
+func (c *checker) checkStatements(statements []Statement) {
+	for _, s := range statements {
+		switch s := s.(type) {
+		case *LetStatement:
+			c.checkLet(s)
+		case *IfStatement:
+			c.checkCondition(s.Cond)
+			c.checkStatements(s.Then.Statements)
+			if s.Else != nil {
+				c.checkStatements(s.Else.Statements)
+			}
+		case *WhileStatement:
+			c.checkCondition(s.Cond)
+			c.checkStatements(s.Body.Statements)
+		case *ForStatement:
+			if s.Init != nil {
+				c.checkLet(s.Init)
+			}
+			c.checkCondition(s.Cond)
+			if s.Step != nil {
+				c.checkLet(s.Step)
+			}
+			c.checkStatements(s.Body.Statements)
+		case *DoStatement:
+			c.checkCall(s.Call)
+		case *ReturnStatement:
+			c.checkReturn(s)
+		}
+	}
+}
+
+func (c *checker) checkLet(s *LetStatement) {
+	v, ok := c.variable(s.Name)
+	target := v.Type
+	if s.Index != nil {
+		if ok && !indexable(v.Type) {
+			c.errorf(s.Name.Pos, "cannot index %s (type %s)", s.Name.Name, v.Type)
+		}
+		c.checkIndex(s.Index)
+		target = typeAny
+	}
+	t := c.checkExpression(s.Value)
+	if ok && !assignable(t, target) {
+		c.errorf(s.Value.Position(), "cannot assign %s to %s (type %s)", t, s.Name.Name, target)
+	}
+}
+
+func (c *checker) checkReturn(s *ReturnStatement) {
+	want := c.sub.ReturnType.Name
+	if s.Value == nil {
+		if want != "void" {
+			c.errorf(s.Pos, "missing return value in %s (returns %s)", c.sub.Name.Name, want)
+		}
+		return
+	}
+	t := c.checkExpression(s.Value)
+	if want == "void" {
+		c.errorf(s.Value.Position(), "void %s %s cannot return a value", c.sub.Kind, c.sub.Name.Name)
+		return
+	}
+	if c.sub.Kind == "constructor" {
+		if k, ok := s.Value.(*KeywordConstant); !ok || k.Value != "this" {
+			c.errorf(s.Value.Position(), "constructor %s must return this", c.sub.Name.Name)
+		}
+		return
+	}
+	if !assignable(t, want) {
+		c.errorf(s.Value.Position(), "cannot return %s from %s (returns %s)", t, c.sub.Name.Name, want)
+	}
+}
+
+func (c *checker) checkCondition(e Expression) {
+	if t := c.checkExpression(e); t != "boolean" && t != typeAny {
+		c.errorf(e.Position(), "condition must be boolean, not %s", t)
+	}
+}
+
+func (c *checker) checkIndex(e Expression) {
+	if t := c.checkExpression(e); !isNumeric(t) {
+		c.errorf(e.Position(), "array index must be int, not %s", t)
+	}
+}
+
+// checkExpression returns the type of e.
+func (c *checker) checkExpression(e Expression) string {
+	switch e := e.(type) {
+	case *IntegerConstant:
+		return "int"
+	case *StringConstant:
+		return "String"
+	case *KeywordConstant:
+		switch e.Value {
+		case "true", "false":
+			return "boolean"
+		case "null":
+			return typeNull
+		}
+		if c.sub.Kind == "function" {
+			c.errorf(e.Pos, "this cannot be used in function %s", c.sub.Name.Name)
+		}
+		return c.class.class.Name.Name
+	case *VarExpr:
+		v, _ := c.variable(Ident{Pos: e.Pos, Name: e.Name})
+		return v.Type
+	case *IndexExpr:
+		if v, ok := c.variable(e.Name); ok && !indexable(v.Type) {
+			c.errorf(e.Pos, "cannot index %s (type %s)", e.Name.Name, v.Type)
+		}
+		c.checkIndex(e.Index)
+		return typeAny
+	case *CallExpr:
+		t := c.checkCall(e)
+		if t == "void" {
+			c.errorf(e.Pos, "%s() returns no value", e.Name.Name)
+			return typeAny
+		}
+		return t
+	case *ParenExpr:
+		return c.checkExpression(e.X)
+	case *UnaryExpr:
+		t := c.checkExpression(e.X)
+		if e.Op == "~" && t == "boolean" {
+			return t
+		}
+		if !isNumeric(t) {
+			c.errorf(e.Pos, "operator %s not defined on %s", e.Op, t)
+		}
+		return "int"
+	case *BinaryExpr:
+		x, y := c.checkExpression(e.X), c.checkExpression(e.Y)
+		switch e.Op {
+		case "=":
+			if !assignable(x, y) && !assignable(y, x) {
+				c.errorf(e.OpPos, "cannot compare %s and %s", x, y)
+			}
+			return "boolean"
+		case "&", "|":
+			if x == "boolean" && y == "boolean" {
+				return "boolean"
+			}
+			if (x == "boolean" && y == typeAny) || (x == typeAny && y == "boolean") {
+				return "boolean"
+			}
+		}
+		for _, t := range []string{x, y} {
+			if !isNumeric(t) {
+				c.errorf(e.OpPos, "operator %s not defined on %s", e.Op, t)
+				break
+			}
+		}
+		if e.Op == "<" || e.Op == ">" {
+			return "boolean"
+		}
+		return "int"
+	}
+	return typeAny
+}
+
+// checkCall checks a call and returns the type of its result.
+func (c *checker) checkCall(call *CallExpr) string {
+	className := c.class.class.Name.Name
+	method := false // the call passes an object
+	if call.Receiver == nil {
+		method = true
+	} else if v, ok := c.lookup(*call.Receiver); ok {
+		if isPrimitive(v.Type) {
+			c.errorf(call.Receiver.Pos, "cannot call %s on %s (type %s)", call.Name.Name, call.Receiver.Name, v.Type)
+			c.checkArgs(call, nil)
+			return typeAny
+		}
+		className, method = v.Type, true
+	} else {
+		className = call.Receiver.Name
+		if !c.index.Known(className) {
+			c.errorf(call.Receiver.Pos, "undefined: %s", className)
+			c.checkArgs(call, nil)
+			return typeAny
+		}
+	}
+
+	ci, ok := c.index.Classes[className]
+	if !ok {
+		// in the rest of the program
+		c.checkArgs(call, nil)
+		return typeAny
+	}
+	dec, ok := ci.Subroutines[call.Name.Name]
+	if !ok {
+		c.errorf(call.Name.Pos, "undefined: %s.%s", className, call.Name.Name)
+		c.checkArgs(call, nil)
+		return typeAny
+	}
+
+	switch {
+	case call.Receiver == nil && dec.Kind == "method" && c.sub.Kind == "function":
+		c.errorf(call.Name.Pos, "method %s cannot be called from function %s", dec.Name.Name, c.sub.Name.Name)
+	case call.Receiver != nil && method && dec.Kind != "method":
+		c.errorf(call.Name.Pos, "%s %s.%s called as a method", dec.Kind, className, dec.Name.Name)
+	case call.Receiver != nil && !method && dec.Kind == "method":
+		c.errorf(call.Name.Pos, "method %s.%s called without an object", className, dec.Name.Name)
+	}
+	c.checkArgs(call, dec)
+	return dec.ReturnType.Name
+}
+
+// checkArgs checks the arguments of a call to dec, or only the argument
+// expressions if dec is unknown.
+func (c *checker) checkArgs(call *CallExpr, dec *SubroutineDec) {
+	var types []string
+	for _, arg := range call.Args {
+		types = append(types, c.checkExpression(arg))
+	}
+	if dec == nil {
+		return
+	}
+	if len(call.Args) != len(dec.Params) {
+		what := "not enough"
+		if len(call.Args) > len(dec.Params) {
+			what = "too many"
+		}
+		c.errorf(call.Name.Pos, "%s arguments in call to %s: have %d, want %d", what, dec.Name.Name, len(call.Args), len(dec.Params))
+		return
+	}
+	for i, param := range dec.Params {
+		if !assignable(types[i], param.Type.Name) {
+			c.errorf(call.Args[i].Position(), "cannot use %s as %s in argument %d to %s", types[i], param.Type.Name, i+1, dec.Name.Name)
+		}
+	}
+}
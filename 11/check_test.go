@@ -0,0 +1,130 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func checkSources(t *testing.T, sources ...string) []string {
+	var classes []*Class
+	for i, src := range sources {
+		class, err := NewParser(NewStringTokenizer(string(rune('A'+i))+".jack", src)).ParseClass()
+		if err != nil {
+			t.Fatal(err)
+		}
+		classes = append(classes, class)
+	}
+	var errs []string
+	for _, err := range Check(NewIndex(classes), classes) {
+		errs = append(errs, err.Error())
+	}
+	return errs
+}
+
+func TestCheck(t *testing.T) {
+	lib := `class Lib {
+  field int n;
+  constructor Lib new() { return this; }
+  method int get() { return n; }
+  function void f(int a, boolean b) { return; }
+}`
+	tests := []struct {
+		name string
+		body string // body of Main.main
+		errs []string
+	}{
+		{"ok", `var Lib l; var int i; var char c; var Array a;
+let l = Lib.new(); let i = l.get() + c; let a = Array.new(3); let a[i] = l;
+do Lib.f(i, i < 3); do Output.printInt(i); return;`, nil},
+		{"undefined variable", `let x = 1; return;`, []string{"A.jack:3:5: undefined: x"}},
+		{"boolean to int", `var int i; let i = true; return;`, []string{"A.jack:3:20: cannot assign boolean to i (type int)"}},
+		{"int to object", `var Lib l; let l = 1; return;`, []string{"A.jack:3:20: cannot assign int to l (type Lib)"}},
+		{"null to object", `var Lib l; let l = null; return;`, nil},
+		{"unknown method", `var Lib l; do l.put(); return;`, []string{"A.jack:3:17: undefined: Lib.put"}},
+		{"function as method", `var Lib l; do l.f(1, true); return;`, []string{"A.jack:3:17: function Lib.f called as a method"}},
+		{"method without object", `do Lib.get(); return;`, []string{"A.jack:3:8: method Lib.get called without an object"}},
+		{"arity", `do Lib.f(1); return;`, []string{"A.jack:3:8: not enough arguments in call to f: have 1, want 2"}},
+		{"argument type", `do Lib.f(true, 1); return;`, []string{
+			"A.jack:3:10: cannot use boolean as int in argument 1 to f",
+			"A.jack:3:16: cannot use int as boolean in argument 2 to f",
+		}},
+		{"void value", `var int i; let i = Lib.f(1, true); return;`, []string{"A.jack:3:20: f() returns no value"}},
+		{"return value from void", `return 1;`, []string{"A.jack:3:8: void function main cannot return a value"}},
+		{"missing return", `var int i; let i = 1;`, []string{"A.jack:4:1: missing return at end of main"}},
+		{"missing return after if", `if (true) { return; }`, []string{"A.jack:4:1: missing return at end of main"}},
+		{"return in both branches", `if (true) { return; } else { return; }`, nil},
+		{"condition", `while (1) { } return;`, []string{"A.jack:3:8: condition must be boolean, not int"}},
+		{"operator", `var int i; let i = 1 + true; return;`, []string{"A.jack:3:22: operator + not defined on boolean"}},
+		{"index non array", `var int i; let i[0] = 1; return;`, []string{"A.jack:3:16: cannot index i (type int)"}},
+		{"call on int", `var int i; do i.f(); return;`, []string{"A.jack:3:15: cannot call f on i (type int)"}},
+		{"this in function", `var Main m; let m = this; return;`, []string{"A.jack:3:21: this cannot be used in function main"}},
+		{"undefined class", `do Foo.bar(); return;`, []string{"A.jack:3:4: undefined: Foo"}},
+		{"undefined type", `var Foo f; return;`, []string{"A.jack:3:5: undefined: Foo"}},
+		{"OS arity", `do Output.printInt(); return;`, []string{"A.jack:3:11: not enough arguments in call to printInt: have 0, want 1"}},
+		{"OS method without object", `var int n; let n = String.length(); return;`, []string{"A.jack:3:27: method String.length called without an object"}},
+		{"OS return type", `var int i; let i = Keyboard.readLine("?"); return;`, []string{"A.jack:3:20: cannot assign String to i (type int)"}},
+		{"OS method", `var String s; let s = "ab"; let s = s.appendChar(99); do s.dispose(); return;`, nil},
+		{"redeclared", `var int i, i; return;`, []string{"A.jack:3:12: i redeclared, previous declaration at A.jack:3:9"}},
+	}
+	for _, test := range tests {
+		main := "class Main {\n  function void main() {\n" + test.body + "\n}\n}\n"
+		errs := checkSources(t, main, lib)
+		if strings.Join(errs, "\n") != strings.Join(test.errs, "\n") {
+			t.Errorf("%s: errors\n%s\nwant\n%s", test.name, strings.Join(errs, "\n"), strings.Join(test.errs, "\n"))
+		}
+	}
+}
+
+func TestCheck_Class(t *testing.T) {
+	errs := checkSources(t, `class Point {
+  field int x;
+  static int count;
+  constructor Point new() { let x = 0; return this; }
+  function int count() { return x; }
+  method void move() { do count(); do move(); return; }
+  function void reset() { do move(); return; }
+  constructor int make() { return 1; }
+}`)
+	want := []string{
+		"A.jack:5:33: field x cannot be used in function count",
+		"A.jack:7:30: method move cannot be called from function reset",
+		"A.jack:8:15: constructor make must return Point",
+		"A.jack:8:35: constructor make must return this",
+	}
+	if strings.Join(errs, "\n") != strings.Join(want, "\n") {
+		t.Errorf("errors\n%s\nwant\n%s", strings.Join(errs, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCheck_Programs(t *testing.T) {
+	dirs, err := filepath.Glob("test/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the programs of test/ext use the language extensions
+	ext, err := filepath.Glob("test/ext/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range append(dirs, ext...) {
+		if dir == filepath.Join("test", "ext") {
+			continue
+		}
+		files, err := findJackFiles(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var classes []*Class
+		for _, path := range files {
+			class, err := parseFile(path, strings.HasPrefix(dir, filepath.Join("test", "ext")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			classes = append(classes, class)
+		}
+		for _, err := range Check(NewIndex(classes), classes) {
+			t.Errorf("%s: %v", dir, err)
+		}
+	}
+}
@@ -1,293 +1,126 @@
 package main
 
 import (
-	"io"
-	"bufio"
+	"bytes"
 	"fmt"
-	"regexp"
-	"log"
-	"strings"
-	"strconv"
-	"os"
+	"io"
 )
 
 var (
-	tagIdentifier = "identifier"
-	regexTag = regexp.MustCompile(`^<(.*?)> (.*) </.*>$`)
 	kindToSegment = map[string]string{
-		"field": "this",
+		"field":  "this",
 		"static": "static",
-		"local": "local",
-		"arg": "argument",
+		"local":  "local",
+		"arg":    "argument",
 	}
 )
 
+// Compiler walks the syntax tree of a class and writes its VM code.
+//
+// With Debug, it also writes the debug information of the class as
+// comments, which the VM tools ignore:
+//
+//	// @source /path/Main.jack      the source of the class, first
+//	// @kind method                  the kind of the subroutine
+//	// @lines 10 14                  its lines, from its declaration to
+//	                                 its closing brace
+//	// @var static 0 int count       a variable: segment, index, type, name
+//	// @line 12                      the commands up to the next @line
+//	                                 are those of the statement at line 12
+//
+// The variables of the class come after @source, the kind and the
+// variables of a subroutine after its function command.
 type Compiler struct {
-	r io.Reader
-	w io.Writer
-	s *bufio.Scanner
-	line string
-	tag string
-	value string
-	indent int
+	Debug  bool
+	Source string // path of the source in the debug information
 
 	symbolTable *SymbolTable
-	vmWriter *VMWriter
+	vmWriter    *VMWriter
+	index       *Index
 
-	className string
+	className      string
 	subroutineName string
 	subroutineKind string
-	expressionListCount int
-	labelCount int
+	subroutineLine int // of the declaration
+	labelCount     int
+	loops          []loopLabels // innermost last
 }
 
-func NewCompiler(r io.Reader, w io.Writer, ww io.Writer) *Compiler {
-	c := &Compiler{
-		r: r,
-		w: w,
-		s: bufio.NewScanner(r),
-		symbolTable: NewSymbolTable(),
-		vmWriter: NewVMWriter(ww),
-	}
+// loopLabels are the labels that continue and break statements go to.
+type loopLabels struct {
+	next string
+	end  string
+}
 
-	// create subroutine symbol table
-	file := r.(*os.File)
-	s := bufio.NewScanner(file)
-	for s.Scan() {
-		line := s.Text()
-		if strings.Index(line, "<keyword>") > -1 {
-			// subroutine kind
-			kind := regexTag.FindAllStringSubmatch(line, -1)[0][2]
-			if kind == "method" || kind == "constructor" || kind == "function" {
-				// subroutine return type
-				s.Scan()
-				line = s.Text()
-				typeName := regexTag.FindAllStringSubmatch(line, -1)[0][2]
-				// subroutine name
-				s.Scan()
-				line = s.Text()
-				name := regexTag.FindAllStringSubmatch(line, -1)[0][2]
-				// set symbol table
-				c.symbolTable.Define(name, typeName, kind)
-			}
-		}
+// NewCompiler returns a compiler resolving calls with index. A nil index
+// only knows the class being compiled and the OS.
+func NewCompiler(w io.Writer, index *Index) *Compiler {
+	return &Compiler{
+		symbolTable: NewSymbolTable(),
+		vmWriter:    NewVMWriter(w),
+		index:       index,
 	}
-	file.Seek(0, 0)
-
-	return c
 }
 
-func (c *Compiler) CompileClass() {
-	// <tokens>
-	c.Scan()
-	c.LineMust("<tokens>")
-	c.Println("<class>")
-	c.indent += 1
-
-	// class
-	c.Scan()
-	c.ValueMust("class")
-	c.PrintLine()
-
-	// className
-	c.Scan()
-	c.TagMust(tagIdentifier)
-	c.className = c.value
-	c.PrintLine()
-
-	// {
-	c.Scan()
-	c.ValueMust("{")
-	c.PrintLine()
-
-	// classVarDec*
-	c.Scan()
-	for c.TagIs("keyword") && c.ValueIs("static", "field") {
-		c.CompileClassVarDec()
+func (c *Compiler) CompileClass(class *Class) {
+	c.className = class.Name.Name
+	if c.index == nil {
+		c.index = NewIndex([]*Class{class})
+		c.index.Open = true
 	}
 
-	// subroutineDec*
-	for c.TagIs("keyword") && c.ValueIs("constructor", "function", "method") {
-		c.CompileSubroutineDec()
+	for _, dec := range class.Vars {
+		c.CompileClassVarDec(dec)
+	}
+	if c.Debug {
+		source := c.Source
+		if source == "" {
+			source = class.Pos.File
+		}
+		c.vmWriter.WriteComment("@source " + source)
+		c.writeVars("static", "field")
+	}
+	for _, dec := range class.Subroutines {
+		c.CompileSubroutineDec(dec)
 	}
-
-	// }
-	c.ValueMust("}")
-	c.PrintLine()
-
-	// close class
-	c.indent -= 1
-	c.Println("</class>")
 }
 
-func (c *Compiler) CompileClassVarDec() {
-	// classVarDec
-	c.Println("<classVarDec>")
-	c.indent += 1
-
-	// static | field
-	c.TagMust("keyword")
-	c.ValueMust("static", "field")
-	c.PrintLine()
-	kind := c.value
-
-	// type
-	c.Scan()
-	c.MustType()
-	c.PrintLine()
-	typeName := c.value
-	
-	// varName
-	c.Scan()
-	c.TagMust(tagIdentifier)
-	c.PrintLine()
-	name := c.value
-
-	c.symbolTable.Define(name, typeName, kind)
-	
-	// (, varName)*
-	c.Scan()
-	for c.ValueIs(",") {
-		// ,
-		c.PrintLine()
-		c.Scan()
-		// varName
-		c.TagMust(tagIdentifier)
-		c.PrintLine()
-		name = c.value
-		c.Scan()
-
-		c.symbolTable.Define(name, typeName, kind)
+func (c *Compiler) CompileClassVarDec(dec *ClassVarDec) {
+	for _, name := range dec.Names {
+		c.symbolTable.Define(name.Name, dec.Type.Name, dec.Kind)
 	}
-	
-	// ;
-	c.ValueMust(";")
-	c.PrintLine()
-	c.Scan()
-
-	// close classVarDec
-	c.indent -= 1
-	c.Println("</classVarDec>")
 }
 
-func (c *Compiler) CompileSubroutineDec() {
-	// subroutineDec
-	c.Println("<subroutineDec>")
-	c.indent += 1
-
+func (c *Compiler) CompileSubroutineDec(dec *SubroutineDec) {
 	c.symbolTable.StartSubroutine()
+	c.subroutineKind = dec.Kind
+	c.subroutineLine = dec.Pos.Line
+	c.subroutineName = dec.Name.Name
 
-	// constructor, function, method
-	c.ValueMust("constructor", "function", "method")
-	c.PrintLine()
-	c.subroutineKind = c.value
-	c.Scan()
-	
-	// void | type
-	if !c.ValueIs("void") && !c.IsType() {
-		log.Fatalf("invalid type: %#v", c)
-	}
-	c.PrintLine()
-	c.Scan()
-
-	// subroutineName
-	c.TagMust(tagIdentifier)
-	c.PrintLine()
-	c.subroutineName = c.value
-	c.Scan()
-
-	// (
-	c.ValueMust("(")
-	c.PrintLine()
-	c.Scan()
-
-	// parameterList
-	c.CompileParameterList()
-
-	// )
-	c.ValueMust(")")
-	c.PrintLine()
-	c.Scan()
-
-	// subroutineBody
-	c.CompileSubroutineBody()
-
-	// close subroutineDec
-	c.indent -= 1
-	c.Println("</subroutineDec>")
+	c.CompileParameterList(dec.Params)
+	c.CompileSubroutineBody(dec.Body)
 }
 
-// ( (type varName) ((, type varName))* )?
-func (c *Compiler) CompileParameterList() {
-	// parameterList
-	c.Println("<parameterList>")
-	c.indent += 1
-
+func (c *Compiler) CompileParameterList(params []*Param) {
 	if c.subroutineKind == "method" {
 		c.symbolTable.Define("this", c.className, "arg")
 	}
-
-	// empty parameterList
-	if c.IsType() {
-
-		// type
-		c.MustType()
-		c.PrintLine()
-		typeName := c.value
-		c.Scan()
-
-		// varName
-		c.TagMust(tagIdentifier)
-		c.PrintLine()
-		name := c.value
-		c.Scan()
-
-		c.symbolTable.Define(name, typeName, "arg")
-
-		// (, type varName)*
-		for c.ValueIs(",") {
-			// ,
-			c.PrintLine()
-			c.Scan()
-
-			// type
-			c.MustType()
-			c.PrintLine()
-			typeName = c.value
-			c.Scan()
-
-			// varName
-			c.TagMust(tagIdentifier)
-			c.PrintLine()
-			name = c.value
-			c.symbolTable.Define(name, typeName, "arg")
-			c.Scan()
-		}
+	for _, param := range params {
+		c.symbolTable.Define(param.Name.Name, param.Type.Name, "arg")
 	}
-
-	// close parameterList
-	c.indent -=1
-	c.Println("</parameterList>")
 }
 
-// { varDec* statements }
-func (c *Compiler) CompileSubroutineBody() {
-
-	// subroutineBody
-	c.Println("<subroutineBody>")
-	c.indent += 1
-
-	// {
-	c.ValueMust("{")
-	c.PrintLine()
-	c.Scan()
-
-	// varDec*
-	for c.ValueIs("var") {
-		c.CompileVarDec()
+func (c *Compiler) CompileSubroutineBody(body *SubroutineBody) {
+	for _, dec := range body.Vars {
+		c.CompileVarDec(dec)
 	}
 
 	c.vmWriter.WriteFunction(fmt.Sprintf("%s.%s", c.className, c.subroutineName), c.symbolTable.VarCount("local"))
+	if c.Debug {
+		c.vmWriter.WriteComment("@kind " + c.subroutineKind)
+		c.vmWriter.WriteComment(fmt.Sprintf("@lines %d %d", c.subroutineLine, body.End.Line))
+		c.writeVars("arg", "local")
+	}
 
 	if c.subroutineKind == "method" {
 		// read this
@@ -303,208 +136,90 @@ func (c *Compiler) CompileSubroutineBody() {
 		c.vmWriter.WritePop("pointer", 0)
 	}
 
-	// statements
-	c.CompileStatements()
-
-	// }
-	c.ValueMust("}")
-	c.PrintLine()
-	c.Scan()
-
-	// close subroutineBody
-	c.indent -=1
-	c.Println("</subroutineBody>")
+	c.CompileStatements(body.Statements)
 }
 
-// var type varName (, varName)* ;
-func (c *Compiler) CompileVarDec() {
-	// varDec
-	c.Println("<varDec>")
-	c.indent += 1
-
-	// var
-	c.ValueMust("var")
-	c.PrintLine()
-	c.Scan()
-
-	// type
-	c.MustType()
-	c.PrintLine()
-	typeName := c.value
-	c.Scan()
-
-	// varName
-	c.TagMust(tagIdentifier)
-	c.PrintLine()
-	name := c.value
-	c.Scan()
-
-	c.symbolTable.Define(name, typeName, "local")
-
-	// (, varName)*
-	for c.ValueIs(",") {
-		// ,
-		c.PrintLine()
-		c.Scan()
-		// varName
-		c.TagMust(tagIdentifier)
-		c.PrintLine()
-		name = c.value
-		c.symbolTable.Define(name, typeName, "local")
-		c.Scan()
+func (c *Compiler) CompileVarDec(dec *VarDec) {
+	for _, name := range dec.Names {
+		c.symbolTable.Define(name.Name, dec.Type.Name, "local")
 	}
-
-	// ;
-	c.ValueMust(";")
-	c.PrintLine()
-	c.Scan()
-
-	// close varDec
-	c.indent -= 1
-	c.Println("</varDec>")
 }
 
-func (c *Compiler) CompileStatements() {
-	// statements
-	c.Println("<statements>")
-	c.indent += 1
-
-	// statement*
-	for c.ValueIs("let", "if", "while", "do", "return") {
-		switch c.Value() {
-		case "let":
-			c.CompileLetStatement()
-		case "if":
-			c.CompileIfStatement()
-		case "while":
-			c.CompileWhileStatement()
-		case "do":
-			c.CompileDoStatement()
-		case "return":
-			c.CompileReturnStatement()
+// writeVars writes the debug information of the variables of kinds.
+func (c *Compiler) writeVars(kinds ...string) {
+	for _, kind := range kinds {
+		for _, e := range c.symbolTable.getList(kind) {
+			c.vmWriter.WriteComment(fmt.Sprintf("@var %s %d %s %s", kindToSegment[kind], e.number, e.typeName, e.name))
 		}
 	}
-
-	// close statements
-	c.indent -= 1
-	c.Println("</statements>")
 }
 
-func (c *Compiler) CompileLetStatement() {
-	// letStatement
-	c.Println("<letStatement>")
-	c.indent += 1
-
-	// let
-	c.ValueMust("let")
-	c.PrintLine()
+// writeLine writes the debug information of the statement at pos.
+func (c *Compiler) writeLine(pos Pos) {
+	if c.Debug {
+		c.vmWriter.WriteComment(fmt.Sprintf("@line %d", pos.Line))
+	}
+}
 
-	// varName
-	c.Scan()
-	c.TagMust(tagIdentifier)
-	name := c.value
-	c.PrintLine()
+func (c *Compiler) CompileStatements(statements []Statement) {
+	for _, s := range statements {
+		c.writeLine(s.Position())
+		switch s := s.(type) {
+		case *LetStatement:
+			c.CompileLetStatement(s)
+		case *IfStatement:
+			c.CompileIfStatement(s)
+		case *WhileStatement:
+			c.CompileWhileStatement(s)
+		case *ForStatement:
+			c.CompileForStatement(s)
+		case *BreakStatement:
+			c.vmWriter.WriteGoto(c.loops[len(c.loops)-1].end)
+		case *ContinueStatement:
+			c.vmWriter.WriteGoto(c.loops[len(c.loops)-1].next)
+		case *DoStatement:
+			c.CompileDoStatement(s)
+		case *ReturnStatement:
+			c.CompileReturnStatement(s)
+		}
+	}
+}
 
+func (c *Compiler) CompileLetStatement(s *LetStatement) {
+	name := s.Name.Name
 	kind := c.symbolTable.KindOf(name)
-	typeName := c.symbolTable.TypeOf(name)
 	number := c.symbolTable.IndexOf(name)
-	hasIndex := false
-
-	// ( [ expression ] )?
-	c.Scan()
-	if c.ValueIs("[") {
-		hasIndex = true
-
-		// [
-		c.PrintLine()
-		c.Scan()
-
-		// expression
-		c.CompileExpression()
-		c.vmWriter.WritePop("temp", 1)
-
-		// ]
-		c.ValueMust("]")
-		c.PrintLine()
-		c.Scan()
-	}
-
-	// =
-	c.ValueMust("=")
-	c.PrintLine()
-	c.Scan()
-
-	// expression
-	c.CompileExpression()
 
-	if typeName == "Array" && hasIndex {
-		// calc addr + index
-		c.vmWriter.WritePush(kindToSegment[kind], number)
-		c.vmWriter.WritePush("temp", 1)
-		c.vmWriter.WriteArithmetic("add")
-		// set pointer
-		c.vmWriter.WritePop("pointer", 1)
-		// insert that
-		c.vmWriter.WritePop("that", 0)
-	} else {
-		// insert var
+	if s.Index == nil {
+		c.CompileExpression(s.Value)
 		c.vmWriter.WritePop(kindToSegment[kind], number)
+		return
 	}
 
-	// ;
-	c.ValueMust(";")
-	c.PrintLine()
-	c.Scan()
-
-	// close letStatement
-	c.indent -= 1
-	c.Println("</letStatement>")
-}
-
-func (c *Compiler) CompileReturnStatement() {
-	// returnStatement
-	c.Println("<returnStatement>")
-	c.indent += 1
-
-	// return
-	c.ValueMust("return")
-	c.PrintLine()
-	c.Scan()
-
-	// expression?
-	if !c.ValueIs(";") {
-		c.CompileExpression()
+	// the address stays on the stack while the value is computed, which
+	// may itself access arrays or call subroutines that do
+	c.CompileExpression(s.Index)
+	c.vmWriter.WritePush(kindToSegment[kind], number)
+	c.vmWriter.WriteArithmetic("add")
+	c.CompileExpression(s.Value)
+	c.vmWriter.WritePop("temp", 0)
+	c.vmWriter.WritePop("pointer", 1)
+	c.vmWriter.WritePush("temp", 0)
+	c.vmWriter.WritePop("that", 0)
+}
+
+func (c *Compiler) CompileReturnStatement(s *ReturnStatement) {
+	if s.Value != nil {
+		c.CompileExpression(s.Value)
+	} else {
+		// void subroutines return 0, which the caller discards
+		c.vmWriter.WritePush("constant", 0)
 	}
-
-	// ;
-	c.ValueMust(";")
-	c.PrintLine()
-	c.Scan()
-
-	// close returnStatement
-	c.indent -= 1
-	c.Println("</returnStatement>")
-
 	c.vmWriter.WriteReturn()
 }
 
-func (c *Compiler) CompileIfStatement() {
-	// ifStatement
-	c.Println("<ifStatement>")
-	c.indent += 1
-
-	// if
-	c.ValueMust("if")
-	c.PrintLine()
-	c.Scan()
-
-	// (
-	c.ValueMust("(")
-	c.PrintLine()
-	c.Scan()
-
-	// expression
-	c.CompileExpression()
+func (c *Compiler) CompileIfStatement(s *IfStatement) {
+	c.CompileExpression(s.Cond)
 
 	c.labelCount += 1
 	l1 := fmt.Sprintf("%s.label.%d", c.className, c.labelCount)
@@ -514,213 +229,124 @@ func (c *Compiler) CompileIfStatement() {
 	c.vmWriter.WriteArithmetic("not")
 	c.vmWriter.WriteIf(l1)
 
-	// )
-	c.ValueMust(")")
-	c.PrintLine()
-	c.Scan()
-
-	// {
-	c.ValueMust("{")
-	c.PrintLine()
-	c.Scan()
-
-	// statements
-	c.CompileStatements()
-
-	// }
-	c.ValueMust("}")
-	c.PrintLine()
-	c.Scan()
+	c.CompileStatements(s.Then.Statements)
 
 	c.vmWriter.WriteGoto(l2)
 	c.vmWriter.WriteLabel(l1)
 
-	// ( else { statements } )?
-	if c.ValueIs("else") {
-		// else
-		c.PrintLine()
-		c.Scan()
-
-		// {
-		c.ValueMust("{")
-		c.PrintLine()
-		c.Scan()
-
-		// statements
-		c.CompileStatements()
-
-		// }
-		c.ValueMust("}")
-		c.PrintLine()
-		c.Scan()
+	if s.Else != nil {
+		c.CompileStatements(s.Else.Statements)
 	}
 
 	c.vmWriter.WriteLabel(l2)
-
-	// close ifStatement
-	c.indent -= 1
-	c.Println("</ifStatement>")
 }
 
-func (c *Compiler) CompileWhileStatement() {
-	// whileStatement
-	c.Println("<whileStatement>")
-	c.indent += 1
-
+func (c *Compiler) CompileWhileStatement(s *WhileStatement) {
 	c.labelCount += 1
 	l1 := fmt.Sprintf("%s.label.%d", c.className, c.labelCount)
 	c.labelCount += 1
 	l2 := fmt.Sprintf("%s.label.%d", c.className, c.labelCount)
 
-	// while
-	c.ValueMust("while")
-	c.PrintLine()
-	c.Scan()
-
-	// (
-	c.ValueMust("(")
-	c.PrintLine()
-	c.Scan()
-
 	c.vmWriter.WriteLabel(l1)
 
-	// expression
-	c.CompileExpression()
+	c.CompileExpression(s.Cond)
 
 	c.vmWriter.WriteArithmetic("not")
 	c.vmWriter.WriteIf(l2)
 
-	// )
-	c.ValueMust(")")
-	c.PrintLine()
-	c.Scan()
-
-	// {
-	c.ValueMust("{")
-	c.PrintLine()
-	c.Scan()
-
-	// statements
-	c.CompileStatements()
-
-	// }
-	c.ValueMust("}")
-	c.PrintLine()
-	c.Scan()
+	c.loops = append(c.loops, loopLabels{next: l1, end: l2})
+	c.CompileStatements(s.Body.Statements)
+	c.loops = c.loops[:len(c.loops)-1]
 
 	c.vmWriter.WriteGoto(l1)
 	c.vmWriter.WriteLabel(l2)
-
-	// close whileStatement
-	c.indent -= 1
-	c.Println("</whileStatement>")
 }
 
-func (c *Compiler) CompileDoStatement() {
-	// doStatement
-	c.Println("<doStatement>")
-	c.indent += 1
-
-	// do
-	c.ValueMust("do")
-	c.PrintLine()
-	c.Scan()
+func (c *Compiler) CompileForStatement(s *ForStatement) {
+	if s.Init != nil {
+		c.CompileLetStatement(s.Init)
+	}
 
-	// subroutineCall
-	c.CompileSubroutineCall()
+	c.labelCount += 1
+	l1 := fmt.Sprintf("%s.label.%d", c.className, c.labelCount)
+	c.labelCount += 1
+	l2 := fmt.Sprintf("%s.label.%d", c.className, c.labelCount)
+	c.labelCount += 1
+	l3 := fmt.Sprintf("%s.label.%d", c.className, c.labelCount)
 
-	// ;
-	c.ValueMust(";")
-	c.PrintLine()
-	c.Scan()
+	c.vmWriter.WriteLabel(l1)
 
-	// close doStatement
-	c.indent -= 1
-	c.Println("</doStatement>")
-}
+	c.CompileExpression(s.Cond)
 
+	c.vmWriter.WriteArithmetic("not")
+	c.vmWriter.WriteIf(l3)
 
-func (c *Compiler) CompileExpression() {
-	// expression
-	c.Println("<expression>")
-	c.indent += 1
+	c.loops = append(c.loops, loopLabels{next: l2, end: l3})
+	c.CompileStatements(s.Body.Statements)
+	c.loops = c.loops[:len(c.loops)-1]
 
-	// term
-	c.CompileTerm()
+	// continue goes on with the step
+	c.vmWriter.WriteLabel(l2)
+	if s.Step != nil {
+		c.CompileLetStatement(s.Step)
+	}
+	c.vmWriter.WriteGoto(l1)
+	c.vmWriter.WriteLabel(l3)
+}
 
-	// (op term)*
-	for c.IsOp() {
-		// op
-		c.PrintLine()
-		op := c.value
-		c.Scan()
-		// term
-		c.CompileTerm()
+func (c *Compiler) CompileDoStatement(s *DoStatement) {
+	c.CompileSubroutineCall(s.Call)
+	// discard the return value
+	c.vmWriter.WritePop("temp", 0)
+}
 
-		switch op {
-		case "+":
-			c.vmWriter.WriteArithmetic("add")
-		case "-":
-			c.vmWriter.WriteArithmetic("sub")
-		case "*":
-			c.vmWriter.WriteCall("Math.multiply", 2)
-		case "/":
-			c.vmWriter.WriteCall("Math.divide", 2)
-		case "&":
-			c.vmWriter.WriteArithmetic("and")
-		case "|":
-			c.vmWriter.WriteArithmetic("or")
-		case "<":
-			c.vmWriter.WriteArithmetic("lt")
-		case ">":
-			c.vmWriter.WriteArithmetic("gt")
-		case "=":
-			c.vmWriter.WriteArithmetic("eq")
-		}
+func (c *Compiler) CompileExpression(e Expression) {
+	b, ok := e.(*BinaryExpr)
+	if !ok {
+		c.CompileTerm(e)
+		return
 	}
 
-	// close expression
-	c.indent -= 1
-	c.Println("</expression>")
-}
+	c.CompileExpression(b.X)
+	c.CompileTerm(b.Y)
 
-func (c *Compiler) CompileTerm() {
-	// term
-	c.Println("<term>")
-	c.indent += 1
+	switch b.Op {
+	case "+":
+		c.vmWriter.WriteArithmetic("add")
+	case "-":
+		c.vmWriter.WriteArithmetic("sub")
+	case "*":
+		c.vmWriter.WriteCall("Math.multiply", 2)
+	case "/":
+		c.vmWriter.WriteCall("Math.divide", 2)
+	case "&":
+		c.vmWriter.WriteArithmetic("and")
+	case "|":
+		c.vmWriter.WriteArithmetic("or")
+	case "<":
+		c.vmWriter.WriteArithmetic("lt")
+	case ">":
+		c.vmWriter.WriteArithmetic("gt")
+	case "=":
+		c.vmWriter.WriteArithmetic("eq")
+	}
+}
 
-	if c.TagIs("integerConstant") {
-		// integerConstant
-		c.PrintLine()
-		v := c.value
-		c.Scan()
+func (c *Compiler) CompileTerm(e Expression) {
+	switch e := e.(type) {
+	case *IntegerConstant:
+		c.vmWriter.WritePush("constant", e.Value)
 
-		i, err := strconv.Atoi(v)
-		if err != nil {
-			log.Fatal(err)
-		}
-		c.vmWriter.WritePush("constant", i)
-	} else if c.TagIs("stringConstant") {
-		// stringConstant
-		c.PrintLine()
-		s := c.value
-		c.Scan()
-
-		c.vmWriter.WritePush("constant", len(s)) // String.new arg 0
-		c.vmWriter.WriteCall("String.new", 1) // new String. stack head is string object.
-		for _, char := range s {
+	case *StringConstant:
+		c.vmWriter.WritePush("constant", len(e.Value)) // String.new arg 0
+		c.vmWriter.WriteCall("String.new", 1)          // new String. stack head is string object.
+		for _, char := range e.Value {
 			c.vmWriter.WritePush("constant", int(char)) // String.appendChar arg 1
 			c.vmWriter.WriteCall("String.appendChar", 2)
-			// c.vmWriter.WritePop("temp", 0) // pop void return
 		}
 
-	} else if c.TagIs("keyword") && c.ValueIs("true", "false", "null", "this") {
-		// true | false | null | this
-		c.PrintLine()
-		v := c.value
-		c.Scan()
-
-		switch v {
+	case *KeywordConstant:
+		switch e.Value {
 		case "true":
 			c.vmWriter.WritePush("constant", 1)
 			c.vmWriter.WriteArithmetic("neg")
@@ -729,310 +355,95 @@ func (c *Compiler) CompileTerm() {
 		case "this":
 			c.vmWriter.WritePush("pointer", 0)
 		}
-	} else if c.ValueIs("(") {
-		// (
-		c.PrintLine()
-		c.Scan()
-
-		// expression
-		c.CompileExpression()
-
-		// )
-		c.ValueMust(")")
-		c.PrintLine()
-		c.Scan()
-	} else if c.TagIs("symbol") && c.ValueIs("-", "~") {
-		// - | ~
-		c.PrintLine()
-		op := c.value
-		c.Scan()
-		// term
-		c.CompileTerm()
-
-		switch op {
+
+	case *ParenExpr:
+		c.CompileExpression(e.X)
+
+	case *UnaryExpr:
+		c.CompileTerm(e.X)
+
+		switch e.Op {
 		case "-":
 			c.vmWriter.WriteArithmetic("neg")
 		case "~":
 			c.vmWriter.WriteArithmetic("not")
 		}
-	} else if c.TagIs(tagIdentifier) {
-		// subroutineCall
-		c.CompileSubroutineCall()
-	}
-
-	// close term
-	c.indent -= 1
-	c.Println("</term>")
-}
-
-// subroutineCall
-func (c *Compiler) CompileSubroutineCall() {
-	// varName | varName [ expression ] | subroutineName ( expressionList ) | (className | varName).subroutineName ( expressionList )
-	c.TagMust(tagIdentifier)
-	c.PrintLine()
-	name := c.value
-	typeName := c.symbolTable.TypeOf(name)
-	kind := c.symbolTable.KindOf(name)
-	number := c.symbolTable.IndexOf(name)
-	c.Scan()
 
-	if c.ValueIs("[") {
-		// varName [ expression ]
+	case *VarExpr:
+		kind := c.symbolTable.KindOf(e.Name)
+		c.vmWriter.WritePush(kindToSegment[kind], c.symbolTable.IndexOf(e.Name))
 
-		// [
-		c.PrintLine()
-		c.Scan()
+	case *IndexExpr:
+		name := e.Name.Name
+		kind := c.symbolTable.KindOf(name)
+		number := c.symbolTable.IndexOf(name)
 
-		// expression
-		c.CompileExpression()
-
-		// ]
-		c.ValueMust("]")
-		c.PrintLine()
-		c.Scan()
+		c.CompileExpression(e.Index)
 
 		c.vmWriter.WritePush(kindToSegment[kind], number)
 		c.vmWriter.WriteArithmetic("add")
 		c.vmWriter.WritePop("pointer", 1)
 		c.vmWriter.WritePush("that", 0)
 
-	} else if c.ValueIs(".") {
-		// (className | varName) . subroutineName ( expressionList )
-
-		// .
-		c.PrintLine()
-		c.Scan()
+	case *CallExpr:
+		c.CompileSubroutineCall(e)
+	}
+}
 
-		// subroutineName
-		c.TagMust(tagIdentifier)
-		c.PrintLine()
-		subroutineName := c.value
-		c.Scan()
+// subroutineName ( expressionList ) | (className | varName) . subroutineName ( expressionList )
+func (c *Compiler) CompileSubroutineCall(call *CallExpr) {
+	isMethod := false
+	className := c.className
 
+	if call.Receiver != nil {
 		// set "this" object to stack
-		isMethod := false
-		className := ""
+		name := call.Receiver.Name
+		kind := c.symbolTable.KindOf(name)
 		if kind == "none" {
 			className = name
 		} else {
 			isMethod = true
-			className = typeName
-			c.vmWriter.WritePush(kindToSegment[kind], number)
+			className = c.symbolTable.TypeOf(name)
+			c.vmWriter.WritePush(kindToSegment[kind], c.symbolTable.IndexOf(name))
 		}
-
-		// (
-		c.ValueMust("(")
-		c.PrintLine()
-		c.Scan()
-
-		// expressionList
-		c.CompileExpressionList()
-
-		// )
-		c.ValueMust(")")
-		c.PrintLine()
-		c.Scan()
-
-		argCount := c.expressionListCount
-		if isMethod {
-			argCount += 1
-		}
-		c.vmWriter.WriteCall(fmt.Sprintf("%s.%s", className, subroutineName), argCount)
-
-	} else if c.ValueIs("(") {
-		// subroutineName ( expressionList )
-
-		isMethod := false
-		for _, e := range c.symbolTable.subroutine {
-			// called method without "this"
-			if e.name == name && e.kind == "method" {
-				isMethod = true
-				c.vmWriter.WritePush("pointer", 0)
-				break
-			}
-		}
-
-		// (
-		c.ValueMust("(")
-		c.PrintLine()
-		c.Scan()
-
-		// expressionList
-		c.CompileExpressionList()
-
-		// )
-		c.ValueMust(")")
-		c.PrintLine()
-		c.Scan()
-
-		argCount := c.expressionListCount
-		if isMethod {
-			argCount += 1
-		}
-		c.vmWriter.WriteCall(fmt.Sprintf("%s.%s", c.className, name), argCount)
-
 	} else {
-		// varName
-		// no op
-
-		c.vmWriter.WritePush(kindToSegment[kind], number)
-	}
-}
-
-// ( expression (, expression)* )?
-func (c *Compiler) CompileExpressionList() {
-	// expressionList
-	c.Println("<expressionList>")
-	c.indent += 1
-
-	count := 0
-
-	if c.IsTerm() {
-
-		// expression
-		c.CompileExpression()
-
-		count += 1
-
-		for c.ValueIs(",") {
-			// ,
-			c.PrintLine()
-			c.Scan()
-
-			// expression
-			c.CompileExpression()
-
-			count += 1
-		}
-
-	}
-
-	// close expressionList
-	c.indent -= 1
-	c.Println("</expressionList>")
-
-	c.expressionListCount = count
-}
-
-func (c *Compiler) Scan() bool {
-	if c.s.Scan() {
-		c.line = strings.TrimSpace(c.s.Text())
-		c.tag = ""
-		c.value = ""
-		log.Printf("SCAN: %s\n", c.line)
-		return true
-	} else {
-		return false
-	}
-}
-
-func (c *Compiler) Tag() string {
-	tag, _ := c.ParseLine()
-	return tag
-}
-
-func (c *Compiler) Value() string {
-	_, value := c.ParseLine()
-	return value
-}
-
-func (c *Compiler) ParseLine() (string, string) {
-	if c.tag == "" && c.value == "" {
-		m := regexTag.FindAllStringSubmatch(c.line, -1)
-		if len(m) != 1 {
-			log.Fatalf("invalid match result: %#v", m)
-		}
-		c.tag, c.value = m[0][1], m[0][2]
-		switch c.value {
-		case "&lt;":
-			c.value = "<"
-		case "&gt;":
-			c.value = ">"
-		case "&amp;":
-			c.value = "&"
+		// called method without "this"
+		if dec := c.index.Lookup(c.className, call.Name.Name); dec != nil && dec.Kind == "method" {
+			isMethod = true
+			c.vmWriter.WritePush("pointer", 0)
 		}
 	}
-	return c.tag, c.value
-}
-
-func (c *Compiler) TagMust(tags ...string) {
-	if !c.TagIs(tags...) {
-		log.Fatalf("TagMust %v, but %s. %#v", tags, c.Tag(), c)
-	}
-}
 
-func (c *Compiler) ValueMust(values ...string) {
-	if !c.ValueIs(values...) {
-		log.Fatalf("ValueMust %v, but %s. %#v", values, c.Value(), c)
-	}
-}
+	c.CompileExpressionList(call.Args)
 
-func (c *Compiler) LineMust(s string) {
-	if c.line != s {
-		log.Fatalf("LineMust %s, but %s. %#v", s, c.line, c)
+	argCount := len(call.Args)
+	if isMethod {
+		argCount += 1
 	}
+	c.vmWriter.WriteCall(fmt.Sprintf("%s.%s", className, call.Name.Name), argCount)
 }
 
-func (c *Compiler) TagIs(tags ...string) bool {
-	match := false
-	for _, t := range tags {
-		if c.Tag() == t {
-			match = true
-			break
-		}
+func (c *Compiler) CompileExpressionList(list []Expression) {
+	for _, e := range list {
+		c.CompileExpression(e)
 	}
-	return match
 }
 
-func (c *Compiler) ValueIs(values ...string) bool {
-	match := false
-	for _, v := range values {
-		if c.Value() == v {
-			match = true
-			break
-		}
+// CompileFile checks and compiles the class read from r to VM code in
+// memory. Positions in errors name the file if r has a Name method, as
+// *os.File does. Errors are returned as an ErrorList sorted by position.
+func CompileFile(r io.Reader) ([]byte, error) {
+	class, err := ParseFile(r)
+	if err != nil {
+		return nil, err
 	}
-	return match
-}
-
-func (c *Compiler) Println(s string) {
-	for i := 0; i < c.indent; i++ {
-		fmt.Fprint(c.w, "  ")
-	}
-	fmt.Fprintln(c.w, s)
-}
-
-func (c *Compiler) PrintLine() {
-	c.Println(c.line)
-}
-
-func (c *Compiler) IsType() bool {
-	return (c.TagIs("keyword") && c.ValueIs("int", "char", "boolean")) || c.TagIs("identifier")
-}
-
-func (c *Compiler) MustType() {
-	if !c.IsType() {
-		log.Fatalf("token must type: %#v", c)
-	}
-}
-
-func (c *Compiler) IsOp() bool {
-	return c.ValueIs("+", "-", "*", "/", "&", "|", "<", ">", "=")
-}
-
-func (c *Compiler) IsTerm() bool {
-	if c.TagIs("integerConstant") {
-		return true
-	} else if c.TagIs("stringConstant") {
-		return true
-	} else if c.TagIs("keyword") && c.ValueIs("true", "false", "null", "this") {
-		return true
-	} else if c.ValueIs("(") {
-		return true
-	} else if c.TagIs("symbol") && c.ValueIs("-", "~") {
-		return true
-	} else if c.TagIs(tagIdentifier) {
-		return true
+	// the rest of the program is unknown
+	index := NewIndex([]*Class{class})
+	index.Open = true
+	if errs := Check(index, []*Class{class}); len(errs) > 0 {
+		return nil, ErrorList(errs)
 	}
-	return false
+	var buf bytes.Buffer
+	NewCompiler(&buf, index).CompileClass(class)
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// ClassDoc is the documentation of a class: the /** */ comments directly
+// before its declaration and those of its subroutines.
+type ClassDoc struct {
+	Class       *Class
+	Doc         string
+	Subroutines []SubroutineDoc
+}
+
+// SubroutineDoc is the documentation of a subroutine, empty if it has no
+// doc comment.
+type SubroutineDoc struct {
+	Dec *SubroutineDec
+	Doc string
+}
+
+// ExtractDoc parses the class of file and returns its documentation. Doc
+// comments are returned without their delimiters and the * at the start
+// of their lines. Subroutines without a doc comment are documented by
+// their signature alone. With ext the source may use the language
+// extensions.
+func ExtractDoc(file, src string, ext bool) (*ClassDoc, error) {
+	t := NewStringTokenizer(file, src)
+	t.Extensions = ext
+	class, err := NewParser(t).ParseClass()
+	if err != nil {
+		return nil, err
+	}
+	// the doc comment of a declaration ends right before its first token
+	docs := map[Pos]string{}
+	t = NewStringTokenizer(file, src)
+	t.Comments, t.Extensions = true, ext
+	doc := ""
+	for {
+		token, err := t.Next()
+		if err != nil {
+			break
+		}
+		if token.Kind == TOKEN_COMMENT {
+			doc = ""
+			if strings.HasPrefix(token.Text, "/**") && token.Text != "/**/" {
+				doc = docText(token.Text)
+			}
+			continue
+		}
+		if doc != "" {
+			docs[token.Pos] = doc
+			doc = ""
+		}
+	}
+	d := &ClassDoc{Class: class, Doc: docs[class.Pos]}
+	for _, dec := range class.Subroutines {
+		d.Subroutines = append(d.Subroutines, SubroutineDoc{Dec: dec, Doc: docs[dec.Pos]})
+	}
+	return d, nil
+}
+
+// docText returns the text of a doc comment.
+func docText(comment string) string {
+	comment = strings.TrimSuffix(strings.TrimPrefix(comment, "/**"), "*/")
+	var lines []string
+	for _, line := range strings.Split(comment, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "*") {
+			line = strings.TrimSpace(line[1:])
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// paragraphs splits a doc text at its blank lines.
+func paragraphs(text string) []string {
+	var list []string
+	for _, p := range strings.Split(text, "\n\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// summary returns the first sentence of a doc text.
+func summary(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if i := strings.Index(text, ". "); i >= 0 {
+		return text[:i+1]
+	}
+	return text
+}
+
+// DocSet is the documentation of the classes of a program, which link to
+// each other: the page of class Foo is Foo.html or Foo.md, and the
+// subroutines of a page are anchored at their names.
+type DocSet struct {
+	Classes []*ClassDoc
+	byName  map[string]*ClassDoc
+}
+
+func NewDocSet(classes []*ClassDoc) *DocSet {
+	s := &DocSet{Classes: classes, byName: map[string]*ClassDoc{}}
+	for _, c := range classes {
+		s.byName[c.Class.Name.Name] = c
+	}
+	return s
+}
+
+// docSpan is a piece of text, which links to a class, or to a subroutine
+// of it, if Class is set.
+type docSpan struct {
+	Text  string
+	Class string
+	Sub   string
+}
+
+var docWord = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?`)
+
+// spans splits text into the names of documented classes and subroutines,
+// written Foo or Foo.bar, and the text between them. The class of the
+// page, self, is not linked to by its name alone.
+func (s *DocSet) spans(text, self string) []docSpan {
+	var list []docSpan
+	last := 0
+	for _, m := range docWord.FindAllStringIndex(text, -1) {
+		word := text[m[0]:m[1]]
+		class, sub := word, ""
+		if i := strings.Index(word, "."); i >= 0 {
+			class, sub = word[:i], word[i+1:]
+		}
+		c, ok := s.byName[class]
+		if !ok || sub == "" && class == self || sub != "" && !c.defines(sub) {
+			continue
+		}
+		if m[0] > last {
+			list = append(list, docSpan{Text: text[last:m[0]]})
+		}
+		list = append(list, docSpan{Text: word, Class: class, Sub: sub})
+		last = m[1]
+	}
+	if last < len(text) {
+		list = append(list, docSpan{Text: text[last:]})
+	}
+	return list
+}
+
+func (c *ClassDoc) defines(name string) bool {
+	for _, sub := range c.Subroutines {
+		if sub.Dec.Name.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// signature returns the spans of the signature of a subroutine of class,
+// its types linked to their classes.
+func (s *DocSet) signature(class string, dec *SubroutineDec) []docSpan {
+	typ := func(name string) docSpan {
+		if _, ok := s.byName[name]; ok && name != class {
+			return docSpan{Text: name, Class: name}
+		}
+		return docSpan{Text: name}
+	}
+	list := []docSpan{{Text: dec.Kind + " "}, typ(dec.ReturnType.Name), {Text: " " + dec.Name.Name + "("}}
+	for i, p := range dec.Params {
+		if i > 0 {
+			list = append(list, docSpan{Text: ", "})
+		}
+		list = append(list, typ(p.Type.Name), docSpan{Text: " " + p.Name.Name})
+	}
+	return append(list, docSpan{Text: ")"})
+}
+
+// docWriter writes the pages of a DocSet in a format.
+type docWriter struct {
+	w   io.Writer
+	ext string // of the pages
+	err error
+}
+
+func (d *docWriter) printf(format string, a ...interface{}) {
+	if d.err == nil {
+		_, d.err = fmt.Fprintf(d.w, format, a...)
+	}
+}
+
+func (d *docWriter) href(span docSpan) string {
+	href := span.Class + d.ext
+	if span.Sub != "" {
+		href += "#" + strings.ToLower(span.Sub)
+	}
+	return href
+}
+
+// WriteHTMLDoc writes the HTML page of the class named name.
+func (s *DocSet) WriteHTMLDoc(w io.Writer, name string) error {
+	c := s.byName[name]
+	d := &docWriter{w: w, ext: ".html"}
+	spans := func(list []docSpan) string {
+		var b strings.Builder
+		for _, span := range list {
+			if span.Class == "" {
+				b.WriteString(html.EscapeString(span.Text))
+			} else {
+				fmt.Fprintf(&b, `<a href="%s">%s</a>`, d.href(span), html.EscapeString(span.Text))
+			}
+		}
+		return b.String()
+	}
+	d.printf("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n", name)
+	d.printf("<p><a href=\"index.html\">Index</a></p>\n")
+	d.printf("<h1>class %s</h1>\n", name)
+	for _, p := range paragraphs(c.Doc) {
+		d.printf("<p>%s</p>\n", spans(s.spans(p, name)))
+	}
+	for _, sub := range c.Subroutines {
+		d.printf("<h2 id=\"%s\"><code>%s</code></h2>\n", strings.ToLower(sub.Dec.Name.Name), spans(s.signature(name, sub.Dec)))
+		for _, p := range paragraphs(sub.Doc) {
+			d.printf("<p>%s</p>\n", spans(s.spans(p, name)))
+		}
+	}
+	d.printf("</body>\n</html>\n")
+	return d.err
+}
+
+// WriteMarkdownDoc writes the Markdown page of the class named name.
+func (s *DocSet) WriteMarkdownDoc(w io.Writer, name string) error {
+	c := s.byName[name]
+	d := &docWriter{w: w, ext: ".md"}
+	spans := func(list []docSpan) string {
+		var b strings.Builder
+		for _, span := range list {
+			if span.Class == "" {
+				b.WriteString(markdownEscape(span.Text))
+			} else {
+				fmt.Fprintf(&b, "[%s](%s)", markdownEscape(span.Text), d.href(span))
+			}
+		}
+		return b.String()
+	}
+	d.printf("[Index](index.md)\n\n# class %s\n", markdownEscape(name))
+	for _, p := range paragraphs(c.Doc) {
+		d.printf("\n%s\n", spans(s.spans(p, name)))
+	}
+	for _, sub := range c.Subroutines {
+		d.printf("\n## %s\n\n%s\n", markdownEscape(sub.Dec.Name.Name), spans(s.signature(name, sub.Dec)))
+		for _, p := range paragraphs(sub.Doc) {
+			d.printf("\n%s\n", spans(s.spans(p, name)))
+		}
+	}
+	return d.err
+}
+
+// markdownEscape escapes the characters of text that Markdown would read
+// as emphasis, code, links or HTML, and those starting a heading, a quote
+// or a list at the start of a line.
+func markdownEscape(text string) string {
+	var b strings.Builder
+	start := true
+	for _, r := range text {
+		if strings.ContainsRune("\\`*_[]<", r) || start && strings.ContainsRune("#>-+", r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+		if r == '\n' {
+			start = true
+		} else if r != ' ' {
+			start = false
+		}
+	}
+	return b.String()
+}
+
+// WriteHTMLIndex writes the HTML index of the classes, with the first
+// sentence of their doc comments.
+func (s *DocSet) WriteHTMLIndex(w io.Writer) error {
+	d := &docWriter{w: w, ext: ".html"}
+	d.printf("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Classes</title>\n</head>\n<body>\n<h1>Classes</h1>\n<dl>\n")
+	for _, c := range s.Classes {
+		name := c.Class.Name.Name
+		d.printf("<dt><a href=\"%s.html\">%s</a></dt>\n<dd>%s</dd>\n", name, name, html.EscapeString(summary(c.Doc)))
+	}
+	d.printf("</dl>\n</body>\n</html>\n")
+	return d.err
+}
+
+// WriteMarkdownIndex writes the Markdown index of the classes, with the
+// first sentence of their doc comments.
+func (s *DocSet) WriteMarkdownIndex(w io.Writer) error {
+	d := &docWriter{w: w, ext: ".md"}
+	d.printf("# Classes\n\n")
+	for _, c := range s.Classes {
+		name := c.Class.Name.Name
+		if text := summary(c.Doc); text != "" {
+			d.printf("- [%s](%s.md): %s\n", markdownEscape(name), name, markdownEscape(text))
+		} else {
+			d.printf("- [%s](%s.md)\n", markdownEscape(name), name)
+		}
+	}
+	return d.err
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const docPoint = `/**
+ * A point of the plane.
+ *
+ * Points are made by Point.new and added with Line.
+ */
+class Point {
+    field int x, y;
+
+    /** Makes the point (ax, ay). */
+    constructor Point new(int ax, int ay) {
+        let x = ax;
+        let y = ay;
+        return this;
+    }
+
+    // not a doc comment
+    method int getX() {
+        return x;
+    }
+
+    /** Returns the sum of this point and p. */
+    method Point plus(Point p) {
+        return Point.new(x + p.getX(), y);
+    }
+}
+`
+
+const docLine = `/** A segment between two Points. */
+class Line {
+    field Point a, b;
+
+    /** Joins a and b, made with Point.new. */
+    constructor Line new(Point pa, Point pb) {
+        let a = pa;
+        let b = pb;
+        return this;
+    }
+}
+`
+
+func docSet(t *testing.T) *DocSet {
+	var docs []*ClassDoc
+	for _, src := range []string{docLine, docPoint} {
+		doc, err := ExtractDoc("A.jack", src, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, doc)
+	}
+	return NewDocSet(docs)
+}
+
+func TestExtractDoc(t *testing.T) {
+	doc, err := ExtractDoc("Point.jack", docPoint, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "A point of the plane.\n\nPoints are made by Point.new and added with Line."; doc.Doc != want {
+		t.Errorf("class doc %q, want %q", doc.Doc, want)
+	}
+	var got []string
+	for _, sub := range doc.Subroutines {
+		got = append(got, sub.Dec.Name.Name+": "+sub.Doc)
+	}
+	want := []string{"new: Makes the point (ax, ay).", "getX: ", "plus: Returns the sum of this point and p."}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("subroutine docs %q, want %q", got, want)
+	}
+	if _, err := ExtractDoc("Bad.jack", "class Bad {", false); err == nil {
+		t.Error("documented a source with syntax errors")
+	}
+}
+
+func TestDocSet(t *testing.T) {
+	set := docSet(t)
+	var buf bytes.Buffer
+	if err := set.WriteMarkdownDoc(&buf, "Point"); err != nil {
+		t.Fatal(err)
+	}
+	md := buf.String()
+	for _, want := range []string{
+		"# class Point\n",
+		"\nPoints are made by [Point.new](Point.md#new) and added with [Line](Line.md).\n",
+		"\n## plus\n\nmethod Point plus(Point p)\n\nReturns the sum",
+	} {
+		if !strings.Contains(md, want) {
+			t.Errorf("Markdown page without %q:\n%s", want, md)
+		}
+	}
+
+	buf.Reset()
+	if err := set.WriteHTMLDoc(&buf, "Line"); err != nil {
+		t.Fatal(err)
+	}
+	page := buf.String()
+	for _, want := range []string{
+		"<h1>class Line</h1>\n<p>A segment between two Points.</p>\n",
+		`<h2 id="new"><code>constructor Line new(<a href="Point.html">Point</a> pa, <a href="Point.html">Point</a> pb)</code></h2>`,
+		`<p>Joins a and b, made with <a href="Point.html#new">Point.new</a>.</p>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("HTML page without %q:\n%s", want, page)
+		}
+	}
+
+	buf.Reset()
+	if err := set.WriteMarkdownIndex(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := "# Classes\n\n- [Line](Line.md): A segment between two Points.\n- [Point](Point.md): A point of the plane.\n"; buf.String() != want {
+		t.Errorf("index %q, want %q", buf.String(), want)
+	}
+}
+
+func TestDocSet_MarkdownEscape(t *testing.T) {
+	src := `/** Returns x*y, *not* [a link] or <b>html</b>, see snake_case.
+ * - not a list
+ */
+class Math {
+    /** Returns x*y. */
+    function int multiply(int x, int y) {
+        return x * y;
+    }
+}
+`
+	doc, err := ExtractDoc("Math.jack", src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := NewDocSet([]*ClassDoc{doc})
+	var buf bytes.Buffer
+	if err := set.WriteMarkdownDoc(&buf, "Math"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"\nReturns x\\*y, \\*not\\* \\[a link\\] or \\<b>html\\</b>, see snake\\_case.\n\\- not a list\n",
+		"\n## multiply\n\nfunction int multiply(int x, int y)\n\nReturns x\\*y.\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Markdown page without %q:\n%s", want, buf.String())
+		}
+	}
+	buf.Reset()
+	if err := set.WriteMarkdownIndex(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := "- [Math](Math.md): Returns x\\*y, \\*not\\* \\[a link\\] or \\<b>html\\</b>, see snake\\_case.\n"; !strings.HasSuffix(buf.String(), want) {
+		t.Errorf("index %q, want %q", buf.String(), want)
+	}
+}
+
+func TestRun_Doc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jackdoc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// -d makes the directory
+	dir = filepath.Join(dir, "doc")
+	if status := run([]string{"-doc", "-d", dir, "test/Square"}); status != 0 {
+		t.Fatalf("exit status %d", status)
+	}
+	for _, name := range []string{"index", "Main", "Square", "SquareGame"} {
+		for _, ext := range []string{".html", ".md"} {
+			if _, err := os.Stat(filepath.Join(dir, name+ext)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Square.vm")); err == nil {
+		t.Error("-doc compiled the program")
+	}
+}
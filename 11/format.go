@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// formatIndent is the indentation of a level of braces.
+const formatIndent = "    "
+
+// Format returns the canonical form of the Jack source of file: four
+// spaces of indentation per level of braces, every declaration and
+// statement on a line of its own, opening braces at the end of the line
+// and spaces around binary operators and after commas. Comments are kept
+// where they are relative to the code, doc blocks re-indented with it. At
+// most one blank line is kept where the source has some, and one always
+// separates subroutine declarations. Sources with syntax errors are not
+// formatted. With ext the source may use the language extensions.
+func Format(file, src string, ext bool) ([]byte, error) {
+	t := NewStringTokenizer(file, src)
+	t.Extensions = ext
+	if _, err := NewParser(t).ParseClass(); err != nil {
+		return nil, err
+	}
+	t = NewStringTokenizer(file, src)
+	t.Comments, t.Extensions = true, ext
+	var tokens []Token
+	for {
+		token, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	f := &formatter{}
+	for i := range tokens {
+		f.token(tokens, i)
+	}
+	f.buf.WriteString("\n")
+	return f.buf.Bytes(), nil
+}
+
+type formatter struct {
+	buf     bytes.Buffer
+	braces  int   // depth of braces
+	parens  int   // depth of parentheses and brackets
+	prev    Token // the last token written that is not a comment
+	comment bool  // the last token written was a comment
+	leading bool  // and it was on a line of its own
+	unary   bool  // the last token written was a unary operator
+	endLine int   // source line where the last token written ends
+	started bool  // something is written on the current line
+	newline bool  // the next token goes on a new line
+}
+
+func (f *formatter) token(tokens []Token, i int) {
+	tok := tokens[i]
+	if tok.Kind == TOKEN_COMMENT && f.started && tok.Line == f.endLine {
+		// a comment at the end of a line stays there
+		f.buf.WriteString(" ")
+		f.writeComment(tok)
+		f.leading = false
+		return
+	}
+
+	isSymbol := func(t Token, values string) bool {
+		return t.Kind == TOKEN_SYMBOL && strings.Contains(values, t.Value)
+	}
+	newline := f.newline || isSymbol(tok, "}") || tok.Kind == TOKEN_COMMENT ||
+		f.comment && tok.Line > f.endLine
+	if isSymbol(tok, "}") {
+		f.braces -= 1
+	}
+	if f.prev.Kind == TOKEN_SYMBOL && f.prev.Value == "}" && tok.Kind == TOKEN_KEYWORD && tok.Value == "else" && !f.comment {
+		newline = false
+	}
+	if f.started && newline {
+		f.buf.WriteString("\n")
+		afterOpen := isSymbol(f.prev, "{") && !f.leading
+		blank := tok.Line > f.endLine+1 && !afterOpen && !isSymbol(tok, "}")
+		// the comments before a subroutine go with it
+		if f.braces == 1 && !afterOpen && !f.leading && startsSubroutine(tokens[i:]) {
+			blank = true
+		}
+		if blank {
+			f.buf.WriteString("\n")
+		}
+		f.started = false
+	}
+	if !f.started {
+		level := f.braces
+		if f.parens > 0 {
+			// a comment broke an expression
+			level += 1
+		}
+		f.buf.WriteString(strings.Repeat(formatIndent, level))
+	} else if f.space(tok) {
+		f.buf.WriteString(" ")
+	}
+	f.newline = false
+
+	if tok.Kind == TOKEN_COMMENT {
+		f.writeComment(tok)
+		f.leading = true
+		return
+	}
+	f.buf.WriteString(tok.Text)
+	f.started, f.comment, f.leading, f.endLine = true, false, false, tok.Line
+	f.unary = isSymbol(tok, "-~") && f.operand()
+	f.prev = tok
+	switch {
+	case isSymbol(tok, "{"):
+		f.braces += 1
+		f.newline = true
+	case isSymbol(tok, "}"):
+		f.newline = true
+	case isSymbol(tok, ";") && f.parens == 0:
+		f.newline = true
+	case isSymbol(tok, "(["):
+		f.parens += 1
+	case isSymbol(tok, ")]"):
+		f.parens -= 1
+	}
+}
+
+// startsSubroutine reports whether tokens, after comments, start a
+// subroutine declaration.
+func startsSubroutine(tokens []Token) bool {
+	for _, t := range tokens {
+		if t.Kind != TOKEN_COMMENT {
+			return t.Kind == TOKEN_KEYWORD && (t.Value == "constructor" || t.Value == "function" || t.Value == "method")
+		}
+	}
+	return false
+}
+
+// operand reports whether the operator just written is unary, which it is
+// where an operand is expected: after another operator, an opening
+// parenthesis or bracket, a comma, the = of let or return.
+func (f *formatter) operand() bool {
+	// f.prev is still the token before the operator
+	switch f.prev.Kind {
+	case TOKEN_SYMBOL:
+		return strings.Contains("([,=+-*/&|<>~", f.prev.Value)
+	case TOKEN_KEYWORD:
+		return f.prev.Value == "return"
+	}
+	return false
+}
+
+// space reports whether tok is separated from the previous token on the
+// same line.
+func (f *formatter) space(tok Token) bool {
+	if f.comment {
+		return true
+	}
+	prev := f.prev
+	if f.unary {
+		return false
+	}
+	if tok.Kind == TOKEN_SYMBOL {
+		switch tok.Value {
+		case ";", ",", ")", "]", ".":
+			return false
+		case "(", "[":
+			// calls and array accesses
+			if prev.Kind == TOKEN_IDENTIFIER {
+				return false
+			}
+		}
+	}
+	if prev.Kind == TOKEN_SYMBOL {
+		switch prev.Value {
+		case "(", "[", ".":
+			return false
+		}
+	}
+	return true
+}
+
+// writeComment writes a comment, aligning the lines of a block comment
+// that start with * under its first line.
+func (f *formatter) writeComment(tok Token) {
+	lines := strings.Split(tok.Text, "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if i > 0 {
+			f.buf.WriteString("\n")
+			if trimmed := strings.TrimLeft(line, " \t"); strings.HasPrefix(trimmed, "*") {
+				line = strings.Repeat(formatIndent, f.braces) + " " + trimmed
+			}
+		}
+		f.buf.WriteString(line)
+	}
+	f.started, f.comment = true, true
+	f.endLine = tok.Line + len(lines) - 1
+	f.newline = f.newline || strings.HasPrefix(tok.Text, "//")
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	src := `// header
+class  Main{static int count;field int x,y; // position
+  /** Doc
+      * block. */
+  function void main(){var int i;var Array a;let i=-1;let a[i+1]=~(i<2)&true;
+if(i>0){do Output.printInt( i );}else{return;}
+
+
+    while (i<3) { let i = i+1; } // loop
+    /* before return */ return;}
+method int sum() {
+return x - -y; }
+}
+`
+	want := `// header
+class Main {
+    static int count;
+    field int x, y; // position
+
+    /** Doc
+     * block. */
+    function void main() {
+        var int i;
+        var Array a;
+        let i = -1;
+        let a[i + 1] = ~(i < 2) & true;
+        if (i > 0) {
+            do Output.printInt(i);
+        } else {
+            return;
+        }
+
+        while (i < 3) {
+            let i = i + 1;
+        } // loop
+        /* before return */ return;
+    }
+
+    method int sum() {
+        return x - -y;
+    }
+}
+`
+	got, err := Format("Main.jack", src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("Format:\n%s\nwant:\n%s", got, want)
+	}
+	if _, err := Format("Main.jack", "class Main { function }", false); err == nil {
+		t.Error("formatted a source with syntax errors")
+	}
+}
+
+// comments returns the comments of src, without the indentation of their
+// lines.
+func comments(t *testing.T, src string) []string {
+	tk := NewStringTokenizer("", src)
+	tk.Comments = true
+	var list []string
+	for {
+		token, err := tk.Next()
+		if token.Kind == TOKEN_EOF {
+			return list
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Kind == TOKEN_COMMENT {
+			var lines []string
+			for _, line := range strings.Split(token.Text, "\n") {
+				lines = append(lines, strings.TrimSpace(line))
+			}
+			list = append(list, strings.Join(lines, "\n"))
+		}
+	}
+}
+
+// compileSource checks and compiles the class of src on its own, as
+// CompileFile does.
+func compileSource(t *testing.T, src string, ext bool) []byte {
+	tk := NewStringTokenizer("", src)
+	tk.Extensions = ext
+	class, err := NewParser(tk).ParseClass()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := NewIndex([]*Class{class})
+	index.Open = true
+	if errs := Check(index, []*Class{class}); len(errs) > 0 {
+		t.Fatal(ErrorList(errs))
+	}
+	var buf bytes.Buffer
+	NewCompiler(&buf, index).CompileClass(class)
+	return buf.Bytes()
+}
+
+// TestFormat_Corpus formats every program, those using the language
+// extensions too, and the OS: formatting is idempotent, keeps the
+// comments and does not change the compiled code.
+func TestFormat_Corpus(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"test/*/*.jack", "test/ext/*/*.jack", "os/*.jack"} {
+		found, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, found...)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no .jack files")
+	}
+	for _, path := range paths {
+		ext := strings.HasPrefix(path, "test/ext/")
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		formatted, err := Format(path, string(src), ext)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		again, err := Format(path, string(formatted), ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, formatted) {
+			t.Errorf("%s: formatting is not idempotent", path)
+		}
+		if got, want := comments(t, string(formatted)), comments(t, string(src)); strings.Join(got, "\x00") != strings.Join(want, "\x00") {
+			t.Errorf("%s: comments changed", path)
+		}
+		if !bytes.Equal(compileSource(t, string(src), ext), compileSource(t, string(formatted), ext)) {
+			t.Errorf("%s: the formatted source compiles to different code", path)
+		}
+	}
+}
+
+func TestRun_Format(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jackfmt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "Main.jack")
+	if err := ioutil.WriteFile(path, []byte("class Main { function void main() { return; } }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if status := run([]string{"-fmt", "-w", dir}); status != 0 {
+		t.Fatalf("exit status %d", status)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "class Main {\n    function void main() {\n        return;\n    }\n}\n"; string(got) != want {
+		t.Errorf("-fmt -w wrote %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Main.vm")); err == nil {
+		t.Error("-fmt compiled the program")
+	}
+}
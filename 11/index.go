@@ -0,0 +1,146 @@
+package main
+
+import "fmt"
+
+// osAPI declares the subroutines of the Jack OS.
+var osAPI = map[string][]string{
+	"Math": {
+		"function void init()",
+		"function int abs(int x)",
+		"function int multiply(int x, int y)",
+		"function int divide(int x, int y)",
+		"function int min(int x, int y)",
+		"function int max(int x, int y)",
+		"function int sqrt(int x)",
+	},
+	"String": {
+		"constructor String new(int maxLength)",
+		"method void dispose()",
+		"method int length()",
+		"method char charAt(int j)",
+		"method void setCharAt(int j, char c)",
+		"method String appendChar(char c)",
+		"method void eraseLastChar()",
+		"method int intValue()",
+		"method void setInt(int val)",
+		"function char backSpace()",
+		"function char doubleQuote()",
+		"function char newLine()",
+	},
+	"Array": {
+		"function Array new(int size)",
+		"method void dispose()",
+	},
+	"Output": {
+		"function void init()",
+		"function void moveCursor(int i, int j)",
+		"function void printChar(char c)",
+		"function void printString(String s)",
+		"function void printInt(int i)",
+		"function void println()",
+		"function void backSpace()",
+	},
+	"Screen": {
+		"function void init()",
+		"function void clearScreen()",
+		"function void setColor(boolean b)",
+		"function void drawPixel(int x, int y)",
+		"function void drawLine(int x1, int y1, int x2, int y2)",
+		"function void drawRectangle(int x1, int y1, int x2, int y2)",
+		"function void drawCircle(int x, int y, int r)",
+	},
+	"Keyboard": {
+		"function void init()",
+		"function char keyPressed()",
+		"function char readChar()",
+		"function String readLine(String message)",
+		"function int readInt(String message)",
+	},
+	"Memory": {
+		"function void init()",
+		"function int peek(int address)",
+		"function void poke(int address, int value)",
+		"function Array alloc(int size)",
+		"function void deAlloc(Array o)",
+	},
+	"Sys": {
+		"function void init()",
+		"function void halt()",
+		"function void error(int errorCode)",
+		"function void wait(int duration)",
+	},
+}
+
+// ClassIndex lists the subroutines of a class. Class is nil for the
+// classes of the OS API.
+type ClassIndex struct {
+	Name        string
+	Class       *Class
+	Subroutines map[string]*SubroutineDec
+}
+
+// Index maps the name of every class of a program and of the OS to its
+// subroutines, so that calls across classes can be resolved. A class of
+// the program replaces the OS class of the same name. An open index
+// belongs to a part of a program: calls to classes it does not know are
+// assumed to go to the rest of the program.
+type Index struct {
+	Classes map[string]*ClassIndex
+	Open    bool
+}
+
+var osIndex = map[string]*ClassIndex{}
+
+func init() {
+	for name, decls := range osAPI {
+		ci := &ClassIndex{Name: name, Subroutines: map[string]*SubroutineDec{}}
+		for _, decl := range decls {
+			dec, err := NewParser(NewStringTokenizer("OS/"+name+".jack", decl)).ParseSignature()
+			if err != nil {
+				panic(fmt.Sprintf("OS API: %v", err))
+			}
+			ci.Subroutines[dec.Name.Name] = dec
+		}
+		osIndex[name] = ci
+	}
+}
+
+// NewIndex indexes the OS and the classes of a program. Only the first of
+// several declarations of the same name is indexed.
+func NewIndex(classes []*Class) *Index {
+	x := &Index{Classes: map[string]*ClassIndex{}}
+	for name, ci := range osIndex {
+		x.Classes[name] = ci
+	}
+	program := map[string]bool{}
+	for _, class := range classes {
+		name := class.Name.Name
+		if program[name] {
+			continue
+		}
+		program[name] = true
+		ci := &ClassIndex{Name: name, Class: class, Subroutines: map[string]*SubroutineDec{}}
+		for _, dec := range class.Subroutines {
+			if _, ok := ci.Subroutines[dec.Name.Name]; !ok {
+				ci.Subroutines[dec.Name.Name] = dec
+			}
+		}
+		x.Classes[name] = ci
+	}
+	return x
+}
+
+// Lookup returns the subroutine className.name, or nil.
+func (x *Index) Lookup(className, name string) *SubroutineDec {
+	if ci, ok := x.Classes[className]; ok {
+		return ci.Subroutines[name]
+	}
+	return nil
+}
+
+// Known reports whether className is a class of the index, or may be one
+// of the rest of the program if the index is open.
+func (x *Index) Known(className string) bool {
+	_, ok := x.Classes[className]
+	return ok || x.Open
+}
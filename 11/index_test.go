@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	class, err := NewParser(NewStringTokenizer("Math.jack", "class Math { function int twice(int x) { return x + x; } }")).ParseClass()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := NewIndex([]*Class{class})
+	if dec := index.Lookup("Math", "twice"); dec == nil || dec.Kind != "function" || len(dec.Params) != 1 {
+		t.Errorf("Math.twice: %#v", dec)
+	}
+	// the program's Math replaces the OS class
+	if dec := index.Lookup("Math", "multiply"); dec != nil {
+		t.Errorf("Math.multiply: %#v", dec)
+	}
+	if dec := index.Lookup("String", "appendChar"); dec == nil || dec.Kind != "method" || dec.ReturnType.Name != "String" {
+		t.Errorf("String.appendChar: %#v", dec)
+	}
+	if index.Known("Game") {
+		t.Error("Game is known to a closed index")
+	}
+	index.Open = true
+	if !index.Known("Game") {
+		t.Error("Game is unknown to an open index")
+	}
+}
+
+func TestCompiler_ResolvesCalls(t *testing.T) {
+	src := `class Main {
+  function void main() {
+    var Game g;
+    let g = Game.new();
+    do g.run();
+    do Game.help();
+    return;
+  }
+}`
+	game := `class Game {
+  constructor Game new() { return this; }
+  method void run() { do step(); do help(); return; }
+  method void step() { return; }
+  function void help() { return; }
+}`
+	var classes []*Class
+	for _, s := range []string{src, game} {
+		class, err := NewParser(NewStringTokenizer("", s)).ParseClass()
+		if err != nil {
+			t.Fatal(err)
+		}
+		classes = append(classes, class)
+	}
+	index := NewIndex(classes)
+	if errs := Check(index, classes); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	var buf bytes.Buffer
+	NewCompiler(&buf, index).CompileClass(classes[1])
+	// step is a method and gets this, help is a function
+	want := "function Game.run 0\npush argument 0\npop pointer 0\npush pointer 0\ncall Game.step 1\npop temp 0\ncall Game.help 0\npop temp 0\npush constant 0\nreturn\n"
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("code:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// lintRules are the rules of the linter, in the order they are listed.
+var lintRules = []struct {
+	Name string
+	Doc  string
+}{
+	{"unused-local", "local variables that are never read"},
+	{"unused-param", "parameters that are never read"},
+	{"unused-field", "fields and static variables that are never read"},
+	{"uninitialized", "local variables read before they are assigned"},
+	{"unreachable", "statements after a return, break or continue"},
+	{"discarded-result", "do statements discarding the result of a subroutine that returns one"},
+	{"infinite-loop", "while (true) loops without a return or break"},
+	{"shadow", "parameters and locals hiding a field or static variable"},
+	{"missing-return", "subroutines that do not end in a return"},
+}
+
+// lintIgnore starts a comment suppressing warnings: "// jacklint:ignore"
+// alone suppresses all of them, followed by rule names separated by
+// commas only those rules. A comment suppresses the warnings on its line
+// and on the line after it.
+const lintIgnore = "jacklint:ignore"
+
+// ParseLintRules returns the rules named by spec, a list separated by
+// commas: names enable rules, names prefixed by - disable them. The rules
+// are all enabled if spec is empty or only disables some.
+func ParseLintRules(spec string) (map[string]bool, error) {
+	known := map[string]bool{}
+	for _, r := range lintRules {
+		known[r.Name] = true
+	}
+	rules := map[string]bool{}
+	var names []string
+	if spec != "" {
+		names = strings.Split(spec, ",")
+	}
+	all := true
+	for _, name := range names {
+		if !strings.HasPrefix(name, "-") {
+			all = false
+		}
+	}
+	if all {
+		for name := range known {
+			rules[name] = true
+		}
+	}
+	for _, name := range names {
+		enable := !strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		if !known[name] {
+			return nil, fmt.Errorf("unknown lint rule %q", name)
+		}
+		rules[name] = enable
+	}
+	return rules, nil
+}
+
+// Warning is a finding of the linter.
+type Warning struct {
+	Pos
+	Rule string
+	Msg  string
+}
+
+func (w *Warning) String() string {
+	return fmt.Sprintf("%s: %s (%s)", w.Pos, w.Msg, w.Rule)
+}
+
+type lintVar struct {
+	Kind string // static, field, argument or local
+	Type string
+	Pos  Pos
+	used bool
+}
+
+type linter struct {
+	index    *Index
+	rules    map[string]bool
+	warnings []*Warning
+
+	class    *Class
+	vars     map[string]*lintVar // of the class
+	sub      *SubroutineDec
+	locals   map[string]*lintVar
+	reported map[string]bool // locals reported read before assignment
+}
+
+// Lint looks for likely mistakes in classes, which parsed without errors,
+// with the rules enabled. Calls are resolved against index, which must
+// include the classes. The linter does not type-check: programs it warns
+// about may not compile. Warnings on lines that sources, the texts of the
+// files of the classes, mark with a jacklint:ignore comment are dropped.
+// The warnings are sorted by position.
+func Lint(index *Index, classes []*Class, rules map[string]bool, sources map[string]string) []*Warning {
+	l := &linter{index: index, rules: rules}
+	for _, class := range classes {
+		l.lintClass(class)
+	}
+	ignored := map[string]map[int][]string{}
+	var warnings []*Warning
+	for _, w := range l.warnings {
+		if _, ok := ignored[w.File]; !ok {
+			ignored[w.File] = lintIgnored(w.File, sources[w.File])
+		}
+		if rules, ok := ignored[w.File][w.Line]; ok && (len(rules) == 0 || contains(rules, w.Rule)) {
+			continue
+		}
+		warnings = append(warnings, w)
+	}
+	sort.SliceStable(warnings, func(i, j int) bool {
+		a, b := warnings[i].Pos, warnings[j].Pos
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return warnings
+}
+
+// lintIgnored returns the rules that the jacklint:ignore comments of src
+// suppress by line, none for all of them.
+func lintIgnored(file, src string) map[int][]string {
+	ignored := map[int][]string{}
+	t := NewStringTokenizer(file, src)
+	t.Comments = true
+	for {
+		token, err := t.Next()
+		if err != nil {
+			return ignored
+		}
+		if token.Kind != TOKEN_COMMENT {
+			continue
+		}
+		text := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(token.Text, "//"), "/*"), "*/")
+		text = strings.TrimSpace(text)
+		if !strings.HasPrefix(text, lintIgnore) {
+			continue
+		}
+		var rules []string
+		if fields := strings.Fields(strings.TrimPrefix(text, lintIgnore)); len(fields) > 0 {
+			rules = strings.Split(fields[0], ",")
+		}
+		line := token.Line + strings.Count(token.Text, "\n")
+		ignored[line] = rules
+		ignored[line+1] = rules
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *linter) warnf(rule string, pos Pos, format string, a ...interface{}) {
+	if l.rules[rule] {
+		l.warnings = append(l.warnings, &Warning{Pos: pos, Rule: rule, Msg: fmt.Sprintf(format, a...)})
+	}
+}
+
+func (l *linter) lintClass(class *Class) {
+	l.class = class
+	l.vars = map[string]*lintVar{}
+	var order []string
+	for _, dec := range class.Vars {
+		for _, id := range dec.Names {
+			if _, ok := l.vars[id.Name]; !ok {
+				l.vars[id.Name] = &lintVar{Kind: dec.Kind, Type: dec.Type.Name, Pos: id.Pos}
+				order = append(order, id.Name)
+			}
+		}
+	}
+	for _, dec := range class.Subroutines {
+		if dec.Body != nil {
+			l.lintSubroutine(dec)
+		}
+	}
+	for _, name := range order {
+		if v := l.vars[name]; !v.used {
+			l.warnf("unused-field", v.Pos, "%s %s declared and not used", v.Kind, name)
+		}
+	}
+}
+
+func (l *linter) lintSubroutine(dec *SubroutineDec) {
+	l.sub = dec
+	l.locals = map[string]*lintVar{}
+	l.reported = map[string]bool{}
+	var order []string
+	declare := func(kind string, typ, id Ident) {
+		if _, ok := l.locals[id.Name]; ok {
+			return
+		}
+		if v, ok := l.vars[id.Name]; ok {
+			l.warnf("shadow", id.Pos, "%s %s shadows %s %s declared at line %d", kind, id.Name, v.Kind, id.Name, v.Pos.Line)
+		}
+		l.locals[id.Name] = &lintVar{Kind: kind, Type: typ.Name, Pos: id.Pos}
+		order = append(order, id.Name)
+	}
+	for _, param := range dec.Params {
+		declare("argument", param.Type, param.Name)
+	}
+	for _, v := range dec.Body.Vars {
+		for _, id := range v.Names {
+			declare("local", v.Type, id)
+		}
+	}
+
+	l.statements(dec.Body.Statements, map[string]bool{})
+	if !returns(dec.Body.Statements) {
+		l.warnf("missing-return", dec.Body.End, "missing return at end of %s", dec.Name.Name)
+	}
+	for _, name := range order {
+		v := l.locals[name]
+		switch {
+		case v.used:
+		case v.Kind == "argument":
+			l.warnf("unused-param", v.Pos, "parameter %s is not used", name)
+		default:
+			l.warnf("unused-local", v.Pos, "%s declared and not used", name)
+		}
+	}
+}
+
+// statements lints a list of statements run with the locals of assigned
+// assigned on every path, which it updates. It reports whether no path
+// through the statements goes on after them, as after a return or a
+// break.
+func (l *linter) statements(statements []Statement, assigned map[string]bool) bool {
+	done := false
+	for _, s := range statements {
+		if done {
+			l.warnf("unreachable", s.Position(), "unreachable statement")
+			// the rest is linted as if it ran
+			done = false
+		}
+		done = l.statement(s, assigned)
+	}
+	return done
+}
+
+func (l *linter) statement(s Statement, assigned map[string]bool) bool {
+	switch s := s.(type) {
+	case *LetStatement:
+		if s.Index != nil {
+			l.use(s.Name, assigned)
+			l.expression(s.Index, assigned)
+			l.expression(s.Value, assigned)
+			return false
+		}
+		// assigning a variable does not use it
+		l.expression(s.Value, assigned)
+		assigned[s.Name.Name] = true
+	case *IfStatement:
+		l.expression(s.Cond, assigned)
+		then := copySet(assigned)
+		thenReturns := l.statements(s.Then.Statements, then)
+		els := copySet(assigned)
+		elseReturns := false
+		if s.Else != nil {
+			elseReturns = l.statements(s.Else.Statements, els)
+		}
+		// the locals assigned after the if are those assigned by every
+		// branch that does not return
+		switch {
+		case thenReturns && elseReturns:
+			return true
+		case thenReturns:
+			then = els
+		case !elseReturns:
+			for name := range then {
+				if !els[name] {
+					delete(then, name)
+				}
+			}
+		}
+		for name := range then {
+			assigned[name] = true
+		}
+	case *WhileStatement:
+		l.expression(s.Cond, assigned)
+		// the body may not run
+		l.statements(s.Body.Statements, copySet(assigned))
+		if alwaysTrue(s.Cond) && !exits(s.Body.Statements) {
+			l.warnf("infinite-loop", s.Pos, "while (true) loop without a return or break never ends")
+		}
+	case *ForStatement:
+		if s.Init != nil {
+			l.statement(s.Init, assigned)
+		}
+		l.expression(s.Cond, assigned)
+		body := copySet(assigned)
+		l.statements(s.Body.Statements, body)
+		if s.Step != nil {
+			l.statement(s.Step, body)
+		}
+	case *BreakStatement, *ContinueStatement:
+		return true
+	case *DoStatement:
+		l.call(s.Call, assigned)
+		if t := l.resultType(s.Call); t != "void" && t != typeAny {
+			l.warnf("discarded-result", s.Call.Pos, "result of %s (%s) is discarded", l.callName(s.Call), t)
+		}
+	case *ReturnStatement:
+		if s.Value != nil {
+			l.expression(s.Value, assigned)
+		}
+		return true
+	}
+	return false
+}
+
+func copySet(set map[string]bool) map[string]bool {
+	c := map[string]bool{}
+	for k, v := range set {
+		c[k] = v
+	}
+	return c
+}
+
+// alwaysTrue reports whether a condition is the constant true.
+func alwaysTrue(e Expression) bool {
+	switch e := e.(type) {
+	case *KeywordConstant:
+		return e.Value == "true"
+	case *ParenExpr:
+		return alwaysTrue(e.X)
+	case *UnaryExpr:
+		k, ok := e.X.(*KeywordConstant)
+		return e.Op == "~" && ok && k.Value == "false"
+	}
+	return false
+}
+
+// exits reports whether the statements of the body of a loop contain a
+// return statement, or a break statement of that loop.
+func exits(statements []Statement) bool {
+	return containsExit(statements, true)
+}
+
+func containsExit(statements []Statement, breaks bool) bool {
+	for _, s := range statements {
+		switch s := s.(type) {
+		case *ReturnStatement:
+			return true
+		case *BreakStatement:
+			if breaks {
+				return true
+			}
+		case *IfStatement:
+			if containsExit(s.Then.Statements, breaks) || s.Else != nil && containsExit(s.Else.Statements, breaks) {
+				return true
+			}
+		case *WhileStatement:
+			if containsExit(s.Body.Statements, false) {
+				return true
+			}
+		case *ForStatement:
+			if containsExit(s.Body.Statements, false) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lookup finds a variable of the current subroutine or class.
+func (l *linter) lookup(name string) (*lintVar, bool) {
+	if v, ok := l.locals[name]; ok {
+		return v, true
+	}
+	v, ok := l.vars[name]
+	return v, ok
+}
+
+// use marks a variable as used and reports a local read before it is
+// assigned on every path.
+func (l *linter) use(id Ident, assigned map[string]bool) {
+	v, ok := l.lookup(id.Name)
+	if !ok {
+		return
+	}
+	v.used = true
+	if v.Kind == "local" && !assigned[id.Name] && !l.reported[id.Name] {
+		l.reported[id.Name] = true
+		l.warnf("uninitialized", id.Pos, "%s is read before it is assigned", id.Name)
+	}
+}
+
+func (l *linter) expression(e Expression, assigned map[string]bool) {
+	switch e := e.(type) {
+	case *VarExpr:
+		l.use(Ident{Pos: e.Pos, Name: e.Name}, assigned)
+	case *IndexExpr:
+		l.use(e.Name, assigned)
+		l.expression(e.Index, assigned)
+	case *CallExpr:
+		l.call(e, assigned)
+	case *ParenExpr:
+		l.expression(e.X, assigned)
+	case *UnaryExpr:
+		l.expression(e.X, assigned)
+	case *BinaryExpr:
+		l.expression(e.X, assigned)
+		l.expression(e.Y, assigned)
+	}
+}
+
+func (l *linter) call(call *CallExpr, assigned map[string]bool) {
+	if call.Receiver != nil {
+		if _, ok := l.lookup(call.Receiver.Name); ok {
+			l.use(*call.Receiver, assigned)
+		}
+	}
+	for _, arg := range call.Args {
+		l.expression(arg, assigned)
+	}
+}
+
+// callClass returns the class of the subroutine a call calls.
+func (l *linter) callClass(call *CallExpr) string {
+	if call.Receiver == nil {
+		return l.class.Name.Name
+	}
+	if v, ok := l.lookup(call.Receiver.Name); ok {
+		return v.Type
+	}
+	return call.Receiver.Name
+}
+
+func (l *linter) callName(call *CallExpr) string {
+	return l.callClass(call) + "." + call.Name.Name
+}
+
+// resultType returns the return type of the subroutine a call calls, or
+// typeAny if it is unknown.
+func (l *linter) resultType(call *CallExpr) string {
+	if dec := l.index.Lookup(l.callClass(call), call.Name.Name); dec != nil {
+		return dec.ReturnType.Name
+	}
+	return typeAny
+}
+
+// WriteLintRules writes the rules of the linter and what they report.
+func WriteLintRules(w io.Writer) {
+	for _, r := range lintRules {
+		fmt.Fprintf(w, "  %-17s %s\n", r.Name, r.Doc)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func lintSource(t *testing.T, src string, spec string) []string {
+	class, err := NewParser(NewStringTokenizer("A.jack", src)).ParseClass()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ParseLintRules(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var warnings []string
+	for _, w := range Lint(NewIndex([]*Class{class}), []*Class{class}, rules, map[string]string{"A.jack": src}) {
+		warnings = append(warnings, w.String())
+	}
+	return warnings
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name string
+		body string // of Main.main, after its declarations
+		want []string
+	}{
+		{"clean", `var int i; let i = 1; let n = i; do Output.printInt(n + f()); return;`, nil},
+		{"unused local", `var int i, j; let i = 1; let n = i; return;`, []string{"A.jack:4:16: j declared and not used (unused-local)"}},
+		{"only assigned", `var int i; let i = 1; return;`, []string{"A.jack:4:13: i declared and not used (unused-local)"}},
+		{"uninitialized", `var int i; let n = i; let i = 1; return;`, []string{"A.jack:4:24: i is read before it is assigned (uninitialized)"}},
+		{"assigned in one branch", `var int i; if (n > 0) { let i = 1; } let n = i; return;`, []string{"A.jack:4:50: i is read before it is assigned (uninitialized)"}},
+		{"assigned in both branches", `var int i; if (n > 0) { let i = 1; } else { let i = 2; } let n = i; return;`, nil},
+		{"other branch returns", `var int i; if (n > 0) { return; } else { let i = 2; } let n = i; return;`, nil},
+		{"assigned in a loop", `var int i; while (n > 0) { let i = 1; let n = n - 1; } let n = i; return;`, []string{"A.jack:4:68: i is read before it is assigned (uninitialized)"}},
+		{"unreachable", `return; let n = 1; return;`, []string{"A.jack:4:13: unreachable statement (unreachable)"}},
+		{"unreachable after if", `if (n > 0) { return; } else { return; } let n = 1; return;`, []string{"A.jack:4:45: unreachable statement (unreachable)"}},
+		{"discarded result", `do f(); let n = 1; return;`, []string{"A.jack:4:8: result of Main.f (int) is discarded (discarded-result)"}},
+		{"infinite loop", `while (true) { let n = 1; } return;`, []string{"A.jack:4:5: while (true) loop without a return or break never ends (infinite-loop)"}},
+		{"loop with return", `while (~false) { if (n > 0) { return; } } return;`, nil},
+		{"missing return", `let n = 1;`, []string{"A.jack:5:3: missing return at end of main (missing-return)"}},
+	}
+	for _, tc := range tests {
+		src := "class Main {\n  static int n;\n  function void main() {\n    " + tc.body + "\n  }\n  function int f() { return n; }\n}\n"
+		if got := lintSource(t, src, ""); strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("%s: warnings\n%s\nwant\n%s", tc.name, strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+		}
+	}
+}
+
+const lintPoint = `class Point {
+  field int x, y, z;
+  constructor Point new(int x, int ay, int unused) { // jacklint:ignore unused-param
+    var int y;
+    let y = ay;
+    return this;
+  }
+  method int getX() { return x; }
+  // jacklint:ignore
+  method void setX(int ax, int bx) { let x = ax; return; }
+}
+`
+
+func TestLint_Class(t *testing.T) {
+	want := []string{
+		"A.jack:2:16: field y declared and not used (unused-field)",
+		"A.jack:2:19: field z declared and not used (unused-field)",
+		"A.jack:3:29: argument x shadows field x declared at line 2 (shadow)",
+		"A.jack:4:13: local y shadows field y declared at line 2 (shadow)",
+		"A.jack:4:13: y declared and not used (unused-local)",
+	}
+	got := lintSource(t, lintPoint, "")
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("warnings\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	got = lintSource(t, lintPoint, "shadow,unused-field,-unused-field")
+	if len(got) != 2 || !strings.HasSuffix(got[0], "(shadow)") || !strings.HasSuffix(got[1], "(shadow)") {
+		t.Errorf("warnings of the shadow rule %q", got)
+	}
+	if _, err := ParseLintRules("unused,shadow"); err == nil {
+		t.Error("an unknown rule was accepted")
+	}
+}
+
+func TestRun_Lint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jacklint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "Main.jack")
+	src := "class Main {\n  function void main() {\n    var int i;\n    do Output.printInt(i);\n    return;\n  }\n}\n"
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	status := run([]string{"-lint", "-json", dir})
+	os.Stdout = stdout
+	w.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 1 {
+		t.Errorf("exit status %d, want 1", status)
+	}
+	var warnings []struct {
+		File    string
+		Line    int
+		Column  int
+		Rule    string
+		Message string
+	}
+	if err := json.Unmarshal(out, &warnings); err != nil {
+		t.Fatalf("%v in %s", err, out)
+	}
+	if len(warnings) != 1 || warnings[0].File != path || warnings[0].Line != 4 || warnings[0].Column != 24 || warnings[0].Rule != "uninitialized" {
+		t.Errorf("warnings %+v", warnings)
+	}
+
+	if status := run([]string{"-lint", "-rules", "-uninitialized", dir}); status != 0 {
+		t.Errorf("exit status %d without the rule, want 0", status)
+	}
+}
+
+func TestLint_Extensions(t *testing.T) {
+	src := `class Main {
+  function void main() {
+    var int i;
+    while (true) {
+      for (i = 0; i < 3; i = i + 1) {
+        break;
+        let i = 5;
+      }
+      break;
+    }
+    while (true) {
+      for (i = 0; i < 3; i = i + 1) {
+        break;
+      }
+    }
+    return;
+  }
+}
+`
+	tk := NewStringTokenizer("A.jack", src)
+	tk.Extensions = true
+	class, err := NewParser(tk).ParseClass()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, _ := ParseLintRules("")
+	var got []string
+	for _, w := range Lint(NewIndex([]*Class{class}), []*Class{class}, rules, nil) {
+		got = append(got, w.String())
+	}
+	// the break of the inner loop does not leave the outer one
+	want := []string{
+		"A.jack:7:9: unreachable statement (unreachable)",
+		"A.jack:11:5: while (true) loop without a return or break never ends (infinite-loop)",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("warnings\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
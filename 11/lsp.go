@@ -0,0 +1,805 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jackSymbol is a declaration a name in the source can refer to.
+type jackSymbol struct {
+	Kind  string // class, constructor, function, method, static, field, arg or local
+	Name  string
+	Type  string // of a variable; the return type of a subroutine
+	Index int    // of a variable in its segment
+	Class string // the class declaring a subroutine or variable
+	Dec   *SubroutineDec
+	Pos   Pos // of the name in the declaration; in no file of the program for the OS API
+}
+
+// jackRef is an occurrence of a name, Decl if it is the declaration.
+type jackRef struct {
+	Pos    Pos
+	Name   string
+	Symbol *jackSymbol
+	Decl   bool
+}
+
+// jackScope holds the parameters and locals of a subroutine, from its
+// declaration to its closing brace.
+type jackScope struct {
+	Class      string
+	Start, End Pos
+	Vars       map[string]*jackSymbol
+}
+
+// analysis resolves every name of a program, whose classes are read from
+// sources by path.
+type analysis struct {
+	sources     map[string]string
+	files       map[string]*Class // the classes parsed, even partially, by path
+	errs        map[string][]*Error
+	index       *Index
+	classes     map[string]*jackSymbol
+	subroutines map[string]*jackSymbol // by Class.name
+	classVars   map[string]map[string]*jackSymbol
+	refs        map[string][]jackRef // by path
+	scopes      []*jackScope
+}
+
+// analyze parses and checks the program made of sources, and resolves its
+// names. Classes with syntax errors are resolved as far as they could be
+// parsed, but not checked, which would report what is only missing. With
+// ext the sources may use the language extensions.
+func analyze(sources map[string]string, ext bool) *analysis {
+	a := &analysis{
+		sources:     sources,
+		files:       map[string]*Class{},
+		errs:        map[string][]*Error{},
+		classes:     map[string]*jackSymbol{},
+		subroutines: map[string]*jackSymbol{},
+		classVars:   map[string]map[string]*jackSymbol{},
+		refs:        map[string][]jackRef{},
+	}
+	var paths []string
+	for path := range sources {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var classes, clean []*Class
+	for _, path := range paths {
+		t := NewStringTokenizer(path, sources[path])
+		t.Extensions = ext
+		class, err := NewParser(t).ParseClass()
+		a.addErrors(err)
+		if class == nil {
+			continue
+		}
+		a.files[path] = class
+		classes = append(classes, class)
+		if err == nil {
+			clean = append(clean, class)
+		}
+	}
+	a.index = NewIndex(classes)
+	for _, err := range Check(a.index, clean) {
+		a.addErrors(err)
+	}
+
+	for name, ci := range a.index.Classes {
+		s := &jackSymbol{Kind: "class", Name: name}
+		if ci.Class != nil {
+			s.Pos = ci.Class.Name.Pos
+		}
+		a.classes[name] = s
+		for _, dec := range ci.Subroutines {
+			a.subroutines[name+"."+dec.Name.Name] = &jackSymbol{
+				Kind: dec.Kind, Name: dec.Name.Name, Type: dec.ReturnType.Name, Class: name, Dec: dec, Pos: dec.Name.Pos,
+			}
+		}
+	}
+	for _, class := range classes {
+		a.resolveClass(class)
+	}
+	return a
+}
+
+func (a *analysis) addErrors(err error) {
+	switch err := err.(type) {
+	case ErrorList:
+		for _, e := range err {
+			a.addErrors(e)
+		}
+	case *Error:
+		a.errs[err.File] = append(a.errs[err.File], err)
+	}
+}
+
+// ref records an occurrence of the name id of s, if s is known.
+func (a *analysis) ref(id Ident, s *jackSymbol, decl bool) {
+	if s != nil {
+		a.refs[id.File] = append(a.refs[id.File], jackRef{id.Pos, id.Name, s, decl})
+	}
+}
+
+func (a *analysis) resolveClass(class *Class) {
+	name := class.Name.Name
+	table := NewSymbolTable()
+	vars := map[string]*jackSymbol{}
+	if a.classVars[name] == nil {
+		// the first class of the name is the one indexed
+		a.classVars[name] = vars
+	}
+	a.ref(class.Name, a.classes[name], true)
+	// declare defines a variable as the compiler does, so that it gets the
+	// same index in its segment
+	declare := func(vars map[string]*jackSymbol, typ, id Ident, kind string) {
+		a.ref(typ, a.classes[typ.Name], false)
+		if prev, ok := vars[id.Name]; ok {
+			a.ref(id, prev, false)
+			return
+		}
+		table.Define(id.Name, typ.Name, kind)
+		s := &jackSymbol{Kind: kind, Name: id.Name, Type: typ.Name, Index: table.VarCount(kind) - 1, Class: name, Pos: id.Pos}
+		vars[id.Name] = s
+		a.ref(id, s, true)
+	}
+	for _, dec := range class.Vars {
+		for _, id := range dec.Names {
+			declare(vars, dec.Type, id, dec.Kind)
+		}
+	}
+	for _, dec := range class.Subroutines {
+		table.StartSubroutine()
+		scope := &jackScope{Class: name, Start: dec.Pos, End: dec.Body.End, Vars: map[string]*jackSymbol{}}
+		a.scopes = append(a.scopes, scope)
+		a.ref(dec.ReturnType, a.classes[dec.ReturnType.Name], false)
+		a.ref(dec.Name, a.subroutines[name+"."+dec.Name.Name], true)
+		if dec.Kind == "method" {
+			table.Define("this", name, "arg")
+		}
+		for _, param := range dec.Params {
+			declare(scope.Vars, param.Type, param.Name, "arg")
+		}
+		for _, v := range dec.Body.Vars {
+			for _, id := range v.Names {
+				declare(scope.Vars, v.Type, id, "local")
+			}
+		}
+		r := &resolver{a, name, func(name string) *jackSymbol {
+			if s, ok := scope.Vars[name]; ok {
+				return s
+			}
+			return vars[name]
+		}}
+		r.statements(dec.Body.Statements)
+	}
+}
+
+// resolver resolves the names used in the statements of a subroutine.
+type resolver struct {
+	a      *analysis
+	class  string
+	lookup func(name string) *jackSymbol
+}
+
+func (r *resolver) statements(statements []Statement) {
+	for _, s := range statements {
+		switch s := s.(type) {
+		case *LetStatement:
+			r.a.ref(s.Name, r.lookup(s.Name.Name), false)
+			if s.Index != nil {
+				r.expression(s.Index)
+			}
+			r.expression(s.Value)
+		case *IfStatement:
+			r.expression(s.Cond)
+			r.statements(s.Then.Statements)
+			if s.Else != nil {
+				r.statements(s.Else.Statements)
+			}
+		case *WhileStatement:
+			r.expression(s.Cond)
+			r.statements(s.Body.Statements)
+		case *ForStatement:
+			if s.Init != nil {
+				r.statements([]Statement{s.Init})
+			}
+			r.expression(s.Cond)
+			if s.Step != nil {
+				r.statements([]Statement{s.Step})
+			}
+			r.statements(s.Body.Statements)
+		case *DoStatement:
+			r.call(s.Call)
+		case *ReturnStatement:
+			if s.Value != nil {
+				r.expression(s.Value)
+			}
+		}
+	}
+}
+
+func (r *resolver) expression(e Expression) {
+	switch e := e.(type) {
+	case *VarExpr:
+		r.a.ref(Ident{e.Pos, e.Name}, r.lookup(e.Name), false)
+	case *IndexExpr:
+		r.a.ref(e.Name, r.lookup(e.Name.Name), false)
+		r.expression(e.Index)
+	case *CallExpr:
+		r.call(e)
+	case *ParenExpr:
+		r.expression(e.X)
+	case *UnaryExpr:
+		r.expression(e.X)
+	case *BinaryExpr:
+		r.expression(e.X)
+		r.expression(e.Y)
+	}
+}
+
+// call resolves the subroutine called the way the compiler does.
+func (r *resolver) call(call *CallExpr) {
+	className := r.class
+	if call.Receiver != nil {
+		if v := r.lookup(call.Receiver.Name); v != nil {
+			r.a.ref(*call.Receiver, v, false)
+			className = v.Type
+		} else {
+			className = call.Receiver.Name
+			r.a.ref(*call.Receiver, r.a.classes[className], false)
+		}
+	}
+	r.a.ref(call.Name, r.a.subroutines[className+"."+call.Name.Name], false)
+	for _, arg := range call.Args {
+		r.expression(arg)
+	}
+}
+
+// refAt returns the name at pos of the file at path.
+func (a *analysis) refAt(path string, pos Pos) (jackRef, bool) {
+	for _, r := range a.refs[path] {
+		if r.Pos.Line == pos.Line && r.Pos.Col <= pos.Col && pos.Col <= r.Pos.Col+len(r.Name) {
+			return r, true
+		}
+	}
+	return jackRef{}, false
+}
+
+// lookupAt returns the variable name visible at pos of the file at path.
+func (a *analysis) lookupAt(path string, pos Pos, name string) *jackSymbol {
+	for _, scope := range a.scopes {
+		if scope.Start.File == path && !before(pos, scope.Start) && !before(scope.End, pos) {
+			if s, ok := scope.Vars[name]; ok {
+				return s
+			}
+		}
+	}
+	if class, ok := a.files[path]; ok {
+		return a.classVars[class.Name.Name][name]
+	}
+	return nil
+}
+
+func before(p, q Pos) bool {
+	return p.Line < q.Line || p.Line == q.Line && p.Col < q.Col
+}
+
+// subroutineSignature describes a subroutine as it is declared.
+func subroutineSignature(class string, dec *SubroutineDec) string {
+	var params []string
+	for _, p := range dec.Params {
+		params = append(params, p.Type.Name+" "+p.Name.Name)
+	}
+	return fmt.Sprintf("%s %s %s.%s(%s)", dec.Kind, dec.ReturnType.Name, class, dec.Name.Name, strings.Join(params, ", "))
+}
+
+// describe is the hover text of s: its declaration and, for a variable,
+// where the compiled code keeps it.
+func describe(s *jackSymbol) string {
+	switch s.Kind {
+	case "class":
+		return "class " + s.Name
+	case "constructor", "function", "method":
+		return subroutineSignature(s.Class, s.Dec)
+	}
+	kind := s.Kind
+	if kind == "arg" {
+		kind = "argument"
+	}
+	return fmt.Sprintf("%s %s %s (%s %d)", kind, s.Type, s.Name, kindToSegment[s.Kind], s.Index)
+}
+
+// members returns the subroutines that can be called on receiver at pos:
+// the methods of the class of a variable, or the functions and
+// constructors of a class.
+func (a *analysis) members(path string, pos Pos, receiver string) []*jackSymbol {
+	className, methods := receiver, false
+	if v := a.lookupAt(path, pos, receiver); v != nil {
+		className, methods = v.Type, true
+	}
+	ci, ok := a.index.Classes[className]
+	if !ok {
+		return nil
+	}
+	var list []*jackSymbol
+	for name, dec := range ci.Subroutines {
+		if (dec.Kind == "method") == methods {
+			list = append(list, a.subroutines[className+"."+name])
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Language Server Protocol over JSON-RPC 2.0, with Content-Length framing.
+type rpcMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// rpcError is an error answered with its JSON-RPC code.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+const (
+	rpcInvalidParams  = -32602
+	rpcMethodNotFound = -32601
+	rpcInternalError  = -32603
+)
+
+func readRPCMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if i := strings.Index(line, ":"); i != -1 && strings.EqualFold(line[:i], "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(line[i+1:])); err != nil {
+				return nil, fmt.Errorf("invalid header %q", line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("message without Content-Length")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func writeRPCMessage(w io.Writer, message interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+// LSP types, as far as the server uses them.
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspPositionParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+	Context  struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"`
+}
+
+// Jack sources are ASCII, so that the UTF-16 characters of LSP positions
+// are the bytes of Pos columns.
+func toPos(path string, p lspPosition) Pos {
+	return Pos{File: path, Line: p.Line + 1, Col: p.Character + 1}
+}
+
+func nameRange(pos Pos, length int) lspRange {
+	start := lspPosition{pos.Line - 1, pos.Col - 1}
+	return lspRange{start, lspPosition{start.Line, start.Character + length}}
+}
+
+func pathToURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+func uriToPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("%s: not a file", uri)
+	}
+	return filepath.Clean(u.Path), nil
+}
+
+// lspServer serves the Jack sources of the directories of the documents
+// open in an editor. A program is the .jack files of a directory, the
+// open documents replacing what is on disk.
+type lspServer struct {
+	w     io.Writer
+	ext   bool                 // the sources may use the language extensions
+	docs  map[string]string    // open documents by path
+	cache map[string]*analysis // by directory
+}
+
+// serveLSP serves the Language Server Protocol, reading from r and
+// writing to w, until the exit notification or the end of r. With ext the
+// sources may use the language extensions.
+func serveLSP(r io.Reader, w io.Writer, ext bool) error {
+	s := &lspServer{w: w, ext: ext, docs: map[string]string{}, cache: map[string]*analysis{}}
+	br := bufio.NewReader(r)
+	for {
+		body, err := readRPCMessage(br)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var m rpcMessage
+		if err := json.Unmarshal(body, &m); err != nil {
+			return err
+		}
+		if m.Method == "" {
+			// a response to the server
+			continue
+		}
+		if m.Method == "exit" {
+			return nil
+		}
+		result, err := s.handle(m.Method, m.Params)
+		if len(m.ID) == 0 {
+			continue
+		}
+		response := map[string]interface{}{"jsonrpc": "2.0", "id": m.ID}
+		if err != nil {
+			e, ok := err.(*rpcError)
+			if !ok {
+				e = &rpcError{rpcInternalError, err.Error()}
+			}
+			response["error"] = e
+		} else {
+			response["result"] = result
+		}
+		if err := writeRPCMessage(w, response); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *lspServer) notify(method string, params interface{}) error {
+	return writeRPCMessage(s.w, map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+// analysis returns the analysis of the program of the file at path.
+func (s *lspServer) analysis(path string) (*analysis, error) {
+	dir := filepath.Dir(path)
+	if a, ok := s.cache[dir]; ok {
+		return a, nil
+	}
+	sources := map[string]string{}
+	files, err := filepath.Glob(filepath.Join(dir, "*.jack"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		sources[file] = string(src)
+	}
+	for path, src := range s.docs {
+		if filepath.Dir(path) == dir {
+			sources[path] = src
+		}
+	}
+	a := analyze(sources, s.ext)
+	s.cache[dir] = a
+	return a, nil
+}
+
+// changed forgets the analysis of the program of path and publishes the
+// diagnostics of its open documents again.
+func (s *lspServer) changed(path string) error {
+	delete(s.cache, filepath.Dir(path))
+	a, err := s.analysis(path)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for doc := range s.docs {
+		if filepath.Dir(doc) == filepath.Dir(path) {
+			paths = append(paths, doc)
+		}
+	}
+	sort.Strings(paths)
+	for _, doc := range paths {
+		diagnostics := []interface{}{}
+		for _, e := range a.errs[doc] {
+			diagnostics = append(diagnostics, map[string]interface{}{
+				"range":    nameRange(e.Pos, tokenLength(a.sources[doc], e.Pos)),
+				"severity": 1,
+				"source":   "jackc",
+				"message":  e.Msg,
+			})
+		}
+		if err := s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+			"uri": pathToURI(doc), "diagnostics": diagnostics,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tokenLength returns the length of the identifier or word at pos of src,
+// at least 1.
+func tokenLength(src string, pos Pos) int {
+	lines := strings.Split(src, "\n")
+	if pos.Line < 1 || pos.Line > len(lines) || pos.Col < 1 || pos.Col > len(lines[pos.Line-1]) {
+		return 1
+	}
+	line := lines[pos.Line-1]
+	n := 0
+	for i := pos.Col - 1; i < len(line) && IsIdentifier(line[i]); i++ {
+		n += 1
+	}
+	if n == 0 {
+		return 1
+	}
+	return n
+}
+
+func (s *lspServer) handle(method string, params json.RawMessage) (interface{}, error) {
+	switch method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       1, // full documents
+				"definitionProvider":     true,
+				"hoverProvider":          true,
+				"referencesProvider":     true,
+				"documentSymbolProvider": true,
+				"completionProvider":     map[string]interface{}{"triggerCharacters": []string{"."}},
+			},
+			"serverInfo": map[string]interface{}{"name": "jackc"},
+		}, nil
+	case "initialized", "shutdown", "$/cancelRequest", "workspace/didChangeConfiguration":
+		return nil, nil
+	case "textDocument/didOpen", "textDocument/didChange", "textDocument/didClose":
+		var p struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		path, err := uriToPath(p.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		switch method {
+		case "textDocument/didOpen":
+			s.docs[path] = p.TextDocument.Text
+		case "textDocument/didChange":
+			if n := len(p.ContentChanges); n > 0 {
+				s.docs[path] = p.ContentChanges[n-1].Text
+			}
+		default:
+			delete(s.docs, path)
+			if err := s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+				"uri": p.TextDocument.URI, "diagnostics": []interface{}{},
+			}); err != nil {
+				return nil, err
+			}
+		}
+		return nil, s.changed(path)
+	case "textDocument/definition", "textDocument/hover", "textDocument/references", "textDocument/completion":
+		var p lspPositionParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		path, err := uriToPath(p.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		a, err := s.analysis(path)
+		if err != nil {
+			return nil, err
+		}
+		pos := toPos(path, p.Position)
+		if method == "textDocument/completion" {
+			return completion(a, path, pos), nil
+		}
+		r, ok := a.refAt(path, pos)
+		if !ok {
+			return nil, nil
+		}
+		switch method {
+		case "textDocument/definition":
+			if _, ok := a.sources[r.Symbol.Pos.File]; !ok {
+				// in the OS API
+				return nil, nil
+			}
+			return lspLocation{pathToURI(r.Symbol.Pos.File), nameRange(r.Symbol.Pos, len(r.Symbol.Name))}, nil
+		case "textDocument/hover":
+			return map[string]interface{}{
+				"contents": map[string]interface{}{"kind": "plaintext", "value": describe(r.Symbol)},
+				"range":    nameRange(r.Pos, len(r.Name)),
+			}, nil
+		}
+		locations := []lspLocation{}
+		var paths []string
+		for path := range a.refs {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			for _, ref := range a.refs[path] {
+				if ref.Symbol == r.Symbol && (!ref.Decl || p.Context.IncludeDeclaration) {
+					locations = append(locations, lspLocation{pathToURI(path), nameRange(ref.Pos, len(ref.Name))})
+				}
+			}
+		}
+		return locations, nil
+	case "textDocument/documentSymbol":
+		var p lspPositionParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		path, err := uriToPath(p.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		a, err := s.analysis(path)
+		if err != nil {
+			return nil, err
+		}
+		class, ok := a.files[path]
+		if !ok {
+			return []interface{}{}, nil
+		}
+		return []interface{}{documentSymbol(class)}, nil
+	}
+	return nil, &rpcError{rpcMethodNotFound, "method not supported: " + method}
+}
+
+// LSP symbol and completion item kinds.
+const (
+	lspKindMethod      = 2
+	lspKindFunction    = 3
+	lspKindConstructor = 4
+
+	lspSymbolClass       = 5
+	lspSymbolMethod      = 6
+	lspSymbolField       = 8
+	lspSymbolConstructor = 9
+	lspSymbolFunction    = 12
+	lspSymbolVariable    = 13
+)
+
+// completion completes the name of a subroutine after "receiver." at pos.
+func completion(a *analysis, path string, pos Pos) []interface{} {
+	items := []interface{}{}
+	lines := strings.Split(a.sources[path], "\n")
+	if pos.Line > len(lines) || pos.Col-1 > len(lines[pos.Line-1]) {
+		return items
+	}
+	text := lines[pos.Line-1][:pos.Col-1]
+	i := len(text)
+	for i > 0 && IsIdentifier(text[i-1]) {
+		i -= 1
+	}
+	prefix := text[i:]
+	if i == 0 || text[i-1] != '.' {
+		return items
+	}
+	j := i - 1
+	for j > 0 && IsIdentifier(text[j-1]) {
+		j -= 1
+	}
+	receiver := text[j : i-1]
+	if receiver == "" {
+		return items
+	}
+	for _, s := range a.members(path, pos, receiver) {
+		if !strings.HasPrefix(s.Name, prefix) {
+			continue
+		}
+		kind := lspKindFunction
+		switch s.Kind {
+		case "method":
+			kind = lspKindMethod
+		case "constructor":
+			kind = lspKindConstructor
+		}
+		items = append(items, map[string]interface{}{"label": s.Name, "kind": kind, "detail": subroutineSignature(s.Class, s.Dec)})
+	}
+	return items
+}
+
+// documentSymbol returns the outline of class.
+func documentSymbol(class *Class) interface{} {
+	symbol := func(name string, kind int, detail string, start, end Pos, id Ident) map[string]interface{} {
+		if end.Line == 0 {
+			// the parse stopped before the end
+			end = start
+		}
+		r := nameRange(start, 0)
+		r.End = nameRange(end, 1).End
+		return map[string]interface{}{
+			"name": name, "kind": kind, "detail": detail,
+			"range": r, "selectionRange": nameRange(id.Pos, len(id.Name)),
+		}
+	}
+	children := []interface{}{}
+	for _, dec := range class.Vars {
+		kind := lspSymbolField
+		if dec.Kind == "static" {
+			kind = lspSymbolVariable
+		}
+		for _, id := range dec.Names {
+			end := id.Pos
+			end.Col += len(id.Name) - 1
+			children = append(children, symbol(id.Name, kind, dec.Kind+" "+dec.Type.Name, id.Pos, end, id))
+		}
+	}
+	for _, dec := range class.Subroutines {
+		kind := lspSymbolFunction
+		switch dec.Kind {
+		case "method":
+			kind = lspSymbolMethod
+		case "constructor":
+			kind = lspSymbolConstructor
+		}
+		children = append(children, symbol(dec.Name.Name, kind, subroutineSignature(class.Name.Name, dec), dec.Pos, dec.Body.End, dec.Name))
+	}
+	s := symbol(class.Name.Name, lspSymbolClass, "", class.Pos, class.End, class.Name)
+	s["children"] = children
+	return s
+}
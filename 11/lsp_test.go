@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// lspClient talks to a server running in the test, as an editor would.
+type lspClient struct {
+	t     *testing.T
+	w     io.Writer
+	r     *bufio.Reader
+	id    int
+	notes []lspTestMessage
+}
+
+type lspTestMessage struct {
+	ID     int             `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+func (c *lspClient) send(message map[string]interface{}) {
+	c.t.Helper()
+	message["jsonrpc"] = "2.0"
+	if err := writeRPCMessage(c.w, message); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *lspClient) read() lspTestMessage {
+	c.t.Helper()
+	body, err := readRPCMessage(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var m lspTestMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+// call sends a request and decodes its result into result.
+func (c *lspClient) call(method string, params interface{}, result interface{}) {
+	c.t.Helper()
+	c.id += 1
+	c.send(map[string]interface{}{"id": c.id, "method": method, "params": params})
+	for {
+		m := c.read()
+		if m.Method != "" {
+			c.notes = append(c.notes, m)
+			continue
+		}
+		if m.ID != c.id {
+			c.t.Fatalf("response to %d, want %d", m.ID, c.id)
+		}
+		if m.Error != nil {
+			c.t.Fatalf("%s: %s", method, m.Error.Message)
+		}
+		if result != nil {
+			if err := json.Unmarshal(m.Result, result); err != nil {
+				c.t.Fatalf("%s: %v in %s", method, err, m.Result)
+			}
+		}
+		return
+	}
+}
+
+// diagnostics waits for the diagnostics of uri and returns their
+// messages, prefixed with their 1-based line.
+func (c *lspClient) diagnostics(uri string) []string {
+	c.t.Helper()
+	for {
+		var m lspTestMessage
+		if len(c.notes) > 0 {
+			m, c.notes = c.notes[0], c.notes[1:]
+		} else {
+			m = c.read()
+		}
+		if m.Method != "textDocument/publishDiagnostics" {
+			continue
+		}
+		var p struct {
+			URI         string
+			Diagnostics []struct {
+				Range   lspRange
+				Message string
+			}
+		}
+		json.Unmarshal(m.Params, &p)
+		if p.URI != uri {
+			continue
+		}
+		msgs := []string{}
+		for _, d := range p.Diagnostics {
+			msgs = append(msgs, strings.Join([]string{strconv.Itoa(d.Range.Start.Line + 1), d.Message}, ": "))
+		}
+		return msgs
+	}
+}
+
+const lspMain = `class Main {
+  function void main() {
+    var Point p;
+    var int n;
+    let p = Point.new(1, 2);
+    let n = p.sum() + q;
+    do Output.printInt(n);
+    return;
+  }
+}
+`
+
+const lspPoint = `/** A point of the plane. */
+class Point {
+  field int x, y;
+  static int count;
+
+  constructor Point new(int ax, int ay) {
+    let x = ax;
+    let y = ay;
+    let count = count + 1;
+    return this;
+  }
+
+  method int sum() {
+    return x + y;
+  }
+
+  function int total() {
+    return count;
+  }
+}
+`
+
+func TestLSP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mainPath := filepath.Join(dir, "Main.jack")
+	pointPath := filepath.Join(dir, "Point.jack")
+	// Main is only open in the editor
+	if err := ioutil.WriteFile(pointPath, []byte(lspPoint), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mainURI, pointURI := pathToURI(mainPath), pathToURI(pointPath)
+
+	requests, server := io.Pipe()
+	client, responses := io.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- serveLSP(requests, responses, false)
+		responses.Close()
+	}()
+	c := &lspClient{t: t, w: server, r: bufio.NewReader(client)}
+
+	var init struct {
+		Capabilities struct {
+			DefinitionProvider bool
+			TextDocumentSync   int
+		}
+	}
+	c.call("initialize", map[string]interface{}{"processId": nil, "rootUri": pathToURI(dir)}, &init)
+	if !init.Capabilities.DefinitionProvider || init.Capabilities.TextDocumentSync != 1 {
+		t.Errorf("capabilities %+v", init.Capabilities)
+	}
+	c.send(map[string]interface{}{"method": "initialized", "params": map[string]interface{}{}})
+
+	c.send(map[string]interface{}{"method": "textDocument/didOpen", "params": map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": mainURI, "languageId": "jack", "version": 1, "text": lspMain},
+	}})
+	if got := c.diagnostics(mainURI); len(got) != 1 || got[0] != "6: undefined: q" {
+		t.Errorf("diagnostics %q", got)
+	}
+	fixed := strings.Replace(lspMain, " + q;", ";", 1)
+	c.send(map[string]interface{}{"method": "textDocument/didChange", "params": map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": mainURI, "version": 2},
+		"contentChanges": []interface{}{map[string]interface{}{"text": strings.Replace(fixed, "return;", "return", 1)}},
+	}})
+	if got := c.diagnostics(mainURI); len(got) != 1 || !strings.HasPrefix(got[0], "9: expected ';'") {
+		t.Errorf("diagnostics of a syntax error %q", got)
+	}
+	c.send(map[string]interface{}{"method": "textDocument/didChange", "params": map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": mainURI, "version": 3},
+		"contentChanges": []interface{}{map[string]interface{}{"text": fixed}},
+	}})
+	if got := c.diagnostics(mainURI); len(got) != 0 {
+		t.Errorf("diagnostics of a correct program %q", got)
+	}
+
+	at := func(uri string, line, char int) map[string]interface{} {
+		return map[string]interface{}{
+			"textDocument": map[string]interface{}{"uri": uri},
+			"position":     map[string]interface{}{"line": line - 1, "character": char - 1},
+			"context":      map[string]interface{}{"includeDeclaration": true},
+		}
+	}
+	// the column of the first s of "sum" in the line "    let n = p.sum();"
+	var loc lspLocation
+	c.call("textDocument/definition", at(mainURI, 6, 15), &loc)
+	if loc.URI != pointURI || loc.Range.Start.Line != 12 || loc.Range.Start.Character != 13 {
+		t.Errorf("definition of sum at %+v", loc)
+	}
+	c.call("textDocument/definition", at(mainURI, 5, 13), &loc)
+	if loc.URI != pointURI || loc.Range.Start.Line != 1 {
+		t.Errorf("definition of Point at %+v", loc)
+	}
+
+	hover := func(uri string, line, char int) string {
+		var h struct{ Contents struct{ Value string } }
+		c.call("textDocument/hover", at(uri, line, char), &h)
+		return h.Contents.Value
+	}
+	for _, tc := range []struct {
+		uri        string
+		line, char int
+		want       string
+	}{
+		{mainURI, 6, 9, "local int n (local 1)"},
+		{mainURI, 5, 19, "constructor Point Point.new(int ax, int ay)"},
+		{mainURI, 7, 15, "function void Output.printInt(int i)"},
+		{pointURI, 8, 9, "field int y (this 1)"},
+		{pointURI, 8, 13, "argument int ay (argument 1)"},
+		{pointURI, 18, 12, "static int count (static 0)"},
+	} {
+		if got := hover(tc.uri, tc.line, tc.char); got != tc.want {
+			t.Errorf("hover at %d:%d = %q, want %q", tc.line, tc.char, got, tc.want)
+		}
+	}
+
+	var refs []lspLocation
+	c.call("textDocument/references", at(pointURI, 3, 13), &refs)
+	if len(refs) != 3 || refs[0].Range.Start.Line != 2 || refs[1].Range.Start.Line != 6 || refs[2].Range.Start.Line != 13 {
+		t.Errorf("references of x %+v", refs)
+	}
+	c.call("textDocument/references", at(mainURI, 5, 13), &refs)
+	if len(refs) != 4 {
+		t.Errorf("references of Point %+v", refs)
+	}
+
+	complete := func(text string, line, char int) []string {
+		c.send(map[string]interface{}{"method": "textDocument/didChange", "params": map[string]interface{}{
+			"textDocument":   map[string]interface{}{"uri": mainURI},
+			"contentChanges": []interface{}{map[string]interface{}{"text": text}},
+		}})
+		c.diagnostics(mainURI)
+		var items []struct{ Label string }
+		c.call("textDocument/completion", at(mainURI, line, char), &items)
+		var labels []string
+		for _, item := range items {
+			labels = append(labels, item.Label)
+		}
+		return labels
+	}
+	typing := strings.Replace(fixed, "do Output.printInt(n);", "do p.", 1)
+	if got := strings.Join(complete(typing, 7, 10), " "); got != "sum" {
+		t.Errorf("completion of p. = %s", got)
+	}
+	typing = strings.Replace(fixed, "do Output.printInt(n);", "let n = Point.t", 1)
+	if got := strings.Join(complete(typing, 7, 20), " "); got != "total" {
+		t.Errorf("completion of Point.t = %s", got)
+	}
+	typing = strings.Replace(fixed, "do Output.printInt(n);", "do Output.", 1)
+	if got := complete(typing, 7, 15); len(got) != 7 || got[0] != "backSpace" {
+		t.Errorf("completion of Output. = %v", got)
+	}
+
+	var symbols []struct {
+		Name     string
+		Kind     int
+		Children []struct {
+			Name   string
+			Kind   int
+			Detail string
+		}
+	}
+	c.call("textDocument/documentSymbol", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": pointURI},
+	}, &symbols)
+	var outline []string
+	for _, s := range symbols[0].Children {
+		outline = append(outline, s.Name+" "+strconv.Itoa(s.Kind))
+	}
+	if symbols[0].Name != "Point" || strings.Join(outline, ", ") != "x 8, y 8, count 13, new 9, sum 6, total 12" {
+		t.Errorf("symbols %s %v", symbols[0].Name, outline)
+	}
+
+	c.id += 1
+	c.send(map[string]interface{}{"id": c.id, "method": "textDocument/formatting", "params": map[string]interface{}{}})
+	if m := c.read(); m.Error == nil || m.Error.Code != rpcMethodNotFound {
+		t.Errorf("unsupported method answered %+v", m)
+	}
+	c.call("shutdown", nil, nil)
+	c.send(map[string]interface{}{"method": "exit"})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnalyze_Extensions(t *testing.T) {
+	path := "test/ext/Loops/Main.jack"
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := map[string]string{path: string(src)}
+	if a := analyze(sources, false); len(a.errs[path]) == 0 {
+		t.Error("no diagnostics for the extensions without ext")
+	}
+	a := analyze(sources, true)
+	if len(a.errs[path]) > 0 {
+		t.Errorf("diagnostics %v", a.errs[path])
+	}
+	// i in the header of the first for loop, "for (i = 1; i < 11; i = i + 1) {"
+	var cols []int
+	for _, ref := range a.refs[path] {
+		if ref.Pos.Line == 18 && ref.Name == "i" && ref.Symbol.Kind == "local" {
+			cols = append(cols, ref.Pos.Col)
+		}
+	}
+	if want := []int{14, 21, 29, 33}; fmt.Sprint(cols) != fmt.Sprint(want) {
+		t.Errorf("references of i at columns %v, want %v", cols, want)
+	}
+}
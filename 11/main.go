@@ -1,90 +1,487 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
-	"fmt"
 )
 
 func main() {
-	filename := os.Args[1]
-	stat, err := os.Stat(filename)
-	if err != nil {
-		log.Fatal(err)
+	log.SetFlags(0)
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	fs := flag.NewFlagSet("jackc", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: jackc [flags] input...")
+		fmt.Fprintln(fs.Output(), "")
+		fmt.Fprintln(fs.Output(), "Each input is a .jack file or a directory of .jack files. Foo.jack is")
+		fmt.Fprintln(fs.Output(), "compiled to Foo.vm, next to the source unless -d is given. The classes of")
+		fmt.Fprintln(fs.Output(), "the Jack OS that the program does not define are compiled with it.")
+		fmt.Fprintln(fs.Output(), "With -lsp it serves the Language Server Protocol on stdin and stdout")
+		fmt.Fprintln(fs.Output(), "instead, for the programs of the documents an editor opens.")
+		fmt.Fprintln(fs.Output(), "With -fmt it is jackfmt: it prints the inputs in their canonical format,")
+		fmt.Fprintln(fs.Output(), "comments kept, or with -w rewrites them.")
+		fmt.Fprintln(fs.Output(), "With -lint it is jacklint: it warns about likely mistakes in the inputs")
+		fmt.Fprintln(fs.Output(), "with the rules below, except on the lines a // jacklint:ignore [rule,...]")
+		fmt.Fprintln(fs.Output(), "comment is on or precedes.")
+		fmt.Fprintln(fs.Output(), "With -doc it is jackdoc: it writes Foo.html and Foo.md reference pages from")
+		fmt.Fprintln(fs.Output(), "the /** */ comments of the inputs, and index.html and index.md.")
+		fmt.Fprintln(fs.Output(), "At most one of -lsp, -fmt, -lint and -doc can be given.")
+		fmt.Fprintln(fs.Output(), "With -ext, every mode accepts the language extensions: for loops")
+		fmt.Fprintln(fs.Output(), "for (i = 0; i < n; i = i + 1) { ... }, break and continue.")
+		fmt.Fprintln(fs.Output(), "")
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output(), "")
+		fmt.Fprintln(fs.Output(), "Lint rules:")
+		WriteLintRules(fs.Output())
+	}
+	outDir := fs.String("d", "", "write output files to `dir` instead of next to the sources")
+	dumpXML := fs.Bool("xml", false, "also write the parse tree to Foo.xml")
+	dumpTokens := fs.Bool("tokens", false, "also write the tokens to FooT.xml")
+	linkOS := fs.Bool("os", true, "write the VM code of the Jack OS classes the program does not define")
+	debug := fs.Bool("g", false, "write debug information as comments in the VM code of the program")
+	lsp := fs.Bool("lsp", false, "serve the Language Server Protocol on stdin and stdout")
+	format := fs.Bool("fmt", false, "format the sources instead of compiling them")
+	write := fs.Bool("w", false, "with -fmt, write the formatted sources back to their files")
+	list := fs.Bool("l", false, "with -fmt, list the files whose format differs instead of printing them")
+	lint := fs.Bool("lint", false, "warn about likely mistakes in the sources instead of compiling them")
+	ruleSpec := fs.String("rules", "", "with -lint, the `rules` to check separated by commas, all by default; -rule disables one")
+	jsonOut := fs.Bool("json", false, "with -lint, print the warnings as JSON")
+	ext := fs.Bool("ext", false, "accept the language extensions: for, break and continue")
+	doc := fs.Bool("doc", false, "write HTML and Markdown reference pages of the sources instead of compiling them")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	modes := 0
+	for _, on := range []bool{*lsp, *format, *lint, *doc} {
+		if on {
+			modes++
+		}
+	}
+	if modes > 1 {
+		log.Print("-lsp, -fmt, -lint and -doc cannot be combined with each other")
+		return 2
+	}
+	if *lsp {
+		if fs.NArg() > 0 {
+			log.Print("-lsp takes no input, the editor opens the documents")
+			return 2
+		}
+		if err := serveLSP(os.Stdin, os.Stdout, *ext); err != nil {
+			log.Print(err)
+			return 1
+		}
+		return 0
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
 	}
 
-	var files []*os.File
-	if stat.IsDir() {
-		list, err := ioutil.ReadDir(filename)
+	var files []string
+	for _, input := range fs.Args() {
+		found, err := findJackFiles(input)
 		if err != nil {
-			log.Fatal(err)
+			log.Print(err)
+			return 1
 		}
-		for _, f := range list {
-			if !strings.HasSuffix(f.Name(), ".jack") {
-				continue
+		files = append(files, found...)
+	}
+	if *format {
+		return formatFiles(files, *write, *list, *ext)
+	}
+	if *lint {
+		rules, err := ParseLintRules(*ruleSpec)
+		if err != nil {
+			log.Print(err)
+			return 2
+		}
+		return lintFiles(files, rules, *jsonOut, *ext)
+	}
+	if *doc {
+		return writeDocs(files, *outDir, *ext)
+	}
+
+	// the whole program is checked before any output is written
+	status := 0
+	var classes []*Class
+	var paths []string
+	for _, path := range files {
+		class, err := parseFile(path, *ext)
+		if err != nil {
+			log.Print(err)
+			status = 1
+			continue
+		}
+		classes = append(classes, class)
+		paths = append(paths, path)
+	}
+	if status != 0 {
+		return status
+	}
+	program, err := programClasses(paths, classes, *ext)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	var osLinked []*Class
+	if *linkOS {
+		if osLinked, err = osClassesFor(program); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	// programs are checked against the API of the OS, not its helpers
+	if errs := Check(NewIndex(program), classes); len(errs) > 0 {
+		for _, err := range errs {
+			log.Print(err)
+		}
+		return 1
+	}
+
+	if *outDir != "" {
+		if err := os.MkdirAll(*outDir, 0755); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	index := NewIndex(append(program, osLinked...))
+	outDirs := map[string]bool{}
+	for i, class := range classes {
+		out := outputPath(paths[i], *outDir)
+		outDirs[filepath.Dir(out)] = true
+		source := ""
+		if *debug {
+			if source, err = filepath.Abs(paths[i]); err != nil {
+				log.Print(err)
+				return 1
 			}
-			ff, err := os.Open(filename + f.Name())
-			if err != nil {
-				log.Fatal(err)
+		}
+		if err := writeVM(out+".vm", class, index, *debug, source); err != nil {
+			log.Print(err)
+			status = 1
+			continue
+		}
+		if *dumpTokens {
+			if err := dumpTo(out+"T.xml", paths[i], *ext, writeTokens); err != nil {
+				log.Print(err)
+				status = 1
 			}
-			files = append(files, ff)
 		}
-	} else {
-		f, err := os.Open(filename)
+		if *dumpXML {
+			if err := dumpTo(out+".xml", paths[i], *ext, writeParseTree); err != nil {
+				log.Print(err)
+				status = 1
+			}
+		}
+	}
+	for dir := range outDirs {
+		for _, class := range osLinked {
+			if err := writeVM(filepath.Join(dir, class.Name.Name+".vm"), class, index, false, ""); err != nil {
+				log.Print(err)
+				status = 1
+			}
+		}
+	}
+	return status
+}
+
+// formatFiles formats files to stdout, back to the files with write, or
+// lists those that change with list.
+func formatFiles(files []string, write, list, ext bool) int {
+	status := 0
+	for _, path := range files {
+		src, err := ioutil.ReadFile(path)
 		if err != nil {
-			log.Fatal(err)
+			log.Print(err)
+			status = 1
+			continue
+		}
+		out, err := Format(path, string(src), ext)
+		if err != nil {
+			log.Print(err)
+			status = 1
+			continue
+		}
+		if list && !bytes.Equal(out, src) {
+			fmt.Println(path)
+		}
+		if write && !bytes.Equal(out, src) {
+			if err := ioutil.WriteFile(path, out, 0644); err != nil {
+				log.Print(err)
+				status = 1
+			}
+		}
+		if !write && !list {
+			os.Stdout.Write(out)
 		}
-		files = append(files, f)
 	}
+	return status
+}
 
-	for _, f := range files {
-		log.Printf("FILE: %s", f.Name())
-		tokenizer := NewTokenizer(f)
+// lintFiles prints the warnings of the linter about files, as text or
+// JSON. The status is 1 if there are any.
+func lintFiles(files []string, rules map[string]bool, jsonOut, ext bool) int {
+	sources := map[string]string{}
+	var classes []*Class
+	status := 0
+	for _, path := range files {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Print(err)
+			status = 1
+			continue
+		}
+		t := NewStringTokenizer(path, string(src))
+		t.Extensions = ext
+		class, err := NewParser(t).ParseClass()
+		if err != nil {
+			log.Print(err)
+			status = 1
+			continue
+		}
+		sources[path] = string(src)
+		classes = append(classes, class)
+	}
+	if status != 0 {
+		return status
+	}
+	program, err := programClasses(files, classes, ext)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	warnings := Lint(NewIndex(program), classes, rules, sources)
+	if jsonOut {
+		type jsonWarning struct {
+			File    string `json:"file"`
+			Line    int    `json:"line"`
+			Column  int    `json:"column"`
+			Rule    string `json:"rule"`
+			Message string `json:"message"`
+		}
+		list := []jsonWarning{}
+		for _, w := range warnings {
+			list = append(list, jsonWarning{w.File, w.Line, w.Col, w.Rule, w.Msg})
+		}
+		out, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		fmt.Printf("%s\n", out)
+	} else {
+		for _, w := range warnings {
+			fmt.Println(w)
+		}
+	}
+	if len(warnings) > 0 {
+		return 1
+	}
+	return 0
+}
 
-		w, err := os.Create(f.Name() + ".tokens")
+// writeDocs writes the reference pages of files and their indexes, next
+// to the sources or in outDir.
+func writeDocs(files []string, outDir string, ext bool) int {
+	var docs []*ClassDoc
+	status := 0
+	for _, path := range files {
+		src, err := ioutil.ReadFile(path)
 		if err != nil {
-			panic(err)
-		}
-
-		fmt.Fprint(w, "<tokens>\n")
-
-		for tokenizer.HasMoreTokens() {
-			log.Printf("%#v", tokenizer)
-			switch tokenizer.TokenType() {
-			case TOKEN_SYMBOL:
-				fmt.Fprintf(w, "<symbol> %s </symbol>\n", tokenizer.Symbol())
-			case TOKEN_KEYWORD:
-				fmt.Fprintf(w, "<keyword> %s </keyword>\n", tokenizer.KeyWord())
-			case TOKEN_INT_CONST:
-				fmt.Fprintf(w, "<integerConstant> %d </integerConstant>\n", tokenizer.IntVal())
-			case TOKEN_STRING_CONST:
-				fmt.Fprintf(w, "<stringConstant> %s </stringConstant>\n", tokenizer.StringVal())
-			case TOKEN_IDENTIFIER:
-				fmt.Fprintf(w, "<identifier> %s </identifier>\n", tokenizer.Identifier())
-			}
+			log.Print(err)
+			status = 1
+			continue
+		}
+		doc, err := ExtractDoc(path, string(src), ext)
+		if err != nil {
+			log.Print(err)
+			status = 1
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	if status != 0 {
+		return status
+	}
+	if outDir != "" {
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	set := NewDocSet(docs)
+	outDirs := map[string]bool{}
+	write := func(path string, page func(w io.Writer) error) {
+		var buf bytes.Buffer
+		err := page(&buf)
+		if err == nil {
+			err = ioutil.WriteFile(path, buf.Bytes(), 0644)
 		}
+		if err != nil {
+			log.Print(err)
+			status = 1
+		}
+	}
+	for i, doc := range docs {
+		out := outputPath(files[i], outDir)
+		outDirs[filepath.Dir(out)] = true
+		name := doc.Class.Name.Name
+		write(out+".html", func(w io.Writer) error { return set.WriteHTMLDoc(w, name) })
+		write(out+".md", func(w io.Writer) error { return set.WriteMarkdownDoc(w, name) })
+	}
+	for dir := range outDirs {
+		write(filepath.Join(dir, "index.html"), set.WriteHTMLIndex)
+		write(filepath.Join(dir, "index.md"), set.WriteMarkdownIndex)
+	}
+	return status
+}
 
-		fmt.Fprint(w, "</tokens>\n")
+// writeVM compiles class to the VM file at path, with its debug
+// information naming source when debug is set.
+func writeVM(path string, class *Class, index *Index, debug bool, source string) error {
+	var buf bytes.Buffer
+	c := NewCompiler(&buf, index)
+	c.Debug, c.Source = debug, source
+	c.CompileClass(class)
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
 
-		w.Close()
-		f.Close()
+// findJackFiles returns input if it is a .jack file, or the .jack files
+// in input if it is a directory.
+func findJackFiles(input string) ([]string, error) {
+	stat, err := os.Stat(input)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		if filepath.Ext(input) != ".jack" {
+			return nil, fmt.Errorf("%s: not a .jack file", input)
+		}
+		return []string{input}, nil
+	}
+	files, err := filepath.Glob(filepath.Join(input, "*.jack"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s: no .jack files found", input)
+	}
+	sort.Strings(files)
+	return files, nil
+}
 
-		// CREATE XML
-		r, err := os.Open(f.Name() + ".tokens")
-		w, err = os.Create(f.Name() + ".xml")
-		if err != nil {
-			panic(err)
+// outputPath returns the path of the output files of a source without
+// extension: dir/Foo.jack becomes dir/Foo, or outDir/Foo if outDir is set.
+func outputPath(path, outDir string) string {
+	base := strings.TrimSuffix(filepath.Base(path), ".jack")
+	if outDir != "" {
+		return filepath.Join(outDir, base)
+	}
+	return filepath.Join(filepath.Dir(path), base)
+}
+
+// programClasses returns the classes being compiled together with the
+// other classes in their directories, which belong to the same program.
+func programClasses(paths []string, classes []*Class, ext bool) ([]*Class, error) {
+	compiled := map[string]bool{}
+	for _, path := range paths {
+		compiled[filepath.Clean(path)] = true
+	}
+	all := classes
+	dirs := map[string]bool{}
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if dirs[dir] {
+			continue
 		}
-		ww, err := os.Create(strings.TrimRight(f.Name(), ".jack") + ".vm")
+		dirs[dir] = true
+		others, err := filepath.Glob(filepath.Join(dir, "*.jack"))
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+		for _, other := range others {
+			if compiled[filepath.Clean(other)] {
+				continue
+			}
+			class, err := parseFile(other, ext)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, class)
+		}
+	}
+	return all, nil
+}
+
+// osClassesFor returns the classes of the Jack OS that program does not
+// define itself.
+func osClassesFor(program []*Class) ([]*Class, error) {
+	defined := map[string]bool{}
+	for _, class := range program {
+		defined[class.Name.Name] = true
+	}
+	all, err := osClasses()
+	if err != nil {
+		return nil, err
+	}
+	var classes []*Class
+	for _, class := range all {
+		if !defined[class.Name.Name] {
+			classes = append(classes, class)
 		}
-		compiler := NewCompiler(r, w, ww)
-		compiler.CompileClass()
-		log.Printf("SYMBOL_TABLE: %#v", compiler.symbolTable)
-		r.Close()
-		w.Close()
 	}
+	return classes, nil
+}
+
+// parseFile parses the class of path, with the language extensions if ext
+// is set.
+func parseFile(path string, ext bool) (*Class, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := NewTokenizer(path, f)
+	t.Extensions = ext
+	return NewParser(t).ParseClass()
+}
+
+func dumpTo(output, path string, ext bool, dump func(w *bytes.Buffer, t *Tokenizer) error) error {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	t := NewStringTokenizer(path, string(src))
+	t.Extensions = ext
+	var buf bytes.Buffer
+	if err := dump(&buf, t); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(output, buf.Bytes(), 0644)
+}
+
+func writeTokens(w *bytes.Buffer, t *Tokenizer) error {
+	return WriteTokensXML(w, t)
+}
+
+func writeParseTree(w *bytes.Buffer, t *Tokenizer) error {
+	class, err := NewParser(t).ParseClass()
+	if err != nil {
+		return err
+	}
+	return WriteXML(w, class)
 }
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutputPath(t *testing.T) {
+	samples := []struct {
+		Path   string
+		OutDir string
+		Out    string
+	}{
+		{"test/Square/Main.jack", "", "test/Square/Main"},
+		{"Track.jack", "", "Track"},
+		{"src/Jack.jack", "", "src/Jack"},
+		{"test/Pong/Ball.jack", "/tmp/out", "/tmp/out/Ball"},
+	}
+	for _, s := range samples {
+		out := outputPath(s.Path, s.OutDir)
+		if out != s.Out {
+			t.Errorf("Sample: %#v, Out: %s", s, out)
+		}
+	}
+}
+
+func TestCompileFile(t *testing.T) {
+	code, err := CompileFile(strings.NewReader("class Track {\n  function int jack() {\n    return 1;\n  }\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "function Track.jack 0\npush constant 1\nreturn\n"
+	if string(code) != want {
+		t.Errorf("code %q, want %q", code, want)
+	}
+
+	f, err := os.Open("test/Seven/Main.jack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	code, err = CompileFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(code, []byte("function Main.main 0\n")) {
+		t.Errorf("unexpected code:\n%s", code)
+	}
+}
+
+func TestCompileFile_Error(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jackc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "Bad.jack")
+	if err := ioutil.WriteFile(path, []byte("class Bad {\n  function void f() {\n    return\n  }\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := run([]string{"-d", dir, path}); status != 1 {
+		t.Errorf("exit status %d, want 1", status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Bad.vm")); !os.IsNotExist(err) {
+		t.Errorf("Bad.vm was written for a file with errors")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = CompileFile(f)
+	want := path + ":4:3: expected ';' but found '}'"
+	if err == nil || err.Error() != want {
+		t.Errorf("error %v, want %s", err, want)
+	}
+}
+
+func TestCompileFile_Errors(t *testing.T) {
+	src := "class Bad {\n  function void f() {\n    let y = 1;\n    let x = 2;\n    return;\n  }\n}\n"
+	_, err := CompileFile(strings.NewReader(src))
+	list, ok := err.(ErrorList)
+	if !ok || len(list) != 2 {
+		t.Fatalf("error %#v, want a list of 2 errors", err)
+	}
+	if list[0].Error() != ":3:9: undefined: y" || list[1].Error() != ":4:9: undefined: x" {
+		t.Errorf("errors %q", err)
+	}
+}
+
+func TestRun_OutDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jackc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if status := run([]string{"-d", dir, "-xml", "-tokens", "test/Square"}); status != 0 {
+		t.Fatalf("exit status %d", status)
+	}
+	for _, name := range []string{"Main.vm", "Square.vm", "SquareGame.vm", "Main.xml", "MainT.xml"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	// nothing is written next to the sources
+	for _, pattern := range []string{"test/Square/*.vm", "test/Square/*.xml", "test/Square/*.tokens"} {
+		if paths, _ := filepath.Glob(pattern); len(paths) > 0 {
+			t.Errorf("unexpected files %v", paths)
+		}
+	}
+}
+
+func TestRun_NewOutDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jackc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "build", "Square")
+	if status := run([]string{"-d", out, "test/Square"}); status != 0 {
+		t.Fatalf("exit status %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(out, "Main.vm")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRun_Modes(t *testing.T) {
+	for _, args := range [][]string{
+		{"-fmt", "-lint", "test/Square"},
+		{"-lint", "-doc", "test/Square"},
+		{"-fmt", "-doc", "test/Square"},
+		{"-lsp", "-fmt"},
+		{"-lsp", "-lint"},
+	} {
+		if status := run(args); status != 2 {
+			t.Errorf("%v: exit status %d, want 2", args, status)
+		}
+	}
+}
+
+func TestRun_LinkOS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jackc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a class of the program replaces the OS class
+	src := "class Math {\n  function int twice(int x) {\n    return x + x;\n  }\n}\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "Math.jack"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if status := run([]string{filepath.Join(dir, "Math.jack")}); status != 0 {
+		t.Fatalf("exit status %d", status)
+	}
+	for _, name := range []string{"Array", "Keyboard", "Memory", "Output", "Screen", "String", "Sys"} {
+		if _, err := os.Stat(filepath.Join(dir, name+".vm")); err != nil {
+			t.Error(err)
+		}
+	}
+	code, err := ioutil.ReadFile(filepath.Join(dir, "Math.vm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(code), "function Math.twice 0\n") {
+		t.Errorf("Math.vm is not the program's:\n%s", code)
+	}
+
+	os.Remove(filepath.Join(dir, "Sys.vm"))
+	if status := run([]string{"-os=false", filepath.Join(dir, "Math.jack")}); status != 0 {
+		t.Fatalf("exit status %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Sys.vm")); err == nil {
+		t.Error("Sys.vm written with -os=false")
+	}
+}
+
+func TestRun_Debug(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jackc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := `class Main {
+  static int count;
+  function void main() {
+    var int i;
+    while (i < 3) {
+      let i = i + 1;
+    }
+    return;
+  }
+}
+`
+	path := filepath.Join(dir, "Main.jack")
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if status := run([]string{"-g", path}); status != 0 {
+		t.Fatalf("exit status %d", status)
+	}
+	code, err := ioutil.ReadFile(filepath.Join(dir, "Main.vm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs, _ := filepath.Abs(path)
+	want := "// @source " + abs + `
+// @var static 0 int count
+function Main.main 1
+// @kind function
+// @lines 3 9
+// @var local 0 int i
+// @line 5
+label Main.label.1
+push local 0
+push constant 3
+lt
+not
+if-goto Main.label.2
+// @line 6
+push local 0
+push constant 1
+add
+pop local 0
+goto Main.label.1
+label Main.label.2
+// @line 8
+push constant 0
+return
+`
+	if string(code) != want {
+		t.Errorf("code with debug information:\n%s\nwant:\n%s", code, want)
+	}
+	// the OS is compiled without
+	code, err = ioutil.ReadFile(filepath.Join(dir, "Sys.vm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(code), "// @") {
+		t.Error("debug information in the OS")
+	}
+}
+
+func TestCompiler_Extensions(t *testing.T) {
+	src := `class Foo {
+  function void f(int n) {
+    var int i;
+    for (i = 0; i < n; i = i + 1) {
+      if (i = 2) { continue; }
+      if (i = 5) { break; }
+    }
+    return;
+  }
+}
+`
+	tk := NewStringTokenizer("Foo.jack", src)
+	tk.Extensions = true
+	class, err := NewParser(tk).ParseClass()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	NewCompiler(&buf, nil).CompileClass(class)
+	// continue goes to the step at label 2, break to the end at label 3
+	want := `function Foo.f 1
+push constant 0
+pop local 0
+label Foo.label.1
+push local 0
+push argument 0
+lt
+not
+if-goto Foo.label.3
+push local 0
+push constant 2
+eq
+not
+if-goto Foo.label.4
+goto Foo.label.2
+goto Foo.label.5
+label Foo.label.4
+label Foo.label.5
+push local 0
+push constant 5
+eq
+not
+if-goto Foo.label.6
+goto Foo.label.3
+goto Foo.label.7
+label Foo.label.6
+label Foo.label.7
+label Foo.label.2
+push local 0
+push constant 1
+add
+pop local 0
+goto Foo.label.1
+label Foo.label.3
+push constant 0
+return
+`
+	if buf.String() != want {
+		t.Errorf("code:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestRun_Extensions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jackc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if status := run([]string{"-d", dir, "test/ext/Loops"}); status != 1 {
+		t.Errorf("exit status %d without -ext, want 1", status)
+	}
+	if status := run([]string{"-ext", "-xml", "-d", dir, "test/ext/Loops"}); status != 0 {
+		t.Fatalf("exit status %d", status)
+	}
+	xml, err := ioutil.ReadFile(filepath.Join(dir, "Main.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, element := range []string{"<forStatement>", "<breakStatement>", "<continueStatement>"} {
+		if !bytes.Contains(xml, []byte(element)) {
+			t.Errorf("Main.xml has no %s", element)
+		}
+	}
+
+	// Loops is in its canonical format
+	if status := run([]string{"-ext", "-fmt", "-l", "test/ext/Loops"}); status != 0 {
+		t.Errorf("exit status %d of -ext -fmt", status)
+	}
+	if status := run([]string{"-ext", "-doc", "-d", dir, "test/ext/Loops"}); status != 0 {
+		t.Errorf("exit status %d of -ext -doc", status)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+// The Jack OS, written in Jack and compiled with the program.
+//
+//go:embed os/*.jack
+var osSources embed.FS
+
+// osClasses parses the classes of the Jack OS, sorted by name.
+func osClasses() ([]*Class, error) {
+	names, err := fs.Glob(osSources, "os/*.jack")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	var classes []*Class
+	for _, name := range names {
+		src, err := osSources.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		class, err := NewParser(NewStringTokenizer("OS/"+path.Base(name), string(src))).ParseClass()
+		if err != nil {
+			return nil, err
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOS_Check(t *testing.T) {
+	classes, err := osClasses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sys.init calls Main.main
+	main, err := NewParser(NewStringTokenizer("Main.jack", "class Main { function void main() { return; } }")).ParseClass()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range Check(NewIndex(append(classes, main)), classes) {
+		t.Error(err)
+	}
+}
+
+// The OS implements the API the checker knows, with the same kinds and
+// types.
+func TestOS_API(t *testing.T) {
+	classes, err := osClasses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	impl := NewIndex(classes)
+	if len(classes) != len(osIndex) {
+		t.Errorf("%d OS classes, want %d", len(classes), len(osIndex))
+	}
+	for name, ci := range osIndex {
+		for _, api := range ci.Subroutines {
+			dec := impl.Lookup(name, api.Name.Name)
+			if dec == nil {
+				t.Errorf("%s.%s is not implemented", name, api.Name.Name)
+				continue
+			}
+			if got, want := signature(dec), signature(api); got != want {
+				t.Errorf("%s.%s is declared as %s, want %s", name, api.Name.Name, got, want)
+			}
+		}
+	}
+}
+
+func signature(dec *SubroutineDec) string {
+	var params []string
+	for _, param := range dec.Params {
+		params = append(params, param.Type.Name)
+	}
+	return dec.Kind + " " + dec.ReturnType.Name + " " + dec.Name.Name + "(" + strings.Join(params, ", ") + ")"
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Parser builds the syntax tree of a class from the tokens of a
+// Tokenizer. It recovers from syntax errors by skipping to the end of the
+// statement or declaration, so that all the errors of a file are
+// reported at once. The language extensions are parsed if the tokenizer
+// recognizes their keywords.
+type Parser struct {
+	t      *Tokenizer
+	token  Token
+	errs   ErrorList
+	loops  int  // depth of the loops around the current statement
+	header bool // in the header of a for loop, up to its body
+}
+
+// bailout unwinds the parser from a syntax error to the nearest
+// statement or declaration, which resynchronizes.
+type bailout struct{}
+
+// ErrorList is a list of errors sorted by position.
+type ErrorList []error
+
+func (l ErrorList) Error() string {
+	var msgs []string
+	for _, err := range l {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Sort sorts errors with a position by file, line and column.
+func (l ErrorList) Sort() {
+	pos := func(err error) Pos {
+		if e, ok := err.(*Error); ok {
+			return e.Pos
+		}
+		return Pos{}
+	}
+	sort.SliceStable(l, func(i, j int) bool {
+		a, b := pos(l[i]), pos(l[j])
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+}
+
+func NewParser(t *Tokenizer) *Parser {
+	return &Parser{t: t}
+}
+
+// ParseFile parses the class read from r. Positions name the file if r
+// has a Name method, as *os.File does.
+func ParseFile(r io.Reader) (*Class, error) {
+	name := ""
+	if f, ok := r.(interface{ Name() string }); ok {
+		name = f.Name()
+	}
+	return NewParser(NewTokenizer(name, r)).ParseClass()
+}
+
+// ParseClass parses a whole file. If there are errors, it returns them
+// as an ErrorList together with the part of the class that could be
+// parsed, which is nil if not even the class header was.
+func (p *Parser) ParseClass() (*Class, error) {
+	var class *Class
+	p.try(func() {
+		p.next()
+		class = p.parseClass()
+		if p.token.Kind != TOKEN_EOF {
+			p.expected("end of file")
+		}
+	})
+	return class, p.err()
+}
+
+// ParseSignature parses a subroutine declaration without a body, such as
+// "function int abs(int x)".
+func (p *Parser) ParseSignature() (*SubroutineDec, error) {
+	var dec *SubroutineDec
+	p.try(func() {
+		p.next()
+		if !p.is("constructor", "function", "method") {
+			p.expected("subroutine declaration")
+		}
+		dec = p.parseSignature()
+		if p.token.Kind != TOKEN_EOF {
+			p.expected("end of file")
+		}
+	})
+	return dec, p.err()
+}
+
+func (p *Parser) err() error {
+	if len(p.errs) == 0 {
+		return nil
+	}
+	p.errs.Sort()
+	return p.errs
+}
+
+// try runs f and reports whether it returned without a syntax error.
+func (p *Parser) try(f func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, isBailout := r.(bailout); !isBailout {
+				panic(r)
+			}
+			ok = false
+		}
+	}()
+	f()
+	return true
+}
+
+// next reads the next token. Lexical errors are recorded and the
+// offending input skipped.
+func (p *Parser) next() {
+	for {
+		token, err := p.t.Next()
+		if err == nil || err == io.EOF {
+			p.token = token
+			return
+		}
+		p.errs = append(p.errs, err)
+		if _, ok := err.(*Error); !ok {
+			// a read error ends the input
+			p.token = Token{Kind: TOKEN_EOF, Pos: token.Pos}
+			return
+		}
+	}
+}
+
+// report records an error. Only the first error at a position is kept,
+// which drops the errors of unwinding at the end of the file.
+func (p *Parser) report(pos Pos, format string, a ...interface{}) {
+	for _, err := range p.errs {
+		if e, ok := err.(*Error); ok && e.Pos == pos {
+			return
+		}
+	}
+	p.errs = append(p.errs, &Error{Pos: pos, Msg: fmt.Sprintf(format, a...)})
+}
+
+func (p *Parser) errorf(pos Pos, format string, a ...interface{}) {
+	p.report(pos, format, a...)
+	panic(bailout{})
+}
+
+func (p *Parser) found() string {
+	if p.token.Kind == TOKEN_EOF {
+		return "end of file"
+	}
+	return fmt.Sprintf("'%s'", p.token.Text)
+}
+
+func (p *Parser) expected(what string) {
+	p.errorf(p.token.Pos, "expected %s but found %s", what, p.found())
+}
+
+// isDeclaration reports whether the current token starts a class or
+// subroutine level declaration.
+func (p *Parser) isDeclaration() bool {
+	return p.is("static", "field", "constructor", "function", "method", "var")
+}
+
+func (p *Parser) isStatement() bool {
+	return p.is("let", "if", "while", "do", "return", "for", "break", "continue")
+}
+
+// syncStatement skips to the end of the current statement: past the next
+// ';', or up to the next statement, declaration or '}'. Blocks opened by
+// the skipped tokens are skipped as a whole.
+func (p *Parser) syncStatement() {
+	depth := 0
+	for p.token.Kind != TOKEN_EOF {
+		switch {
+		case p.is("{"):
+			depth += 1
+		case p.is("}"):
+			if depth == 0 {
+				return
+			}
+			depth -= 1
+			if depth == 0 {
+				p.next()
+				return
+			}
+		case depth > 0:
+		case p.is(";"):
+			p.next()
+			return
+		case p.isStatement() || p.isDeclaration():
+			return
+		}
+		p.next()
+	}
+}
+
+// syncDeclaration skips to the next class variable or subroutine
+// declaration, or up to the '}' closing the class.
+func (p *Parser) syncDeclaration() {
+	depth := 0
+	for p.token.Kind != TOKEN_EOF && !p.is("static", "field", "constructor", "function", "method") {
+		switch {
+		case p.is("{"):
+			depth += 1
+		case p.is("}"):
+			if depth == 0 {
+				return
+			}
+			depth -= 1
+		}
+		p.next()
+	}
+}
+
+// is reports whether the current token is a keyword or symbol with one
+// of the given values.
+func (p *Parser) is(values ...string) bool {
+	if p.token.Kind != TOKEN_KEYWORD && p.token.Kind != TOKEN_SYMBOL {
+		return false
+	}
+	for _, v := range values {
+		if p.token.Value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// expect consumes the keyword or symbol value and returns its position.
+func (p *Parser) expect(value string) Pos {
+	if !p.is(value) {
+		p.expected(fmt.Sprintf("'%s'", value))
+	}
+	pos := p.token.Pos
+	p.next()
+	return pos
+}
+
+func (p *Parser) ident() Ident {
+	if p.token.Kind != TOKEN_IDENTIFIER {
+		p.expected("identifier")
+	}
+	id := Ident{Pos: p.token.Pos, Name: p.token.Value}
+	p.next()
+	return id
+}
+
+// isType reports whether the current token starts a type: int, char,
+// boolean or a class name.
+func (p *Parser) isType() bool {
+	return p.token.Kind == TOKEN_IDENTIFIER || p.is("int", "char", "boolean")
+}
+
+func (p *Parser) typeName() Ident {
+	if !p.isType() {
+		p.expected("type")
+	}
+	id := Ident{Pos: p.token.Pos, Name: p.token.Value}
+	p.next()
+	return id
+}
+
+// class className { classVarDec* subroutineDec* }
+func (p *Parser) parseClass() *Class {
+	class := &Class{Pos: p.expect("class")}
+	class.Name = p.ident()
+	p.expect("{")
+	for p.token.Kind != TOKEN_EOF && !p.is("}") {
+		switch {
+		case p.is("static", "field"):
+			if len(class.Subroutines) > 0 {
+				p.report(p.token.Pos, "class variables must be declared before subroutines")
+			}
+			var dec *ClassVarDec
+			if p.try(func() { dec = p.parseClassVarDec() }) {
+				class.Vars = append(class.Vars, dec)
+			} else {
+				p.syncStatement()
+			}
+		case p.is("constructor", "function", "method"):
+			var dec *SubroutineDec
+			if p.try(func() { dec = p.parseSubroutineDec() }) {
+				class.Subroutines = append(class.Subroutines, dec)
+			} else {
+				p.syncDeclaration()
+			}
+		default:
+			p.report(p.token.Pos, "expected class variable or subroutine declaration but found %s", p.found())
+			p.next()
+			p.syncDeclaration()
+		}
+	}
+	class.End = p.expect("}")
+	return class
+}
+
+// (static | field) type varName (, varName)* ;
+func (p *Parser) parseClassVarDec() *ClassVarDec {
+	dec := &ClassVarDec{Pos: p.token.Pos, Kind: p.token.Value}
+	p.next()
+	dec.Type = p.typeName()
+	dec.Names = append(dec.Names, p.ident())
+	for p.is(",") {
+		p.next()
+		dec.Names = append(dec.Names, p.ident())
+	}
+	p.expect(";")
+	return dec
+}
+
+// (constructor | function | method) (void | type) subroutineName ( parameterList ) subroutineBody
+func (p *Parser) parseSubroutineDec() *SubroutineDec {
+	dec := p.parseSignature()
+	dec.Body = p.parseSubroutineBody()
+	return dec
+}
+
+// (constructor | function | method) (void | type) subroutineName ( parameterList )
+func (p *Parser) parseSignature() *SubroutineDec {
+	dec := &SubroutineDec{Pos: p.token.Pos, Kind: p.token.Value}
+	p.next()
+	if p.is("void") {
+		dec.ReturnType = Ident{Pos: p.token.Pos, Name: "void"}
+		p.next()
+	} else {
+		dec.ReturnType = p.typeName()
+	}
+	dec.Name = p.ident()
+	p.expect("(")
+	dec.Params = p.parseParameterList()
+	p.expect(")")
+	return dec
+}
+
+// ( (type varName) (, type varName)* )?
+func (p *Parser) parseParameterList() []*Param {
+	var params []*Param
+	if !p.isType() {
+		return params
+	}
+	for {
+		param := &Param{Type: p.typeName()}
+		param.Name = p.ident()
+		params = append(params, param)
+		if !p.is(",") {
+			return params
+		}
+		p.next()
+	}
+}
+
+// { varDec* statements }
+func (p *Parser) parseSubroutineBody() *SubroutineBody {
+	body := &SubroutineBody{Pos: p.expect("{")}
+	for p.is("var") {
+		var dec *VarDec
+		if p.try(func() { dec = p.parseVarDec() }) {
+			body.Vars = append(body.Vars, dec)
+		} else {
+			p.syncStatement()
+		}
+	}
+	body.Statements = p.parseStatements()
+	body.End = p.expect("}")
+	return body
+}
+
+// var type varName (, varName)* ;
+func (p *Parser) parseVarDec() *VarDec {
+	dec := &VarDec{Pos: p.expect("var")}
+	dec.Type = p.typeName()
+	dec.Names = append(dec.Names, p.ident())
+	for p.is(",") {
+		p.next()
+		dec.Names = append(dec.Names, p.ident())
+	}
+	p.expect(";")
+	return dec
+}
+
+// { statements }
+func (p *Parser) parseBlock() *Block {
+	block := &Block{Pos: p.expect("{")}
+	block.Statements = p.parseStatements()
+	block.End = p.expect("}")
+	return block
+}
+
+func (p *Parser) parseStatements() []Statement {
+	var statements []Statement
+	for p.token.Kind != TOKEN_EOF && !p.is("}") {
+		if !p.isStatement() {
+			if p.isDeclaration() {
+				// most likely a missing '}'
+				return statements
+			}
+			if p.token.Kind == TOKEN_IDENTIFIER && extensionKeywordSet[p.token.Value] {
+				p.skipExtension()
+				continue
+			}
+			p.report(p.token.Pos, "expected statement but found %s", p.found())
+			p.next()
+			p.syncStatement()
+			continue
+		}
+		var s Statement
+		if p.try(func() { s = p.parseStatement() }) {
+			statements = append(statements, s)
+		} else {
+			if p.header {
+				// the ; of the header do not end the statement
+				p.header = false
+				p.syncHeader()
+			}
+			p.syncStatement()
+		}
+	}
+	return statements
+}
+
+// syncHeader skips to the body of a for loop, up to the next '{', '}' or
+// declaration.
+func (p *Parser) syncHeader() {
+	for p.token.Kind != TOKEN_EOF && !p.is("{", "}") && !p.isDeclaration() {
+		p.next()
+	}
+}
+
+// skipExtension reports a statement of the language extensions, which the
+// tokenizer does not recognize, and skips it: a for loop up to the end of
+// its body.
+func (p *Parser) skipExtension() {
+	p.report(p.token.Pos, "%s is a language extension", p.token.Value)
+	if p.token.Value == "for" {
+		p.syncHeader()
+	} else {
+		p.next()
+	}
+	p.syncStatement()
+}
+
+func (p *Parser) parseStatement() Statement {
+	switch {
+	case p.is("let"):
+		return p.parseLetStatement()
+	case p.is("if"):
+		return p.parseIfStatement()
+	case p.is("while"):
+		return p.parseWhileStatement()
+	case p.is("do"):
+		return p.parseDoStatement()
+	case p.is("for"):
+		return p.parseForStatement()
+	case p.is("break", "continue"):
+		return p.parseBreakStatement()
+	}
+	return p.parseReturnStatement()
+}
+
+// let varName ([ expression ])? = expression ;
+func (p *Parser) parseLetStatement() *LetStatement {
+	s := &LetStatement{Pos: p.expect("let")}
+	s.Name = p.ident()
+	if p.is("[") {
+		p.next()
+		s.Index = p.parseExpression()
+		p.expect("]")
+	}
+	p.expect("=")
+	s.Value = p.parseExpression()
+	p.expect(";")
+	return s
+}
+
+// if ( expression ) { statements } (else { statements })?
+func (p *Parser) parseIfStatement() *IfStatement {
+	s := &IfStatement{Pos: p.expect("if")}
+	p.expect("(")
+	s.Cond = p.parseExpression()
+	p.expect(")")
+	s.Then = p.parseBlock()
+	if p.is("else") {
+		p.next()
+		s.Else = p.parseBlock()
+	}
+	return s
+}
+
+// while ( expression ) { statements }
+func (p *Parser) parseWhileStatement() *WhileStatement {
+	s := &WhileStatement{Pos: p.expect("while")}
+	p.expect("(")
+	s.Cond = p.parseExpression()
+	p.expect(")")
+	s.Body = p.parseLoopBody()
+	return s
+}
+
+// for ( assignment? ; expression ; assignment? ) { statements }
+func (p *Parser) parseForStatement() *ForStatement {
+	s := &ForStatement{Pos: p.expect("for")}
+	p.header = true
+	p.expect("(")
+	if !p.is(";") {
+		s.Init = p.parseAssignment()
+	}
+	p.expect(";")
+	s.Cond = p.parseExpression()
+	p.expect(";")
+	if !p.is(")") {
+		s.Step = p.parseAssignment()
+	}
+	p.expect(")")
+	p.header = false
+	s.Body = p.parseLoopBody()
+	return s
+}
+
+// varName ([ expression ])? = expression
+func (p *Parser) parseAssignment() *LetStatement {
+	s := &LetStatement{Pos: p.token.Pos}
+	s.Name = p.ident()
+	if p.is("[") {
+		p.next()
+		s.Index = p.parseExpression()
+		p.expect("]")
+	}
+	p.expect("=")
+	s.Value = p.parseExpression()
+	return s
+}
+
+// parseLoopBody parses the block of a loop, where break and continue are
+// allowed.
+func (p *Parser) parseLoopBody() *Block {
+	p.loops += 1
+	defer func() { p.loops -= 1 }()
+	return p.parseBlock()
+}
+
+// (break | continue) ;
+func (p *Parser) parseBreakStatement() Statement {
+	pos, keyword := p.token.Pos, p.token.Value
+	p.next()
+	p.expect(";")
+	if p.loops == 0 {
+		p.report(pos, "%s is not in a loop", keyword)
+	}
+	if keyword == "break" {
+		return &BreakStatement{Pos: pos}
+	}
+	return &ContinueStatement{Pos: pos}
+}
+
+// do subroutineCall ;
+func (p *Parser) parseDoStatement() *DoStatement {
+	s := &DoStatement{Pos: p.expect("do")}
+	name := p.ident()
+	s.Call = p.parseCall(name)
+	p.expect(";")
+	return s
+}
+
+// return expression? ;
+func (p *Parser) parseReturnStatement() *ReturnStatement {
+	s := &ReturnStatement{Pos: p.expect("return")}
+	if p.isTerm() {
+		s.Value = p.parseExpression()
+	}
+	p.expect(";")
+	return s
+}
+
+func (p *Parser) isOp() bool {
+	return p.token.Kind == TOKEN_SYMBOL && p.is("+", "-", "*", "/", "&", "|", "<", ">", "=")
+}
+
+// isTerm reports whether the current token starts a term.
+func (p *Parser) isTerm() bool {
+	switch p.token.Kind {
+	case TOKEN_INT_CONST, TOKEN_STRING_CONST, TOKEN_IDENTIFIER:
+		return true
+	}
+	return p.is("true", "false", "null", "this", "(", "-", "~")
+}
+
+// term (op term)*
+func (p *Parser) parseExpression() Expression {
+	x := p.parseTerm()
+	for p.isOp() {
+		e := &BinaryExpr{Pos: x.Position(), Op: p.token.Value, OpPos: p.token.Pos, X: x}
+		p.next()
+		e.Y = p.parseTerm()
+		x = e
+	}
+	return x
+}
+
+func (p *Parser) parseTerm() Expression {
+	token := p.token
+	switch token.Kind {
+	case TOKEN_INT_CONST:
+		p.next()
+		return &IntegerConstant{Pos: token.Pos, Value: token.Int}
+	case TOKEN_STRING_CONST:
+		p.next()
+		return &StringConstant{Pos: token.Pos, Value: token.Value}
+	case TOKEN_KEYWORD:
+		if p.is("true", "false", "null", "this") {
+			p.next()
+			return &KeywordConstant{Pos: token.Pos, Value: token.Value}
+		}
+	case TOKEN_SYMBOL:
+		switch token.Value {
+		case "(":
+			p.next()
+			e := &ParenExpr{Pos: token.Pos, X: p.parseExpression()}
+			p.expect(")")
+			return e
+		case "-", "~":
+			p.next()
+			return &UnaryExpr{Pos: token.Pos, Op: token.Value, X: p.parseTerm()}
+		}
+	case TOKEN_IDENTIFIER:
+		name := p.ident()
+		switch {
+		case p.is("["):
+			p.next()
+			e := &IndexExpr{Pos: name.Pos, Name: name, Index: p.parseExpression()}
+			p.expect("]")
+			return e
+		case p.is(".", "("):
+			return p.parseCall(name)
+		}
+		return &VarExpr{Pos: name.Pos, Name: name.Name}
+	}
+	p.expected("expression")
+	return nil
+}
+
+// subroutineName ( expressionList ) | (className | varName) . subroutineName ( expressionList )
+func (p *Parser) parseCall(name Ident) *CallExpr {
+	call := &CallExpr{Pos: name.Pos, Name: name}
+	if p.is(".") {
+		p.next()
+		receiver := name
+		call.Receiver = &receiver
+		call.Name = p.ident()
+	}
+	p.expect("(")
+	call.Args = p.parseExpressionList()
+	p.expect(")")
+	return call
+}
+
+// (expression (, expression)*)?
+func (p *Parser) parseExpressionList() []Expression {
+	var list []Expression
+	if !p.isTerm() {
+		return list
+	}
+	list = append(list, p.parseExpression())
+	for p.is(",") {
+		p.next()
+		list = append(list, p.parseExpression())
+	}
+	return list
+}
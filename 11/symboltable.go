@@ -5,7 +5,6 @@ type SymbolTable struct {
 	field []SymbolEntity
 	local []SymbolEntity
 	arg []SymbolEntity
-	subroutine []SymbolEntity
 }
 
 type SymbolEntity struct {
@@ -23,7 +22,6 @@ func NewSymbolTable() *SymbolTable {
 		field: []SymbolEntity{},
 		local: []SymbolEntity{},
 		arg: []SymbolEntity{},
-		subroutine: []SymbolEntity{},
 	}
 }
 
@@ -45,8 +43,6 @@ func (s *SymbolTable) Define(name string, typeName string, kind string) {
 		s.local = list
 	case "arg":
 		s.arg = list
-	case "function", "method", "constructor":
-		s.subroutine = list
 	}
 }
 
@@ -64,8 +60,6 @@ func (s *SymbolTable) getList(kind string) []SymbolEntity {
 		return s.local
 	case "arg":
 		return s.arg
-	case "function", "method", "constructor":
-		return s.subroutine
 	}
 	return nil
 }
@@ -0,0 +1,4 @@
+# reads the count and the numbers with Keyboard.readInt, echoed
+cycles 8000000
+keys average.keys
+output "How many numbers? 3\nEnter a number: 4\nEnter a number: 5\nEnter a number: 9\nThe average is 6"
@@ -0,0 +1,3 @@
+# bump is called 500 times, fill writes 99 to RAM[8105]
+cycles 500000
+ram 8100 500 0 4 210 5 99
@@ -0,0 +1,2 @@
+cycles 15000000
+output "Test 1: expected result: 5; actual result: 5\nTest 2: expected result: 40; actual result: 40\nTest 3: expected result: 0; actual result: 0\nTest 4: expected result: 77; actual result: 77\nTest 5: expected result: 110; actual result: 110\n"
@@ -0,0 +1,3 @@
+# 1234 = 0b10011010010
+set 8000 1234
+ram 8001 0 1 0 0 1 0 1 1 0 0 1 0 0 0 0 0
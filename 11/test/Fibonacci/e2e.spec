@@ -0,0 +1,3 @@
+# Fibonacci numbers up to 610
+cycles 300000
+ram 8000 0 1 1 2 3 5 8 13 21 34 55 89 144 233 377 610
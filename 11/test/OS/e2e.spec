@@ -0,0 +1,10 @@
+# arithmetic, heap, strings, drawing and printing
+cycles 3000000
+ram 8000 -5535 -3 10922 181 4 -4 -1 6 -32768 45 0
+# the diagonal line
+screen 0 1
+screen 480 -32768
+# rows 125 and 128 of the circle, x = 255..257 and x = 253..259
+screen 4015 -32768 3
+screen 4111 -8192 15
+output "-32768 ok\n"
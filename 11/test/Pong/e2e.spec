@@ -0,0 +1,9 @@
+# the bat, the bottom line and the score, before any key is pressed; the
+# bat moves between the waits of the game loop
+running
+timed
+cycles 5000000
+screen 7343 -4 -1 -1 31
+screen 7616 -1 -1 -1 -1
+output "Score: 0"
+screenshot screen.png
@@ -0,0 +1 @@
+output "7"
@@ -0,0 +1,7 @@
+# the square drawn at the top left grows twice, then the game quits
+cycles 8000000
+keys square.keys
+screen 0 -1 -1 7
+screen 1088 -1 -1 7
+screen 1120 0 0 0
+screenshot screen.png
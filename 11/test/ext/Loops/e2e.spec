@@ -0,0 +1,5 @@
+# sums, primes, a power of two and odd numbers computed with for, break
+# and continue
+ext
+cycles 3000000
+ram 8000 55 50 2 3 5 7 11 13 17 19 23 29 10 1024 1 3 5 7 9
@@ -1,11 +1,11 @@
 package main
 
 import (
-	"bufio"
+	"fmt"
 	"io"
-	"log"
-	"strings"
+	"io/ioutil"
 	"strconv"
+	"strings"
 )
 
 var (
@@ -16,8 +16,54 @@ var (
 		"class", "constructor", "function", "method", "field", "static", "var", "int", "char", "boolean",
 		"void", "true", "false", "null", "this", "let", "do", "if", "else", "while", "return",
 	}
+	// extensionKeywords are the keywords of the language extensions.
+	extensionKeywords = []string{"for", "break", "continue"}
+)
+
+// maxIntConst is the largest integer constant of the Jack language.
+const maxIntConst = 32767
+
+// character classes for the lookup table
+const (
+	charSpace uint8 = 1 << iota
+	charSymbol
+	charDigit
+	charIdentifierHead
 )
 
+var (
+	charClass           = newCharClass()
+	keywordSet          = newKeywordSet(keywords)
+	extensionKeywordSet = newKeywordSet(extensionKeywords)
+)
+
+func newCharClass() [256]uint8 {
+	var class [256]uint8
+	for _, c := range []byte{' ', '\t', '\n', '\r', '\f', '\v'} {
+		class[c] |= charSpace
+	}
+	for _, c := range symbols {
+		class[c] |= charSymbol
+	}
+	for c := '0'; c <= '9'; c++ {
+		class[c] |= charDigit
+	}
+	for c := 'a'; c <= 'z'; c++ {
+		class[c] |= charIdentifierHead
+		class[c-'a'+'A'] |= charIdentifierHead
+	}
+	class['_'] |= charIdentifierHead
+	return class
+}
+
+func newKeywordSet(keywords []string) map[string]bool {
+	set := map[string]bool{}
+	for _, k := range keywords {
+		set[k] = true
+	}
+	return set
+}
+
 type TokenType uint8
 
 const (
@@ -27,190 +73,238 @@ const (
 	TOKEN_IDENTIFIER
 	TOKEN_INT_CONST
 	TOKEN_STRING_CONST
+	TOKEN_EOF
+	TOKEN_COMMENT
 )
 
+var tokenTypeNames = map[TokenType]string{
+	TOKEN_NONE:         "none",
+	TOKEN_KEYWORD:      "keyword",
+	TOKEN_SYMBOL:       "symbol",
+	TOKEN_IDENTIFIER:   "identifier",
+	TOKEN_INT_CONST:    "integerConstant",
+	TOKEN_STRING_CONST: "stringConstant",
+	TOKEN_EOF:          "EOF",
+	TOKEN_COMMENT:      "comment",
+}
+
+// String returns the XML tag name of the token type.
+func (t TokenType) String() string {
+	return tokenTypeNames[t]
+}
+
+// Pos is a position in a source file. Line and Col are 1-based; Col
+// counts bytes.
+type Pos struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+// Token is a lexical token. Text is the token as written in the source,
+// Value its decoded value: the contents of a string constant without the
+// quotes and the canonical form of an integer constant, whose value is
+// also available as Int.
+type Token struct {
+	Kind  TokenType
+	Text  string
+	Value string
+	Int   int
+	Pos
+}
+
+// Error is a lexical error.
+type Error struct {
+	Pos
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// Tokenizer splits Jack source into tokens. The whole source is read
+// once; token texts are substrings of it, so scanning does not allocate
+// per character or per token.
+//
+// Comments are skipped, unless Comments is set: they are then returned
+// as TOKEN_COMMENT tokens whose Text is the whole comment, delimiters
+// included, for tools that rewrite the source.
+//
+// With Extensions, for, break and continue are keywords, for the for
+// loops and the early exits of the language extensions.
 type Tokenizer struct {
+	Comments   bool
+	Extensions bool
+
 	r         io.Reader
-	s         *bufio.Scanner
-	line      string
-	index     int
-	token     string
-	tokenType TokenType
+	file      string
+	src       string
+	loaded    bool
+	offset    int
+	line      int
+	lineStart int
 }
 
-func NewTokenizer(r io.Reader) *Tokenizer {
-	return &Tokenizer{r: r, s: bufio.NewScanner(r)}
+// NewTokenizer returns a tokenizer reading r. The file name is only used
+// for positions.
+func NewTokenizer(file string, r io.Reader) *Tokenizer {
+	return &Tokenizer{r: r, file: file, line: 1}
 }
 
-func (t *Tokenizer) HasMoreTokens() bool {
-	log.Printf("%#v", t)
-	if t.line == "" || len(t.line) <= t.index {
-		log.Printf(t.line)
-		if !t.s.Scan() {
-			return false
-		}
+// NewStringTokenizer returns a tokenizer over src.
+func NewStringTokenizer(file string, src string) *Tokenizer {
+	return &Tokenizer{file: file, src: src, loaded: true, line: 1}
+}
 
-		line := strings.TrimSpace(t.s.Text())
+func (t *Tokenizer) pos() Pos {
+	return Pos{File: t.file, Line: t.line, Col: t.offset - t.lineStart + 1}
+}
 
-		if len(line) == 0 {
-			return t.HasMoreTokens()
-		}
+func (t *Tokenizer) errorf(pos Pos, format string, a ...interface{}) error {
+	return &Error{Pos: pos, Msg: fmt.Sprintf(format, a...)}
+}
 
-		t.line = line
-		t.index = 0
-	}
-	log.Printf(t.line)
-	c := t.line[t.index]
-	l := string(t.line[t.index:])
-
-	// skip space
-	if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
-		t.index += 1
-		return t.HasMoreTokens()
-	}
+// newline records a line break at offset i.
+func (t *Tokenizer) newline(i int) {
+	t.line += 1
+	t.lineStart = i + 1
+}
 
-	// skip '//' comment
-	if strings.Index(l, "//") == 0 {
-		t.index = len(t.line)
-		return t.HasMoreTokens()
+// Next returns the next token. At the end of the input it returns a
+// TOKEN_EOF token and io.EOF. A lexical error is returned as an *Error;
+// scanning continues after it with the following call.
+func (t *Tokenizer) Next() (Token, error) {
+	if !t.loaded {
+		b, err := ioutil.ReadAll(t.r)
+		if err != nil {
+			return Token{}, err
+		}
+		t.src = string(b)
+		t.loaded = true
 	}
+	src := t.src
 
-	// skip '/* */' comment
-	if strings.Index(l, "/*") == 0 {
-		var i int
-		for {
-			i = strings.Index(l, "*/")
-			if i != -1 {
-				break
+	// skip spaces and comments
+	for t.offset < len(src) {
+		c := src[t.offset]
+		if charClass[c]&charSpace != 0 {
+			if c == '\n' {
+				t.newline(t.offset)
 			}
-			// read next line
-			if !t.s.Scan() {
-				return false
+			t.offset += 1
+			continue
+		}
+		if c != '/' || t.offset+1 == len(src) {
+			break
+		}
+		if src[t.offset+1] == '/' {
+			pos, start := t.pos(), t.offset
+			for t.offset < len(src) && src[t.offset] != '\n' {
+				t.offset += 1
+			}
+			if t.Comments {
+				text := strings.TrimRight(src[start:t.offset], "\r")
+				return Token{Kind: TOKEN_COMMENT, Text: text, Value: text, Pos: pos}, nil
 			}
-			line := strings.TrimSpace(t.s.Text())
-			t.line = line
-			t.index = 0
-			l = t.line
+			continue
 		}
-		t.index = t.index + i + 2
-		return t.HasMoreTokens()
-	}
-
-	// symbol?
-	if IsSymbol(c) {
-		t.token = string([]byte{c})
-		t.tokenType = TOKEN_SYMBOL
-		t.index += 1
-		return true
-	}
-
-	// number?
-	if IsNumber(c) {
-		list := []byte{c}
-		i := t.index + 1
-		for i < len(t.line) {
-			if IsNumber(t.line[i]) {
-				list = append(list, t.line[i])
-				i += 1
-			} else {
-				break
+		if src[t.offset+1] == '*' {
+			pos, start := t.pos(), t.offset
+			i := t.offset + 2
+			for ; i+1 < len(src); i++ {
+				if src[i] == '*' && src[i+1] == '/' {
+					break
+				}
+				if src[i] == '\n' {
+					t.newline(i)
+				}
+			}
+			if i+1 >= len(src) {
+				t.offset = len(src)
+				return Token{}, t.errorf(pos, "comment not terminated")
+			}
+			t.offset = i + 2
+			if t.Comments {
+				text := src[start:t.offset]
+				return Token{Kind: TOKEN_COMMENT, Text: text, Value: text, Pos: pos}, nil
 			}
+			continue
 		}
-		t.token = string(list)
-		t.tokenType = TOKEN_INT_CONST
-		t.index = i
-		return true
+		break
 	}
 
-	// string?
-	if c == '"' {
-		i := strings.Index(string(t.line[t.index+1:]), `"`)
-		if i == -1 {
-			panic("string literal close word not found: " + t.line)
-		}
-		t.token = string(t.line[t.index+1 : t.index+i+1])
-		t.tokenType = TOKEN_STRING_CONST
-		t.index = t.index + i + 2
-		return true
+	pos := t.pos()
+	if t.offset >= len(src) {
+		return Token{Kind: TOKEN_EOF, Pos: pos}, io.EOF
 	}
+	start := t.offset
+	c := src[start]
+	class := charClass[c]
 
-	// keyword?
+	switch {
+	case class&charSymbol != 0:
+		t.offset += 1
+		text := src[start:t.offset]
+		return Token{Kind: TOKEN_SYMBOL, Text: text, Value: text, Pos: pos}, nil
 
-	// identifier?
-	if IsIdentifierHead(c) {
-		list := []byte{c}
-		i := t.index + 1
-		for i < len(t.line) {
-			if IsIdentifier(t.line[i]) {
-				list = append(list, t.line[i])
+	case class&charDigit != 0:
+		i := start + 1
+		for i < len(src) && charClass[src[i]]&charDigit != 0 {
+			i += 1
+		}
+		if i < len(src) && charClass[src[i]]&charIdentifierHead != 0 {
+			// 12abc is neither a number nor an identifier
+			for i < len(src) && charClass[src[i]]&(charIdentifierHead|charDigit) != 0 {
 				i += 1
-			} else {
-				break
 			}
+			t.offset = i
+			return Token{}, t.errorf(pos, "invalid integer constant %s", src[start:i])
 		}
-		t.token = string(list)
-		t.index = i
-		if IsKeyword(t.token) {
-			t.tokenType = TOKEN_KEYWORD
-		} else {
-			t.tokenType = TOKEN_IDENTIFIER
+		t.offset = i
+		text := src[start:i]
+		n, err := strconv.Atoi(text)
+		if err != nil || n > maxIntConst {
+			return Token{}, t.errorf(pos, "integer constant %s out of range (0..%d)", text, maxIntConst)
 		}
-		return true
-	}
-
-	return false
-}
-
-func (t *Tokenizer) TokenType() TokenType {
-	return t.tokenType
-}
-
-func (t *Tokenizer) KeyWord() string {
-	if t.tokenType == TOKEN_KEYWORD {
-		return t.token
-	}
-	return ""
-}
-
-func (t *Tokenizer) Symbol() string {
-	if t.tokenType == TOKEN_SYMBOL {
-		switch t.token {
-		case "<":
-			return "&lt;"
-		case ">":
-			return "&gt;"
-		case "&":
-			return "&amp;"
-		default:
-			return t.token
+		value := text
+		if len(text) > 1 && text[0] == '0' {
+			value = strconv.Itoa(n)
 		}
-	}
-	return ""
-}
+		return Token{Kind: TOKEN_INT_CONST, Text: text, Value: value, Int: n, Pos: pos}, nil
 
-func (t *Tokenizer) Identifier() string {
-	if t.tokenType == TOKEN_IDENTIFIER {
-		return t.token
-	}
-	return ""
-}
+	case c == '"':
+		i := start + 1
+		for i < len(src) && src[i] != '"' && src[i] != '\n' {
+			i += 1
+		}
+		if i == len(src) || src[i] != '"' {
+			t.offset = i
+			return Token{}, t.errorf(pos, "string constant not terminated before the end of the line")
+		}
+		t.offset = i + 1
+		return Token{Kind: TOKEN_STRING_CONST, Text: src[start:t.offset], Value: src[start+1 : i], Pos: pos}, nil
 
-func (t *Tokenizer) IntVal() int {
-	if t.tokenType == TOKEN_INT_CONST {
-		i, err := strconv.Atoi(t.token)
-		if err != nil {
-			panic(err)
+	case class&charIdentifierHead != 0:
+		i := start + 1
+		for i < len(src) && charClass[src[i]]&(charIdentifierHead|charDigit) != 0 {
+			i += 1
+		}
+		t.offset = i
+		text := src[start:i]
+		kind := TOKEN_IDENTIFIER
+		if keywordSet[text] || t.Extensions && extensionKeywordSet[text] {
+			kind = TOKEN_KEYWORD
 		}
-		return i
+		return Token{Kind: kind, Text: text, Value: text, Pos: pos}, nil
 	}
-	return 0
-}
 
-func (t *Tokenizer) StringVal() string {
-	if t.tokenType == TOKEN_STRING_CONST {
-		return t.token
-	}
-	return ""
+	t.offset += 1
+	return Token{}, t.errorf(pos, "unexpected character %q", c)
 }
 
 func IsAlpha(b byte) bool {
@@ -218,31 +312,21 @@ func IsAlpha(b byte) bool {
 }
 
 func IsNumber(b byte) bool {
-	return '0' <= b && b <= '9'
+	return charClass[b]&charDigit != 0
 }
 
 func IsSymbol(b byte) bool {
-	for _, s := range symbols {
-		if b == s {
-			return true
-		}
-	}
-	return false
+	return charClass[b]&charSymbol != 0
 }
 
 func IsIdentifierHead(b byte) bool {
-	return IsAlpha(b) || b == '_'
+	return charClass[b]&charIdentifierHead != 0
 }
 
 func IsIdentifier(b byte) bool {
-	return IsIdentifierHead(b) || IsNumber(b)
+	return charClass[b]&(charIdentifierHead|charDigit) != 0
 }
 
 func IsKeyword(s string) bool {
-	for _, k := range keywords {
-		if s == k {
-			return true
-		}
-	}
-	return false
+	return keywordSet[s]
 }
@@ -49,3 +49,6 @@ func (v *VMWriter) WriteReturn() {
 	fmt.Fprint(v.w,"return\n")
 }
 
+func (v *VMWriter) WriteComment(text string) {
+	fmt.Fprintf(v.w,"// %s\n", text)
+}
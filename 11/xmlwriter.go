@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var xmlReplacer = strings.NewReplacer("<", "&lt;", ">", "&gt;", "&", "&amp;")
+
+func xmlEscape(s string) string {
+	return xmlReplacer.Replace(s)
+}
+
+// WriteXML writes the parse tree of class in the XML format of the
+// nand2tetris syntax analyzer.
+func WriteXML(w io.Writer, class *Class) error {
+	x := &xmlWriter{w: w}
+	x.class(class)
+	return x.err
+}
+
+// WriteTokensXML writes the tokens of t in the XML format of the
+// nand2tetris tokenizer. It stops at the first lexical error.
+func WriteTokensXML(w io.Writer, t *Tokenizer) error {
+	x := &xmlWriter{w: w}
+	x.println("<tokens>")
+	for {
+		token, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		x.token(token.Kind, token.Value)
+	}
+	x.println("</tokens>")
+	return x.err
+}
+
+type xmlWriter struct {
+	w      io.Writer
+	indent int
+	err    error
+}
+
+func (x *xmlWriter) println(s string) {
+	if x.err != nil {
+		return
+	}
+	_, x.err = fmt.Fprintf(x.w, "%s%s\n", strings.Repeat("  ", x.indent), s)
+}
+
+func (x *xmlWriter) open(tag string) {
+	x.println("<" + tag + ">")
+	x.indent += 1
+}
+
+func (x *xmlWriter) close(tag string) {
+	x.indent -= 1
+	x.println("</" + tag + ">")
+}
+
+func (x *xmlWriter) token(kind TokenType, value string) {
+	x.println(fmt.Sprintf("<%s> %s </%s>", kind, xmlEscape(value), kind))
+}
+
+func (x *xmlWriter) keyword(value string) {
+	x.token(TOKEN_KEYWORD, value)
+}
+
+func (x *xmlWriter) symbol(value string) {
+	x.token(TOKEN_SYMBOL, value)
+}
+
+func (x *xmlWriter) identifier(id Ident) {
+	x.token(TOKEN_IDENTIFIER, id.Name)
+}
+
+func (x *xmlWriter) typeName(id Ident) {
+	switch id.Name {
+	case "int", "char", "boolean", "void":
+		x.keyword(id.Name)
+	default:
+		x.identifier(id)
+	}
+}
+
+func (x *xmlWriter) class(class *Class) {
+	x.open("class")
+	x.keyword("class")
+	x.identifier(class.Name)
+	x.symbol("{")
+	for _, dec := range class.Vars {
+		x.open("classVarDec")
+		x.keyword(dec.Kind)
+		x.typeName(dec.Type)
+		x.names(dec.Names)
+		x.symbol(";")
+		x.close("classVarDec")
+	}
+	for _, dec := range class.Subroutines {
+		x.subroutineDec(dec)
+	}
+	x.symbol("}")
+	x.close("class")
+}
+
+func (x *xmlWriter) names(names []Ident) {
+	for i, name := range names {
+		if i > 0 {
+			x.symbol(",")
+		}
+		x.identifier(name)
+	}
+}
+
+func (x *xmlWriter) subroutineDec(dec *SubroutineDec) {
+	x.open("subroutineDec")
+	x.keyword(dec.Kind)
+	x.typeName(dec.ReturnType)
+	x.identifier(dec.Name)
+	x.symbol("(")
+	x.open("parameterList")
+	for i, param := range dec.Params {
+		if i > 0 {
+			x.symbol(",")
+		}
+		x.typeName(param.Type)
+		x.identifier(param.Name)
+	}
+	x.close("parameterList")
+	x.symbol(")")
+
+	x.open("subroutineBody")
+	x.symbol("{")
+	for _, dec := range dec.Body.Vars {
+		x.open("varDec")
+		x.keyword("var")
+		x.typeName(dec.Type)
+		x.names(dec.Names)
+		x.symbol(";")
+		x.close("varDec")
+	}
+	x.statements(dec.Body.Statements)
+	x.symbol("}")
+	x.close("subroutineBody")
+	x.close("subroutineDec")
+}
+
+func (x *xmlWriter) block(block *Block) {
+	x.symbol("{")
+	x.statements(block.Statements)
+	x.symbol("}")
+}
+
+func (x *xmlWriter) statements(statements []Statement) {
+	x.open("statements")
+	for _, s := range statements {
+		switch s := s.(type) {
+		case *LetStatement:
+			x.open("letStatement")
+			x.keyword("let")
+			x.assignment(s)
+			x.symbol(";")
+			x.close("letStatement")
+		case *IfStatement:
+			x.open("ifStatement")
+			x.keyword("if")
+			x.symbol("(")
+			x.expression(s.Cond)
+			x.symbol(")")
+			x.block(s.Then)
+			if s.Else != nil {
+				x.keyword("else")
+				x.block(s.Else)
+			}
+			x.close("ifStatement")
+		case *WhileStatement:
+			x.open("whileStatement")
+			x.keyword("while")
+			x.symbol("(")
+			x.expression(s.Cond)
+			x.symbol(")")
+			x.block(s.Body)
+			x.close("whileStatement")
+		case *ForStatement:
+			x.open("forStatement")
+			x.keyword("for")
+			x.symbol("(")
+			if s.Init != nil {
+				x.assignment(s.Init)
+			}
+			x.symbol(";")
+			x.expression(s.Cond)
+			x.symbol(";")
+			if s.Step != nil {
+				x.assignment(s.Step)
+			}
+			x.symbol(")")
+			x.block(s.Body)
+			x.close("forStatement")
+		case *BreakStatement:
+			x.open("breakStatement")
+			x.keyword("break")
+			x.symbol(";")
+			x.close("breakStatement")
+		case *ContinueStatement:
+			x.open("continueStatement")
+			x.keyword("continue")
+			x.symbol(";")
+			x.close("continueStatement")
+		case *DoStatement:
+			x.open("doStatement")
+			x.keyword("do")
+			x.call(s.Call)
+			x.symbol(";")
+			x.close("doStatement")
+		case *ReturnStatement:
+			x.open("returnStatement")
+			x.keyword("return")
+			if s.Value != nil {
+				x.expression(s.Value)
+			}
+			x.symbol(";")
+			x.close("returnStatement")
+		}
+	}
+	x.close("statements")
+}
+
+// assignment writes the tokens of a let statement after let, which are
+// also the initialization and the step of a for statement.
+func (x *xmlWriter) assignment(s *LetStatement) {
+	x.identifier(s.Name)
+	if s.Index != nil {
+		x.symbol("[")
+		x.expression(s.Index)
+		x.symbol("]")
+	}
+	x.symbol("=")
+	x.expression(s.Value)
+}
+
+func (x *xmlWriter) expression(e Expression) {
+	x.open("expression")
+	x.terms(e)
+	x.close("expression")
+}
+
+// terms writes the flat term (op term)* sequence of a left-nested
+// BinaryExpr.
+func (x *xmlWriter) terms(e Expression) {
+	if b, ok := e.(*BinaryExpr); ok {
+		x.terms(b.X)
+		x.symbol(b.Op)
+		x.term(b.Y)
+		return
+	}
+	x.term(e)
+}
+
+func (x *xmlWriter) term(e Expression) {
+	x.open("term")
+	switch e := e.(type) {
+	case *IntegerConstant:
+		x.token(TOKEN_INT_CONST, strconv.Itoa(e.Value))
+	case *StringConstant:
+		x.token(TOKEN_STRING_CONST, e.Value)
+	case *KeywordConstant:
+		x.keyword(e.Value)
+	case *VarExpr:
+		x.identifier(Ident{Pos: e.Pos, Name: e.Name})
+	case *IndexExpr:
+		x.identifier(e.Name)
+		x.symbol("[")
+		x.expression(e.Index)
+		x.symbol("]")
+	case *CallExpr:
+		x.call(e)
+	case *UnaryExpr:
+		x.symbol(e.Op)
+		x.term(e.X)
+	case *ParenExpr:
+		x.symbol("(")
+		x.expression(e.X)
+		x.symbol(")")
+	}
+	x.close("term")
+}
+
+func (x *xmlWriter) call(call *CallExpr) {
+	if call.Receiver != nil {
+		x.identifier(*call.Receiver)
+		x.symbol(".")
+	}
+	x.identifier(call.Name)
+	x.symbol("(")
+	x.open("expressionList")
+	for i, arg := range call.Args {
+		if i > 0 {
+			x.symbol(",")
+		}
+		x.expression(arg)
+	}
+	x.close("expressionList")
+	x.symbol(")")
+}